@@ -23,26 +23,37 @@ import (
 	"fmt"
 	"log"
 	_ "net/http/pprof"
+	"path/filepath"
 	"sync"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcapgo"
 
+	"git.tcp.direct/kayos/rout5/config"
 	"git.tcp.direct/kayos/rout5/ipc"
+	"git.tcp.direct/kayos/rout5/ipc/events"
 	"git.tcp.direct/kayos/rout5/multilisten"
 	"git.tcp.direct/kayos/rout5/networking"
+	"git.tcp.direct/kayos/rout5/privdrop"
 )
 
 var (
 	hostKeyPath = flag.String("host_key",
-		"/perm/breakglass.host_key",
-		"path to a PEM-encoded RSA, DSA or ECDSA private key (create using e.g. ssh-keygen -f /perm/breakglass.host_key -N '' -t rsa)")
+		"",
+		"path to a PEM-encoded RSA, DSA or ECDSA private key, defaults to breakglass.host_key within data.directory (create using e.g. ssh-keygen -f /perm/breakglass.host_key -N '' -t rsa)")
 )
 
 func capturePackets(ctx context.Context) (chan gopacket.Packet, error) {
 	packets := make(chan gopacket.Packet)
-	for _, ifname := range []string{"uplink0", "lan0"} {
+	var ifnames []string
+	if len(config.PreferredWAN) > 0 {
+		ifnames = append(ifnames, config.PreferredWAN[0])
+	}
+	if len(config.PreferredLAN) > 0 {
+		ifnames = append(ifnames, config.PreferredLAN[0])
+	}
+	for _, ifname := range ifnames {
 		handle, err := pcapgo.NewEthernetHandle(ifname)
 		if err != nil {
 			return nil, fmt.Errorf("pcapgo.NewEthernetHandle(%v): %v", ifname, err)
@@ -124,9 +135,11 @@ func logic() error {
 		return err
 	}
 
+	ch := make(chan ipc.Message, 1)
+	if err := ipc.Subscribe(ch, events.NameAddressesChanged); err != nil {
+		return err
+	}
 	go func() {
-		ch := make(chan ipc.Signal, 1)
-		ipc.Notify(ch, ipc.SigUSR1)
 		for range ch {
 			if err := updateListeners(srv); err != nil {
 				log.Printf("updateListeners: %v", err)
@@ -138,6 +151,10 @@ func logic() error {
 	if err != nil {
 		return err
 	}
+	// The packet sockets are open, no further privileges required.
+	if err := privdrop.Drop(); err != nil {
+		return err
+	}
 	for packet := range packets {
 		prb.writePacket(packet)
 	}
@@ -146,6 +163,10 @@ func logic() error {
 
 func main() {
 	flag.Parse()
+	config.Init()
+	if *hostKeyPath == "" {
+		*hostKeyPath = filepath.Join(config.DataDirectory, "breakglass.host_key")
+	}
 	if err := logic(); err != nil {
 		log.Fatal(err)
 	}
@@ -20,10 +20,13 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"strconv"
 
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcapgo"
 	"golang.org/x/crypto/ssh"
+
+	"git.tcp.direct/kayos/rout5/config"
 )
 
 func handleChannel(newChannel ssh.NewChannel, prb *packetRingBuffer) {
@@ -157,7 +160,7 @@ type serverListener struct {
 }
 
 func (sl *serverListener) ListenAndServe() error {
-	ln, err := net.Listen("tcp", net.JoinHostPort(sl.host, "5022"))
+	ln, err := net.Listen("tcp", net.JoinHostPort(sl.host, strconv.Itoa(config.CapturedPort)))
 	if err != nil {
 		return err
 	}
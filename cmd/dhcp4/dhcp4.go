@@ -12,8 +12,8 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// Binary dhcp4 obtains a DHCPv4 lease, persists it to
-// /perm/dhcp4/wire/lease.json and notifies netconfigd.
+// Binary dhcp4 obtains a DHCPv4 lease on each WAN interface, persists it to
+// /perm/dhcp4/wire/lease.json (see config.DHCP4Dir) and notifies netconfigd.
 package main
 
 import (
@@ -25,7 +25,9 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/google/gopacket"
@@ -38,8 +40,10 @@ import (
 	"git.tcp.direct/kayos/rout5/db"
 	"git.tcp.direct/kayos/rout5/dhcp/dhcp4"
 	"git.tcp.direct/kayos/rout5/ipc"
+	"git.tcp.direct/kayos/rout5/ipc/events"
 	"git.tcp.direct/kayos/rout5/logging"
 	"git.tcp.direct/kayos/rout5/netconfig"
+	"git.tcp.direct/kayos/rout5/privdrop"
 )
 
 var log *zerolog.Logger
@@ -48,8 +52,10 @@ func init() {
 	log = logging.GetLogger()
 }
 
-func healthy() error {
-	req, err := http.NewRequest("GET", "http://localhost:7733/health.json", nil)
+// healthy queries diagd about the health of the uplink ifname.
+func healthy(ifname string) error {
+	u := fmt.Sprintf("http://localhost:%d/health.json?uplink=%s", config.DiagdPort, url.QueryEscape(ifname))
+	req, err := http.NewRequest("GET", u, nil)
 	if err != nil {
 		return err
 	}
@@ -87,20 +93,48 @@ func healthy() error {
 	return nil
 }
 
-func logic() error {
-	// TODO: support multiple interfaces
-	var netInterface = config.DHCPInterfaces[0]
+// uplink is the DHCPv4 client of one WAN interface, which persists its lease
+// to config.DHCP4Dir(ifname).
+type uplink struct {
+	ifname    string
+	leasePath string
+	ackFn     string
+	c         dhcp4.Client
+	release   chan chan error
+}
+
+// waitForInterface waits up to timeout for the network interface ifname to
+// appear: netconfigd creates VLAN interfaces, which might not exist yet when
+// dhcp4 starts.
+func waitForInterface(ifname string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := net.InterfaceByName(ifname)
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
 
-	iface, err := net.InterfaceByName(netInterface)
+func newUplink(ifname string, first bool) (*uplink, error) {
+	dir := filepath.Join(config.DataDirectory, config.DHCP4Dir(ifname))
+	u := &uplink{
+		ifname:    ifname,
+		leasePath: filepath.Join(dir, "lease.json"),
+		ackFn:     filepath.Join(dir, "ack"),
+		release:   make(chan chan error),
+	}
+	iface, err := net.InterfaceByName(ifname)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	hwaddr := iface.HardwareAddr
 	// The interface may not have been configured by netconfigd yet and might
 	// still use the old hardware address. We overwrite it with the address that
 	// netconfigd is going to use to fix this issue without additional
 	// synchronization.
-	details, err := netconfig.Interface("/perm", netInterface)
+	details, err := netconfig.Interface(config.DataDirectory, ifname)
 	if err == nil {
 		if spoof := details.SpoofHardwareAddr; spoof != "" {
 			if addr, err := net.ParseMAC(spoof); err == nil {
@@ -108,23 +142,39 @@ func logic() error {
 			}
 		}
 	}
-	var ack *layers.DHCPv4
-	ackB, dErr := db.DHCPMessages()
-	if dErr != nil {
-		log.Warn().Msgf("Loading previous DHCPACK packet from database: %v", dErr)
+	var ackB []byte
+	if first {
+		var dErr error
+		if ackB, dErr = db.DHCPMessages(); dErr != nil {
+			log.Warn().Msgf("Loading previous DHCPACK packet from database: %v", dErr)
+		}
 	} else {
+		// Only the first uplink is recorded in the database.
+		var rErr error
+		if ackB, rErr = ioutil.ReadFile(u.ackFn); rErr != nil && !os.IsNotExist(rErr) {
+			log.Warn().Msgf("Loading previous DHCPACK packet: %v", rErr)
+		}
+	}
+	var ack *layers.DHCPv4
+	if len(ackB) > 0 {
 		pkt := gopacket.NewPacket(ackB, layers.LayerTypeDHCPv4, gopacket.DecodeOptions{})
 		if dhcp, ok := pkt.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4); ok {
 			ack = dhcp
 		}
 	}
-	c := dhcp4.Client{
+	u.c = dhcp4.Client{
 		Interface: iface,
 		HWAddr:    hwaddr,
 		Ack:       ack,
 	}
-	usr2 := make(chan os.Signal, 1)
-	ipc.Notify(usr2, ipc.SigUSR2)
+	if err := privdrop.Chown(dir); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (u *uplink) obtainOrRenew() error {
+	c := &u.c
 	boff := backoff.Backoff{
 		Factor: 2,
 		Jitter: true,
@@ -135,18 +185,18 @@ ObtainOrRenew:
 	for c.ObtainOrRenew() {
 		if err := c.Err(); err != nil {
 			dur := boff.Duration()
-			log.Printf("Temporary error: %v (waiting %v)", err, dur)
+			log.Printf("%s: Temporary error: %v (waiting %v)", u.ifname, err, dur)
 			time.Sleep(dur)
 			continue
 		}
 		boff.Reset()
-		log.Printf("lease: %+v", c.Config())
+		log.Printf("%s: lease: %+v", u.ifname, c.Config())
 		b, err := json.Marshal(c.Config())
 		if err != nil {
 			return err
 		}
-		if err := renameio.WriteFile(leasePath, b, 0644); err != nil {
-			return fmt.Errorf("persisting lease to %s: %v", leasePath, err)
+		if err := renameio.WriteFile(u.leasePath, b, 0644); err != nil {
+			return fmt.Errorf("persisting lease to %s: %v", u.leasePath, err)
 		}
 		buf := gopacket.NewSerializeBuffer()
 		gopacket.SerializeLayers(buf,
@@ -156,11 +206,14 @@ ObtainOrRenew:
 			},
 			c.Ack,
 		)
-		if err := renameio.WriteFile(ackFn, buf.Bytes(), 0644); err != nil {
-			return fmt.Errorf("persisting DHCPACK to %s: %v", ackFn, err)
+		if err := renameio.WriteFile(u.ackFn, buf.Bytes(), 0644); err != nil {
+			return fmt.Errorf("persisting DHCPACK to %s: %v", u.ackFn, err)
 		}
-		if err := ipc.Process("/user/netconfigd", ipc.SigUSR1); err != nil {
-			log.Printf("notifying netconfig: %v", err)
+		if err := ipc.PublishAll(events.DHCP4Lease{
+			Interface: u.ifname,
+			Config:    c.Config(),
+		}); err != nil {
+			log.Printf("publishing lease: %v", err)
 		}
 
 		unhealthyCycles := 0
@@ -171,42 +224,97 @@ ObtainOrRenew:
 				continue ObtainOrRenew
 
 			case <-time.After(1 * time.Minute):
-				if err := healthy(); err == nil {
+				if err := healthy(u.ifname); err == nil {
 					unhealthyCycles = 0
 					continue // wait another minute
 				} else {
 					unhealthyCycles++
-					log.Printf("router unhealthy (cycle %d of 5): %v", unhealthyCycles, err)
+					log.Printf("%s unhealthy (cycle %d of 5): %v", u.ifname, unhealthyCycles, err)
 					if unhealthyCycles < 20 {
 						continue // wait until unhealthy for longer
 					}
 					// fallthrough
 				}
 				// Still not healthy? Drop DHCP lease and start from scratch.
-				log.Printf("unhealthy for 5 cycles, starting over without lease")
+				log.Printf("%s: unhealthy for 5 cycles, starting over without lease", u.ifname)
 				c.Ack = nil
 
-			case <-usr2:
-				log.Printf("SIGUSR2 received, sending DHCPRELEASE")
+			case result := <-u.release:
 				if err := c.Release(); err != nil {
-					return err
+					result <- err
+					continue
 				}
 				// Ensure dhcp4 does start from scratch next time
 				// by deleting the DHCPACK file:
-				if err := os.Remove(ackFn); err != nil && !os.IsNotExist(err) {
-					return err
+				if err := os.Remove(u.ackFn); err != nil && !os.IsNotExist(err) {
+					result <- err
+					continue
 				}
-				os.Exit(125) // quit supervision by gokrazy
+				result <- nil
 			}
 		}
 	}
 	return c.Err() // permanent error
 }
 
+func logic() error {
+	if len(config.DHCPInterfaces) == 0 {
+		return fmt.Errorf("no WAN interface configured (interfaces.wan_ifnames)")
+	}
+	var uplinks []*uplink
+	for idx, ifname := range config.DHCPInterfaces {
+		if err := waitForInterface(ifname, 10*time.Second); err != nil {
+			// e.g. a USB network adapter which is not plugged in.
+			log.Printf("%s: %v, not obtaining a lease", ifname, err)
+			continue
+		}
+		u, err := newUplink(ifname, idx == 0)
+		if err != nil {
+			log.Printf("%s: %v, not obtaining a lease", ifname, err)
+			continue
+		}
+		uplinks = append(uplinks, u)
+	}
+	if len(uplinks) == 0 {
+		return fmt.Errorf("none of the WAN interfaces %v are usable", config.DHCPInterfaces)
+	}
+	usr2 := make(chan ipc.Signal, 1)
+	if err := ipc.Notify(usr2, ipc.SigUSR2); err != nil {
+		return err
+	}
+	// The raw socket is (re-)opened by c.ObtainOrRenew.
+	if err := privdrop.Drop(privdrop.CAP_NET_RAW); err != nil {
+		return err
+	}
+	errs := make(chan error, len(uplinks))
+	for _, u := range uplinks {
+		go func(u *uplink) {
+			if err := u.obtainOrRenew(); err != nil {
+				errs <- fmt.Errorf("%s: %v", u.ifname, err)
+			}
+		}(u)
+	}
+	select {
+	case err := <-errs:
+		return err
+	case <-usr2:
+		log.Printf("SIGUSR2 received, sending DHCPRELEASE")
+		for _, u := range uplinks {
+			result := make(chan error)
+			u.release <- result
+			if err := <-result; err != nil {
+				return fmt.Errorf("%s: %v", u.ifname, err)
+			}
+		}
+		os.Exit(125) // quit supervision by gokrazy
+	}
+	return nil
+}
+
 func main() {
-	// TODO: drop privileges, run as separate uid?
 	flag.Parse()
+	config.Init()
 	if err := logic(); err != nil {
-		log.Fatal(err)
+		log.Fatal().Err(err).Msg("dhcp4")
 	}
 }
@@ -28,6 +28,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -39,14 +40,17 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"git.tcp.direct/kayos/rout5/config"
 	"git.tcp.direct/kayos/rout5/dhcp/dhcp4d"
 	"git.tcp.direct/kayos/rout5/ipc"
+	"git.tcp.direct/kayos/rout5/ipc/events"
 	"git.tcp.direct/kayos/rout5/multilisten"
 	"git.tcp.direct/kayos/rout5/networking"
+	"git.tcp.direct/kayos/rout5/privdrop"
 	"git.tcp.direct/kayos/rout5/util/oui"
 )
 
-var iface = flag.String("interface", "lan0", "ethernet interface to listen for DHCPv4 requests on")
+var iface = flag.String("interface", "", "ethernet interface to listen for DHCPv4 requests on (defaults to the first of interfaces.lan_ifnames)")
 
 var nonExpiredLeases = promauto.NewGauge(prometheus.GaugeOpts{
 	Name: "non_expired_leases",
@@ -65,11 +69,12 @@ func updateNonExpired(leases []*dhcp4d.Lease) {
 	nonExpiredLeases.Set(float64(nonExpired))
 }
 
-var ouiDB = oui.NewDB("/perm/dhcp4d/oui")
+var ouiDB *oui.DB
 
 var (
 	leasesMu sync.Mutex
 	leases   []*dhcp4d.Lease
+	handler  *dhcp4d.Handler
 )
 
 var (
@@ -78,6 +83,7 @@ var (
 	}
 	leasesTmpl = template.Must(template.New("").Funcs(template.FuncMap{
 		"timefmt": timefmt,
+		"bytes":   humanBytes,
 		"since": func(t time.Time) string {
 			dur := time.Since(t)
 			if dur.Hours() > 24 {
@@ -125,7 +131,7 @@ span.hostname-override {
   min-width: 1em;
   background-color: orange;
 }
-.ipaddr, .hwaddr {
+.ipaddr, .hwaddr, .traffic {
   font-family: monospace;
 }
 tr:nth-child(even) {
@@ -143,6 +149,7 @@ form {
 <th>Hostname</th>
 <th>MAC address</th>
 <th>Vendor</th>
+<th>Traffic</th>
 <th>Expiry</th>
 </tr>
 {{ range $idx, $l := . }}
@@ -159,6 +166,12 @@ form {
 </td>
 <td class="hwaddr">{{$l.HardwareAddr}}</td>
 <td>{{$l.Vendor}}</td>
+<td class="traffic">
+{{ if $l.Traffic }}
+<span title="sent to the uplink">↑ {{ bytes $l.Traffic.TxBytes }}</span>
+<span title="received from the uplink">↓ {{ bytes $l.Traffic.RxBytes }}</span>
+{{ end }}
+</td>
 <td title="{{ timefmt $l.Expiry }}">
 {{ if $l.Expired }}
 {{ since $l.Expiry }}
@@ -192,12 +205,12 @@ func updateListeners() error {
 	if err != nil {
 		return err
 	}
-	if net1, err := multilisten.IPv6Net1("/perm"); err == nil {
+	if net1, err := multilisten.IPv6Net1(config.DataDirectory); err == nil {
 		hosts = append(hosts, net1)
 	}
 
 	httpListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
-		return &http.Server{Addr: net.JoinHostPort(host, "8067")}
+		return &http.Server{Addr: net.JoinHostPort(host, strconv.Itoa(config.DHCP4dPort))}
 	})
 	return nil
 }
@@ -212,9 +225,13 @@ func newSrv(permDir string) (*srv, error) {
 	if err := updateListeners(); err != nil {
 		return nil, err
 	}
+	// netconfigd publishes AddressesChanged so that we can update our
+	// listeners for prometheus metrics on the external interface.
+	ch := make(chan ipc.Message, 1)
+	if err := ipc.Subscribe(ch, events.NameAddressesChanged); err != nil {
+		return nil, err
+	}
 	go func() {
-		ch := make(chan os.Signal, 1)
-		ipc.Notify(ch, ipc.SigUSR1)
 		for range ch {
 			if err := updateListeners(); err != nil {
 				log.Printf("updateListeners: %v", err)
@@ -225,17 +242,40 @@ func newSrv(permDir string) (*srv, error) {
 	if err := os.MkdirAll(filepath.Join(permDir, "dhcp4d"), 0755); err != nil {
 		return nil, err
 	}
+	ouiDB = oui.NewDB(filepath.Join(permDir, "dhcp4d/oui"))
 	errs := make(chan error)
-	ifc, err := net.InterfaceByName(*iface)
+	ifname := *iface
+	if ifname == "" && len(config.PreferredLAN) > 0 {
+		ifname = config.PreferredLAN[0]
+	}
+	ifc, err := net.InterfaceByName(ifname)
 	if err != nil {
 		return nil, err
 	}
-	handler, err := dhcp4d.NewHandler(permDir, ifc, *iface, nil)
+	handler, err = dhcp4d.NewHandler(permDir, ifc, ifname, nil)
 	if err != nil {
 		return nil, err
 	}
+	handler.SetLeasePeriod(config.DHCPLeaseTime)
+	// netconfigd publishes ConfigChanged once it accepted a modified
+	// config.toml, which might specify a different lease time.
+	cfgch := make(chan ipc.Message, 1)
+	if err := ipc.Subscribe(cfgch, events.NameConfigChanged); err != nil {
+		return nil, err
+	}
+	go func() {
+		for range cfgch {
+			if err := config.Reload(); err != nil {
+				log.Printf("reloading config: %v", err)
+				continue
+			}
+			handler.SetLeasePeriod(config.Current().DHCPLeaseTime)
+		}
+	}()
 
 	http.HandleFunc("/sethostname", handleSetHostname)
+	http.HandleFunc("/release", handleRelease)
+	http.HandleFunc("/leases.json", handleLeasesJSON)
 
 	http.HandleFunc("/lease/", func(w http.ResponseWriter, r *http.Request) {
 		hostname := strings.TrimPrefix(r.URL.Path, "/lease/")
@@ -262,7 +302,7 @@ func newSrv(permDir string) (*srv, error) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		w.Header().Set("X-Lease-Active", fmt.Sprint(lease.Expiry.After(time.Now().Add(handler.LeasePeriod*2/3))))
+		w.Header().Set("X-Lease-Active", fmt.Sprint(lease.Expiry.After(time.Now().Add(handler.LeasePeriod()*2/3))))
 		if _, err := io.Copy(w, bytes.NewReader(b)); err != nil {
 			log.Printf("/lease/%s: %v", hostname, err)
 		}
@@ -274,7 +314,9 @@ func newSrv(permDir string) (*srv, error) {
 		leasesMu.Lock()
 		defer leasesMu.Unlock()
 		leases = newLeases
-		log.Printf("DHCPACK %+v", latest)
+		if latest != nil {
+			log.Printf("DHCPACK %+v", latest)
+		}
 		b, err := json.Marshal(leases)
 		if err != nil {
 			errs <- err
@@ -289,8 +331,16 @@ func newSrv(permDir string) (*srv, error) {
 		}
 		updateNonExpired(leases)
 
+		if latest == nil {
+			return
+		}
+		go func(l dhcp4d.Lease) {
+			if err := ipc.PublishAll(events.LeaseHandedOut{Lease: l}); err != nil {
+				log.Printf("publishing lease: %v", err)
+			}
+		}(*latest)
 	}
-	c, err := conn.NewUDP4BoundListener(*iface, ":67")
+	c, err := conn.NewUDP4BoundListener(ifname, ":67")
 	if err != nil {
 		return nil, err
 	}
@@ -313,12 +363,19 @@ func (s *srv) run(ctx context.Context) error {
 }
 
 func main() {
-	// TODO: drop privileges, run as separate uid?
 	flag.Parse()
-	srv, err := newSrv("/perm")
+	config.Init()
+	srv, err := newSrv(config.DataDirectory)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := privdrop.Chown(filepath.Join(config.DataDirectory, "dhcp4d")); err != nil {
+		log.Fatal(err)
+	}
+	// newSrv opened the raw socket and bound port 67.
+	if err := privdrop.Drop(); err != nil {
+		log.Fatal(err)
+	}
 	if err := srv.run(context.Background()); err != nil {
 		log.Fatal(err)
 	}
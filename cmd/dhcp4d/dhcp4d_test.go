@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
@@ -45,6 +46,23 @@ const interfacesJson = `
 }
 `
 
+// waitForListener waits until addr accepts TCP connections: multilisten
+// starts serving in the background.
+func waitForListener(t *testing.T, addr string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestLeaseHandler(t *testing.T) {
 	flag.Set("interface", "lo")
 	ctx, canc := context.WithCancel(context.Background())
@@ -71,6 +89,7 @@ func TestLeaseHandler(t *testing.T) {
 		Expiry:       time.Now().Add(20 * time.Minute),
 	}
 	srv.leases([]*dhcp4d.Lease{&lease}, &lease)
+	waitForListener(t, "localhost:8067")
 	req, err := http.NewRequest("GET", "http://localhost:8067/lease/midna", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -100,6 +119,7 @@ func TestLeaseHandler(t *testing.T) {
 	}
 	lease.Expiry = time.Now().Add(-1 * time.Minute)
 	srv.leases([]*dhcp4d.Lease{&lease}, &lease)
+	waitForListener(t, "localhost:8067")
 	resp, err = http.DefaultClient.Do(req)
 	if err != nil {
 		t.Fatal(err)
@@ -117,3 +137,38 @@ func TestLeaseHandler(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestHostTraffic(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+{"hardware_addr":"02:73:53:00:ca:fe","hostname":"xps","family":"ip","tx_packets":3,"tx_bytes":1024,"rx_packets":5,"rx_bytes":2048},
+{"hardware_addr":"02:73:53:00:ca:fe","hostname":"xps","family":"ip6","tx_packets":1,"tx_bytes":512,"rx_packets":1,"rx_bytes":1572864}
+]`))
+	}))
+	defer srv.Close()
+
+	got, err := hostTraffic(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]*traffic{
+		"02:73:53:00:ca:fe": {TxBytes: 1536, RxBytes: 1574912},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("hostTraffic: diff (-want +got):\n%s", diff)
+	}
+
+	for _, tt := range []struct {
+		n    uint64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KiB"},
+		{1574912, "1.5 MiB"},
+	} {
+		if got := humanBytes(tt.n); got != tt.want {
+			t.Errorf("humanBytes(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
@@ -1,21 +1,27 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
 	"net"
 	"net/http"
 	"sort"
+	"strconv"
 	"time"
 
+	"git.tcp.direct/kayos/rout5/config"
 	"git.tcp.direct/kayos/rout5/dhcp/dhcp4d"
 	"git.tcp.direct/kayos/rout5/networking"
 )
 
-func handleHome(w http.ResponseWriter, r *http.Request) {
+// privateOnly replies with an error and returns false unless r originates
+// from a private network.
+func privateOnly(w http.ResponseWriter, r *http.Request) bool {
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		http.Error(w, "bad request", http.StatusBadRequest)
-		return
+		return false
 	}
 	ip := net.ParseIP(host)
 	if xff := r.Header.Get("X-Forwarded-For"); ip.IsLoopback() && xff != "" {
@@ -23,21 +29,84 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 	}
 	if !networking.IsInPrivateNet(ip) {
 		http.Error(w, fmt.Sprintf("access from %v forbidden", ip), http.StatusForbidden)
-		return
+		return false
 	}
+	return true
+}
+
+type tmplLease struct {
+	dhcp4d.Lease
+
+	Vendor  string `json:"vendor"`
+	Expired bool   `json:"expired"`
+	Static  bool   `json:"static"`
+
+	// Traffic is the traffic between the client and the uplink, if
+	// netconfigd counts it (see the accounting firewall option).
+	Traffic *traffic `json:"-"`
+}
+
+// traffic sums the IPv4 and IPv6 counters of a host which netconfigd serves
+// in /hosts.json.
+type traffic struct {
+	TxBytes uint64 `json:"tx_bytes"`
+	RxBytes uint64 `json:"rx_bytes"`
+}
+
+var netconfigdClient = &http.Client{Timeout: 1 * time.Second}
 
-	type tmplLease struct {
-		dhcp4d.Lease
+// hostTraffic fetches the per-host counters from netconfigd at u, keyed by
+// MAC address.
+func hostTraffic(u string) (map[string]*traffic, error) {
+	resp, err := netconfigdClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	var counters []struct {
+		HardwareAddr string `json:"hardware_addr"`
+		traffic
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&counters); err != nil {
+		return nil, err
+	}
+	byAddr := make(map[string]*traffic)
+	for _, c := range counters {
+		t, ok := byAddr[c.HardwareAddr]
+		if !ok {
+			t = &traffic{}
+			byAddr[c.HardwareAddr] = t
+		}
+		t.TxBytes += c.TxBytes
+		t.RxBytes += c.RxBytes
+	}
+	return byAddr, nil
+}
 
-		Vendor  string
-		Expired bool
-		Static  bool
+// humanBytes formats n like 1.5 MiB.
+func humanBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatUint(n, 10) + " B"
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
 	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
 
+// sortedLeases returns static leases ordered by number and dynamic leases
+// ordered by expiry, most recent first.
+func sortedLeases() (static, dynamic []tmplLease) {
 	leasesMu.Lock()
 	defer leasesMu.Unlock()
-	static := make([]tmplLease, 0, len(leases))
-	dynamic := make([]tmplLease, 0, len(leases))
+	static = make([]tmplLease, 0, len(leases))
+	dynamic = make([]tmplLease, 0, len(leases))
 	tl := func(l *dhcp4d.Lease) tmplLease {
 		return tmplLease{
 			Lease:   *l,
@@ -59,6 +128,26 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 	sort.Slice(dynamic, func(i, j int) bool {
 		return !dynamic[i].Expiry.Before(dynamic[j].Expiry)
 	})
+	return static, dynamic
+}
+
+func handleHome(w http.ResponseWriter, r *http.Request) {
+	if !privateOnly(w, r) {
+		return
+	}
+
+	static, dynamic := sortedLeases()
+
+	u := "http://" + net.JoinHostPort("localhost", strconv.Itoa(config.NetconfigdPort)) + "/hosts.json"
+	if byAddr, err := hostTraffic(u); err != nil {
+		log.Printf("traffic: %v", err)
+	} else {
+		for _, ls := range [][]tmplLease{static, dynamic} {
+			for idx := range ls {
+				ls[idx].Traffic = byAddr[ls[idx].HardwareAddr]
+			}
+		}
+	}
 
 	if err := leasesTmpl.Execute(w, struct {
 		StaticLeases  []tmplLease
@@ -77,6 +166,9 @@ func handleSetHostname(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "want POST", http.StatusMethodNotAllowed)
 		return
 	}
+	if !privateOnly(w, r) {
+		return
+	}
 	hwaddr := r.FormValue("hardwareaddr")
 	if hwaddr == "" {
 		http.Error(w, "missing hardwareaddr parameter", http.StatusBadRequest)
@@ -93,3 +185,37 @@ func handleSetHostname(w http.ResponseWriter, r *http.Request) {
 	}
 	http.Redirect(w, r, "/", http.StatusFound)
 }
+
+func handleLeasesJSON(w http.ResponseWriter, r *http.Request) {
+	if !privateOnly(w, r) {
+		return
+	}
+	static, dynamic := sortedLeases()
+	b, err := json.Marshal(append(static, dynamic...))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func handleRelease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "want POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !privateOnly(w, r) {
+		return
+	}
+	hwaddr := r.FormValue("hardwareaddr")
+	if hwaddr == "" {
+		http.Error(w, "missing hardwareaddr parameter", http.StatusBadRequest)
+		return
+	}
+	if err := handler.Release(hwaddr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
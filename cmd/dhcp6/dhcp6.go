@@ -19,6 +19,7 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -28,31 +29,46 @@ import (
 	"github.com/google/renameio"
 	"github.com/jpillora/backoff"
 
-	"git.tcp.direct/kayos/rout5/ipc"
-
+	"git.tcp.direct/kayos/rout5/config"
 	"git.tcp.direct/kayos/rout5/dhcp/dhcp6"
+	"git.tcp.direct/kayos/rout5/ipc"
+	"git.tcp.direct/kayos/rout5/ipc/events"
+	"git.tcp.direct/kayos/rout5/privdrop"
 )
 
 func logic() error {
-	const leasePath = "/perm/dhcp6/wire/lease.json"
+	if len(config.DHCPInterfaces) == 0 {
+		return fmt.Errorf("no WAN interface configured (interfaces.wan_ifnames)")
+	}
+	leasePath := filepath.Join(config.DataDirectory, "dhcp6/wire/lease.json")
 	if err := os.MkdirAll(filepath.Dir(leasePath), 0755); err != nil {
 		return err
 	}
 
-	duid, err := ioutil.ReadFile("/perm/dhcp6/duid")
+	duidPath := filepath.Join(config.DataDirectory, "dhcp6/duid")
+	duid, err := ioutil.ReadFile(duidPath)
 	if err != nil {
-		log.Printf("could not read /perm/dhcp6/duid (%v), proceeding with DUID-LLT", err)
+		log.Printf("could not read %s (%v), proceeding with DUID-LLT", duidPath, err)
 	}
 
 	c, err := dhcp6.NewClient(dhcp6.ClientConfig{
-		InterfaceName: "uplink0",
+		InterfaceName: config.DHCPInterfaces[0],
 		DUID:          duid,
 	})
 	if err != nil {
 		return err
 	}
-	usr2 := make(chan os.Signal, 1)
-	ipc.Notify(usr2, ipc.SigUSR2)
+	usr2 := make(chan ipc.Signal, 1)
+	if err := ipc.Notify(usr2, ipc.SigUSR2); err != nil {
+		return err
+	}
+	if err := privdrop.Chown(filepath.Dir(leasePath)); err != nil {
+		return err
+	}
+	// NewClient already bound the DHCPv6 client port.
+	if err := privdrop.Drop(); err != nil {
+		return err
+	}
 	boff := backoff.Backoff{
 		Factor: 2,
 		Jitter: true,
@@ -76,11 +92,9 @@ func logic() error {
 		if err := renameio.WriteFile(leasePath, b, 0644); err != nil {
 			return err
 		}
-		if err := notify.Process("/user/netconfigd", ipc.SigUSR1); err != nil {
-			log.Printf("notifying netconfig: %v", err)
-		}
-		if err := notify.Process("/user/radvd", ipc.SigUSR1); err != nil {
-			log.Printf("notifying radvd: %v", err)
+		// netconfigd and radvd (among others) subscribe to prefix changes.
+		if err := ipc.PublishAll(events.DelegatedPrefix{Config: c.Config()}); err != nil {
+			log.Printf("publishing prefix: %v", err)
 		}
 		select {
 		case <-time.After(time.Until(c.Config().RenewAfter)):
@@ -98,6 +112,7 @@ func logic() error {
 
 func main() {
 	flag.Parse()
+	config.Init()
 	if err := logic(); err != nil {
 		log.Fatal(err)
 	}
@@ -25,12 +25,21 @@ import (
 	"net"
 	"net/http"
 	_ "net/http/pprof"
-	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/google/renameio"
+
+	"git.tcp.direct/kayos/rout5/config"
 	diag2 "git.tcp.direct/kayos/rout5/diag"
+	"git.tcp.direct/kayos/rout5/ipc"
+	"git.tcp.direct/kayos/rout5/ipc/events"
 	"git.tcp.direct/kayos/rout5/multilisten"
+	"git.tcp.direct/kayos/rout5/networking"
+	"git.tcp.direct/kayos/rout5/privdrop"
 )
 
 var httpListeners = multilisten.NewPool()
@@ -42,7 +51,7 @@ func updateListeners() error {
 	}
 
 	httpListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
-		return &http.Server{Addr: net.JoinHostPort(host, "7733")}
+		return &http.Server{Addr: net.JoinHostPort(host, strconv.Itoa(config.DiagdPort))}
 	})
 	return nil
 }
@@ -75,41 +84,150 @@ func firstError(re *diag2.EvalResult) string {
 	return ""
 }
 
+// uplinkTree returns the diag checks which decide whether the uplink ifname
+// is healthy, i.e. whether netconfig routes traffic via it. Like the checks of
+// the main tree, they end in a connection to the Internet, which must use
+// ifname even while the default route uses another uplink.
+func uplinkTree(ifname string) diag2.Node {
+	return diag2.Link(ifname).
+		Then(diag2.DHCPv4On(ifname).
+			Then(diag2.Ping4GatewayOn(ifname).
+				Then(diag2.TCP4On(ifname, "www.google.ch:80"))))
+}
+
+// healthFile (relative to config.DataDirectory) is read by netconfig, see
+// its uplinkHealthFile.
+const healthFile = "diagd/uplinks.json"
+
+// watchUplinks evaluates the health of each uplink periodically. Whenever it
+// changes, the health of all uplinks is persisted to healthFile and published.
+func watchUplinks(mu *sync.Mutex, uplinks []string, monitors map[string]*diag2.Monitor) {
+	health := make(map[string]bool)
+	for {
+		var changed []events.UplinkHealth
+		for _, ifname := range uplinks {
+			mu.Lock()
+			re := monitors[ifname].Evaluate()
+			mu.Unlock()
+			msg := firstError(re)
+			healthy := msg == ""
+			if prev, ok := health[ifname]; ok && prev == healthy {
+				continue
+			}
+			health[ifname] = healthy
+			log.Printf("uplink %s healthy: %v %s", ifname, healthy, msg)
+			changed = append(changed, events.UplinkHealth{
+				Interface:  ifname,
+				Healthy:    healthy,
+				FirstError: msg,
+			})
+		}
+		if len(changed) > 0 {
+			// netconfigd reads healthFile once notified.
+			b, err := json.Marshal(health)
+			if err == nil {
+				err = renameio.WriteFile(filepath.Join(config.DataDirectory, healthFile), b, 0644)
+			}
+			if err != nil {
+				log.Printf("persisting uplink health: %v", err)
+			}
+			for _, ev := range changed {
+				if err := ipc.PublishAll(ev); err != nil {
+					log.Printf("publishing uplink health: %v", err)
+				}
+			}
+		}
+		time.Sleep(30 * time.Second)
+	}
+}
+
 func logic() error {
 	var (
 		ifname = flag.String("interface",
-			"uplink0",
-			"interface name to query")
+			"",
+			"interface name to query (defaults to the first of interfaces.wan_ifnames)")
 	)
 	const (
 		ip6allrouters = "ff02::2" // no /etc/hosts on gokrazy
 	)
 	flag.Parse()
-	uplink := *ifname
+	config.Init()
+	uplinks := config.PreferredWAN
+	if *ifname != "" {
+		uplinks = []string{*ifname}
+	}
+	var uplink string
+	if len(uplinks) > 0 {
+		uplink = uplinks[0]
+	}
+	lan := "lan0"
+	if len(config.PreferredLAN) > 0 {
+		lan = config.PreferredLAN[0]
+	}
 	m := diag2.NewMonitor(diag2.Link(uplink).
+		Then(diag2.Qdisc(uplink)).
 		Then(diag2.DHCPv4().
 			Then(diag2.Ping4Gateway().
 				Then(diag2.Ping4("google.ch").
 					Then(diag2.TCP4("www.google.ch:80"))))).
 		Then(diag2.DHCPv6().
-			Then(diag2.Ping6("lan0", "google.ch"))).
+			Then(diag2.Ping6(lan, "google.ch"))).
 		Then(diag2.RouterAdvertisments(uplink).
 			Then(diag2.Ping6Gateway().
 				Then(diag2.Ping6(uplink, "google.ch").
 					Then(diag2.TCP6("www.google.ch:80"))))).
 		Then(diag2.Ping6("", ip6allrouters+"%"+uplink)))
+	monitors := make(map[string]*diag2.Monitor)
+	// netconfig shapes every uplink (see its SQM), so the queues of all of
+	// them are shown. They do not affect the health of the uplinks.
+	qdiscs := make(map[string]*diag2.Monitor)
+	for _, ifname := range uplinks {
+		monitors[ifname] = diag2.NewMonitor(uplinkTree(ifname))
+		qdiscs[ifname] = diag2.NewMonitor(diag2.Qdisc(ifname))
+	}
 	var mu sync.Mutex
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		mu.Lock()
 		re := m.Evaluate()
+		var others []*diag2.EvalResult
+		for idx, ifname := range uplinks {
+			if idx > 0 { // the first uplink is covered by m
+				others = append(others, monitors[ifname].Evaluate(), qdiscs[ifname].Evaluate())
+			}
+		}
 		mu.Unlock()
 		fmt.Fprintf(w, `<!DOCTYPE html><style type="text/css">ul { list-style-type: none; }</style><ul>`)
 		dump(0, w, re)
+		for _, re := range others {
+			dump(0, w, re)
+		}
 	})
-	http.HandleFunc("/health.json", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/diag.json", func(w http.ResponseWriter, r *http.Request) {
 		mu.Lock()
 		re := m.Evaluate()
 		mu.Unlock()
+		b, err := json.Marshal(re)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+	// /health.json?uplink=uplink1 reports the health of a single uplink (see
+	// uplinkTree), without the parameter all checks are considered.
+	http.HandleFunc("/health.json", func(w http.ResponseWriter, r *http.Request) {
+		monitor := m
+		if ifname := r.FormValue("uplink"); ifname != "" {
+			var ok bool
+			if monitor, ok = monitors[ifname]; !ok {
+				http.Error(w, fmt.Sprintf("unknown uplink %q", ifname), http.StatusNotFound)
+				return
+			}
+		}
+		mu.Lock()
+		re := monitor.Evaluate()
+		mu.Unlock()
 		reply := struct {
 			FirstError string `json:"first_error"`
 		}{
@@ -125,11 +243,43 @@ func logic() error {
 	if err := updateListeners(); err != nil {
 		return err
 	}
-	ch := make(chan os.Signal, 1)
-	ipc.Notify(ch, ipc.SigUSR1)
-	for range ch {
-		if err := updateListeners(); err != nil {
-			log.Printf("updateListeners: %v", err)
+	// Register on the bus before dropping privileges: only root may create
+	// sockets in ipc.Dir.
+	ch := make(chan ipc.Message, 1)
+	if err := ipc.Subscribe(ch,
+		events.NameAddressesChanged,
+		events.NameDHCP4Lease,
+		events.NameDelegatedPrefix); err != nil {
+		return err
+	}
+	if err := privdrop.Chown(filepath.Join(config.DataDirectory, filepath.Dir(healthFile))); err != nil {
+		return err
+	}
+	// ICMP pings and router solicitations require raw sockets, which are
+	// opened for every evaluation.
+	if err := privdrop.Drop(privdrop.CAP_NET_RAW); err != nil {
+		return err
+	}
+	// Failing over requires more than one uplink.
+	if len(uplinks) > 1 {
+		go watchUplinks(&mu, uplinks, monitors)
+	}
+	for msg := range ch {
+		switch msg.Event {
+		case events.NameDHCP4Lease:
+			var ev events.DHCP4Lease
+			if err := msg.Decode(&ev); err == nil {
+				diag2.UpdateLease(diag2.LeaseDHCPv4On(ev.Interface), ev.Config.RenewAfter)
+			}
+		case events.NameDelegatedPrefix:
+			var ev events.DelegatedPrefix
+			if err := msg.Decode(&ev); err == nil {
+				diag2.UpdateLease(diag2.LeaseDHCPv6, ev.Config.RenewAfter)
+			}
+		case events.NameAddressesChanged:
+			if err := updateListeners(); err != nil {
+				log.Printf("updateListeners: %v", err)
+			}
 		}
 	}
 	return nil
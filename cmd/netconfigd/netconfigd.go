@@ -16,22 +16,34 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
-	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/google/nftables"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 
+	"git.tcp.direct/kayos/rout5/config"
+	"git.tcp.direct/kayos/rout5/dhcp/dhcp4d"
 	"git.tcp.direct/kayos/rout5/ipc"
+	"git.tcp.direct/kayos/rout5/ipc/events"
 	"git.tcp.direct/kayos/rout5/multilisten"
 	"git.tcp.direct/kayos/rout5/netconfig"
 	"git.tcp.direct/kayos/rout5/networking"
+	"git.tcp.direct/kayos/rout5/privdrop"
 )
 
 func init() {
@@ -46,7 +58,7 @@ func init() {
 			name:   "filter_forward",
 			labels: prometheus.Labels{"family": "ipv4"},
 			obj: &nftables.CounterObj{
-				Table: &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"},
+				Table: &nftables.Table{Family: nftables.TableFamilyIPv4, Name: netconfig.FilterTable},
 				Name:  "fwded",
 			},
 		},
@@ -54,7 +66,7 @@ func init() {
 			name:   "filter_forward",
 			labels: prometheus.Labels{"family": "ipv6"},
 			obj: &nftables.CounterObj{
-				Table: &nftables.Table{Family: nftables.TableFamilyIPv6, Name: "filter"},
+				Table: &nftables.Table{Family: nftables.TableFamilyIPv6, Name: netconfig.FilterTable},
 				Name:  "fwded",
 			},
 		},
@@ -99,57 +111,603 @@ func init() {
 	}
 }
 
+// forwardingCollector exports the named counters of port forwardings (see
+// the counter option of forwardings). Unlike filter_forward, these counters
+// are defined by the config, so they cannot be registered up front.
+type forwardingCollector struct {
+	packets, bytes *prometheus.Desc
+
+	mu       sync.Mutex
+	c        nftables.Conn
+	counters map[string]*nftables.CounterObj // accumulated, by name
+}
+
+func newForwardingCollector() *forwardingCollector {
+	return &forwardingCollector{
+		packets: prometheus.NewDesc(
+			"nftables_forwarding_packets",
+			"packet count (i.e. connection count, as only the first packet of a connection traverses the NAT chains)",
+			[]string{"counter"},
+			nil),
+		bytes: prometheus.NewDesc(
+			"nftables_forwarding_bytes",
+			"bytes count",
+			[]string{"counter"},
+			nil),
+		counters: make(map[string]*nftables.CounterObj),
+	}
+}
+
+func (fc *forwardingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- fc.packets
+	ch <- fc.bytes
+}
+
+func (fc *forwardingCollector) Collect(ch chan<- prometheus.Metric) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	objs, err := fc.c.GetObjReset(&nftables.CounterObj{
+		Table: &nftables.Table{Family: nftables.TableFamilyIPv4, Name: netconfig.NATTable},
+	})
+	if err == nil {
+		for _, obj := range objs {
+			co, ok := obj.(*nftables.CounterObj)
+			if !ok {
+				continue
+			}
+			acc, ok := fc.counters[co.Name]
+			if !ok {
+				acc = &nftables.CounterObj{Name: co.Name}
+				fc.counters[co.Name] = acc
+			}
+			acc.Packets += co.Packets
+			acc.Bytes += co.Bytes
+		}
+	}
+	for name, co := range fc.counters {
+		ch <- prometheus.MustNewConstMetric(fc.packets, prometheus.CounterValue, float64(co.Packets), name)
+		ch <- prometheus.MustNewConstMetric(fc.bytes, prometheus.CounterValue, float64(co.Bytes), name)
+	}
+}
+
+// hostCollector exports the per-host counters of the accounting firewall
+// option, see netconfig.HostTraffic.
+type hostCollector struct {
+	packets, bytes *prometheus.Desc
+}
+
+func newHostCollector() *hostCollector {
+	labels := []string{"hostname", "mac", "family", "direction"}
+	return &hostCollector{
+		packets: prometheus.NewDesc(
+			"nftables_host_packets",
+			"packet count between a LAN host and the uplink (direction tx: sent by the host)",
+			labels,
+			nil),
+		bytes: prometheus.NewDesc(
+			"nftables_host_bytes",
+			"bytes count between a LAN host and the uplink (direction tx: sent by the host)",
+			labels,
+			nil),
+	}
+}
+
+func (hc *hostCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- hc.packets
+	ch <- hc.bytes
+}
+
+func (hc *hostCollector) Collect(ch chan<- prometheus.Metric) {
+	counters, err := netconfig.HostTraffic(config.DataDirectory)
+	if err != nil {
+		return
+	}
+	for _, c := range counters {
+		for _, m := range []struct {
+			direction      string
+			packets, bytes uint64
+		}{
+			{"tx", c.TxPackets, c.TxBytes},
+			{"rx", c.RxPackets, c.RxBytes},
+		} {
+			ch <- prometheus.MustNewConstMetric(hc.packets, prometheus.CounterValue, float64(m.packets), c.Hostname, c.HardwareAddr, c.Family, m.direction)
+			ch <- prometheus.MustNewConstMetric(hc.bytes, prometheus.CounterValue, float64(m.bytes), c.Hostname, c.HardwareAddr, c.Family, m.direction)
+		}
+	}
+}
+
+func init() {
+	prometheus.MustRegister(newForwardingCollector())
+	prometheus.MustRegister(newHostCollector())
+}
+
 var httpListeners = multilisten.NewPool()
 
+// net1 is the IPv6 address rout5 picked from the delegated prefix, updated
+// from events.DelegatedPrefix.
+var net1 string
+
 func updateListeners() error {
 	hosts, err := networking.PrivateInterfaceAddrs()
 	if err != nil {
 		return err
 	}
-	if net1, err := multilisten.IPv6Net1("/perm"); err == nil {
+	if net1 != "" {
 		hosts = append(hosts, net1)
 	}
 
 	httpListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
-		return &http.Server{Addr: net.JoinHostPort(host, "8066")}
+		return &http.Server{Addr: net.JoinHostPort(host, strconv.Itoa(config.NetconfigdPort))}
 	})
 	return nil
 }
 
+// watchConfig sends the name of every modified config file (config.toml or
+// one of netconfig.ConfigFiles) to changed.
+func watchConfig(changed chan<- string) error {
+	config.Watch(func() { changed <- config.Filename })
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// Watch the directory instead of the files so that files which are
+	// created later or replaced atomically (renamed) are picked up.
+	if err := w.Add(config.DataDirectory); err != nil {
+		w.Close()
+		return err
+	}
+	isConfig := make(map[string]bool)
+	for _, fn := range netconfig.ConfigFiles {
+		isConfig[fn] = true
+	}
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if !isConfig[filepath.Base(ev.Name)] || ev.Op == fsnotify.Chmod {
+					continue
+				}
+				changed <- ev.Name
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("watching %s: %v", config.DataDirectory, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// reload re-reads config.toml or netconfig.ConfigFiles, depending on which
+// file changed. If the new config is invalid, prev is returned so that the
+// previous config stays in place.
+func reload(prev *netconfig.Config, fn string) (*netconfig.Config, error) {
+	if fn == config.Filename {
+		if err := config.Reload(); err != nil {
+			return prev, err
+		}
+	}
+	cfg, err := netconfig.LoadConfig(config.DataDirectory)
+	if err != nil {
+		return prev, err
+	}
+	return cfg, nil
+}
+
+// leaseChanged reports whether cfg must be applied again because of the new or
+// modified lease l, i.e. whether cfg depends on the client’s lease and its
+// address or hostname changed. seen holds the previously reported leases.
+func leaseChanged(cfg *netconfig.Config, seen map[string]string, l dhcp4d.Lease) bool {
+	if !cfg.DependsOnLease(l.HardwareAddr, l.Hostname, l.HostnameOverride) {
+		return false
+	}
+	key := l.Addr.String() + " " + l.Hostname + " " + l.HostnameOverride
+	if seen[l.HardwareAddr] == key {
+		return false
+	}
+	seen[l.HardwareAddr] = key
+	return true
+}
+
+// neighborChanged reports whether cfg must be applied again because of the
+// neighbour table update u, i.e. whether a host which pinholes or accounting
+// depend on (see netconfig.Config.DependsOnNeighbor) uses a new IPv6
+// interface identifier. seen holds the previously reported identifiers.
+func neighborChanged(cfg *netconfig.Config, seen map[string]bool, u netlink.NeighUpdate) bool {
+	if u.Type != unix.RTM_NEWNEIGH ||
+		u.Family != netlink.FAMILY_V6 ||
+		!u.IP.IsGlobalUnicast() ||
+		len(u.HardwareAddr) == 0 ||
+		u.State&(netlink.NUD_INCOMPLETE|netlink.NUD_FAILED) != 0 {
+		return false
+	}
+	// The rules match the interface identifier regardless of the prefix.
+	key := u.HardwareAddr.String() + " " + net.IP(u.IP.To16()[8:]).String()
+	if seen[key] || !cfg.DependsOnNeighbor(config.DataDirectory, u.HardwareAddr) {
+		return false
+	}
+	seen[key] = true
+	return true
+}
+
+// jsonHandler serves the result of fn as JSON, e.g. for “rout5 fw show”.
+func jsonHandler(fn func() (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v, err := fn()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// confirmHandler serves “rout5 config confirm” by sending on confirm, which
+// replies with an error if no config change is awaiting confirmation.
+func confirmHandler(confirm chan<- chan error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "expected a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		result := make(chan error)
+		confirm <- result
+		if err := <-result; err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Write([]byte("confirmed\n"))
+	}
+}
+
+// An applyRequest asks the main loop to apply the plan with the given digest
+// (see netconfig.Plan.Digest), i.e. the plan which “rout5 config plan”
+// printed. The result of applying it is sent on result.
+type applyRequest struct {
+	digest string
+	result chan error
+}
+
+// applyHandler serves “rout5 config apply” by sending on apply.
+func applyHandler(apply chan<- applyRequest) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "expected a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		digest := r.FormValue("digest")
+		if digest == "" {
+			http.Error(w, "missing digest parameter", http.StatusBadRequest)
+			return
+		}
+		req := applyRequest{digest: digest, result: make(chan error)}
+		apply <- req
+		if err := <-req.result; err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Write([]byte("applied\n"))
+	}
+}
+
 func logic() error {
+	confirm := make(chan chan error)
+	applyReviewed := make(chan applyRequest)
 	http.Handle("/metrics", promhttp.Handler())
+	// Changing the config must not be possible over the network, so these
+	// handlers are only served on the control socket.
+	ctl := http.NewServeMux()
+	ctl.HandleFunc("/confirm", confirmHandler(confirm))
+	ctl.HandleFunc("/apply", applyHandler(applyReviewed))
+	ctlListener, err := ipc.Listen(netconfig.ControlSocket)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := http.Serve(ctlListener, ctl); err != nil {
+			log.Printf("serving %s: %v", netconfig.ControlSocket, err)
+		}
+	}()
+	http.HandleFunc("/firewall.json", jsonHandler(func() (interface{}, error) {
+		return netconfig.FirewallStatus()
+	}))
+	http.HandleFunc("/wireguard.json", jsonHandler(func() (interface{}, error) {
+		return netconfig.WireGuardStatuses()
+	}))
+	http.HandleFunc("/hosts.json", jsonHandler(func() (interface{}, error) {
+		return netconfig.HostTraffic(config.DataDirectory)
+	}))
+	if addr, err := multilisten.IPv6Net1(config.DataDirectory); err == nil {
+		net1 = addr
+	}
 	if err := updateListeners(); err != nil {
 		return err
 	}
-	ch := make(chan os.Signal, 1)
-	ipc.Notify(ch, ipc.SigUSR1)
+	ch := make(chan ipc.Signal, 1)
+	if err := ipc.Notify(ch, ipc.SigUSR1); err != nil {
+		return err
+	}
+	// Events which arrive while the config is being applied are buffered;
+	// once the buffer is full, publishers get an error (see ipc.Subscribe).
+	evs := make(chan ipc.Message, 16)
+	if err := ipc.Subscribe(evs, events.NameDHCP4Lease, events.NameDelegatedPrefix, events.NameLeaseHandedOut, events.NameUplinkHealth); err != nil {
+		return err
+	}
+	watched := make(chan string)
+	if err := watchConfig(watched); err != nil {
+		return err
+	}
+	// Pinholes and accounting match the IPv6 addresses which hosts use, see
+	// neighborChanged.
+	neighs := make(chan netlink.NeighUpdate, 16)
+	if err := netlink.NeighSubscribe(neighs, nil); err != nil {
+		return err
+	}
+	cfg, err := netconfig.LoadConfig(config.DataDirectory)
+	if err != nil {
+		return err
+	}
+	// restored is set while the config to roll back to is being applied,
+	// see netconfig.ConfirmedFile.
+	restored := false
+	if c, err := netconfig.LoadConfirmed(config.DataDirectory); err != nil {
+		log.Printf("not rolling back: %v", err)
+	} else if c != nil {
+		log.Printf("modified config was not confirmed before netconfigd exited, rolling back to the last confirmed config")
+		cfg, restored = c, true
+	}
+	// CAP_NET_ADMIN covers netlink (links, addresses, routes, WireGuard) and
+	// nftables, CAP_DAC_OVERRIDE is required for writing sysctls in /proc/sys.
+	if err := privdrop.Drop(privdrop.CAP_NET_ADMIN, privdrop.CAP_DAC_OVERRIDE); err != nil {
+		return err
+	}
+	var (
+		good     *netconfig.Config // last config which was applied successfully
+		modified []string          // config files modified since the last ApplyConfig
+		leases   = make(map[string]string)
+		iids     = make(map[string]bool)
+
+		// reviewed is the plan of an applyRequest, which is applied instead
+		// of planning cfg again. Its result is sent on reviewedResult.
+		reviewed       *netconfig.Plan
+		reviewedResult chan error
+
+		// While modified configs await confirmation (see
+		// netconfig.Config.ConfirmTimeout), pending holds the state before
+		// the first of them was applied, confirmed the config in effect
+		// back then (also persisted, see netconfig.ConfirmedFile) and
+		// applied the modified configs.
+		pending   *netconfig.Snapshot
+		confirmed *netconfig.Config
+		applied   []*netconfig.Config
+		timer     *time.Timer
+		deadline  <-chan time.Time // nil unless pending
+	)
+	rollback := func() {
+		if err := pending.Restore(applied...); err != nil {
+			log.Printf("rolling back: %v", err)
+		}
+		timer.Stop()
+		cfg, good, restored = confirmed, confirmed, true
+		pending, confirmed, applied, deadline = nil, nil, nil, nil
+	}
 	for {
-		err := netconfig.Apply("/perm/", "/")
+		if timeout := cfg.ConfirmTimeout(); len(modified) > 0 && good != nil && timeout > 0 {
+			if pending == nil {
+				snap, err := netconfig.TakeSnapshot(good, config.DataDirectory)
+				if err == nil {
+					// Otherwise, the modified config would become permanent
+					// if netconfigd restarted before it is confirmed.
+					err = netconfig.WriteConfirmed(config.DataDirectory, good)
+				}
+				if err != nil {
+					// The modified config could not be rolled back.
+					log.Printf("keeping previous config: snapshot: %v", err)
+					cfg, modified = good, nil
+				} else {
+					pending, confirmed = snap, good
+					timer = time.NewTimer(timeout)
+					deadline = timer.C
+				}
+			} else {
+				// Like re-committing on network appliances, a further
+				// change restarts the timeout.
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(timeout)
+			}
+			if pending != nil {
+				log.Printf("applying modified config, rolling back unless confirmed within %v (rout5 config confirm)", timeout)
+			}
+		}
 
-		// Notify dhcp4d so that it can update its listeners for prometheus
-		// metrics on the external interface.
-		if err := ipc.Process("/user/dhcp4d", ipc.SigUSR1); err != nil {
-			log.Printf("notifying dhcp4d: %v", err)
+		if pending != nil {
+			applied = append(applied, cfg)
+		}
+		var err error
+		if reviewed != nil {
+			for _, c := range reviewed.Changes {
+				log.Print(c)
+			}
+			err = reviewed.Apply()
+			reviewedResult <- err
+			reviewed, reviewedResult = nil, nil
+		} else {
+			err = netconfig.ApplyConfig(cfg, config.DataDirectory, "/")
 		}
 
 		// Notify rout5 processes about new addresses (netconfig.Apply might have
 		// modified state before returning an error) so that listeners can be
 		// updated.
-		ipc.NotifyAll(ipc.SigHUP)
+		changed := events.AddressesChanged{}
+		if err != nil {
+			changed.Err = err.Error()
+		}
+		if err := ipc.PublishAll(changed); err != nil {
+			log.Print(err)
+		}
 
 		if err != nil {
-			return err
+			if pending != nil {
+				log.Printf("applying config failed, rolling back to the last confirmed config: %v", err)
+				rollback()
+				modified = nil
+				continue
+			}
+			if len(modified) == 0 || good == nil {
+				return err
+			}
+			log.Printf("applying modified config failed, reverting to previous config: %v", err)
+			cfg, modified = good, nil
+			continue
+		}
+		good = cfg
+
+		if restored {
+			if err := netconfig.RemoveConfirmed(config.DataDirectory); err != nil {
+				log.Print(err)
+			}
+			restored = false
+		}
+
+		if len(modified) > 0 {
+			if err := ipc.PublishAll(events.ConfigChanged{Files: modified}); err != nil {
+				log.Print(err)
+			}
+			modified = nil
+		}
+
+		for apply := false; !apply; {
+			apply = true
+			select {
+			case <-deadline:
+				log.Printf("modified config not confirmed in time, rolling back")
+				rollback()
+			case result := <-confirm:
+				apply = false
+				if pending == nil {
+					result <- errors.New("no config changes await confirmation")
+					break
+				}
+				timer.Stop()
+				pending, confirmed, applied, deadline = nil, nil, nil, nil
+				if err := netconfig.RemoveConfirmed(config.DataDirectory); err != nil {
+					log.Print(err)
+				}
+				log.Printf("modified config confirmed")
+				result <- nil
+			case req := <-applyReviewed:
+				apply = false
+				// Plan again: the config files or the kernel state might
+				// have changed since the plan was reviewed.
+				next, err := reload(cfg, config.Filename)
+				if err != nil {
+					req.result <- fmt.Errorf("loading config: %v", err)
+					break
+				}
+				p, err := netconfig.PlanConfig(next, config.DataDirectory, "/")
+				if err != nil {
+					req.result <- err
+					break
+				}
+				if got := p.Digest(); got != req.digest {
+					req.result <- fmt.Errorf("the plan changed since it was reviewed (now %s), review it again with rout5 config plan", got)
+					break
+				}
+				log.Printf("applying reviewed plan %s", req.digest)
+				apply = true
+				cfg, reviewed, reviewedResult = next, p, req.result
+				modified = append([]string{config.Filename}, netconfig.ConfigFiles...)
+			case <-ch:
+				if cfg.Review() {
+					log.Printf("not re-reading the config: changes must be reviewed (rout5 config plan, rout5 config apply)")
+					apply = false
+					break
+				}
+				// Explicitly requested, so re-read all config files.
+				var err error
+				if cfg, err = reload(cfg, config.Filename); err != nil {
+					log.Printf("keeping previous config: %v", err)
+				} else {
+					modified = append([]string{config.Filename}, netconfig.ConfigFiles...)
+				}
+			case fn := <-watched:
+				if cfg.Review() {
+					log.Printf("%s changed, review the changes with rout5 config plan and apply them with rout5 config apply", fn)
+					apply = false
+					break
+				}
+				log.Printf("%s changed, reloading", fn)
+				var err error
+				if cfg, err = reload(cfg, fn); err != nil {
+					log.Printf("keeping previous config: %v", err)
+				} else {
+					modified = []string{fn}
+				}
+			case u := <-neighs:
+				apply = neighborChanged(cfg, iids, u)
+				if apply {
+					log.Printf("%s uses IPv6 address %s, updating firewall", u.HardwareAddr, u.IP)
+				}
+			case msg := <-evs:
+				switch msg.Event {
+				case events.NameDHCP4Lease:
+					var ev events.DHCP4Lease
+					if err := msg.Decode(&ev); err == nil {
+						log.Printf("new DHCPv4 lease on %s: %s", ev.Interface, ev.Config.ClientIP)
+					}
+				case events.NameDelegatedPrefix:
+					var ev events.DelegatedPrefix
+					if err := msg.Decode(&ev); err == nil {
+						if addr, err := multilisten.ConfigNet1(ev.Config); err == nil {
+							net1 = addr
+						}
+					}
+				case events.NameUplinkHealth:
+					// diagd persisted the health of all uplinks, which
+					// decides the default routes.
+					var ev events.UplinkHealth
+					if err := msg.Decode(&ev); err == nil {
+						log.Printf("uplink %s healthy: %v %s", ev.Interface, ev.Healthy, ev.FirstError)
+					}
+				case events.NameLeaseHandedOut:
+					var ev events.LeaseHandedOut
+					if err := msg.Decode(&ev); err != nil {
+						log.Print(err)
+						apply = false
+						break
+					}
+					// dhcp4d publishes every renewal, which mostly does not
+					// affect any forwardings or pinholes.
+					apply = leaseChanged(cfg, leases, ev.Lease)
+					if apply {
+						log.Printf("DHCPv4 lease of %s (%s) changed, updating firewall", ev.Lease.HardwareAddr, ev.Lease.Addr)
+					}
+				}
+			}
 		}
-		<-ch
 		if err := updateListeners(); err != nil {
 			log.Printf("updateListeners: %v", err)
 		}
 	}
-	return nil
 }
 
 func main() {
 	flag.Parse()
+	config.Init()
 	if err := logic(); err != nil {
 		log.Fatal(err)
 	}
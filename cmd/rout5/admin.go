@@ -0,0 +1,95 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.tcp.direct/kayos/rout5/ipc"
+)
+
+// daemonURL returns the URL of path on the admin HTTP server of the daemon
+// listening on port. All daemons serve on loopback, among other addresses.
+func daemonURL(port int) string {
+	return "http://" + net.JoinHostPort("localhost", strconv.Itoa(port))
+}
+
+var httpClient = &http.Client{
+	Timeout: 10 * time.Second,
+	// Handlers like /sethostname redirect browsers back to the index page,
+	// which is of no interest here.
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 400 {
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s: %s: %s", resp.Request.URL, resp.Status, strings.TrimSpace(string(b)))
+}
+
+// getJSON decodes the JSON response to a GET request for u into v.
+func getJSON(u string, v interface{}) error {
+	resp, err := httpClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// postForm sends a POST request with data to u and discards the response.
+func postForm(u string, data url.Values) error {
+	return postFormWith(httpClient, u, data)
+}
+
+// postControl is like postForm, but sends the request for path to the
+// control socket name of a daemon (see ipc.Listen) instead of its admin port.
+func postControl(name, path string, data url.Values) error {
+	c := &http.Client{
+		Timeout: httpClient.Timeout,
+		Transport: &http.Transport{
+			DialContext: func(context.Context, string, string) (net.Conn, error) {
+				return ipc.Dial(name)
+			},
+		},
+	}
+	// The host is ignored by DialContext.
+	return postFormWith(c, "http://localhost"+path, data)
+}
+
+func postFormWith(c *http.Client, u string, data url.Values) error {
+	resp, err := c.PostForm(u, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp)
+}
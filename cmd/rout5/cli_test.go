@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"git.tcp.direct/kayos/rout5/ipc"
+)
+
+func TestLeasesList(t *testing.T) {
+	now := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/leases.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`[
+{"num":1,"addr":"192.168.42.2","hardware_addr":"02:73:53:00:ca:fe","hostname":"xps","hostname_override":"","expiry":"0001-01-01T00:00:00Z","static":true},
+{"num":3,"addr":"192.168.42.4","hardware_addr":"02:73:53:00:b0:0c","hostname":"android-123","hostname_override":"pixel","expiry":"2018-07-01T12:10:00Z","vendor":"Google"}
+]`))
+	}))
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	if err := leasesList(&buf, srv.URL, now); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"IP            HWADDR             HOSTNAME  VENDOR  EXPIRY",
+		"192.168.42.2  02:73:53:00:ca:fe  xps               static",
+		"192.168.42.4  02:73:53:00:b0:0c  pixel     Google  in 10m0s",
+	}
+	got := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("leasesList: diff (-want +got):\n%s", diff)
+	}
+
+	if err := leasesList(&buf, srv.URL+"/nonexistent", now); err == nil {
+		t.Fatalf("leasesList unexpectedly succeeded on a 404 response")
+	}
+}
+
+func TestDiagShow(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"uplink0","status":"link up","children":[{"name":"ping4/google.ch","error":true,"status":"timeout"}],"error":true}`))
+	}))
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	if err := diagShow(&buf, srv.URL); err == nil {
+		t.Fatalf("diagShow unexpectedly succeeded despite a failing check")
+	}
+	want := "✘ uplink0: link up\n  ✘ ping4/google.ch: timeout\n"
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Fatalf("diagShow: diff (-want +got):\n%s", diff)
+	}
+}
+
+// serveControl serves h on the control socket name in a temporary ipc.Dir.
+func serveControl(t *testing.T, name string, h http.Handler) {
+	t.Helper()
+	prev := ipc.Dir
+	t.Cleanup(func() { ipc.Dir = prev })
+	ipc.Dir = t.TempDir()
+	l, err := ipc.Listen(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go http.Serve(l, h)
+}
+
+func TestConfigConfirm(t *testing.T) {
+	pending := true
+	serveControl(t, "/user/netconfigd", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/confirm" {
+			http.NotFound(w, r)
+			return
+		}
+		if !pending {
+			http.Error(w, "no config changes await confirmation", http.StatusConflict)
+			return
+		}
+		pending = false
+	}))
+
+	var buf bytes.Buffer
+	if err := configConfirm(&buf, "/user/netconfigd"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "config confirmed\n"; got != want {
+		t.Errorf("configConfirm: got %q, want %q", got, want)
+	}
+
+	if err := configConfirm(&buf, "/user/netconfigd"); err == nil || !strings.Contains(err.Error(), "no config changes await confirmation") {
+		t.Errorf("configConfirm: got %v, want error about no pending changes", err)
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	serveControl(t, "/user/netconfigd", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/apply" {
+			http.NotFound(w, r)
+			return
+		}
+		if got := r.FormValue("digest"); got != "3f2a9c1e0b7d4a65" {
+			http.Error(w, "the plan changed since it was reviewed (now 3f2a9c1e0b7d4a65)", http.StatusConflict)
+			return
+		}
+	}))
+
+	var buf bytes.Buffer
+	if err := configApply(&buf, "/user/netconfigd", "3f2a9c1e0b7d4a65"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "plan 3f2a9c1e0b7d4a65 applied\n"; got != want {
+		t.Errorf("configApply: got %q, want %q", got, want)
+	}
+
+	if err := configApply(&buf, "/user/netconfigd", "0000000000000000"); err == nil || !strings.Contains(err.Error(), "the plan changed") {
+		t.Errorf("configApply: got %v, want error about a changed plan", err)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"git.tcp.direct/kayos/rout5/config"
+	"git.tcp.direct/kayos/rout5/netconfig"
+)
+
+// configCmd implements the “rout5 config” subcommands.
+func configCmd(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	switch args[0] {
+	case "check":
+		if len(args) > 1 {
+			return errUsage
+		}
+		return configCheck(os.Stdout)
+	case "dump":
+		if len(args) > 1 {
+			return errUsage
+		}
+		return config.Dump(os.Stdout)
+	case "gen":
+		path := "config.toml"
+		switch len(args) {
+		case 1:
+		case 2:
+			path = args[1]
+		default:
+			return errUsage
+		}
+		if err := config.WriteDefault(path); err != nil {
+			return err
+		}
+		fmt.Printf("default config written to %s\n", path)
+		return nil
+	case "import":
+		fset := flag.NewFlagSet("import", flag.ContinueOnError)
+		force := fset.Bool("force", false, "overwrite an existing ["+netconfig.Section+"] section")
+		if err := fset.Parse(args[1:]); err != nil || fset.NArg() > 0 {
+			return errUsage
+		}
+		return configImport(os.Stdout, *force)
+	case "confirm":
+		if len(args) > 1 {
+			return errUsage
+		}
+		return configConfirm(os.Stdout, netconfig.ControlSocket)
+	case "plan":
+		fset := flag.NewFlagSet("plan", flag.ContinueOnError)
+		asJSON := fset.Bool("json", false, "print the plan as JSON")
+		if err := fset.Parse(args[1:]); err != nil || fset.NArg() > 0 {
+			return errUsage
+		}
+		return configPlan(os.Stdout, *asJSON)
+	case "apply":
+		if len(args) != 2 {
+			return errUsage
+		}
+		return configApply(os.Stdout, netconfig.ControlSocket, args[1])
+	}
+	return errUsage
+}
+
+// configConfirm implements “rout5 config confirm”: it keeps netconfigd from
+// rolling back the modified config (see the confirm_timeout option). The
+// request is sent to the control socket ctl of netconfigd.
+func configConfirm(w io.Writer, ctl string) error {
+	if err := postControl(ctl, "/confirm", nil); err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "config confirmed")
+	return nil
+}
+
+// configApply implements “rout5 config apply”: netconfigd plans the config
+// again and applies the plan only if its digest still matches the one which
+// “rout5 config plan” printed. Like configConfirm, it uses the control socket
+// ctl.
+func configApply(w io.Writer, ctl, digest string) error {
+	if err := postControl(ctl, "/apply", url.Values{"digest": {digest}}); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "plan %s applied\n", digest)
+	return nil
+}
+
+// configPlan implements “rout5 config plan”: it prints the changes which
+// netconfigd would make to the running system, without making them, followed
+// by the digest which “rout5 config apply” expects.
+func configPlan(w io.Writer, asJSON bool) error {
+	cfg, err := netconfig.LoadConfig(config.DataDirectory)
+	if err != nil {
+		return err
+	}
+	p, err := netconfig.PlanConfig(cfg, config.DataDirectory, "/")
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			*netconfig.Plan
+			Digest string `json:"digest"`
+		}{p, p.Digest()})
+	}
+	if len(p.Changes) == 0 && len(p.Errors) == 0 {
+		fmt.Fprintln(w, "no changes")
+		return nil
+	}
+	if _, err := io.WriteString(w, p.String()); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\nto apply these changes, run: rout5 config apply %s\n", p.Digest())
+	return nil
+}
+
+// configCheck implements “rout5 config check”: it prints every problem found
+// in config.toml and the netconfig state files to w.
+func configCheck(w io.Writer) error {
+	problems := netconfig.Check(config.DataDirectory)
+	for _, p := range problems {
+		fmt.Fprintln(w, p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problem(s) found", len(problems))
+	}
+	fmt.Fprintf(w, "%s and %s: OK\n", config.Filename, config.DataDirectory)
+	return nil
+}
+
+// configImport implements “rout5 config import”: it converts the legacy
+// netconfig JSON files in config.DataDirectory into the [netconfig] section of
+// config.toml, so that upgraded installations need not be rewritten by hand.
+func configImport(w io.Writer, force bool) error {
+	if config.Snek.IsSet(netconfig.Section) && !force {
+		return fmt.Errorf("%s already contains a [%s] section (use -force to overwrite it)", config.Filename, netconfig.Section)
+	}
+	var found []string
+	for _, name := range netconfig.ConfigFiles {
+		fn := filepath.Join(config.DataDirectory, name)
+		if _, err := os.Stat(fn); err == nil {
+			found = append(found, fn)
+		}
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("none of %v found in %s", netconfig.ConfigFiles, config.DataDirectory)
+	}
+	cfg, err := netconfig.LoadJSONConfig(config.DataDirectory)
+	if err != nil {
+		return err
+	}
+	section, err := cfg.Section()
+	if err != nil {
+		return err
+	}
+	config.Snek.Set(netconfig.Section, section)
+	if err := config.Snek.WriteConfigAs(config.Filename); err != nil {
+		return err
+	}
+	for _, fn := range found {
+		fmt.Fprintf(w, "imported %s\n", fn)
+	}
+	fmt.Fprintf(w, "wrote %s; the imported files are no longer read and can be removed\n", config.Filename)
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"git.tcp.direct/kayos/rout5/config"
+	"git.tcp.direct/kayos/rout5/dhcp/dhcp4d"
+)
+
+// lease is an entry of dhcp4d’s /leases.json.
+type lease struct {
+	dhcp4d.Lease
+
+	Vendor  string `json:"vendor"`
+	Expired bool   `json:"expired"`
+	Static  bool   `json:"static"`
+}
+
+// leasesCmd implements the “rout5 leases” subcommands, which talk to dhcp4d.
+func leasesCmd(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	base := daemonURL(config.DHCP4dPort)
+	switch args[0] {
+	case "list":
+		if len(args) != 1 {
+			return errUsage
+		}
+		return leasesList(os.Stdout, base, time.Now())
+	case "release":
+		if len(args) != 2 {
+			return errUsage
+		}
+		return postForm(base+"/release", url.Values{
+			"hardwareaddr": {args[1]},
+		})
+	case "set-hostname":
+		if len(args) != 3 {
+			return errUsage
+		}
+		return postForm(base+"/sethostname", url.Values{
+			"hardwareaddr": {args[1]},
+			"hostname":     {args[2]},
+		})
+	}
+	return errUsage
+}
+
+func leasesList(w io.Writer, base string, now time.Time) error {
+	var leases []lease
+	if err := getJSON(base+"/leases.json", &leases); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "IP\tHWADDR\tHOSTNAME\tVENDOR\tEXPIRY\n")
+	for _, l := range leases {
+		hostname := l.Hostname
+		if l.HostnameOverride != "" {
+			hostname = l.HostnameOverride
+		}
+		var expiry string
+		switch {
+		case l.Static:
+			expiry = "static"
+		case l.Expired:
+			expiry = "expired " + now.Sub(l.Expiry).Truncate(time.Second).String() + " ago"
+		default:
+			expiry = "in " + l.Expiry.Sub(now).Truncate(time.Second).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			l.Addr,
+			l.HardwareAddr,
+			hostname,
+			l.Vendor,
+			expiry)
+	}
+	return tw.Flush()
+}
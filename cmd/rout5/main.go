@@ -1 +1,195 @@
-package rout5
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary rout5 starts and supervises all rout5 daemons, so that the router can
+// run on a regular Linux distribution without gokrazy.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"git.tcp.direct/kayos/rout5/config"
+)
+
+var configPath = flag.String("config",
+	"",
+	"path to config.toml, which is passed on to all components via $"+config.EnvConfig)
+
+// components lists the daemons which rout5 supervises. Each component is
+// only started once all of its dependencies are up.
+var components = []component{
+	// netconfigd configures interfaces (e.g. renames uplink0 and lan0), which
+	// all other daemons rely on.
+	{Name: "netconfigd"},
+	{Name: "dhcp4", Deps: []string{"netconfigd"}},
+	{Name: "dhcp6", Deps: []string{"netconfigd"}},
+	{Name: "dhcp4d", Deps: []string{"netconfigd"}},
+	{Name: "diagd", Deps: []string{"netconfigd"}},
+	{Name: "captured", Deps: []string{"netconfigd"}},
+}
+
+func serveStatus(s *supervisor, addr string) {
+	http.HandleFunc("/status.json", func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.MarshalIndent(s.Status(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "COMPONENT\tSTATE\tPID\tRESTARTS\tSINCE\tLAST EXIT\n")
+		for _, st := range s.Status() {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\n",
+				st.Name,
+				st.State,
+				st.PID,
+				st.Restarts,
+				time.Since(st.Since).Truncate(time.Second),
+				st.LastExit)
+		}
+		tw.Flush()
+	})
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		log.Printf("status listener: %v", err)
+	}
+}
+
+// runCmd implements “rout5 run”: it starts all components and supervises
+// them until rout5 receives SIGINT or SIGTERM.
+func runCmd(args []string) error {
+	fset := flag.NewFlagSet("run", flag.ContinueOnError)
+	binDir := fset.String("bindir",
+		"",
+		"directory containing the daemon binaries (defaults to the directory of the rout5 binary, then $PATH)")
+	statusAddr := fset.String("status_listen",
+		"",
+		"[host]:port on which to serve per-component status (defaults to localhost and ports.supervisor, \"off\" disables)")
+	if err := fset.Parse(args); err != nil {
+		return errUsage
+	}
+	if fset.NArg() > 0 {
+		return errUsage
+	}
+
+	dir := *binDir
+	if dir == "" {
+		if exe, err := os.Executable(); err == nil {
+			dir = filepath.Dir(exe)
+		}
+	}
+
+	ctx, canc := context.WithCancel(context.Background())
+	defer canc()
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-ch
+		log.Printf("%v received, stopping all components", sig)
+		canc()
+	}()
+
+	s, err := newSupervisor(dir, components)
+	if err != nil {
+		return err
+	}
+	addr := *statusAddr
+	if addr == "" {
+		addr = net.JoinHostPort("localhost", strconv.Itoa(config.SupervisorPort))
+	}
+	if addr != "off" {
+		go serveStatus(s, addr)
+	}
+	s.Run(ctx)
+	return nil
+}
+
+// errUsage is returned by commands which were invoked incorrectly.
+var errUsage = errors.New("usage")
+
+// A command is a rout5 subcommand. run returns errUsage if args are invalid.
+type command struct {
+	name  string
+	usage string // without the leading “rout5 ”
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"run", "run [-bindir=dir] [-status_listen=[host]:port]", runCmd},
+	{"config", "config check|dump|gen [path]|import [-force]|plan [-json]|apply <digest>|confirm", configCmd},
+	{"leases", "leases list|release <hwaddr>|set-hostname <hwaddr> <hostname>", leasesCmd},
+	{"diag", "diag", diagCmd},
+	{"fw", "fw show", fwCmd},
+	{"wg", "wg peers", wgCmd},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: rout5 [-config=path] <command> [args]\n\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "\trout5 %s\n", c.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nWithout a command, rout5 run is assumed.\n\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if *configPath != "" {
+		// Set before config.Init so that it and all components read the same file.
+		os.Setenv(config.EnvConfig, *configPath)
+	}
+
+	name, args := "run", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	var cmd *command
+	for idx := range commands {
+		if commands[idx].name == name {
+			cmd = &commands[idx]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "rout5: unknown command %q\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	config.Init()
+	if err := cmd.run(args); err != nil {
+		if err == errUsage {
+			fmt.Fprintf(os.Stderr, "usage: rout5 %s\n", cmd.usage)
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "rout5 %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"git.tcp.direct/kayos/rout5/config"
+	"git.tcp.direct/kayos/rout5/diag"
+	"git.tcp.direct/kayos/rout5/netconfig"
+)
+
+// diagCmd implements “rout5 diag”: it prints the diagd health tree and fails
+// if any check fails.
+func diagCmd(args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+	return diagShow(os.Stdout, daemonURL(config.DiagdPort))
+}
+
+func diagShow(w io.Writer, base string) error {
+	var re diag.EvalResult
+	if err := getJSON(base+"/diag.json", &re); err != nil {
+		return err
+	}
+	dumpEval(w, 0, &re)
+	if re.Error {
+		return fmt.Errorf("%s: %s", re.Name, re.Status)
+	}
+	return nil
+}
+
+func dumpEval(w io.Writer, indent int, re *diag.EvalResult) {
+	symbol := "✔"
+	if re.Error {
+		symbol = "✘"
+	}
+	fmt.Fprintf(w, "%s%s %s: %s\n", strings.Repeat("  ", indent), symbol, re.Name, re.Status)
+	for _, ch := range re.Children {
+		dumpEval(w, indent+1, ch)
+	}
+}
+
+// fwCmd implements “rout5 fw show”, which lists the nftables rule set as seen
+// by netconfigd.
+func fwCmd(args []string) error {
+	if len(args) != 1 || args[0] != "show" {
+		return errUsage
+	}
+	return fwShow(os.Stdout, daemonURL(config.NetconfigdPort))
+}
+
+func fwShow(w io.Writer, base string) error {
+	var tables []netconfig.TableStatus
+	if err := getJSON(base+"/firewall.json", &tables); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "TABLE\tCHAIN\tHOOK\tPOLICY\tRULES\tPACKETS\tBYTES\n")
+	for _, t := range tables {
+		for _, ch := range t.Chains {
+			hook := "-"
+			if ch.Hook != "" {
+				hook = fmt.Sprintf("%s %s (%d)", ch.Type, ch.Hook, ch.Priority)
+			}
+			policy := ch.Policy
+			if policy == "" {
+				policy = "-"
+			}
+			fmt.Fprintf(tw, "%s %s\t%s\t%s\t%s\t%d\t%d\t%d\n",
+				t.Family,
+				t.Name,
+				ch.Name,
+				hook,
+				policy,
+				ch.Rules,
+				ch.Packets,
+				ch.Bytes)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	var printed bool
+	for _, t := range tables {
+		for _, c := range t.Counters {
+			if !printed {
+				fmt.Fprintf(tw, "\nCOUNTER\tPACKETS\tBYTES\n")
+				printed = true
+			}
+			fmt.Fprintf(tw, "%s %s %s\t%d\t%d\n", t.Family, t.Name, c.Name, c.Packets, c.Bytes)
+		}
+	}
+	return tw.Flush()
+}
+
+// wgCmd implements “rout5 wg peers”, which lists the peers of all WireGuard
+// interfaces.
+func wgCmd(args []string) error {
+	if len(args) != 1 || args[0] != "peers" {
+		return errUsage
+	}
+	return wgPeers(os.Stdout, daemonURL(config.NetconfigdPort), time.Now())
+}
+
+func wgPeers(w io.Writer, base string, now time.Time) error {
+	var ifaces []netconfig.WireGuardStatus
+	if err := getJSON(base+"/wireguard.json", &ifaces); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "INTERFACE\tPEER\tENDPOINT\tALLOWED IPS\tHANDSHAKE\tRX\tTX\n")
+	for _, iface := range ifaces {
+		for _, p := range iface.Peers {
+			endpoint := p.Endpoint
+			if endpoint == "" {
+				endpoint = "-"
+			}
+			handshake := "never"
+			if !p.LastHandshake.IsZero() {
+				handshake = now.Sub(p.LastHandshake).Truncate(time.Second).String() + " ago"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\n",
+				iface.Name,
+				p.PublicKey,
+				endpoint,
+				strings.Join(p.AllowedIPs, ","),
+				handshake,
+				p.ReceiveBytes,
+				p.TransmitBytes)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,319 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jpillora/backoff"
+
+	"git.tcp.direct/kayos/rout5/ipc"
+)
+
+// exitStopPermanently is the exit code with which a daemon asks not to be
+// restarted, e.g. dhcp4 after releasing its lease. This is the same
+// convention gokrazy uses.
+const exitStopPermanently = 125
+
+// readyTimeout bounds how long dependents wait for a component to register on
+// the ipc bus before they are started regardless.
+const readyTimeout = 10 * time.Second
+
+type component struct {
+	Name string   // binary name, e.g. dhcp4d
+	Deps []string // components which must be up before this one starts
+	Args []string // additional command line arguments
+}
+
+const (
+	stateWaiting = "waiting" // for dependencies
+	stateRunning = "running"
+	stateBackoff = "backoff" // crashed, will be restarted
+	stateStopped = "stopped" // permanently
+)
+
+// Status describes the supervision state of a component.
+type Status struct {
+	Name     string    `json:"name"`
+	State    string    `json:"state"`
+	PID      int       `json:"pid,omitempty"`
+	Restarts int       `json:"restarts"`
+	Since    time.Time `json:"since"`
+	LastExit string    `json:"last_exit,omitempty"`
+}
+
+type supervisor struct {
+	dir        string
+	components []component
+
+	mu     sync.Mutex
+	status map[string]*Status
+	up     map[string]chan struct{} // closed once a component is up
+	upOnce map[string]*sync.Once
+}
+
+func newSupervisor(dir string, components []component) (*supervisor, error) {
+	ordered, err := dependencyOrder(components)
+	if err != nil {
+		return nil, err
+	}
+	s := &supervisor{
+		dir:        dir,
+		components: ordered,
+		status:     make(map[string]*Status),
+		up:         make(map[string]chan struct{}),
+		upOnce:     make(map[string]*sync.Once),
+	}
+	for _, c := range ordered {
+		s.status[c.Name] = &Status{
+			Name:  c.Name,
+			State: stateWaiting,
+			Since: time.Now(),
+		}
+		s.up[c.Name] = make(chan struct{})
+		s.upOnce[c.Name] = &sync.Once{}
+	}
+	return s, nil
+}
+
+// dependencyOrder returns components sorted such that every component comes
+// after its dependencies.
+func dependencyOrder(components []component) ([]component, error) {
+	byName := make(map[string]component)
+	for _, c := range components {
+		if _, ok := byName[c.Name]; ok {
+			return nil, fmt.Errorf("duplicate component %q", c.Name)
+		}
+		byName[c.Name] = c
+	}
+	var (
+		ordered  []component
+		done     = make(map[string]bool)
+		visiting = make(map[string]bool)
+		visit    func(name string) error
+	)
+	visit = func(name string) error {
+		if done[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("dependency cycle involving %v", sortedNames(visiting))
+		}
+		c, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("unknown component %q", name)
+		}
+		visiting[name] = true
+		for _, dep := range c.Deps {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		delete(visiting, name)
+		done[name] = true
+		ordered = append(ordered, c)
+		return nil
+	}
+	for _, c := range components {
+		if err := visit(c.Name); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// sortedNames is used for deterministic log output.
+func sortedNames(m map[string]bool) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Status returns the state of all components in dependency order.
+func (s *supervisor) Status() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]Status, 0, len(s.components))
+	for _, c := range s.components {
+		result = append(result, *s.status[c.Name])
+	}
+	return result
+}
+
+func (s *supervisor) setState(name, state string, update func(st *Status)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.status[name]
+	st.State = state
+	st.Since = time.Now()
+	if update != nil {
+		update(st)
+	}
+}
+
+func (s *supervisor) markUp(name string) {
+	s.upOnce[name].Do(func() { close(s.up[name]) })
+}
+
+// Run supervises all components until ctx is canceled.
+func (s *supervisor) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, c := range s.components {
+		wg.Add(1)
+		go func(c component) {
+			defer wg.Done()
+			s.supervise(ctx, c)
+		}(c)
+	}
+	wg.Wait()
+}
+
+func (s *supervisor) lookPath(name string) (string, error) {
+	if s.dir != "" {
+		path := filepath.Join(s.dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return exec.LookPath(name)
+}
+
+func (s *supervisor) supervise(ctx context.Context, c component) {
+	for _, dep := range c.Deps {
+		select {
+		case <-s.up[dep]:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	boff := backoff.Backoff{
+		Factor: 2,
+		Jitter: true,
+		Min:    1 * time.Second,
+		Max:    1 * time.Minute,
+	}
+	for {
+		started := time.Now()
+		err := s.runOnce(ctx, c)
+		if ctx.Err() != nil {
+			s.setState(c.Name, stateStopped, nil)
+			return
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == exitStopPermanently {
+			log.Printf("%s: exited with status %d, not restarting", c.Name, exitStopPermanently)
+			s.setState(c.Name, stateStopped, func(st *Status) {
+				st.PID = 0
+				st.LastExit = err.Error()
+			})
+			// Do not block dependents forever.
+			s.markUp(c.Name)
+			return
+		}
+		if time.Since(started) > boff.Max {
+			boff.Reset() // the component ran fine for a while
+		}
+		dur := boff.Duration()
+		log.Printf("%s: %v, restarting in %v", c.Name, err, dur)
+		s.setState(c.Name, stateBackoff, func(st *Status) {
+			st.PID = 0
+			st.Restarts++
+			if err != nil {
+				st.LastExit = err.Error()
+			} else {
+				st.LastExit = "exited"
+			}
+		})
+		select {
+		case <-time.After(dur):
+		case <-ctx.Done():
+			s.setState(c.Name, stateStopped, nil)
+			return
+		}
+	}
+}
+
+// runOnce starts c and waits until it exits or ctx is canceled, in which case
+// the component is sent SIGTERM (and SIGKILL if it does not exit in time).
+func (s *supervisor) runOnce(ctx context.Context, c component) error {
+	path, err := s.lookPath(c.Name)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(path, c.Args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("%s: started (pid %d)", c.Name, cmd.Process.Pid)
+	s.setState(c.Name, stateRunning, func(st *Status) {
+		st.PID = cmd.Process.Pid
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	go s.awaitReady(ctx, c.Name)
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(5 * time.Second):
+			cmd.Process.Kill()
+			return <-done
+		}
+	}
+}
+
+// awaitReady marks the component as up once it is reachable on the ipc bus
+// (or after readyTimeout, so that a missing registration cannot block startup).
+func (s *supervisor) awaitReady(ctx context.Context, name string) {
+	want := "/user/" + name
+	deadline := time.After(readyTimeout)
+	for {
+		if err := ipc.Ping(want); err == nil {
+			s.markUp(name)
+			return
+		}
+		select {
+		case <-deadline:
+			log.Printf("%s: not registered as %s after %v, starting dependents anyway", name, want, readyTimeout)
+			s.markUp(name)
+			return
+		case <-ctx.Done():
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"git.tcp.direct/kayos/rout5/ipc"
+)
+
+func TestDependencyOrder(t *testing.T) {
+	ordered, err := dependencyOrder([]component{
+		{Name: "diagd", Deps: []string{"netconfigd"}},
+		{Name: "dhcp4", Deps: []string{"netconfigd"}},
+		{Name: "netconfigd"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, c := range ordered {
+		names = append(names, c.Name)
+	}
+	if diff := cmp.Diff([]string{"netconfigd", "diagd", "dhcp4"}, names); diff != "" {
+		t.Fatalf("dependencyOrder: diff (-want +got):\n%s", diff)
+	}
+
+	if _, err := dependencyOrder([]component{
+		{Name: "a", Deps: []string{"b"}},
+		{Name: "b", Deps: []string{"a"}},
+	}); err == nil {
+		t.Fatalf("dependencyOrder unexpectedly accepted a cycle")
+	}
+}
+
+func TestStopPermanently(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rout5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	ipc.Dir = filepath.Join(tmp, "run")
+
+	// releaser mimics dhcp4 after sending a DHCPRELEASE.
+	script := "#!/bin/sh\nexit 125\n"
+	if err := ioutil.WriteFile(filepath.Join(tmp, "releaser"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSupervisor(tmp, []component{{Name: "releaser"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, canc := context.WithTimeout(context.Background(), 30*time.Second)
+	defer canc()
+	s.Run(ctx) // returns once the only component stopped permanently
+	if ctx.Err() != nil {
+		t.Fatalf("supervisor did not honor exit status %d", exitStopPermanently)
+	}
+	st := s.Status()
+	if got, want := st[0].State, stateStopped; got != want {
+		t.Fatalf("releaser state: got %q, want %q", got, want)
+	}
+	if got, want := st[0].Restarts, 0; got != want {
+		t.Fatalf("releaser restarts: got %d, want %d", got, want)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"runtime"
 
 	"github.com/spf13/viper"
@@ -37,15 +38,22 @@ func Init() {
 	Snek.SetConfigType("toml")
 	Snek.SetConfigName("config")
 
-	argParse()
+	// Daemons started by the rout5 supervisor inherit its config file.
+	if fn := os.Getenv(EnvConfig); fn != "" {
+		loadCustomConfig(fn)
+	}
 
 	if customconfig {
+		setDefaults(Snek)
+		if len(Filename) < 1 {
+			Filename = customFilename
+		}
 		associateExportedVariables()
 		return
 	}
 
 	setConfigFileLocations()
-	setDefaults()
+	setDefaults(Snek)
 
 	for _, loc := range configLocations {
 		Snek.AddConfigPath(loc)
@@ -89,32 +97,35 @@ func loadCustomConfig(path string) {
 		break
 	}
 	customconfig = true
+	customFilename = path
 }
 
-func printUsage() {
-	println("\n" + Title + " v" + Version + " Usage\n")
-	println("-c <config.toml> - Specify config file")
-	println("--nocolor - disable color and banner ")
-	println("--banner - show banner + version and exit")
-	println("--genconfig - write default config to 'default.toml' then exit")
-	os.Exit(0)
+// WriteDefault writes a config file containing only the default values to
+// path, which must not exist yet.
+func WriteDefault(path string) error {
+	v := viper.New()
+	v.SetConfigType("toml")
+	setDefaults(v)
+	return v.SafeWriteConfigAs(path)
 }
 
-// TODO: should probably just make a proper CLI with flags or something
-func argParse() {
-	for i, arg := range os.Args {
-		switch arg {
-		case "-h":
-			printUsage()
-		case "--genconfig":
-			GenConfig = true
-		case "--config", "-c":
-			if len(os.Args) <= i-1 {
-				panic("syntax error! expected file after -c")
-			}
-			loadCustomConfig(os.Args[i+1])
-		default:
-			continue
-		}
+// Dump writes the effective configuration, i.e. the config file merged with
+// the default values, to w in TOML format.
+func Dump(w io.Writer) error {
+	// viper can only encode into files.
+	dir, err := os.MkdirTemp("", "rout5-config")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "config.toml")
+	if err := Snek.WriteConfigAs(fn); err != nil {
+		return err
+	}
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return err
 	}
+	_, err = w.Write(b)
+	return err
 }
@@ -16,21 +16,23 @@ const (
 )
 
 var (
-	// GenConfig when toggled causes HellPot to write its default config to the cwd and then exit.
-	GenConfig = false
 	// NoColor stops zerolog from outputting color, necessary on Windows.
 	NoColor = true
 )
 
+// The defaults below match those written by setDefaults, so that packages
+// work as expected even when Init was not called (e.g. in tests).
+
 // "data"
 var (
-	DataDirectory string
+	// DataDirectory holds all persistent state, e.g. DHCP leases.
+	DataDirectory = "/perm"
 )
 
 // "interfaces"
 var (
-	PreferredWAN []string
-	PreferredLAN []string
+	PreferredWAN = []string{"uplink0"}
+	PreferredLAN = []string{"lan0"}
 	// Uplinks are connections to WAN(s).
 	Uplinks = make(map[string]net.Interface)
 	// Downlinks are connections to our LAN(s).
@@ -39,17 +41,49 @@ var (
 
 // "dhcp"
 var (
-	DHCPEnabled    = true
-	DHCPInterfaces []string
-	DHCPLeaseTime  time.Duration
+	DHCPEnabled = true
+	// DHCPInterfaces are the interfaces on which dhcp4 and dhcp6 obtain
+	// leases, i.e. the WAN interfaces.
+	DHCPInterfaces = PreferredWAN
+	// DHCPLeaseTime is the lease period handed out by dhcp4d.
+	DHCPLeaseTime = 20 * time.Minute
 )
 
+// DHCP4Dir returns the directory (relative to DataDirectory) in which dhcp4
+// persists the lease it obtained on the WAN interface ifname: dhcp4/wire for
+// the first of interfaces.wan_ifnames, like before multiple uplinks were
+// supported, and dhcp4/<ifname> for all others.
+func DHCP4Dir(ifname string) string {
+	wan := Current().PreferredWAN
+	if len(wan) == 0 || ifname == wan[0] {
+		return "dhcp4/wire"
+	}
+	return "dhcp4/" + ifname
+}
+
 // "admin"
 var (
 	AdminHTTP []string
 	AdminSSH  []string
 )
 
+// "ports"
+var (
+	NetconfigdPort = 8066
+	DHCP4dPort     = 8067
+	DiagdPort      = 7733
+	CapturedPort   = 5022
+	SupervisorPort = 8065
+)
+
+// "privileges"
+var (
+	// UID and GID are the ids daemons switch to after acquiring their
+	// privileged resources.
+	UID = 65534
+	GID = 65534
+)
+
 var (
 	f   *os.File
 	err error
@@ -57,9 +91,14 @@ var (
 
 var (
 	customconfig    = false
+	customFilename  string
 	configLocations []string
 )
 
+// EnvConfig names the environment variable which, if set, specifies the config
+// file to use, like rout5 -config does.
+const EnvConfig = "ROUT5_CONFIG"
+
 var (
 	// Debug and Trace are our global debug toggles.
 	Debug, Trace bool
@@ -1,15 +1,15 @@
 package config
 
 import (
-	"fmt"
-	"os"
+	"time"
 
 	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
 )
 
-func setDefaults() {
+func setDefaults(v *viper.Viper) {
 	var (
-		configSections = []string{"logger", "http", "interfaces", "data"}
+		configSections = []string{"logger", "admin", "dhcp", "interfaces", "data", "ports", "privileges"}
 		deflogdir      = "/var/logging/" + Title
 	)
 
@@ -31,29 +31,37 @@ func setDefaults() {
 	}
 
 	Opt["dhcp"] = map[string]interface{}{
-		"lease_time_seconds": 3600,
+		// Apple recommends a DHCP lease time of 1 hour in
+		// https://support.apple.com/de-ch/HT202068,
+		// so if 20 minutes ever causes any trouble,
+		// we should try increasing it to 1 hour.
+		"lease_time_seconds": 1200,
 	}
 
 	Opt["interfaces"] = map[string]interface{}{
-		"wan_ifnames": []string{"eth0"},
-		"lan_ifnames": []string{"eth1"},
+		"wan_ifnames": []string{"uplink0"},
+		"lan_ifnames": []string{"lan0"},
 	}
 
 	Opt["data"] = map[string]interface{}{
-		"directory": "/rout5",
+		"directory": "/perm",
 	}
 
-	for _, def := range configSections {
-		Snek.SetDefault(def, Opt[def])
+	Opt["ports"] = map[string]interface{}{
+		"netconfigd": 8066,
+		"dhcp4d":     8067,
+		"diagd":      7733,
+		"captured":   5022,
+		"supervisor": 8065,
+	}
+
+	Opt["privileges"] = map[string]interface{}{
+		"uid": 65534,
+		"gid": 65534,
 	}
 
-	if GenConfig {
-		if err = Snek.SafeWriteConfigAs("./config.toml"); err != nil {
-			fmt.Println(err.Error())
-			os.Exit(1)
-		}
-		println("config generated -> ./config.toml")
-		os.Exit(0)
+	for _, def := range configSections {
+		v.SetDefault(def, Opt[def])
 	}
 }
 func processOpts() {
@@ -77,7 +85,15 @@ func processOpts() {
 	}
 
 	// int options and their exported variables
-	intOpt := map[string]*int{}
+	intOpt := map[string]*int{
+		"ports.netconfigd": &NetconfigdPort,
+		"ports.dhcp4d":     &DHCP4dPort,
+		"ports.diagd":      &DiagdPort,
+		"ports.captured":   &CapturedPort,
+		"ports.supervisor": &SupervisorPort,
+		"privileges.uid":   &UID,
+		"privileges.gid":   &GID,
+	}
 
 	for key, opt := range intOpt {
 		*opt = Snek.GetInt(key)
@@ -93,6 +109,10 @@ func processOpts() {
 	for key, opt := range boolOpt {
 		*opt = Snek.GetBool(key)
 	}
+
+	DHCPInterfaces = PreferredWAN
+	DHCPLeaseTime = time.Duration(Snek.GetInt("dhcp.lease_time_seconds")) * time.Second
+	current.Store(readReloadable(Snek))
 }
 
 func associateExportedVariables() {
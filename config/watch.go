@@ -0,0 +1,139 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// FieldError describes an invalid value in the config file.
+type FieldError struct {
+	Key     string // e.g. ports.dhcp4d
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Key + ": " + e.Message
+}
+
+// Validate checks the values read from the config file, before they are
+// copied into the exported variables. It returns one FieldError per problem.
+func Validate() []FieldError {
+	return validate(Snek)
+}
+
+func validate(v *viper.Viper) []FieldError {
+	var errs []FieldError
+	for _, key := range []string{
+		"ports.netconfigd",
+		"ports.dhcp4d",
+		"ports.diagd",
+		"ports.captured",
+		"ports.supervisor",
+	} {
+		if port := v.GetInt(key); port <= 0 || port > 65535 {
+			errs = append(errs, FieldError{key, fmt.Sprintf("invalid port %d", port)})
+		}
+	}
+	for _, key := range []string{"interfaces.wan_ifnames", "interfaces.lan_ifnames"} {
+		if len(v.GetStringSlice(key)) == 0 {
+			errs = append(errs, FieldError{key, "at least one interface name required"})
+		}
+	}
+	if v.GetString("data.directory") == "" {
+		errs = append(errs, FieldError{"data.directory", "must not be empty"})
+	}
+	if secs := v.GetInt("dhcp.lease_time_seconds"); secs <= 0 {
+		errs = append(errs, FieldError{"dhcp.lease_time_seconds", fmt.Sprintf("invalid lease time %d", secs)})
+	}
+	return errs
+}
+
+// Reloadable holds the settings which Reload changes while the daemons run.
+// All other settings, e.g. ports or privileges, take effect on restart.
+type Reloadable struct {
+	PreferredWAN  []string
+	PreferredLAN  []string
+	DHCPLeaseTime time.Duration
+}
+
+var current atomic.Value // *Reloadable, set by Init and Reload
+
+func readReloadable(v *viper.Viper) *Reloadable {
+	return &Reloadable{
+		PreferredWAN:  v.GetStringSlice("interfaces.wan_ifnames"),
+		PreferredLAN:  v.GetStringSlice("interfaces.lan_ifnames"),
+		DHCPLeaseTime: time.Duration(v.GetInt("dhcp.lease_time_seconds")) * time.Second,
+	}
+}
+
+// Current returns the Reloadable settings in effect. Unlike the exported
+// variables, which only Init sets, it reflects Reload and is safe for
+// concurrent use. Before Init, it returns the exported variables (which
+// tests modify).
+func Current() *Reloadable {
+	if r, ok := current.Load().(*Reloadable); ok {
+		return r
+	}
+	return &Reloadable{
+		PreferredWAN:  PreferredWAN,
+		PreferredLAN:  PreferredLAN,
+		DHCPLeaseTime: DHCPLeaseTime,
+	}
+}
+
+// Reload re-reads the config file. If the file cannot be parsed or is invalid,
+// Snek and Current keep their previous values and an error is returned. The
+// exported variables are not modified, as other goroutines read them without
+// synchronization. Snek must only be used by the goroutine which calls Reload.
+func Reload() error {
+	if Filename == "" {
+		return nil
+	}
+	b, err := os.ReadFile(Filename)
+	if err != nil {
+		return err
+	}
+	// Validate the new contents in a fresh instance, so that a rejected file
+	// does not leave its values behind in Snek.
+	v := viper.New()
+	v.SetConfigType("toml")
+	setDefaults(v)
+	if err := v.ReadConfig(bytes.NewReader(b)); err != nil {
+		return fmt.Errorf("%s: %v", Filename, err)
+	}
+	if errs := validate(v); len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for idx, err := range errs {
+			msgs[idx] = err.Error()
+		}
+		return fmt.Errorf("%s: %s", Filename, strings.Join(msgs, "; "))
+	}
+	Snek.SetConfigType("toml")
+	if err := Snek.ReadConfig(bytes.NewReader(b)); err != nil {
+		return fmt.Errorf("%s: %v", Filename, err)
+	}
+	current.Store(readReloadable(v))
+	return nil
+}
+
+// Watch calls fn whenever the config file changed. fn typically arranges for
+// Reload to be called, which validates the new contents before they take
+// effect.
+func Watch(fn func()) {
+	if Filename == "" {
+		return
+	}
+	// viper re-reads a watched file by itself, so watch through a separate
+	// instance: only Reload may modify Snek.
+	w := viper.New()
+	w.SetConfigFile(Filename)
+	w.OnConfigChange(func(fsnotify.Event) { fn() })
+	w.WatchConfig()
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReloadConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "config.toml")
+	write := func(wan string) {
+		t.Helper()
+		contents := "[interfaces]\nwan_ifnames = [\"" + wan + "\"]\nlan_ifnames = [\"lan0\"]\n"
+		if err := os.WriteFile(fn, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(prev string) { Filename = prev }(Filename)
+	Filename = fn
+
+	// Daemons read the settings from other goroutines while Reload runs,
+	// which go test -race verifies.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if r := Current(); len(r.PreferredWAN) != 1 {
+					t.Errorf("PreferredWAN = %q, want one interface", r.PreferredWAN)
+					return
+				}
+				_ = DHCP4Dir("uplink1")
+				_ = DataDirectory
+			}
+		}()
+	}
+
+	for _, wan := range []string{"uplink0", "uplink1", "uplink2"} {
+		write(wan)
+		if err := Reload(); err != nil {
+			t.Fatal(err)
+		}
+		if got := Current().PreferredWAN[0]; got != wan {
+			t.Errorf("after Reload: PreferredWAN[0] = %q, want %q", got, wan)
+		}
+		if got, want := Current().DHCPLeaseTime, 20*time.Minute; got != want {
+			t.Errorf("after Reload: DHCPLeaseTime = %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// An invalid file leaves the settings in effect untouched.
+	if err := os.WriteFile(fn, []byte("[interfaces]\nwan_ifnames = []\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reload(); err == nil {
+		t.Errorf("Reload unexpectedly accepted an empty interfaces.wan_ifnames")
+	}
+	if got, want := Current().PreferredWAN[0], "uplink2"; got != want {
+		t.Errorf("after failed Reload: PreferredWAN[0] = %q, want %q", got, want)
+	}
+
+	close(done)
+	wg.Wait()
+}
@@ -50,13 +50,16 @@ func (l *Lease) Expired(at time.Time) bool {
 }
 
 type Handler struct {
-	serverIP    net.IP
-	start       net.IP // first IP address to hand out
-	leaseRange  int    // number of IP addresses to hand out
-	LeasePeriod time.Duration
-	options     dhcp4.Options
-	rawConn     net.PacketConn
-	iface       *net.Interface
+	serverIP   net.IP
+	start      net.IP // first IP address to hand out
+	leaseRange int    // number of IP addresses to hand out
+	options    dhcp4.Options
+	rawConn    net.PacketConn
+	iface      *net.Interface
+
+	// leasePeriod is updated when the config is reloaded, while serving.
+	periodMu    sync.Mutex
+	leasePeriod time.Duration
 
 	timeNow func() time.Time
 
@@ -101,7 +104,7 @@ func NewHandler(dir string, iface *net.Interface, ifaceName string, conn net.Pac
 		// https://support.apple.com/de-ch/HT202068,
 		// so if 20 minutes ever causes any trouble,
 		// we should try increasing it to 1 hour.
-		LeasePeriod: 20 * time.Minute,
+		leasePeriod: 20 * time.Minute,
 		options: dhcp4.Options{
 			dhcp4.OptionSubnetMask:       []byte{255, 255, 255, 0},
 			dhcp4.OptionRouter:           []byte(serverIP),
@@ -142,8 +145,8 @@ func (h *Handler) SetHostname(hwaddr, hostname string) error {
 	h.leasesMu.Lock()
 	defer h.leasesMu.Unlock()
 	leaseNum := h.leasesHW[hwaddr]
-	lease := h.leasesIP[leaseNum]
-	if lease.HardwareAddr != hwaddr || lease.Expired(h.timeNow()) {
+	lease, ok := h.leasesIP[leaseNum]
+	if !ok || lease.HardwareAddr != hwaddr || lease.Expired(h.timeNow()) {
 		return fmt.Errorf("hwaddr %v does not have a valid lease", hwaddr)
 	}
 	lease.Hostname = hostname
@@ -152,6 +155,27 @@ func (h *Handler) SetHostname(hwaddr, hostname string) error {
 	return nil
 }
 
+// Release expires the lease of hwaddr, so that its address can be handed out
+// to a different device.
+func (h *Handler) Release(hwaddr string) error {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	leaseNum, ok := h.leasesHW[hwaddr]
+	if !ok {
+		return fmt.Errorf("hwaddr %v does not have a lease", hwaddr)
+	}
+	lease, ok := h.leasesIP[leaseNum]
+	if !ok || lease.HardwareAddr != hwaddr {
+		return fmt.Errorf("hwaddr %v does not have a lease", hwaddr)
+	}
+	if lease.Expiry.IsZero() {
+		return fmt.Errorf("hwaddr %v has a static lease", hwaddr)
+	}
+	lease.Expiry = h.timeNow()
+	h.callLeasesLocked(nil)
+	return nil
+}
+
 func (h *Handler) findLease() int {
 	h.leasesMu.Lock()
 	defer h.leasesMu.Unlock()
@@ -259,14 +283,29 @@ func (h *Handler) leaseHW(hwAddr string) (*Lease, bool) {
 	return l, ok && l.HardwareAddr == hwAddr
 }
 
+// LeasePeriod returns the lease time handed out to most devices.
+func (h *Handler) LeasePeriod() time.Duration {
+	h.periodMu.Lock()
+	defer h.periodMu.Unlock()
+	return h.leasePeriod
+}
+
+// SetLeasePeriod changes the lease time of subsequently handed out leases. It
+// is safe to call while serving.
+func (h *Handler) SetLeasePeriod(d time.Duration) {
+	h.periodMu.Lock()
+	defer h.periodMu.Unlock()
+	h.leasePeriod = d
+}
+
 func (h *Handler) leasePeriodForDevice(hwAddr string) time.Duration {
 	hwAddrPrefix, err := hex.DecodeString(strings.ReplaceAll(hwAddr, ":", ""))
 	if err != nil {
-		return h.LeasePeriod
+		return h.LeasePeriod()
 	}
 	if len(hwAddrPrefix) != 6 {
 		// Invalid MAC address
-		return h.LeasePeriod
+		return h.LeasePeriod()
 	}
 	hwAddrPrefix = hwAddrPrefix[:3]
 	i := sort.Search(len(nintendoMacPrefixes), func(i int) bool {
@@ -275,7 +314,7 @@ func (h *Handler) leasePeriodForDevice(hwAddr string) time.Duration {
 	if i < len(nintendoMacPrefixes) && bytes.Equal(nintendoMacPrefixes[i][:], hwAddrPrefix) {
 		return 1 * time.Hour
 	}
-	return h.LeasePeriod
+	return h.LeasePeriod()
 }
 
 // TODO: is ServeDHCP always run from the same goroutine, or do we need locking?
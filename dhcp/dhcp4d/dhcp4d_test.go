@@ -557,3 +557,41 @@ func TestClientDecline(t *testing.T) {
 		}
 	})
 }
+
+func TestRelease(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	now := time.Now()
+	handler.timeNow = func() time.Time { return now }
+
+	var (
+		addr         = net.IP{192, 168, 42, 23}
+		hardwareAddr = net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+		otherAddr    = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	)
+
+	p := request(addr, hardwareAddr)
+	if resp := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions()); messageType(resp) != dhcp4.ACK {
+		t.Fatalf("DHCPREQUEST resulted in unexpected message type: got %v, want %v", messageType(resp), dhcp4.ACK)
+	}
+
+	if err := handler.Release(otherAddr.String()); err == nil {
+		t.Fatalf("Release(%v) unexpectedly succeeded without a lease", otherAddr)
+	}
+	if err := handler.Release(hardwareAddr.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(time.Second)
+
+	// The released address can be handed out to a different device.
+	p = request(addr, otherAddr)
+	resp := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if got, want := messageType(resp), dhcp4.ACK; got != want {
+		t.Fatalf("DHCPREQUEST resulted in unexpected message type: got %v, want %v", got, want)
+	}
+	if got, want := resp.YIAddr().To4(), addr.To4(); !got.Equal(want) {
+		t.Errorf("DHCPREQUEST resulted in wrong IP: got %v, want %v", got, want)
+	}
+}
@@ -18,19 +18,49 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"sync"
 	"time"
+
+	"git.tcp.direct/kayos/rout5/config"
+)
+
+// Lease files relative to config.DataDirectory, as passed to UpdateLease.
+const (
+	LeaseDHCPv4 = "dhcp4/wire/lease.json"
+	LeaseDHCPv6 = "dhcp6/wire/lease.json"
 )
 
+var (
+	leasesMu sync.Mutex
+	leases   = make(map[string]time.Time)
+)
+
+// UpdateLease records the expiry of the lease persisted in fn, typically as
+// received over the ipc bus, so that it need not be re-read from disk.
+func UpdateLease(fn string, validUntil time.Time) {
+	leasesMu.Lock()
+	defer leasesMu.Unlock()
+	leases[fn] = validUntil
+}
+
 func leaseValid(fn string) (status string, _ error) {
 	var lease struct {
 		ValidUntil time.Time `json:"valid_until"`
 	}
-	b, err := ioutil.ReadFile(fn)
-	if err != nil {
-		return "", err
-	}
-	if err := json.Unmarshal(b, &lease); err != nil {
-		return "", err
+	leasesMu.Lock()
+	validUntil, ok := leases[fn]
+	leasesMu.Unlock()
+	if ok {
+		lease.ValidUntil = validUntil
+	} else {
+		b, err := ioutil.ReadFile(filepath.Join(config.DataDirectory, fn))
+		if err != nil {
+			return "", err
+		}
+		if err := json.Unmarshal(b, &lease); err != nil {
+			return "", err
+		}
 	}
 	if time.Now().After(lease.ValidUntil) {
 		return "", fmt.Errorf("lease expired at %v", lease.ValidUntil)
@@ -40,9 +70,13 @@ func leaseValid(fn string) (status string, _ error) {
 
 type dhcpv4 struct {
 	children []Node
+	ifname   string // empty for the first uplink
 }
 
 func (d *dhcpv4) String() string {
+	if d.ifname != "" {
+		return "dhcp4/" + d.ifname
+	}
 	return "dhcp4"
 }
 
@@ -56,15 +90,30 @@ func (d *dhcpv4) Children() []Node {
 }
 
 func (d *dhcpv4) Evaluate() (string, error) {
-	return leaseValid("/perm/dhcp4/wire/lease.json")
+	if d.ifname != "" {
+		return leaseValid(LeaseDHCPv4On(d.ifname))
+	}
+	return leaseValid(LeaseDHCPv4)
 }
 
-// DHCPv4 returns a Node which succeeds if /perm/dhcp4/wire/lease.json contains
+// DHCPv4 returns a Node which succeeds if dhcp4/wire/lease.json (within
+// config.DataDirectory) contains
 // a non-expired DHCPv4 lease.
 func DHCPv4() Node {
 	return &dhcpv4{}
 }
 
+// LeaseDHCPv4On returns the lease file of the uplink ifname, see
+// config.DHCP4Dir.
+func LeaseDHCPv4On(ifname string) string {
+	return config.DHCP4Dir(ifname) + "/lease.json"
+}
+
+// DHCPv4On is like DHCPv4, but checks the lease of the uplink ifname.
+func DHCPv4On(ifname string) Node {
+	return &dhcpv4{ifname: ifname}
+}
+
 type dhcpv6 struct {
 	children []Node
 }
@@ -83,10 +132,11 @@ func (d *dhcpv6) Children() []Node {
 }
 
 func (d *dhcpv6) Evaluate() (string, error) {
-	return leaseValid("/perm/dhcp6/wire/lease.json")
+	return leaseValid(LeaseDHCPv6)
 }
 
-// DHCPv6 returns a Node which succeeds if /perm/dhcp6/wire/lease.json contains
+// DHCPv6 returns a Node which succeeds if dhcp6/wire/lease.json (within
+// config.DataDirectory) contains
 // a non-expired DHCPv6 lease.
 func DHCPv6() Node {
 	return &dhcpv6{}
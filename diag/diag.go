@@ -32,10 +32,10 @@ func NewMonitor(n Node) *Monitor {
 }
 
 type EvalResult struct {
-	Name     string
-	Error    bool
-	Status   string
-	Children []*EvalResult
+	Name     string        `json:"name"`
+	Error    bool          `json:"error"`
+	Status   string        `json:"status"`
+	Children []*EvalResult `json:"children,omitempty"`
 }
 
 func evaluate(n Node, err string) *EvalResult {
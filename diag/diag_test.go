@@ -15,6 +15,7 @@
 package diag_test
 
 import (
+	"net"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -52,3 +53,28 @@ func TestDiagMonitor(t *testing.T) {
 		t.Fatalf("Evaluate(): unexpected result: diff (-want +got):\n%s", diff)
 	}
 }
+
+func TestDiagTCP4On(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	if _, err := diag2.TCP4On("lo", ln.Addr().String()).Evaluate(); err != nil {
+		t.Errorf("TCP4On(lo).Evaluate = %v, want nil", err)
+	}
+
+	if _, err := diag2.TCP4On("nonexistant", ln.Addr().String()).Evaluate(); err == nil {
+		t.Errorf("TCP4On(nonexistant).Evaluate = nil, want non-nil")
+	}
+}
@@ -16,13 +16,18 @@ package diag
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/digineo/go-ping"
 	"github.com/vishvananda/netlink"
+
+	"git.tcp.direct/kayos/rout5/config"
 )
 
 func formatRTT(rtt time.Duration) string {
@@ -88,6 +93,61 @@ func Ping4Gateway() Node {
 	return &ping4gw{}
 }
 
+type ping4uplink struct {
+	children []Node
+	ifname   string
+}
+
+func (d *ping4uplink) String() string {
+	return "ping4: $gateway%" + d.ifname
+}
+
+func (d *ping4uplink) Then(t Node) Node {
+	d.children = append(d.children, t)
+	return d
+}
+
+func (d *ping4uplink) Children() []Node {
+	return d.children
+}
+
+func (d *ping4uplink) Evaluate() (string, error) {
+	const timeout = 1 * time.Second
+	b, err := ioutil.ReadFile(filepath.Join(config.DataDirectory, LeaseDHCPv4On(d.ifname)))
+	if err != nil {
+		return "", err
+	}
+	var lease struct {
+		ClientIP string `json:"client_ip"`
+		Router   string `json:"router"`
+	}
+	if err := json.Unmarshal(b, &lease); err != nil {
+		return "", err
+	}
+	addr, err := net.ResolveIPAddr("ip4", lease.Router)
+	if err != nil {
+		return "", err
+	}
+	// Sending from the address of the uplink makes the reply arrive via the
+	// uplink, regardless of which uplink the default route uses.
+	p, err := ping.New(lease.ClientIP, "")
+	if err != nil {
+		return "", err
+	}
+	defer p.Close()
+	rtt, err := p.Ping(addr, timeout)
+	if err != nil {
+		return "", err
+	}
+	return formatRTT(rtt) + " from " + lease.Router, nil
+}
+
+// Ping4GatewayOn returns a Node which succeeds when the gateway of the DHCPv4
+// lease of the uplink ifname responds to an ICMPv4 ping.
+func Ping4GatewayOn(ifname string) Node {
+	return &ping4uplink{ifname: ifname}
+}
+
 type ping4 struct {
 	children []Node
 	addr     string
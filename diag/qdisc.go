@@ -0,0 +1,142 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diag
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+type qdisc struct {
+	children []Node
+	ifname   string
+}
+
+func (d *qdisc) String() string {
+	return "qdisc/" + d.ifname
+}
+
+func (d *qdisc) Then(t Node) Node {
+	d.children = append(d.children, t)
+	return d
+}
+
+func (d *qdisc) Children() []Node {
+	return d.children
+}
+
+// queueStats is struct gnet_stats_queue from linux/gen_stats.h.
+type queueStats struct {
+	kind    string
+	backlog uint32 // bytes
+	drops   uint32
+}
+
+// rootQdiscStats returns the statistics of the root qdisc of the link with
+// index ifindex. netlink.QdiscList does not parse statistics, hence the
+// qdiscs are dumped here.
+func rootQdiscStats(ifindex int) (*queueStats, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETQDISC, unix.NLM_F_DUMP)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(ifindex),
+	})
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWQDISC)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		msg := nl.DeserializeTcMsg(m)
+		if int(msg.Ifindex) != ifindex || msg.Parent != netlink.HANDLE_ROOT {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return nil, err
+		}
+		var s queueStats
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case nl.TCA_KIND:
+				s.kind = strings.TrimRight(string(attr.Value), "\x00")
+			case nl.TCA_STATS2:
+				nested, err := nl.ParseRouteAttr(attr.Value)
+				if err != nil {
+					return nil, err
+				}
+				for _, n := range nested {
+					if n.Attr.Type != nl.TCA_STATS_QUEUE || len(n.Value) < 12 {
+						continue
+					}
+					// qlen, backlog, drops, requeues, overlimits
+					s.backlog = nl.NativeEndian().Uint32(n.Value[4:8])
+					s.drops = nl.NativeEndian().Uint32(n.Value[8:12])
+				}
+			}
+		}
+		return &s, nil
+	}
+	return nil, fmt.Errorf("no root qdisc found")
+}
+
+// ingressDevice returns the device to which all traffic received on l is
+// redirected (e.g. the IFB device of rout5’s SQM), or nil.
+func ingressDevice(l netlink.Link) (netlink.Link, error) {
+	filters, err := netlink.FilterList(l, netlink.MakeHandle(0xffff, 0))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range filters {
+		if u32, ok := f.(*netlink.U32); ok && u32.RedirIndex != 0 {
+			return netlink.LinkByIndex(u32.RedirIndex)
+		}
+	}
+	return nil, nil
+}
+
+func (d *qdisc) Evaluate() (string, error) {
+	l, err := netlink.LinkByName(d.ifname)
+	if err != nil {
+		return "", err
+	}
+	egress, err := rootQdiscStats(l.Attrs().Index)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", d.ifname, err)
+	}
+	status := fmt.Sprintf("egress %s: %d dropped, %d bytes backlog", egress.kind, egress.drops, egress.backlog)
+	ifb, err := ingressDevice(l)
+	if err != nil {
+		return "", fmt.Errorf("%s: ingress: %v", d.ifname, err)
+	}
+	if ifb != nil {
+		ingress, err := rootQdiscStats(ifb.Attrs().Index)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", ifb.Attrs().Name, err)
+		}
+		status += fmt.Sprintf("; ingress (%s) %s: %d dropped, %d bytes backlog", ifb.Attrs().Name, ingress.kind, ingress.drops, ingress.backlog)
+	}
+	return status, nil
+}
+
+// Qdisc returns a Node which reports the drops and backlog of the root qdisc
+// of the specified network interface and, if its ingress is redirected (for
+// shaping, see netconfig’s SQM), of the device it is redirected to.
+func Qdisc(ifname string) Node {
+	return &qdisc{ifname: ifname}
+}
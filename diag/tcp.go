@@ -16,6 +16,10 @@ package diag
 
 import (
 	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 type tcp4 struct {
@@ -51,6 +55,54 @@ func TCP4(addr string) Node {
 	return &tcp4{addr: addr}
 }
 
+type tcp4uplink struct {
+	children []Node
+	ifname   string
+	addr     string
+}
+
+func (d *tcp4uplink) String() string {
+	return "tcp4: " + d.ifname + " → " + d.addr
+}
+
+func (d *tcp4uplink) Then(t Node) Node {
+	d.children = append(d.children, t)
+	return d
+}
+
+func (d *tcp4uplink) Children() []Node {
+	return d.children
+}
+
+func (d *tcp4uplink) Evaluate() (string, error) {
+	dialer := net.Dialer{
+		Timeout: 5 * time.Second,
+		// Binding the socket to the uplink makes the connection use the
+		// uplink, regardless of which uplink the default route uses.
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = unix.BindToDevice(int(fd), d.ifname)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	conn, err := dialer.Dial("tcp4", d.addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return "connection established from " + conn.LocalAddr().String(), nil
+}
+
+// TCP4On returns a Node which succeeds when the specified address accepts a
+// TCPv4 connection via the uplink ifname.
+func TCP4On(ifname, addr string) Node {
+	return &tcp4uplink{ifname: ifname, addr: addr}
+}
+
 type tcp6 struct {
 	children []Node
 	addr     string
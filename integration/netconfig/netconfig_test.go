@@ -16,6 +16,7 @@ package integration_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -25,13 +26,17 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/vishvananda/netlink"
 
 	"github.com/andreyvit/diff"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/spf13/viper"
 
+	"git.tcp.direct/kayos/rout5/config"
 	"git.tcp.direct/kayos/rout5/netconfig"
 )
 
@@ -115,7 +120,8 @@ func goldenPortForwardings(additionalForwarding bool) string {
     {
       "port": "8080",
       "dest_addr": "192.168.42.23",
-      "dest_port": "9999"
+      "dest_port": "9999",
+      "hairpin": true
     },
 ` + add + `
     {
@@ -134,16 +140,77 @@ func goldenPortForwardings(additionalForwarding bool) string {
 `
 }
 
+// goldenTrusted returns the rules which accept all traffic from trusted
+// interfaces. WireGuard interfaces are not trusted unless listed in
+// firewall.trusted_interfaces.
+func goldenTrusted() string {
+	return `
+		iifname "lo" accept
+		iifname "lan0" accept`
+}
+
+// goldenInput returns the input chain for icmp (IPv4) or icmpv6 (IPv6),
+// including the rules from [[netconfig.filter]] and, if wg is true, the
+// WireGuard port of goldenWireguard.
+func goldenInput(icmp, filter string, wg bool) string {
+	types := `
+		icmp type echo-request accept
+		icmp type destination-unreachable accept
+		icmp type time-exceeded accept
+		icmp type parameter-problem accept
+		udp sport 67 udp dport 68 accept`
+	if icmp == "icmpv6" {
+		types = `
+		icmpv6 type echo-request accept
+		icmpv6 type destination-unreachable accept
+		icmpv6 type packet-too-big accept
+		icmpv6 type time-exceeded accept
+		icmpv6 type parameter-problem accept
+		icmpv6 type nd-router-advert accept
+		icmpv6 type nd-neighbor-solicit accept
+		icmpv6 type nd-neighbor-advert accept
+		udp sport 547 udp dport 546 accept`
+	}
+	wgPort := ""
+	if wg {
+		wgPort = `
+		udp dport 51820 accept`
+	}
+	return `
+	chain input {
+		type filter hook input priority 0; policy drop;
+		ct state established,related accept` + filter + goldenTrusted() + `
+		tcp dport 8066 drop
+		tcp dport 8067 drop
+		tcp dport 7733 drop
+		tcp dport 5022 drop
+		tcp dport 8065 drop` + types + wgPort + `
+	}`
+}
+
+// goldenForward6 returns the rules which implement the IPv6 forward policy,
+// followed by pinholes.
+func goldenForward6(pinholes string) string {
+	return `
+		ct state established,related accept` + goldenTrusted() + `
+		icmpv6 type echo-request accept
+		icmpv6 type destination-unreachable accept
+		icmpv6 type packet-too-big accept
+		icmpv6 type time-exceeded accept
+		icmpv6 type parameter-problem accept` + pinholes
+}
+
 func goldenNftablesRules(additionalForwarding bool) string {
 	add := ""
 	if additionalForwarding {
 		add = `
 		iifname "uplink0" tcp dport 8045 dnat to 192.168.42.22:8045`
 	}
-	return `table ip nat {
+	return `table ip rout5_nat {
 	chain prerouting {
 		type nat hook prerouting priority 0; policy accept;
-		iifname "uplink0" tcp dport 8080 dnat to 192.168.42.23:9999` + add + `
+		iifname "uplink0" tcp dport 8080 dnat to 192.168.42.23:9999
+		iifname != "uplink0" ip daddr 85.195.207.62 tcp dport 8080 dnat to 192.168.42.23:9999` + add + `
 		iifname "uplink0" tcp dport 8040-8060 dnat to 192.168.42.99:8040-8060
 		iifname "uplink0" udp dport 53 dnat to 192.168.42.99:53
 	}
@@ -151,9 +218,10 @@ func goldenNftablesRules(additionalForwarding bool) string {
 	chain postrouting {
 		type nat hook postrouting priority 100; policy accept;
 		oifname "uplink0" masquerade
+		iifname != "uplink0" oifname != "uplink0" ip daddr 192.168.42.23 tcp dport 9999 ct status dnat masquerade
 	}
 }
-table ip filter {
+table ip rout5_filter {
 	counter fwded {
 		packets 23 bytes 42
 	}
@@ -163,17 +231,19 @@ table ip filter {
 		oifname "uplink0" tcp flags 0x2 tcp option maxseg size set rt mtu
 		counter name "fwded"
 	}
+` + goldenInput("icmp", "", wireGuardAvailable) + `
 }
-table ip6 filter {
+table ip6 rout5_filter {
 	counter fwded {
 		packets 23 bytes 42
 	}
 
 	chain forward {
-		type filter hook forward priority 0; policy accept;
+		type filter hook forward priority 0; policy drop;
 		oifname "uplink0" tcp flags 0x2 tcp option maxseg size set rt mtu
-		counter name "fwded"
+		counter name "fwded"` + goldenForward6("") + `
 	}
+` + goldenInput("icmpv6", "", wireGuardAvailable) + `
 }`
 }
 
@@ -283,6 +353,9 @@ func TestNetconfig(t *testing.T) {
 			t.Fatalf("netconfig.Apply: %v", err)
 		}
 
+		// Once applied, the config must not entail any further changes.
+		assertNoChanges(t, tmp, filepath.Join(tmp, "root"))
+
 		b, err := ioutil.ReadFile(filepath.Join(tmp, "root", "tmp", "resolv.conf"))
 		if err != nil {
 			t.Fatal(err)
@@ -718,3 +791,2627 @@ func TestDHCPv4OldAddressDeconfigured(t *testing.T) {
 		}
 	})
 }
+
+func TestLoadConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rout5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, golden := range []struct {
+		filename, content string
+	}{
+		{"interfaces.json", goldenInterfaces},
+		{"portforwardings.json", goldenPortForwardings(false)},
+		{"wireguard.json", goldenWireguard},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(tmp, golden.filename), []byte(golden.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := netconfig.LoadConfig(tmp); err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	for _, tt := range []struct {
+		filename, content string
+	}{
+		{"interfaces.json", `{"interfaces":[{"name": "lan0", "addr": "192.168.42.1"}]}`},
+		{"interfaces.json", `{"interfaces":[{"name": "lan0", "hardware_addr": "02:73:53"}]}`},
+		{"portforwardings.json", `{"forwardings":[{"proto": "sctp", "port": "80", "dest_addr": "192.168.42.23", "dest_port": "80"}]}`},
+		{"portforwardings.json", `{"forwardings":[{"port": "80", "dest_addr": "fe80::1", "dest_port": "80"}]}`},
+		{"wireguard.json", `{"interfaces":[{"name": "wg0", "private_key": "invalid"}]}`},
+		{"wireguard.json", `{"interfaces":`},
+	} {
+		t.Run(tt.filename, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "rout5")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			if err := ioutil.WriteFile(filepath.Join(dir, tt.filename), []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err = netconfig.LoadConfig(dir)
+			if err == nil {
+				t.Fatalf("LoadConfig(%s) unexpectedly succeeded", tt.content)
+			}
+			if !strings.Contains(err.Error(), tt.filename) {
+				t.Fatalf("LoadConfig: error %q does not mention %s", err, tt.filename)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rout5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, golden := range []struct {
+		filename, content string
+	}{
+		{"interfaces.json", `
+{
+  "interfaces":[
+    {"hardware_addr": "02:73:53:00:ca:fe", "name": "uplink0"},
+    {"hardware_addr": "02:73:53:00:ca:fe", "name": "lan0", "addr": "192.168.42.1/33"},
+    {"name": "lan0", "addr": "10.0.0.1/24"}
+  ]
+}`},
+		{"portforwardings.json", `
+{
+  "forwardings":[
+    {"port": "8090-8080", "dest_addr": "10.0.0.23", "dest_port": "9999"},
+    {"port": "53", "dest_addr": "192.168.1.1", "dest_port": "53"}
+  ]
+}`},
+		{"wireguard.json", `
+{
+  "interfaces":[
+    {
+      "name": "wg0",
+      "private_key": "gBCV3afBKfW7RycmeZFMpJykvO+58KfSEIyavay90kE=",
+      "peers": [{"public_key": "ScxV5nQsUIaaOp3qdwPqRcgM", "allowed_ips": ["10.0.137.0"]}]
+    }
+  ]
+}`},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(tmp, golden.filename), []byte(golden.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type problem struct{ File, Field string }
+	var got []problem
+	for _, p := range netconfig.Check(tmp) {
+		got = append(got, problem{filepath.Base(p.File), p.Field})
+	}
+	want := []problem{
+		{"interfaces.json", "interfaces[1].hardware_addr"},
+		{"interfaces.json", "interfaces[1].addr"},
+		{"interfaces.json", "interfaces[2].name"},
+		{"portforwardings.json", "forwardings[0].port"},
+		{"wireguard.json", "interfaces[0].peers[0].public_key"},
+		{"wireguard.json", "interfaces[0].peers[0].allowed_ips[0]"},
+		{"portforwardings.json", "forwardings[1].dest_addr"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Check: unexpected problems: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestImportJSON(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rout5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, golden := range []struct {
+		filename, content string
+	}{
+		{"interfaces.json", goldenInterfaces},
+		{"portforwardings.json", goldenPortForwardings(true)},
+		{"wireguard.json", goldenWireguard},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(tmp, golden.filename), []byte(golden.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	imported, err := netconfig.LoadJSONConfig(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := imported.Section()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write config.toml like “rout5 config import” does, then read it back.
+	defer func(snek *viper.Viper, fn string) {
+		config.Snek, config.Filename = snek, fn
+	}(config.Snek, config.Filename)
+	config.Filename = filepath.Join(tmp, "config.toml")
+	config.Snek = viper.New()
+	config.Snek.SetConfigType("toml")
+	config.Snek.Set(netconfig.Section, want)
+	if err := config.Snek.WriteConfigAs(config.Filename); err != nil {
+		t.Fatal(err)
+	}
+	config.Snek = viper.New()
+	config.Snek.SetConfigFile(config.Filename)
+	if err := config.Snek.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The JSON files must no longer be read.
+	for _, fn := range netconfig.ConfigFiles {
+		if err := os.Remove(filepath.Join(tmp, fn)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg, err := netconfig.LoadConfig(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := cfg.Section()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("config.toml: unexpected [netconfig] section: diff (-want +got):\n%s", diff)
+	}
+
+	details, err := netconfig.Interface(tmp, "lan0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := details.Addr, "192.168.42.1/24"; got != want {
+		t.Errorf("Interface(lan0).Addr = %q, want %q", got, want)
+	}
+
+	// Typos in config.toml are reported with their location.
+	if err := ioutil.WriteFile(config.Filename, []byte("[[netconfig.interfaces]]\nname = 'lan0'\naddress = '192.168.42.1/24'\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Snek.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = netconfig.LoadConfig(tmp)
+	if err == nil || !strings.Contains(err.Error(), "address") {
+		t.Errorf("LoadConfig: got %v, want error mentioning invalid key address", err)
+	}
+}
+
+func TestFirewallConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rout5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	defer func(snek *viper.Viper, fn string) {
+		config.Snek, config.Filename = snek, fn
+	}(config.Snek, config.Filename)
+	config.Filename = filepath.Join(tmp, "config.toml")
+	const toml = `
+[[netconfig.interfaces]]
+name = "uplink0"
+
+[[netconfig.interfaces]]
+name = "lan0"
+addr = "192.168.42.1/24"
+
+[netconfig.firewall]
+input_policy = "reject"
+allow_tcp = ["22", "8060-8070"]
+allow_udp = ["51820-"]
+trusted_interfaces = ["guest0", "uplink0"]
+admin_interfaces = ["lan0", "uplink0"]
+admin_ports = [8066, 22]
+`
+	if err := ioutil.WriteFile(config.Filename, []byte(toml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.Snek = viper.New()
+	config.Snek.SetConfigFile(config.Filename)
+	if err := config.Snek.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, p := range netconfig.Check(tmp) {
+		if strings.HasPrefix(p.Field, "netconfig.firewall.") {
+			got = append(got, p.Field)
+		}
+	}
+	want := []string{
+		"netconfig.firewall.input_policy",
+		"netconfig.firewall.trusted_interfaces[1]", // uplink
+		"netconfig.firewall.admin_interfaces[1]",   // uplink
+		"netconfig.firewall.allow_udp[0]",
+		"netconfig.firewall.admin_ports[1]", // not an admin port
+		"netconfig.firewall.allow_tcp[1]",   // covers admin ports
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Check: unexpected problems: diff (-want +got):\n%s", diff)
+	}
+}
+
+const goldenFilterConfig = `
+[[netconfig.interfaces]]
+hardware_addr = "02:73:53:00:ca:fe"
+name = "uplink0"
+
+[[netconfig.interfaces]]
+hardware_addr = "02:73:53:00:b0:0c"
+name = "lan0"
+addr = "192.168.42.1/24"
+
+[[netconfig.filter]]
+iif = "lan0"
+oif = "uplink0"
+proto = "tcp"
+dport = "25"
+action = "reject"
+
+[[netconfig.filter]]
+src = "192.168.42.0/24"
+dst = "10.0.0.0/8"
+action = "drop"
+
+[[netconfig.filter]]
+dst = "2001:db8::/32"
+proto = "udp"
+sport = "1024-65535"
+ct_state = ["new"]
+action = "log"
+log_prefix = "fwd6: "
+
+[[netconfig.filter]]
+proto = "icmp"
+action = "counter"
+
+[[netconfig.filter]]
+chain = "input"
+iif = "lan0"
+src = "192.168.42.99/32"
+proto = "tcp"
+dport = "22"
+action = "accept"
+
+[[netconfig.filter]]
+chain = "input"
+iif = "lan0"
+proto = "tcp"
+dport = "22"
+action = "drop"
+
+[[netconfig.pinholes]]
+hardware_addr = "02:73:53:00:b0:0c"
+port = "443"
+
+[[netconfig.pinholes]]
+iid = "::1:2"
+proto = "tcp,udp"
+port = "60000-61000"
+
+[[netconfig.pinholes]]
+host = "nas"
+port = "22"
+
+[[netconfig.pinholes]]
+host = "printer" # no lease, hence skipped
+port = "631"
+
+[[netconfig.forwardings]]
+description = "ssh to the nas, from the office only"
+port = "2222"
+dest_host = "nas"
+dest_port = "22"
+allowed_src = ["203.0.113.0/24", "198.51.100.7/32"]
+rate_limit = 10
+counter = "nas_ssh"
+
+[[netconfig.forwardings]]
+proto = "udp"
+port = "5000"
+dest_mac = "02:73:53:00:CA:FD"
+dest_port = "5000"
+
+[[netconfig.forwardings]]
+port = "8443"
+dest_host = "printer" # no lease, hence skipped
+dest_port = "443"
+
+[[netconfig.forwardings]]
+port = "3389"
+dest_host = "printer" # disabled, hence not checked
+dest_port = "3389"
+counter = "rdp"
+disabled = true
+`
+
+const goldenFilterLeases = `[
+  {"num": 3, "addr": "192.168.42.4", "hardware_addr": "02:73:53:00:ca:fd", "hostname": "android-1234", "hostname_override": "nas"}
+]`
+
+func goldenFilterRules() string {
+	return `table ip rout5_nat {
+	counter nas_ssh {
+		packets 23 bytes 42
+	}
+
+	chain prerouting {
+		type nat hook prerouting priority 0; policy accept;
+		iifname "uplink0" ip saddr 203.0.113.0/24 tcp dport 2222 limit rate 10/second counter name "nas_ssh" dnat to 192.168.42.4:22
+		iifname "uplink0" ip saddr 198.51.100.7 tcp dport 2222 limit rate 10/second counter name "nas_ssh" dnat to 192.168.42.4:22
+		iifname "uplink0" udp dport 5000 dnat to 192.168.42.4:5000
+	}
+
+	chain postrouting {
+		type nat hook postrouting priority 100; policy accept;
+		oifname "uplink0" masquerade
+	}
+}
+table ip rout5_filter {
+	counter fwded {
+		packets 23 bytes 42
+	}
+
+	chain forward {
+		type filter hook forward priority 0; policy accept;
+		oifname "uplink0" tcp flags 0x2 tcp option maxseg size set rt mtu
+		counter name "fwded"
+		iifname "lan0" oifname "uplink0" tcp dport 25 reject with tcp reset
+		ip saddr 192.168.42.0/24 ip daddr 10.0.0.0/8 drop
+		meta l4proto icmp counter packets 0 bytes 0
+	}
+` + goldenInput("icmp", `
+		iifname "lan0" ip saddr 192.168.42.99 tcp dport 22 accept
+		iifname "lan0" tcp dport 22 drop`, false) + `
+}
+table ip6 rout5_filter {
+	counter fwded {
+		packets 23 bytes 42
+	}
+
+	chain forward {
+		type filter hook forward priority 0; policy drop;
+		oifname "uplink0" tcp flags 0x2 tcp option maxseg size set rt mtu
+		counter name "fwded"
+		iifname "lan0" oifname "uplink0" tcp dport 25 reject with tcp reset
+		ip6 daddr 2001:db8::/32 udp sport 1024-65535 ct state new log prefix "fwd6: "` + goldenForward6(`
+		ip6 daddr & ::ffff:ffff:ffff:ffff == ::73:53ff:fe00:b00c tcp dport 443 accept
+		ip6 daddr & ::ffff:ffff:ffff:ffff == ::1:2 tcp dport 60000-61000 accept
+		ip6 daddr & ::ffff:ffff:ffff:ffff == ::1:2 udp dport 60000-61000 accept
+		ip6 daddr & ::ffff:ffff:ffff:ffff == ::73:53ff:fe00:cafd tcp dport 22 accept`) + `
+	}
+` + goldenInput("icmpv6", `
+		iifname "lan0" tcp dport 22 drop`, false) + `
+}`
+}
+
+// useConfig makes config.Snek read the config.toml contents into a file in dir
+// and returns a function which restores the previous config.
+func useConfig(t *testing.T, dir, contents string) func() {
+	snek, fn := config.Snek, config.Filename
+	config.Filename = filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(config.Filename, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.Snek = viper.New()
+	config.Snek.SetConfigFile(config.Filename)
+	if err := config.Snek.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	return func() { config.Snek, config.Filename = snek, fn }
+}
+
+func TestNetconfigFilter(t *testing.T) {
+	if os.Getenv("HELPER_PROCESS") == "1" {
+		tmp, err := ioutil.TempDir("", "rout5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		defer useConfig(t, tmp, goldenFilterConfig)()
+
+		if err := os.MkdirAll(filepath.Join(tmp, "dhcp4d"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmp, "dhcp4d", "leases.json"), []byte(goldenFilterLeases), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, dir := range []string{"etc", "tmp"} {
+			if err := os.MkdirAll(filepath.Join(tmp, "root", dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		netconfig.DefaultCounterObj = &nftables.CounterObj{Packets: 23, Bytes: 42}
+		if err := netconfig.Apply(tmp, filepath.Join(tmp, "root")); err != nil {
+			t.Fatalf("netconfig.Apply: %v", err)
+		}
+
+		// Apply twice to ensure user-defined rules are replaced, not
+		// appended to.
+		netconfig.DefaultCounterObj = &nftables.CounterObj{Packets: 0, Bytes: 0}
+		if err := netconfig.Apply(tmp, filepath.Join(tmp, "root")); err != nil {
+			t.Fatalf("netconfig.Apply: %v", err)
+		}
+
+		return
+	}
+	const ns = "ns7" // name of the network namespace to use for this test
+
+	add := exec.Command("ip", "netns", "add", ns)
+	add.Stderr = os.Stderr
+	if err := add.Run(); err != nil {
+		t.Fatalf("%v: %v", add.Args, err)
+	}
+	defer exec.Command("ip", "netns", "delete", ns).Run()
+
+	nsSetup := []*exec.Cmd{
+		exec.Command("ip", "-netns", ns, "link", "add", "dummy0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "add", "eth0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "set", "dummy0", "address", "02:73:53:00:ca:fe"),
+		exec.Command("ip", "-netns", ns, "link", "set", "eth0", "address", "02:73:53:00:b0:0c"),
+	}
+
+	for _, cmd := range nsSetup {
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("%v: %v", cmd.Args, err)
+		}
+	}
+
+	cmd := exec.Command("ip", "netns", "exec", ns, os.Args[0], "-test.run=^TestNetconfigFilter$")
+	cmd.Env = append(os.Environ(), "HELPER_PROCESS=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := ipLines("netns", "exec", ns, "nft", "--numeric", "list", "ruleset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(rules, "\n"), goldenFilterRules(); got != want {
+		t.Fatalf("unexpected nftables rules: diff (-want +got):\n%s", diff.LineDiff(want, got))
+	}
+}
+
+// goldenForeignTable is the table which TestNetconfigForeignTables creates on
+// behalf of other software. iptables-nft uses the same table name.
+const goldenForeignTable = `table ip fail2ban {
+	chain INPUT {
+		type filter hook input priority 0; policy accept;
+		accept
+	}
+}`
+
+func TestNetconfigForeignTables(t *testing.T) {
+	if os.Getenv("HELPER_PROCESS") == "1" {
+		tmp, err := ioutil.TempDir("", "rout5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		defer useConfig(t, tmp, goldenFilterConfig)()
+
+		for _, dir := range []string{"etc", "tmp"} {
+			if err := os.MkdirAll(filepath.Join(tmp, "root", dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		c := &nftables.Conn{}
+		foreign := c.AddTable(&nftables.Table{
+			Family: nftables.TableFamilyIPv4,
+			Name:   "fail2ban",
+		})
+		input := c.AddChain(&nftables.Chain{
+			Name:     "INPUT",
+			Hooknum:  nftables.ChainHookInput,
+			Priority: nftables.ChainPriorityFilter,
+			Table:    foreign,
+			Type:     nftables.ChainTypeFilter,
+		})
+		c.AddRule(&nftables.Rule{
+			Table: foreign,
+			Chain: input,
+			Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}},
+		})
+
+		// The tables of previous versions of rout5, before their names
+		// were prefixed.
+		nat := c.AddTable(&nftables.Table{
+			Family: nftables.TableFamilyIPv4,
+			Name:   "nat",
+		})
+		for _, hook := range []struct {
+			name     string
+			hooknum  nftables.ChainHook
+			priority nftables.ChainPriority
+		}{
+			{"prerouting", nftables.ChainHookPrerouting, nftables.ChainPriorityFilter},
+			{"postrouting", nftables.ChainHookPostrouting, nftables.ChainPriorityNATSource},
+		} {
+			c.AddChain(&nftables.Chain{
+				Name:     hook.name,
+				Hooknum:  hook.hooknum,
+				Priority: hook.priority,
+				Table:    nat,
+				Type:     nftables.ChainTypeNAT,
+			})
+		}
+		for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+			filter := c.AddTable(&nftables.Table{
+				Family: family,
+				Name:   "filter",
+			})
+			c.AddObj(&nftables.CounterObj{Table: filter, Name: "fwded"})
+			c.AddChain(&nftables.Chain{
+				Name:     "forward",
+				Hooknum:  nftables.ChainHookForward,
+				Priority: nftables.ChainPriorityFilter,
+				Table:    filter,
+				Type:     nftables.ChainTypeFilter,
+			})
+		}
+		if err := c.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Apply twice: the first run creates the tables of rout5, the second
+		// run replaces them.
+		for i := 0; i < 2; i++ {
+			if err := netconfig.Apply(tmp, filepath.Join(tmp, "root")); err != nil {
+				t.Fatalf("netconfig.Apply: %v", err)
+			}
+		}
+
+		return
+	}
+	const ns = "ns8" // name of the network namespace to use for this test
+
+	add := exec.Command("ip", "netns", "add", ns)
+	add.Stderr = os.Stderr
+	if err := add.Run(); err != nil {
+		t.Fatalf("%v: %v", add.Args, err)
+	}
+	defer exec.Command("ip", "netns", "delete", ns).Run()
+
+	nsSetup := []*exec.Cmd{
+		exec.Command("ip", "-netns", ns, "link", "add", "dummy0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "add", "eth0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "set", "dummy0", "address", "02:73:53:00:ca:fe"),
+		exec.Command("ip", "-netns", ns, "link", "set", "eth0", "address", "02:73:53:00:b0:0c"),
+	}
+
+	for _, cmd := range nsSetup {
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("%v: %v", cmd.Args, err)
+		}
+	}
+
+	cmd := exec.Command("ip", "netns", "exec", ns, os.Args[0], "-test.run=^TestNetconfigForeignTables$")
+	cmd.Env = append(os.Environ(), "HELPER_PROCESS=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	tables, err := ipLines("netns", "exec", ns, "nft", "list", "tables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"table ip fail2ban",
+		"table ip " + netconfig.NATTable,
+		"table ip " + netconfig.FilterTable,
+		"table ip6 " + netconfig.FilterTable,
+	}
+	if diff := cmp.Diff(want, tables); diff != "" {
+		t.Errorf("unexpected nftables tables: diff (-want +got):\n%s", diff)
+	}
+
+	rules, err := ipLines("netns", "exec", ns, "nft", "--numeric", "list", "table", "ip", "fail2ban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(rules, "\n"), goldenForeignTable; got != want {
+		t.Fatalf("foreign table modified: diff (-want +got):\n%s", diff.LineDiff(want, got))
+	}
+}
+
+func TestPlanString(t *testing.T) {
+	p := &netconfig.Plan{
+		Changes: []netconfig.Change{
+			{Op: "~", Kind: "link", Object: "eth0 name lan0"},
+			{Op: "+", Kind: "addr", Object: "192.168.42.1/24 on lan0"},
+			{Op: "~", Kind: "sysctl", Object: "net.ipv4.ip_forward=1", From: "0"},
+			{Op: "-", Kind: "nft", Object: "rule ip rout5_nat postrouting oifname \"uplink0\" masquerade"},
+		},
+		Errors: []string{"dhcp4: invalid DHCP lease: no subnet mask present"},
+	}
+	want := `~ link eth0 name lan0
++ addr 192.168.42.1/24 on lan0
+~ sysctl net.ipv4.ip_forward=1 (was 0)
+- nft rule ip rout5_nat postrouting oifname "uplink0" masquerade
+! dhcp4: invalid DHCP lease: no subnet mask present
+`
+	if diff := cmp.Diff(want, p.String()); diff != "" {
+		t.Errorf("Plan.String: diff (-want +got):\n%s", diff)
+	}
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJSON := `{"changes":[` +
+		`{"op":"~","kind":"link","object":"eth0 name lan0"},` +
+		`{"op":"+","kind":"addr","object":"192.168.42.1/24 on lan0"},` +
+		`{"op":"~","kind":"sysctl","object":"net.ipv4.ip_forward=1","from":"0"},` +
+		`{"op":"-","kind":"nft","object":"rule ip rout5_nat postrouting oifname \"uplink0\" masquerade"}],` +
+		`"errors":["dhcp4: invalid DHCP lease: no subnet mask present"]}`
+	if diff := cmp.Diff(wantJSON, string(b)); diff != "" {
+		t.Errorf("json.Marshal(Plan): diff (-want +got):\n%s", diff)
+	}
+
+	// “rout5 config apply” relies on the digest identifying the changes.
+	same := &netconfig.Plan{
+		Changes: append([]netconfig.Change{}, p.Changes...),
+		Errors:  p.Errors,
+	}
+	if got, want := same.Digest(), p.Digest(); got != want {
+		t.Errorf("Digest of an identical plan: got %s, want %s", got, want)
+	}
+	same.Changes[1].Object = "192.168.42.2/24 on lan0"
+	if got := same.Digest(); got == p.Digest() {
+		t.Errorf("Digest of a different plan: got %s, want a different digest", got)
+	}
+}
+
+func TestConfirmTimeout(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rout5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, tt := range []struct {
+		value   string
+		want    time.Duration
+		wantErr string
+	}{
+		{value: `"5m"`, want: 5 * time.Minute},
+		{value: `"soon"`, wantErr: "confirm_timeout"},
+		{value: `"-1m"`, wantErr: "confirm_timeout: must not be negative"},
+	} {
+		restore := useConfig(t, tmp, "[netconfig]\nconfirm_timeout = "+tt.value+"\n"+goldenFilterConfig)
+		cfg, err := netconfig.LoadConfig(tmp)
+		restore()
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("confirm_timeout = %s: got %v, want error containing %q", tt.value, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("confirm_timeout = %s: LoadConfig: %v", tt.value, err)
+		}
+		if got := cfg.ConfirmTimeout(); got != tt.want {
+			t.Errorf("confirm_timeout = %s: got %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestConfirmedConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rout5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if cfg, err := netconfig.LoadConfirmed(tmp); err != nil || cfg != nil {
+		t.Fatalf("LoadConfirmed without %s: got (%v, %v), want (nil, nil)", netconfig.ConfirmedFile, cfg, err)
+	}
+
+	restore := useConfig(t, tmp, "[netconfig]\nconfirm_timeout = \"5m\"\n"+goldenFilterConfig)
+	cfg, err := netconfig.LoadConfig(tmp)
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netconfig.WriteConfirmed(tmp, cfg); err != nil {
+		t.Fatal(err)
+	}
+	got, err := netconfig.LoadConfirmed(tmp)
+	if err != nil {
+		t.Fatalf("LoadConfirmed: %v", err)
+	}
+	want, err := cfg.Section()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotSection, err := got.Section()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, gotSection); diff != "" {
+		t.Errorf("LoadConfirmed: diff (-want +got):\n%s", diff)
+	}
+
+	if err := netconfig.RemoveConfirmed(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := netconfig.LoadConfirmed(tmp); err != nil || cfg != nil {
+		t.Fatalf("LoadConfirmed after RemoveConfirmed: got (%v, %v), want (nil, nil)", cfg, err)
+	}
+}
+
+func TestNetconfigRollback(t *testing.T) {
+	if os.Getenv("HELPER_PROCESS") == "1" {
+		tmp, err := ioutil.TempDir("", "rout5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+
+		if err := os.MkdirAll(filepath.Join(tmp, "dhcp4d"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmp, "dhcp4d", "leases.json"), []byte(goldenFilterLeases), 0600); err != nil {
+			t.Fatal(err)
+		}
+		for _, dir := range []string{"etc", "tmp"} {
+			if err := os.MkdirAll(filepath.Join(tmp, "root", dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		restore := useConfig(t, tmp, goldenFilterConfig)
+		netconfig.DefaultCounterObj = &nftables.CounterObj{Packets: 23, Bytes: 42}
+		if err := netconfig.Apply(tmp, filepath.Join(tmp, "root")); err != nil {
+			t.Fatalf("netconfig.Apply: %v", err)
+		}
+		cfg, err := netconfig.LoadConfig(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snap, err := netconfig.TakeSnapshot(cfg, tmp)
+		if err != nil {
+			t.Fatalf("netconfig.TakeSnapshot: %v", err)
+		}
+		restore()
+
+		// A modified config which moves the LAN to a different subnet and
+		// adds a bridge, neither of which must survive the rollback.
+		modified := strings.Replace(goldenFilterConfig, `addr = "192.168.42.1/24"`, `addr = "10.23.0.1/24"`, 1) + `
+[[netconfig.bridges]]
+name = "br0"
+`
+		defer useConfig(t, tmp, modified)()
+		netconfig.DefaultCounterObj = &nftables.CounterObj{Packets: 0, Bytes: 0}
+		modifiedCfg, err := netconfig.LoadConfig(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := netconfig.ApplyConfig(modifiedCfg, tmp, filepath.Join(tmp, "root")); err != nil {
+			t.Fatalf("netconfig.ApplyConfig(modified): %v", err)
+		}
+
+		// Links, addresses and routes of other software, which must survive
+		// the rollback.
+		for _, args := range [][]string{
+			{"link", "add", "other0", "type", "bridge"},
+			{"address", "add", "198.51.100.1/24", "dev", "lan0"},
+			{"route", "add", "blackhole", "203.0.113.0/24", "proto", "boot"},
+		} {
+			if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+				t.Fatalf("ip %v: %v (%s)", args, err, out)
+			}
+		}
+
+		if err := snap.Restore(modifiedCfg); err != nil {
+			t.Fatalf("Snapshot.Restore: %v", err)
+		}
+
+		// The original config must not entail any changes after the
+		// rollback.
+		p, err := netconfig.PlanConfig(cfg, tmp, filepath.Join(tmp, "root"))
+		if err != nil {
+			t.Fatalf("netconfig.PlanConfig: %v", err)
+		}
+		if len(p.Changes) > 0 || len(p.Errors) > 0 {
+			t.Errorf("netconfig.PlanConfig: unexpected changes after rollback:\n%s", p)
+		}
+		return
+	}
+	const ns = "ns9" // name of the network namespace to use for this test
+
+	add := exec.Command("ip", "netns", "add", ns)
+	add.Stderr = os.Stderr
+	if err := add.Run(); err != nil {
+		t.Fatalf("%v: %v", add.Args, err)
+	}
+	defer exec.Command("ip", "netns", "delete", ns).Run()
+
+	nsSetup := []*exec.Cmd{
+		exec.Command("ip", "-netns", ns, "link", "add", "dummy0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "add", "eth0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "set", "dummy0", "address", "02:73:53:00:ca:fe"),
+		exec.Command("ip", "-netns", ns, "link", "set", "eth0", "address", "02:73:53:00:b0:0c"),
+	}
+
+	for _, cmd := range nsSetup {
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("%v: %v", cmd.Args, err)
+		}
+	}
+
+	cmd := exec.Command("ip", "netns", "exec", ns, os.Args[0], "-test.run=^TestNetconfigRollback$")
+	cmd.Env = append(os.Environ(), "HELPER_PROCESS=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	addrs, err := ipLines("-netns", ns, "-4", "-brief", "address", "show", "dev", "lan0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || !strings.Contains(addrs[0], "192.168.42.1/24") || strings.Contains(addrs[0], "10.23.0.1") {
+		t.Errorf("unexpected lan0 addresses after rollback: %q", addrs)
+	}
+	if len(addrs) == 1 && !strings.Contains(addrs[0], "198.51.100.1/24") {
+		t.Errorf("address 198.51.100.1/24, which netconfig did not add, was deleted by the rollback: %q", addrs)
+	}
+
+	if err := exec.Command("ip", "-netns", ns, "link", "show", "dev", "br0").Run(); err == nil {
+		t.Errorf("bridge br0 still exists after rollback")
+	}
+	if err := exec.Command("ip", "-netns", ns, "link", "show", "dev", "other0").Run(); err != nil {
+		t.Errorf("bridge other0, which netconfig did not create, was deleted by the rollback")
+	}
+	routes, err := ipLines("-netns", ns, "route", "show", "203.0.113.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 {
+		t.Errorf("route 203.0.113.0/24, which netconfig did not install, was deleted by the rollback: %q", routes)
+	}
+
+	rules, err := ipLines("netns", "exec", ns, "nft", "--numeric", "list", "ruleset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(rules, "\n"), goldenFilterRules(); got != want {
+		t.Fatalf("unexpected nftables rules after rollback: diff (-want +got):\n%s", diff.LineDiff(want, got))
+	}
+}
+
+func TestNetconfigAccounting(t *testing.T) {
+	if os.Getenv("HELPER_PROCESS") == "1" {
+		tmp, err := ioutil.TempDir("", "rout5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		defer useConfig(t, tmp, "[netconfig.firewall]\naccounting = true\n"+goldenFilterConfig)()
+
+		if err := os.MkdirAll(filepath.Join(tmp, "dhcp4d"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		// 02:73:53:00:ca:fb previously had the address of the nas, which
+		// must not be counted twice.
+		leases := strings.Replace(goldenFilterLeases, "[", `[
+  {"num": 3, "addr": "192.168.42.4", "hardware_addr": "02:73:53:00:ca:fb", "hostname": "laptop", "expiry": "2018-05-18T23:46:04Z"},`, 1)
+		if err := ioutil.WriteFile(filepath.Join(tmp, "dhcp4d", "leases.json"), []byte(leases), 0600); err != nil {
+			t.Fatal(err)
+		}
+		for _, dir := range []string{"etc", "tmp"} {
+			if err := os.MkdirAll(filepath.Join(tmp, "root", dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		netconfig.DefaultCounterObj = &nftables.CounterObj{Packets: 23, Bytes: 42}
+		if err := netconfig.Apply(tmp, filepath.Join(tmp, "root")); err != nil {
+			t.Fatalf("netconfig.Apply: %v", err)
+		}
+
+		// Like most operating systems, the nas additionally uses an address
+		// which is not derived from its MAC address (e.g. RFC 7217).
+		neigh := exec.Command("ip", "-6", "neigh", "add", "2a02:168:4a00::1234:5678:9abc:def0", "lladdr", "02:73:53:00:ca:fd", "dev", "lan0", "nud", "permanent")
+		neigh.Stderr = os.Stderr
+		if err := neigh.Run(); err != nil {
+			t.Fatalf("%v: %v", neigh.Args, err)
+		}
+		if err := netconfig.Apply(tmp, filepath.Join(tmp, "root")); err != nil {
+			t.Fatalf("netconfig.Apply: %v", err)
+		}
+
+		got, err := netconfig.HostTraffic(tmp)
+		if err != nil {
+			t.Fatalf("netconfig.HostTraffic: %v", err)
+		}
+		want := []netconfig.HostCounter{
+			{HardwareAddr: "02:73:53:00:ca:fd", Hostname: "nas", Family: "ip", TxPackets: 23, TxBytes: 42, RxPackets: 23, RxBytes: 42},
+			{HardwareAddr: "02:73:53:00:ca:fd", Hostname: "nas", Family: "ip6", TxPackets: 23, TxBytes: 42, RxPackets: 23, RxBytes: 42},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("netconfig.HostTraffic: diff (-want +got):\n%s", diff)
+		}
+		return
+	}
+	const ns = "ns10" // name of the network namespace to use for this test
+
+	add := exec.Command("ip", "netns", "add", ns)
+	add.Stderr = os.Stderr
+	if err := add.Run(); err != nil {
+		t.Fatalf("%v: %v", add.Args, err)
+	}
+	defer exec.Command("ip", "netns", "delete", ns).Run()
+
+	nsSetup := []*exec.Cmd{
+		exec.Command("ip", "-netns", ns, "link", "add", "dummy0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "add", "eth0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "set", "dummy0", "address", "02:73:53:00:ca:fe"),
+		exec.Command("ip", "-netns", ns, "link", "set", "eth0", "address", "02:73:53:00:b0:0c"),
+	}
+
+	for _, cmd := range nsSetup {
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("%v: %v", cmd.Args, err)
+		}
+	}
+
+	cmd := exec.Command("ip", "netns", "exec", ns, os.Args[0], "-test.run=^TestNetconfigAccounting$")
+	cmd.Env = append(os.Environ(), "HELPER_PROCESS=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		family string
+		want   []string
+	}{
+		{
+			family: "ip",
+			want: []string{
+				`oifname "uplink0" ip saddr 192.168.42.4 counter name "host_02735300cafd_tx"`,
+				`iifname "uplink0" ip daddr 192.168.42.4 counter name "host_02735300cafd_rx"`,
+			},
+		},
+		{
+			family: "ip6",
+			want: []string{
+				`oifname "uplink0" ip6 saddr & ::ffff:ffff:ffff:ffff == ::1234:5678:9abc:def0 counter name "host_02735300cafd_tx"`,
+				`oifname "uplink0" ip6 saddr & ::ffff:ffff:ffff:ffff == ::73:53ff:fe00:cafd counter name "host_02735300cafd_tx"`,
+				`iifname "uplink0" ip6 daddr & ::ffff:ffff:ffff:ffff == ::1234:5678:9abc:def0 counter name "host_02735300cafd_rx"`,
+				`iifname "uplink0" ip6 daddr & ::ffff:ffff:ffff:ffff == ::73:53ff:fe00:cafd counter name "host_02735300cafd_rx"`,
+				// The pinhole to the nas covers both addresses.
+				`ip6 daddr & ::ffff:ffff:ffff:ffff == ::1234:5678:9abc:def0 tcp dport 22 accept`,
+				`ip6 daddr & ::ffff:ffff:ffff:ffff == ::73:53ff:fe00:cafd tcp dport 22 accept`,
+			},
+		},
+	} {
+		rules, err := ipLines("netns", "exec", ns, "nft", "--numeric", "list", "chain", tt.family, netconfig.FilterTable, "forward")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Join(rules, "\n")
+		for _, want := range tt.want {
+			if !strings.Contains(got, "\t\t"+want+"\n") {
+				t.Errorf("%s forward chain does not contain %q:\n%s", tt.family, want, got)
+			}
+		}
+		if strings.Contains(got, "host_02735300cafb") {
+			t.Errorf("%s forward chain counts the expired lease of 02:73:53:00:ca:fb:\n%s", tt.family, got)
+		}
+	}
+}
+
+func TestFilterConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rout5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	restore := useConfig(t, tmp, goldenFilterConfig)
+	if _, err := netconfig.LoadConfig(tmp); err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	restore()
+
+	restore = useConfig(t, tmp, goldenFilterConfig+`
+[[netconfig.filter]]
+action = "log"
+action_typo = "drop"
+`)
+	// The unknown key makes the whole section invalid.
+	if _, err := netconfig.LoadConfig(tmp); err == nil || !strings.Contains(err.Error(), "action_typo") {
+		t.Fatalf("LoadConfig: got %v, want error mentioning invalid key action_typo", err)
+	}
+	restore()
+
+	restore = useConfig(t, tmp, goldenFilterConfig+`
+[[netconfig.filter]]
+chain = "output"
+src = "10.0.0.0/8"
+dst = "2001:db8::/32"
+dport = "22"
+ct_state = ["bogus"]
+action = "reject"
+
+[[netconfig.filter]]
+oif = "lan1"
+action = "log"
+`)
+	defer restore()
+	var got []string
+	for _, p := range netconfig.Check(tmp) {
+		if strings.HasPrefix(p.Field, "netconfig.filter[") {
+			got = append(got, p.Field)
+		}
+	}
+	want := []string{
+		"netconfig.filter[6].chain",
+		"netconfig.filter[6]", // mixed IPv4/IPv6
+		"netconfig.filter[6].dport",
+		"netconfig.filter[6].ct_state[0]",
+		"netconfig.filter[7].oif", // not configured
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Check: unexpected problems: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestPinholeConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rout5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(filepath.Join(tmp, "dhcp4d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "dhcp4d", "leases.json"), []byte(goldenFilterLeases), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer useConfig(t, tmp, goldenFilterConfig+`
+[[netconfig.pinholes]]
+host = "nas"
+iid = "::1"
+port = "22"
+
+[[netconfig.pinholes]]
+iid = "2001:db8::1"
+proto = "sctp"
+port = "22"
+
+[[netconfig.pinholes]]
+hardware_addr = "02:73:53:00:b0:0c:00:01"
+port = ""
+`)()
+
+	var got []string
+	for _, p := range netconfig.Check(tmp) {
+		if strings.HasPrefix(p.Field, "netconfig.pinholes") {
+			got = append(got, p.Field)
+		}
+	}
+	want := []string{
+		"netconfig.pinholes[4]", // host and iid
+		"netconfig.pinholes[5].iid",
+		"netconfig.pinholes[5].proto",
+		"netconfig.pinholes[6].hardware_addr", // not 48 bits
+		"netconfig.pinholes[6].port",
+		"netconfig.pinholes[3].host", // printer has no lease
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Check: unexpected problems: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestForwardingHosts(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rout5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(filepath.Join(tmp, "dhcp4d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "dhcp4d", "leases.json"), []byte(goldenFilterLeases), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer useConfig(t, tmp, goldenFilterConfig+`
+[[netconfig.forwardings]]
+port = "80"
+dest_addr = "192.168.42.4"
+dest_host = "nas"
+dest_port = "80"
+
+[[netconfig.forwardings]]
+port = "81"
+dest_mac = "02:73:53"
+dest_port = "81"
+`)()
+
+	var got []string
+	for _, p := range netconfig.Check(tmp) {
+		if strings.HasPrefix(p.Field, "netconfig.forwardings") {
+			got = append(got, p.Field)
+		}
+	}
+	want := []string{
+		"netconfig.forwardings[4]", // dest_addr and dest_host
+		"netconfig.forwardings[5].dest_mac",
+		"netconfig.forwardings[2].dest_host", // printer has no lease
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Check: unexpected problems: diff (-want +got):\n%s", diff)
+	}
+
+	defer useConfig(t, tmp, goldenFilterConfig)()
+	cfg, err := netconfig.LoadConfig(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		hwaddr    string
+		hostnames []string
+		want      bool
+	}{
+		{"02:73:53:00:ca:fd", []string{"android-1234", "nas"}, true},
+		{"02:73:53:00:ca:fd", nil, true}, // dest_mac
+		{"02:73:53:00:00:01", []string{"PRINTER"}, true},
+		{"02:73:53:00:00:01", []string{"laptop", ""}, false},
+	} {
+		if got := cfg.DependsOnLease(tt.hwaddr, tt.hostnames...); got != tt.want {
+			t.Errorf("DependsOnLease(%s, %q) = %v, want %v", tt.hwaddr, tt.hostnames, got, tt.want)
+		}
+	}
+}
+
+func TestForwardingOptions(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rout5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(filepath.Join(tmp, "dhcp4d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "dhcp4d", "leases.json"), []byte(goldenFilterLeases), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer useConfig(t, tmp, goldenFilterConfig+`
+[[netconfig.forwardings]]
+port = "80"
+dest_addr = "192.168.42.4"
+dest_port = "80"
+allowed_src = ["203.0.113.0/24", "2001:db8::/32", "bogus"]
+rate_limit = -1
+counter = "web server"
+
+[[netconfig.forwardings]]
+port = "81"
+dest_addr = "10.0.0.1" # not within a LAN subnet, but disabled
+dest_port = "81"
+disabled = true
+`)()
+
+	var got []string
+	for _, p := range netconfig.Check(tmp) {
+		if strings.HasPrefix(p.Field, "netconfig.forwardings") {
+			got = append(got, p.Field)
+		}
+	}
+	want := []string{
+		"netconfig.forwardings[4].allowed_src[1]", // IPv6
+		"netconfig.forwardings[4].allowed_src[2]",
+		"netconfig.forwardings[4].rate_limit",
+		"netconfig.forwardings[4].counter",
+		"netconfig.forwardings[2].dest_host", // printer has no lease
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Check: unexpected problems: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSQMConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rout5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wan := config.PreferredWAN
+	defer func() { config.PreferredWAN = wan }()
+	config.PreferredWAN = []string{"uplink0", "uplink1"}
+
+	for _, tt := range []struct {
+		section string
+		wantErr string
+	}{
+		{section: "upload_kbit = 9000\ndownload_kbit = 95000\n"},
+		{section: "download_kbit = 95000\n"},
+		{section: "upload_kbit = -1\n", wantErr: "sqm.upload_kbit: must not be negative"},
+		{section: "", wantErr: "at least one of upload_kbit and download_kbit must be set"},
+		{section: "[[netconfig.sqm.uplinks]]\nname = \"uplink1\"\ndownload_kbit = 18000\n"},
+		{section: "[[netconfig.sqm.uplinks]]\nname = \"uplink2\"\ndownload_kbit = 18000\n", wantErr: `sqm.uplinks[0].name: "uplink2" is not listed in interfaces.wan_ifnames`},
+		{section: "upload_kbit = 9000\n[[netconfig.sqm.uplinks]]\nname = \"uplink1\"\nupload_kbit = -1\n", wantErr: "sqm.uplinks[0].upload_kbit: must not be negative"},
+	} {
+		restore := useConfig(t, tmp, "[netconfig.sqm]\n"+tt.section+goldenFilterConfig)
+		_, err := netconfig.LoadConfig(tmp)
+		restore()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%q: LoadConfig: %v", tt.section, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%q: got %v, want error containing %q", tt.section, err, tt.wantErr)
+		}
+	}
+}
+
+func TestNetconfigSQM(t *testing.T) {
+	if os.Getenv("HELPER_PROCESS") == "1" {
+		tmp, err := ioutil.TempDir("", "rout5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		wan := config.PreferredWAN
+		defer func() { config.PreferredWAN = wan }()
+		config.PreferredWAN = []string{"uplink0", "uplink1"}
+		// uplink1 is shaped to its own bandwidth, i.e. even while uplink0
+		// carries the default route.
+		defer useConfig(t, tmp, `[netconfig.sqm]
+upload_kbit = 9000
+download_kbit = 95000
+
+[[netconfig.sqm.uplinks]]
+name = "uplink1"
+download_kbit = 18000
+`+goldenFilterConfig)()
+
+		for _, dir := range []string{"etc", "tmp"} {
+			if err := os.MkdirAll(filepath.Join(tmp, "root", dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := netconfig.Apply(tmp, filepath.Join(tmp, "root")); err != nil {
+			t.Fatalf("netconfig.Apply: %v", err)
+		}
+
+		assertNoChanges(t, tmp, filepath.Join(tmp, "root"))
+		return
+	}
+	const ns = "ns11" // name of the network namespace to use for this test
+
+	add := exec.Command("ip", "netns", "add", ns)
+	add.Stderr = os.Stderr
+	if err := add.Run(); err != nil {
+		t.Fatalf("%v: %v", add.Args, err)
+	}
+	defer exec.Command("ip", "netns", "delete", ns).Run()
+
+	nsSetup := []*exec.Cmd{
+		exec.Command("ip", "-netns", ns, "link", "add", "dummy0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "add", "eth0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "set", "dummy0", "address", "02:73:53:00:ca:fe"),
+		exec.Command("ip", "-netns", ns, "link", "set", "eth0", "address", "02:73:53:00:b0:0c"),
+		exec.Command("ip", "-netns", ns, "link", "add", "uplink1", "type", "dummy"),
+	}
+
+	for _, cmd := range nsSetup {
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("%v: %v", cmd.Args, err)
+		}
+	}
+
+	cmd := exec.Command("ip", "netns", "exec", ns, os.Args[0], "-test.run=^TestNetconfigSQM$")
+	cmd.Env = append(os.Environ(), "HELPER_PROCESS=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		dev  string
+		want []string
+	}{
+		{
+			dev: "uplink0",
+			want: []string{
+				"qdisc htb 1: root",
+				"qdisc fq_codel 10: parent 1:1",
+				"qdisc ingress ffff: parent ffff:fff1",
+			},
+		},
+		{
+			dev: "ifb4uplink0",
+			want: []string{
+				"qdisc htb 1: root",
+				"qdisc fq_codel 10: parent 1:1",
+			},
+		},
+		{
+			dev: "uplink1",
+			want: []string{
+				"qdisc ingress ffff: parent ffff:fff1",
+			},
+		},
+		{
+			dev: "ifb4uplink1",
+			want: []string{
+				"qdisc htb 1: root",
+				"qdisc fq_codel 10: parent 1:1",
+			},
+		},
+	} {
+		qdiscs, err := ipLines("netns", "exec", ns, "tc", "qdisc", "show", "dev", tt.dev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Join(qdiscs, "\n")
+		for _, want := range tt.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("tc qdisc show dev %s does not contain %q:\n%s", tt.dev, want, got)
+			}
+		}
+	}
+
+	for dev, want := range map[string]string{
+		"ifb4uplink0": "rate 95Mbit ceil 95Mbit",
+		"ifb4uplink1": "rate 18Mbit ceil 18Mbit",
+	} {
+		classes, err := ipLines("netns", "exec", ns, "tc", "class", "show", "dev", dev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(classes, "\n"); !strings.Contains(got, want) {
+			t.Errorf("tc class show dev %s does not contain %q:\n%s", dev, want, got)
+		}
+	}
+	qdiscs, err := ipLines("netns", "exec", ns, "tc", "qdisc", "show", "dev", "uplink1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(qdiscs, "\n"); strings.Contains(got, "htb") {
+		t.Errorf("tc qdisc show dev uplink1: unexpected upload shaping:\n%s", got)
+	}
+}
+
+func TestMultiWANConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rout5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wan := config.PreferredWAN
+	defer func() { config.PreferredWAN = wan }()
+	config.PreferredWAN = []string{"uplink0", "uplink1"}
+
+	restore := useConfig(t, tmp, `
+[netconfig.multiwan]
+mode = "balance"
+
+[[netconfig.multiwan.uplinks]]
+name = "uplink0"
+weight = 3
+
+[[netconfig.multiwan.uplinks]]
+name = "uplink1"
+metric = 10
+`+goldenFilterConfig)
+	if _, err := netconfig.LoadConfig(tmp); err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	restore()
+
+	restore = useConfig(t, tmp, `
+[netconfig.multiwan]
+mode = "roundrobin"
+
+[[netconfig.multiwan.uplinks]]
+name = "uplink2"
+
+[[netconfig.multiwan.uplinks]]
+name = "uplink0"
+weight = 1000
+`+goldenFilterConfig)
+	defer restore()
+	var got []string
+	for _, p := range netconfig.Check(tmp) {
+		if strings.HasPrefix(p.Field, "netconfig.multiwan") {
+			got = append(got, p.Field+": "+p.Message)
+		}
+	}
+	want := []string{
+		`netconfig.multiwan.mode: unknown mode "roundrobin", expected "failover" or "balance"`,
+		`netconfig.multiwan.uplinks[0].name: "uplink2" is not listed in interfaces.wan_ifnames`,
+		`netconfig.multiwan.uplinks[1].weight: must be between 1 and 256 (got 1000)`,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Check: diff (-want +got):\n%s", diff)
+	}
+}
+
+const multiWANDhcp4 = `
+{
+  "valid_until":"2018-05-18T23:46:04.429895261+02:00",
+  "client_ip":"10.0.0.2",
+  "subnet_mask":"255.255.255.0",
+  "router":"10.0.0.1",
+  "dns":[]
+}
+`
+
+func TestNetconfigMultiWAN(t *testing.T) {
+	if os.Getenv("HELPER_PROCESS") == "1" {
+		tmp, err := ioutil.TempDir("", "rout5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		config.PreferredWAN = []string{"uplink0", "uplink1"}
+
+		for _, dir := range []string{"root/etc", "root/tmp", "dhcp4/wire", "dhcp4/uplink1", "diagd"} {
+			if err := os.MkdirAll(filepath.Join(tmp, dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, f := range []struct {
+			fn, contents string
+		}{
+			{"dhcp4/wire/lease.json", goldenDhcp4},
+			{"dhcp4/uplink1/lease.json", multiWANDhcp4},
+		} {
+			if err := ioutil.WriteFile(filepath.Join(tmp, f.fn), []byte(f.contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		const interfaces = `
+[[netconfig.interfaces]]
+hardware_addr = "02:73:53:00:ca:fb"
+name = "uplink1"
+` + goldenFilterConfig
+
+		for _, tt := range []struct {
+			name    string
+			section string
+			health  string
+			want    []string
+		}{
+			{
+				name:   "failover",
+				health: `{"uplink0": false, "uplink1": true}`,
+				want: []string{
+					"default via 10.0.0.1 dev uplink1 proto dhcp src 10.0.0.2 metric 1 ",
+					"default via 85.195.207.1 dev uplink0 proto dhcp src 85.195.207.62 metric 1000 ",
+				},
+			},
+			{
+				name:    "balance",
+				section: "[netconfig.multiwan]\nmode = \"balance\"\n[[netconfig.multiwan.uplinks]]\nname = \"uplink0\"\nweight = 3\n",
+				health:  `{"uplink0": true, "uplink1": true}`,
+				want: []string{
+					"default proto dhcp ",
+					"nexthop via 85.195.207.1 dev uplink0 weight 3 ",
+					"nexthop via 10.0.0.1 dev uplink1 weight 1 ",
+				},
+			},
+			{
+				// diagd checks unhealthy uplinks via the route with the
+				// penalty, see diag.TCP4On.
+				name:    "balance with unhealthy uplink",
+				section: "[netconfig.multiwan]\nmode = \"balance\"\n",
+				health:  `{"uplink0": true, "uplink1": false}`,
+				want: []string{
+					"default via 85.195.207.1 dev uplink0 proto dhcp src 85.195.207.62 ",
+					"default via 10.0.0.1 dev uplink1 proto dhcp src 10.0.0.2 metric 1001 ",
+				},
+			},
+		} {
+			if err := ioutil.WriteFile(filepath.Join(tmp, "diagd/uplinks.json"), []byte(tt.health), 0600); err != nil {
+				t.Fatal(err)
+			}
+			restore := useConfig(t, tmp, tt.section+interfaces)
+			if err := netconfig.Apply(tmp, filepath.Join(tmp, "root")); err != nil {
+				t.Fatalf("%s: netconfig.Apply: %v", tt.name, err)
+			}
+			routes, err := ipLines("route", "show", "default")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for idx := range routes {
+				routes[idx] = strings.TrimLeft(routes[idx], "\t ")
+			}
+			if diff := cmp.Diff(tt.want, routes); diff != "" {
+				t.Errorf("%s: default routes: diff (-want +got):\n%s", tt.name, diff)
+			}
+
+			assertNoChanges(t, tmp, filepath.Join(tmp, "root"))
+			restore()
+		}
+
+		rules, err := exec.Command("nft", "--numeric", "list", "chain", "ip", netconfig.NATTable, "postrouting").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{`oifname "uplink0" masquerade`, `oifname "uplink1" masquerade`} {
+			if !strings.Contains(string(rules), want) {
+				t.Errorf("postrouting chain does not contain %q:\n%s", want, rules)
+			}
+		}
+		return
+	}
+	const ns = "ns12" // name of the network namespace to use for this test
+
+	add := exec.Command("ip", "netns", "add", ns)
+	add.Stderr = os.Stderr
+	if err := add.Run(); err != nil {
+		t.Fatalf("%v: %v", add.Args, err)
+	}
+	defer exec.Command("ip", "netns", "delete", ns).Run()
+
+	nsSetup := []*exec.Cmd{
+		exec.Command("ip", "-netns", ns, "link", "add", "dummy0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "add", "dummy1", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "add", "eth0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "set", "dummy0", "address", "02:73:53:00:ca:fe"),
+		exec.Command("ip", "-netns", ns, "link", "set", "dummy1", "address", "02:73:53:00:ca:fb"),
+		exec.Command("ip", "-netns", ns, "link", "set", "eth0", "address", "02:73:53:00:b0:0c"),
+	}
+
+	for _, cmd := range nsSetup {
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("%v: %v", cmd.Args, err)
+		}
+	}
+
+	cmd := exec.Command("ip", "netns", "exec", ns, os.Args[0], "-test.run=^TestNetconfigMultiWAN$")
+	cmd.Env = append(os.Environ(), "HELPER_PROCESS=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNetconfigMultiWANForwarding(t *testing.T) {
+	if os.Getenv("HELPER_PROCESS") == "1" {
+		tmp, err := ioutil.TempDir("", "rout5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		config.PreferredWAN = []string{"uplink0", "uplink1"}
+
+		for _, dir := range []string{"root/etc", "root/tmp", "dhcp4/wire", "dhcp4/uplink1"} {
+			if err := os.MkdirAll(filepath.Join(tmp, dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, f := range []struct {
+			fn, contents string
+		}{
+			{"dhcp4/wire/lease.json", goldenDhcp4},
+			{"dhcp4/uplink1/lease.json", multiWANDhcp4},
+		} {
+			if err := ioutil.WriteFile(filepath.Join(tmp, f.fn), []byte(f.contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		restore := useConfig(t, tmp, `
+[[netconfig.interfaces]]
+hardware_addr = "02:73:53:00:ca:fe"
+name = "uplink0"
+
+[[netconfig.interfaces]]
+hardware_addr = "02:73:53:00:ca:fb"
+name = "uplink1"
+
+[[netconfig.interfaces]]
+hardware_addr = "02:73:53:00:b0:0c"
+name = "lan0"
+addr = "192.168.42.1/24"
+
+[[netconfig.forwardings]]
+port = "8080"
+dest_addr = "192.168.42.4"
+dest_port = "80"
+`)
+		defer restore()
+		if err := netconfig.Apply(tmp, filepath.Join(tmp, "root")); err != nil {
+			t.Fatalf("netconfig.Apply: %v", err)
+		}
+
+		// The forwarding exists on uplink1, and connections which arrive
+		// via uplink1 are marked with it.
+		for _, tt := range []struct {
+			chain []string
+			want  []string // substrings of the same rule
+		}{
+			{
+				chain: []string{"ip", netconfig.NATTable, "prerouting"},
+				want:  []string{`iifname "uplink1"`, "dport 8080", "dnat to 192.168.42.4:80"},
+			},
+			{
+				chain: []string{"ip", netconfig.FilterTable, "prerouting"},
+				want:  []string{`iifname "uplink1"`, "ct state new", "ct mark set"},
+			},
+			{
+				chain: []string{"ip", netconfig.FilterTable, "prerouting"},
+				want:  []string{`iifname != "uplink0"`, `iifname != "uplink1"`, "meta mark set"},
+			},
+			{
+				chain: []string{"ip", netconfig.FilterTable, "output"},
+				want:  []string{"ct mark", "meta mark set"},
+			},
+		} {
+			args := append([]string{"--numeric", "list", "chain"}, tt.chain...)
+			out, err := exec.Command("nft", args...).Output()
+			if err != nil {
+				t.Fatalf("nft %v: %v", args, err)
+			}
+			var found bool
+			for _, line := range strings.Split(string(out), "\n") {
+				all := true
+				for _, want := range tt.want {
+					all = all && strings.Contains(line, want)
+				}
+				found = found || all
+			}
+			if !found {
+				t.Errorf("chain %v: no rule contains %q:\n%s", tt.chain, tt.want, out)
+			}
+		}
+
+		rules, err := normalizedLines("-4", "rule", "show")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{
+			"10: from all fwmark 0x1000000/0xff000000 lookup 1000",
+			"10: from all fwmark 0x2000000/0xff000000 lookup 1001",
+		} {
+			var found bool
+			for _, r := range rules {
+				found = found || strings.HasPrefix(r, want)
+			}
+			if !found {
+				t.Errorf("rule %q not found in %q", want, rules)
+			}
+		}
+
+		// Replies to connections which arrived via uplink1 leave via
+		// uplink1, all other traffic via the default route (uplink0).
+		for _, tt := range []struct {
+			args []string
+			want string
+		}{
+			{[]string{"route", "get", "203.0.113.9", "mark", "0x2000000"}, "203.0.113.9 via 10.0.0.1 dev uplink1"},
+			{[]string{"route", "get", "203.0.113.9", "mark", "0x1000000"}, "203.0.113.9 via 85.195.207.1 dev uplink0"},
+			{[]string{"route", "get", "203.0.113.9"}, "203.0.113.9 via 85.195.207.1 dev uplink0"},
+		} {
+			got, err := normalizedLines(tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(got[0], tt.want) {
+				t.Errorf("ip %v = %q, want prefix %q", tt.args, got[0], tt.want)
+			}
+		}
+
+		assertNoChanges(t, tmp, filepath.Join(tmp, "root"))
+
+		// With a single uplink, connections are not marked.
+		config.PreferredWAN = []string{"uplink0"}
+		if err := netconfig.Apply(tmp, filepath.Join(tmp, "root")); err != nil {
+			t.Fatalf("netconfig.Apply: %v", err)
+		}
+		routes, err := normalizedLines("route", "show", "table", "1001")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(routes) != 1 || routes[0] != "" {
+			t.Errorf("stale routes %q in table 1001 not removed", routes)
+		}
+		rules, err = normalizedLines("-4", "rule", "show")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range rules {
+			if strings.HasPrefix(r, "10:") {
+				t.Errorf("stale rule %q not removed", r)
+			}
+		}
+		if err := exec.Command("nft", "list", "chain", "ip", netconfig.FilterTable, "prerouting").Run(); err == nil {
+			t.Errorf("stale chain prerouting not removed")
+		}
+		assertNoChanges(t, tmp, filepath.Join(tmp, "root"))
+		return
+	}
+	const ns = "ns17" // name of the network namespace to use for this test
+
+	add := exec.Command("ip", "netns", "add", ns)
+	add.Stderr = os.Stderr
+	if err := add.Run(); err != nil {
+		t.Fatalf("%v: %v", add.Args, err)
+	}
+	defer exec.Command("ip", "netns", "delete", ns).Run()
+
+	nsSetup := []*exec.Cmd{
+		exec.Command("ip", "-netns", ns, "link", "add", "dummy0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "add", "dummy1", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "add", "eth0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "set", "dummy0", "address", "02:73:53:00:ca:fe"),
+		exec.Command("ip", "-netns", ns, "link", "set", "dummy1", "address", "02:73:53:00:ca:fb"),
+		exec.Command("ip", "-netns", ns, "link", "set", "eth0", "address", "02:73:53:00:b0:0c"),
+	}
+
+	for _, cmd := range nsSetup {
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("%v: %v", cmd.Args, err)
+		}
+	}
+
+	cmd := exec.Command("ip", "netns", "exec", ns, os.Args[0], "-test.run=^TestNetconfigMultiWANForwarding$")
+	cmd.Env = append(os.Environ(), "HELPER_PROCESS=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoutingConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rout5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	restore := useConfig(t, tmp, `
+[[netconfig.routing_tables]]
+name = "guest"
+id = 100
+
+[[netconfig.routing_tables.routes]]
+dst = "default"
+via = "dhcp"
+dev = "uplink1"
+
+[[netconfig.routing_tables]]
+name = "vpn"
+id = 256
+
+[[netconfig.routing_tables.routes]]
+dst = "::/0"
+dev = "wg0"
+
+[[netconfig.routing_rules]]
+priority = 1000
+from = "192.168.43.0/24"
+table = "guest"
+
+[[netconfig.routing_rules]]
+priority = 1001
+fwmark = "0x1/0xff"
+uid_range = "1000-1999"
+table = "vpn"
+`+goldenFilterConfig)
+	if _, err := netconfig.LoadConfig(tmp); err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	restore()
+
+	restore = useConfig(t, tmp, `
+[[netconfig.routing_tables]]
+name = "main"
+id = 254
+
+[[netconfig.routing_tables]]
+name = "guest"
+id = 100
+
+[[netconfig.routing_tables.routes]]
+dst = "::/0"
+via = "10.0.0.1"
+
+[[netconfig.routing_tables.routes]]
+dst = "default"
+via = "dhcp"
+
+[[netconfig.routing_tables]]
+name = "backup"
+id = 1001
+
+[[netconfig.routing_rules]]
+priority = 32766
+fwmark = "mark"
+uid_range = "2000-1000"
+table = "vpn"
+`+goldenFilterConfig)
+	defer restore()
+	var got []string
+	for _, p := range netconfig.Check(tmp) {
+		if strings.HasPrefix(p.Field, "netconfig.routing") {
+			got = append(got, p.Field+": "+p.Message)
+		}
+	}
+	want := []string{
+		`netconfig.routing_tables[0].name: "main" is reserved`,
+		`netconfig.routing_tables[0].id: must be between 1 and 252 or at least 256 (got 254)`,
+		`netconfig.routing_tables[1].routes[0].via: address family of 10.0.0.1 does not match dst ::/0`,
+		`netconfig.routing_tables[1].routes[1].dev: must be set for via = "dhcp"`,
+		`netconfig.routing_tables[2].id: ids from 1000 to 1254 are reserved for the uplinks (got 1001)`,
+		`netconfig.routing_rules[0].priority: must be between 1 and 32765 (got 32766)`,
+		`netconfig.routing_rules[0].fwmark: strconv.ParseUint: parsing "mark": invalid syntax`,
+		`netconfig.routing_rules[0].uid_range: invalid range "2000-1000": 1000 < 2000`,
+		`netconfig.routing_rules[0].table: unknown table "vpn", expected “main” or one of routing_tables`,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Check: diff (-want +got):\n%s", diff)
+	}
+}
+
+// normalizedLines returns the lines of ip output with all whitespace runs
+// replaced by a single space.
+func normalizedLines(args ...string) ([]string, error) {
+	lines, err := ipLines(args...)
+	if err != nil {
+		return nil, err
+	}
+	for idx, l := range lines {
+		lines[idx] = strings.Join(strings.Fields(l), " ")
+	}
+	return lines, nil
+}
+
+// assertNoChanges fails t unless the config in dir (see useConfig) entails no
+// further changes, i.e. unless it was applied completely.
+func assertNoChanges(t *testing.T, dir, root string) {
+	t.Helper()
+	cfg, err := netconfig.LoadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := netconfig.PlanConfig(cfg, dir, root)
+	if err != nil {
+		t.Fatalf("netconfig.PlanConfig: %v", err)
+	}
+	if len(p.Changes) > 0 || len(p.Errors) > 0 {
+		t.Errorf("netconfig.PlanConfig: unexpected changes after Apply:\n%s", p)
+	}
+}
+
+func TestNetconfigRouting(t *testing.T) {
+	if os.Getenv("HELPER_PROCESS") == "1" {
+		tmp, err := ioutil.TempDir("", "rout5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		config.PreferredWAN = []string{"uplink0", "uplink1"}
+
+		for _, dir := range []string{"root/etc", "root/tmp", "dhcp4/wire", "dhcp4/uplink1"} {
+			if err := os.MkdirAll(filepath.Join(tmp, dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, f := range []struct {
+			fn, contents string
+		}{
+			{"dhcp4/wire/lease.json", goldenDhcp4},
+			{"dhcp4/uplink1/lease.json", multiWANDhcp4},
+		} {
+			if err := ioutil.WriteFile(filepath.Join(tmp, f.fn), []byte(f.contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		const interfaces = `
+[[netconfig.interfaces]]
+hardware_addr = "02:73:53:00:ca:fb"
+name = "uplink1"
+` + goldenFilterConfig
+
+		const routing = `
+[[netconfig.routing_tables]]
+name = "guest"
+id = 100
+
+[[netconfig.routing_tables.routes]]
+dst = "default"
+via = "dhcp"
+dev = "uplink1"
+
+[[netconfig.routing_tables]]
+name = "vpn"
+id = 200
+
+[[netconfig.routing_tables.routes]]
+dst = "10.8.0.0/24"
+dev = "lan0"
+
+[[netconfig.routing_rules]]
+priority = 1000
+from = "192.168.43.0/24"
+table = "guest"
+
+[[netconfig.routing_rules]]
+priority = 1001
+iif = "lan0"
+fwmark = "0x1/0xff"
+table = "guest"
+
+[[netconfig.routing_rules]]
+priority = 1002
+uid_range = "1000-1999"
+table = "vpn"
+`
+
+		restore := useConfig(t, tmp, routing+interfaces)
+		if err := netconfig.Apply(tmp, filepath.Join(tmp, "root")); err != nil {
+			t.Fatalf("netconfig.Apply: %v", err)
+		}
+
+		rules, err := normalizedLines("-4", "rule", "show")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules6, err := normalizedLines("-6", "rule", "show")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range []struct {
+			rules []string
+			want  string
+		}{
+			{rules, "1000: from 192.168.43.0/24 lookup 100"},
+			{rules, "1001: from all fwmark 0x1/0xff iif lan0 lookup 100"},
+			{rules, "1002: from all uidrange 1000-1999 lookup 200"},
+			{rules6, "1001: from all fwmark 0x1/0xff iif lan0 lookup 100"},
+			{rules6, "1002: from all uidrange 1000-1999 lookup 200"},
+		} {
+			var found bool
+			for _, r := range tt.rules {
+				found = found || strings.HasPrefix(r, tt.want)
+			}
+			if !found {
+				t.Errorf("rule %q not found in %q", tt.want, tt.rules)
+			}
+		}
+
+		for _, tt := range []struct {
+			table string
+			want  []string
+		}{
+			{"100", []string{"default via 10.0.0.1 dev uplink1 proto static"}},
+			{"200", []string{"10.8.0.0/24 dev lan0 proto static scope link"}},
+		} {
+			routes, err := normalizedLines("route", "show", "table", tt.table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, routes); diff != "" {
+				t.Errorf("routes of table %s: diff (-want +got):\n%s", tt.table, diff)
+			}
+		}
+
+		assertNoChanges(t, tmp, filepath.Join(tmp, "root"))
+		restore()
+
+		// Removing the routing policy from the config removes the rules and
+		// routes.
+		restore = useConfig(t, tmp, interfaces)
+		defer restore()
+		if err := netconfig.Apply(tmp, filepath.Join(tmp, "root")); err != nil {
+			t.Fatalf("netconfig.Apply: %v", err)
+		}
+		rules, err = normalizedLines("rule", "show")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range rules {
+			if strings.HasPrefix(r, "100") {
+				t.Errorf("stale rule %q not removed", r)
+			}
+		}
+		routes, err := normalizedLines("route", "show", "table", "all")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range routes {
+			if strings.Contains(r, "proto static") {
+				t.Errorf("stale route %q not removed", r)
+			}
+		}
+		assertNoChanges(t, tmp, filepath.Join(tmp, "root"))
+		return
+	}
+	const ns = "ns13" // name of the network namespace to use for this test
+
+	add := exec.Command("ip", "netns", "add", ns)
+	add.Stderr = os.Stderr
+	if err := add.Run(); err != nil {
+		t.Fatalf("%v: %v", add.Args, err)
+	}
+	defer exec.Command("ip", "netns", "delete", ns).Run()
+
+	nsSetup := []*exec.Cmd{
+		exec.Command("ip", "-netns", ns, "link", "add", "dummy0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "add", "dummy1", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "add", "eth0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "set", "dummy0", "address", "02:73:53:00:ca:fe"),
+		exec.Command("ip", "-netns", ns, "link", "set", "dummy1", "address", "02:73:53:00:ca:fb"),
+		exec.Command("ip", "-netns", ns, "link", "set", "eth0", "address", "02:73:53:00:b0:0c"),
+	}
+
+	for _, cmd := range nsSetup {
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("%v: %v", cmd.Args, err)
+		}
+	}
+
+	cmd := exec.Command("ip", "netns", "exec", ns, os.Args[0], "-test.run=^TestNetconfigRouting$")
+	cmd.Env = append(os.Environ(), "HELPER_PROCESS=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStaticRoutesConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rout5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	restore := useConfig(t, tmp, `
+[[netconfig.routes]]
+dst = "10.10.0.0/16"
+via = "192.168.42.254"
+
+[[netconfig.routes]]
+dst = "2001:db8::/32"
+dev = "lan0"
+metric = 10
+`+goldenFilterConfig)
+	if _, err := netconfig.LoadConfig(tmp); err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	restore()
+
+	restore = useConfig(t, tmp, `
+[[netconfig.routes]]
+dst = "10.10.0.0"
+via = "192.168.42.254"
+
+[[netconfig.routes]]
+dst = "2001:db8::/32"
+metric = -1
+table = "guest"
+`+goldenFilterConfig)
+	defer restore()
+	var got []string
+	for _, p := range netconfig.Check(tmp) {
+		if strings.HasPrefix(p.Field, "netconfig.routes") {
+			got = append(got, p.Field+": "+p.Message)
+		}
+	}
+	want := []string{
+		`netconfig.routes[0].dst: invalid CIDR address: 10.10.0.0`,
+		`netconfig.routes[1]: must set via or dev`,
+		`netconfig.routes[1].metric: must not be negative (got -1)`,
+		`netconfig.routes[1].table: unknown table "guest", expected “main” or one of routing_tables`,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Check: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestNetconfigStaticRoutes(t *testing.T) {
+	if os.Getenv("HELPER_PROCESS") == "1" {
+		tmp, err := ioutil.TempDir("", "rout5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+
+		for _, dir := range []string{"root/etc", "root/tmp", "dhcp4/wire"} {
+			if err := os.MkdirAll(filepath.Join(tmp, dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmp, "dhcp4/wire/lease.json"), []byte(goldenDhcp4), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		const kept = `
+[[netconfig.routes]]
+dst = "10.10.0.0/16"
+via = "192.168.42.254"
+`
+		const routes = kept + `
+[[netconfig.routes]]
+dst = "10.11.0.0/16"
+dev = "lan0"
+metric = 5
+
+[[netconfig.routes]]
+dst = "2001:db8::/32"
+dev = "lan0"
+`
+
+		restore := useConfig(t, tmp, routes+goldenFilterConfig)
+		if err := netconfig.Apply(tmp, filepath.Join(tmp, "root")); err != nil {
+			t.Fatalf("netconfig.Apply: %v", err)
+		}
+
+		for _, tt := range []struct {
+			args []string
+			want []string
+		}{
+			{
+				args: []string{"-4", "route", "show", "proto", "static"},
+				want: []string{
+					"10.10.0.0/16 via 192.168.42.254 dev lan0",
+					"10.11.0.0/16 dev lan0 scope link metric 5",
+				},
+			},
+			{
+				args: []string{"-6", "route", "show", "proto", "static"},
+				want: []string{
+					"2001:db8::/32 dev lan0 metric 1024 pref medium",
+				},
+			},
+		} {
+			got, err := normalizedLines(tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("ip %v: diff (-want +got):\n%s", tt.args, diff)
+			}
+		}
+
+		assertNoChanges(t, tmp, filepath.Join(tmp, "root"))
+		restore()
+
+		// Routes of other protocols must survive, stale static routes not.
+		foreign := exec.Command("ip", "route", "add", "10.30.0.0/16", "via", "192.168.42.254", "proto", "boot")
+		foreign.Stderr = os.Stderr
+		if err := foreign.Run(); err != nil {
+			t.Fatalf("%v: %v", foreign.Args, err)
+		}
+		restore = useConfig(t, tmp, kept+goldenFilterConfig)
+		defer restore()
+		if err := netconfig.Apply(tmp, filepath.Join(tmp, "root")); err != nil {
+			t.Fatalf("netconfig.Apply: %v", err)
+		}
+		got, err := normalizedLines("-4", "route", "show", "root", "10.0.0.0/8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{
+			"10.10.0.0/16 via 192.168.42.254 dev lan0 proto static",
+			"10.30.0.0/16 via 192.168.42.254 dev lan0", // proto boot is the default
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("routes: diff (-want +got):\n%s", diff)
+		}
+		assertNoChanges(t, tmp, filepath.Join(tmp, "root"))
+		return
+	}
+	const ns = "ns14" // name of the network namespace to use for this test
+
+	add := exec.Command("ip", "netns", "add", ns)
+	add.Stderr = os.Stderr
+	if err := add.Run(); err != nil {
+		t.Fatalf("%v: %v", add.Args, err)
+	}
+	defer exec.Command("ip", "netns", "delete", ns).Run()
+
+	nsSetup := []*exec.Cmd{
+		exec.Command("ip", "-netns", ns, "link", "add", "dummy0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "add", "eth0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "set", "dummy0", "address", "02:73:53:00:ca:fe"),
+		exec.Command("ip", "-netns", ns, "link", "set", "eth0", "address", "02:73:53:00:b0:0c"),
+	}
+
+	for _, cmd := range nsSetup {
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("%v: %v", cmd.Args, err)
+		}
+	}
+
+	cmd := exec.Command("ip", "netns", "exec", ns, os.Args[0], "-test.run=^TestNetconfigStaticRoutes$")
+	cmd.Env = append(os.Environ(), "HELPER_PROCESS=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVLANConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rout5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	restore := useConfig(t, tmp, goldenVLANConfig)
+	if _, err := netconfig.LoadConfig(tmp); err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	details, err := netconfig.Interface(tmp, "iot0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := details.Addr, "192.168.44.1/24"; got != want {
+		t.Errorf("Interface(iot0).Addr: got %q, want %q", got, want)
+	}
+	restore()
+
+	restore = useConfig(t, tmp, `
+[[netconfig.interfaces]]
+hardware_addr = "02:73:53:00:b0:0c"
+name = "lan0"
+
+[[netconfig.bridges]]
+name = "br0"
+interface_names = [""]
+
+[[netconfig.vlans]]
+name = "lan0"
+parent = "lan0"
+id = 4095
+
+[[netconfig.vlans]]
+name = "iot0"
+parent = "lan0"
+id = 20
+addr = "192.168.44.1"
+
+[[netconfig.vlans]]
+name = "iot1"
+parent = "lan0"
+id = 20
+`)
+	defer restore()
+	var got []string
+	for _, p := range netconfig.Check(tmp) {
+		if strings.HasPrefix(p.Field, "netconfig.vlans") || strings.HasPrefix(p.Field, "netconfig.bridges") {
+			got = append(got, p.Field+": "+p.Message)
+		}
+	}
+	want := []string{
+		`netconfig.bridges[0].interface_names[0]: must not be empty`,
+		`netconfig.vlans[0].name: duplicate interface name "lan0" (also used by interfaces[0])`,
+		`netconfig.vlans[0].parent: must not be the VLAN itself`,
+		`netconfig.vlans[0].id: must be between 1 and 4094 (got 4095)`,
+		`netconfig.vlans[1].addr: invalid CIDR address "192.168.44.1", expected e.g. 192.168.42.1/24`,
+		`netconfig.vlans[2].id: duplicate VLAN 20 on lan0 (also used by vlans[1])`,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Check: diff (-want +got):\n%s", diff)
+	}
+}
+
+// goldenVLANConfig connects to the uplink via VLAN 7 on wan0 and serves the
+// guest (bridged) and IoT networks via VLANs on lan0.
+const goldenVLANConfig = `
+[[netconfig.interfaces]]
+hardware_addr = "02:73:53:00:ca:fe"
+name = "wan0"
+
+[[netconfig.interfaces]]
+hardware_addr = "02:73:53:00:b0:0c"
+name = "lan0"
+addr = "192.168.42.1/24"
+
+[[netconfig.interfaces]]
+name = "br0"
+addr = "192.168.43.1/24"
+
+[[netconfig.bridges]]
+name = "br0"
+interface_names = ["guest0"]
+
+[[netconfig.vlans]]
+name = "uplink0"
+parent = "wan0"
+id = 7
+
+[[netconfig.vlans]]
+name = "guest0"
+parent = "lan0"
+id = 10
+
+[[netconfig.vlans]]
+name = "iot0"
+parent = "lan0"
+id = 20
+addr = "192.168.44.1/24"
+`
+
+func TestNetconfigVLAN(t *testing.T) {
+	if os.Getenv("HELPER_PROCESS") == "1" {
+		tmp, err := ioutil.TempDir("", "rout5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+
+		for _, dir := range []string{"root/etc", "root/tmp", "dhcp4/wire"} {
+			if err := os.MkdirAll(filepath.Join(tmp, dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmp, "dhcp4/wire/lease.json"), []byte(goldenDhcp4), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		restore := useConfig(t, tmp, goldenVLANConfig)
+		if err := netconfig.Apply(tmp, filepath.Join(tmp, "root")); err != nil {
+			t.Fatalf("netconfig.Apply: %v", err)
+		}
+
+		for _, tt := range []struct {
+			ifname string
+			want   []string
+		}{
+			{"uplink0", []string{"uplink0@wan0:", "vlan protocol 802.1Q id 7 ", "inet 85.195.207.62/25 "}},
+			{"guest0", []string{"guest0@lan0:", "master br0", "vlan protocol 802.1Q id 10 "}},
+			{"iot0", []string{"iot0@lan0:", "vlan protocol 802.1Q id 20 ", "inet 192.168.44.1/24 "}},
+			{"br0", []string{"inet 192.168.43.1/24 "}},
+		} {
+			out, err := exec.Command("ip", "-d", "addr", "show", "dev", tt.ifname).Output()
+			if err != nil {
+				t.Fatalf("ip addr show dev %s: %v", tt.ifname, err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(out), want) {
+					t.Errorf("%s: %q not found in:\n%s", tt.ifname, want, out)
+				}
+			}
+		}
+
+		// Untagged frames on wan0, the parent of the uplink, come from the
+		// ISP’s segment and must neither reach the router nor the LAN.
+		for _, family := range []string{"ip", "ip6"} {
+			for _, chain := range []string{"input", "forward"} {
+				out, err := exec.Command("nft", "--numeric", "list", "chain", family, netconfig.FilterTable, chain).Output()
+				if err != nil {
+					t.Fatalf("nft list chain %s %s: %v", family, chain, err)
+				}
+				if !strings.Contains(string(out), "\t\tiifname \"wan0\" drop\n") {
+					t.Errorf("%s %s chain does not drop wan0:\n%s", family, chain, out)
+				}
+				if strings.Contains(string(out), "iifname \"lan0\" drop") {
+					t.Errorf("%s %s chain drops lan0, the parent of LAN VLANs:\n%s", family, chain, out)
+				}
+			}
+		}
+
+		assertNoChanges(t, tmp, filepath.Join(tmp, "root"))
+		restore()
+
+		// Changing the VLAN ID re-creates the VLAN.
+		restore = useConfig(t, tmp, strings.Replace(goldenVLANConfig, "id = 20", "id = 21", 1))
+		defer restore()
+		if err := netconfig.Apply(tmp, filepath.Join(tmp, "root")); err != nil {
+			t.Fatalf("netconfig.Apply: %v", err)
+		}
+		out, err := exec.Command("ip", "-d", "addr", "show", "dev", "iot0").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"vlan protocol 802.1Q id 21 ", "inet 192.168.44.1/24 "} {
+			if !strings.Contains(string(out), want) {
+				t.Errorf("iot0: %q not found in:\n%s", want, out)
+			}
+		}
+		assertNoChanges(t, tmp, filepath.Join(tmp, "root"))
+		return
+	}
+	const ns = "ns15" // name of the network namespace to use for this test
+
+	add := exec.Command("ip", "netns", "add", ns)
+	add.Stderr = os.Stderr
+	if err := add.Run(); err != nil {
+		t.Fatalf("%v: %v", add.Args, err)
+	}
+	defer exec.Command("ip", "netns", "delete", ns).Run()
+
+	nsSetup := []*exec.Cmd{
+		exec.Command("ip", "-netns", ns, "link", "add", "dummy0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "add", "eth0", "type", "dummy"),
+		exec.Command("ip", "-netns", ns, "link", "set", "dummy0", "address", "02:73:53:00:ca:fe"),
+		exec.Command("ip", "-netns", ns, "link", "set", "eth0", "address", "02:73:53:00:b0:0c"),
+	}
+
+	for _, cmd := range nsSetup {
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("%v: %v", cmd.Args, err)
+		}
+	}
+
+	cmd := exec.Command("ip", "netns", "exec", ns, os.Args[0], "-test.run=^TestNetconfigVLAN$")
+	cmd.Env = append(os.Environ(), "HELPER_PROCESS=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBondConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rout5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	restore := useConfig(t, tmp, goldenBondConfig)
+	if _, err := netconfig.LoadConfig(tmp); err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	restore()
+
+	restore = useConfig(t, tmp, `
+[[netconfig.interfaces]]
+name = "lan0"
+addr = "192.168.42.1/24"
+
+[[netconfig.bonds]]
+name = "lan0"
+mode = "lacp"
+miimon = -1
+interface_hardware_addrs = ["02:73:53:00:b0"]
+
+[[netconfig.bonds]]
+name = "lan0"
+`)
+	defer restore()
+	var got []string
+	for _, p := range netconfig.Check(tmp) {
+		if strings.HasPrefix(p.Field, "netconfig.bonds") {
+			got = append(got, p.Field+": "+p.Message)
+		}
+	}
+	want := []string{
+		`netconfig.bonds[0].mode: unknown mode "lacp", expected e.g. 802.3ad or active-backup`,
+		`netconfig.bonds[0].miimon: must not be negative (got -1)`,
+		`netconfig.bonds[0].interface_hardware_addrs[0]: address 02:73:53:00:b0: invalid MAC address`,
+		`netconfig.bonds[1].name: duplicate bond name "lan0" (also used by bonds[0])`,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Check: diff (-want +got):\n%s", diff)
+	}
+}
+
+// goldenBondConfig aggregates eth1 and eth2 into lan0.
+const goldenBondConfig = `
+[[netconfig.interfaces]]
+name = "lan0"
+addr = "192.168.42.1/24"
+
+[[netconfig.bonds]]
+name = "lan0"
+mode = "active-backup"
+interface_hardware_addrs = ["02:73:53:00:b0:01", "02:73:53:00:b0:02"]
+`
+
+func TestNetconfigBond(t *testing.T) {
+	if os.Getenv("HELPER_PROCESS") == "1" {
+		tmp, err := ioutil.TempDir("", "rout5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+
+		for _, dir := range []string{"root/etc", "root/tmp"} {
+			if err := os.MkdirAll(filepath.Join(tmp, dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, tt := range []struct {
+			name string
+			cfg  string
+			want string
+		}{
+			{"active-backup", goldenBondConfig, "bond mode active-backup miimon 100 "},
+			// Changing the mode re-creates the bond.
+			{"802.3ad", strings.Replace(goldenBondConfig, `"active-backup"`, `"802.3ad"`, 1), "bond mode 802.3ad miimon 100 "},
+		} {
+			restore := useConfig(t, tmp, tt.cfg)
+			if err := netconfig.Apply(tmp, filepath.Join(tmp, "root")); err != nil {
+				t.Fatalf("%s: netconfig.Apply: %v", tt.name, err)
+			}
+
+			out, err := exec.Command("ip", "-d", "addr", "show", "dev", "lan0").Output()
+			if err != nil {
+				t.Fatalf("%s: ip addr show dev lan0: %v", tt.name, err)
+			}
+			for _, want := range []string{tt.want, "inet 192.168.42.1/24 "} {
+				if !strings.Contains(string(out), want) {
+					t.Errorf("%s: lan0: %q not found in:\n%s", tt.name, want, out)
+				}
+			}
+			for _, ifname := range []string{"eth1", "eth2"} {
+				out, err := exec.Command("ip", "link", "show", "dev", ifname).Output()
+				if err != nil {
+					t.Fatalf("%s: ip link show dev %s: %v", tt.name, ifname, err)
+				}
+				if !strings.Contains(string(out), "master lan0 ") {
+					t.Errorf("%s: %s is not a member of lan0:\n%s", tt.name, ifname, out)
+				}
+			}
+
+			assertNoChanges(t, tmp, filepath.Join(tmp, "root"))
+			restore()
+		}
+		return
+	}
+	const ns = "ns16" // name of the network namespace to use for this test
+
+	add := exec.Command("ip", "netns", "add", ns)
+	add.Stderr = os.Stderr
+	if err := add.Run(); err != nil {
+		t.Fatalf("%v: %v", add.Args, err)
+	}
+	defer exec.Command("ip", "netns", "delete", ns).Run()
+
+	// sw1 and sw2 are the switch ends of the veth pairs.
+	nsSetup := []*exec.Cmd{
+		exec.Command("ip", "-netns", ns, "link", "add", "eth1", "type", "veth", "peer", "name", "sw1"),
+		exec.Command("ip", "-netns", ns, "link", "add", "eth2", "type", "veth", "peer", "name", "sw2"),
+		exec.Command("ip", "-netns", ns, "link", "set", "eth1", "address", "02:73:53:00:b0:01"),
+		exec.Command("ip", "-netns", ns, "link", "set", "eth2", "address", "02:73:53:00:b0:02"),
+		exec.Command("ip", "-netns", ns, "link", "set", "sw1", "up"),
+		exec.Command("ip", "-netns", ns, "link", "set", "sw2", "up"),
+	}
+
+	for _, cmd := range nsSetup {
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("%v: %v", cmd.Args, err)
+		}
+	}
+
+	cmd := exec.Command("ip", "netns", "exec", ns, os.Args[0], "-test.run=^TestNetconfigBond$")
+	cmd.Env = append(os.Environ(), "HELPER_PROCESS=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
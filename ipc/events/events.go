@@ -0,0 +1,77 @@
+// Package events defines the typed events which rout5 daemons exchange over
+// the ipc bus, so that subscribers learn what changed without re-reading state
+// files from the permanent data directory.
+package events
+
+import (
+	"git.tcp.direct/kayos/rout5/dhcp/dhcp4"
+	"git.tcp.direct/kayos/rout5/dhcp/dhcp4d"
+	"git.tcp.direct/kayos/rout5/dhcp/dhcp6"
+)
+
+// Event names, as returned by EventName.
+const (
+	NameDHCP4Lease       = "dhcp4.lease"
+	NameDelegatedPrefix  = "dhcp6.prefix"
+	NameAddressesChanged = "netconfig.addresses"
+	NameLeaseHandedOut   = "dhcp4d.lease"
+	NameConfigChanged    = "netconfig.config"
+	NameUplinkHealth     = "diagd.uplink"
+)
+
+// DHCP4Lease is published by dhcp4 whenever it obtained or renewed a DHCPv4
+// lease on Interface.
+type DHCP4Lease struct {
+	Interface string       `json:"interface"` // e.g. uplink0
+	Config    dhcp4.Config `json:"config"`
+}
+
+func (DHCP4Lease) EventName() string { return NameDHCP4Lease }
+
+// DelegatedPrefix is published by dhcp6 whenever the delegated IPv6 prefix
+// was obtained or renewed.
+type DelegatedPrefix struct {
+	Config dhcp6.Config `json:"config"`
+}
+
+func (DelegatedPrefix) EventName() string { return NameDelegatedPrefix }
+
+// AddressesChanged is published by netconfigd after netconfig.Apply, i.e.
+// whenever interface addresses might have changed, so that daemons can update
+// their listeners.
+type AddressesChanged struct {
+	// Err is the error returned by netconfig.Apply, if any. Apply might have
+	// modified state before returning an error.
+	Err string `json:"err,omitempty"`
+}
+
+func (AddressesChanged) EventName() string { return NameAddressesChanged }
+
+// LeaseHandedOut is published by dhcp4d whenever it handed out (or modified)
+// a DHCPv4 lease.
+type LeaseHandedOut struct {
+	Lease dhcp4d.Lease `json:"lease"`
+}
+
+func (LeaseHandedOut) EventName() string { return NameLeaseHandedOut }
+
+// ConfigChanged is published by netconfigd after it accepted and applied a
+// modified config.toml or state directory file, so that daemons can re-read
+// the config (see config.Reload).
+type ConfigChanged struct {
+	// Files lists the modified files, e.g. /etc/rout5/config.toml or
+	// /perm/interfaces.json.
+	Files []string `json:"files"`
+}
+
+func (ConfigChanged) EventName() string { return NameConfigChanged }
+
+// UplinkHealth is published by diagd whenever the diag checks of an uplink
+// start or stop failing, so that netconfigd can fail over to other uplinks.
+type UplinkHealth struct {
+	Interface  string `json:"interface"` // e.g. uplink1
+	Healthy    bool   `json:"healthy"`
+	FirstError string `json:"first_error,omitempty"`
+}
+
+func (UplinkHealth) EventName() string { return NameUplinkHealth }
@@ -1,12 +1,46 @@
+// Package ipc implements a small message bus over unix domain sockets, which
+// rout5 daemons use to notify each other about state changes (e.g. new
+// addresses or a new DHCP lease).
+//
+// Messages carry either a bare Signal or a typed Event, serialized as JSON.
+// Event types shared between daemons are defined in package events.
+//
+// Each daemon registers under a name (e.g. /user/dhcp4d) and thereby creates a
+// socket in Dir. Other daemons deliver signals to it by connecting to that
+// socket, which works regardless of whether the daemons run in the same
+// process or as separate binaries.
+//
+// Only root and the rout5 daemons (config.UID and config.GID) may connect:
+// Dir and the sockets are not accessible to other users, and messages from
+// peers with other credentials are discarded.
 package ipc
 
 import (
-	"github.com/akutz/memconn"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"git.tcp.direct/kayos/rout5/config"
 )
 
-type Signal uint8
+// Dir is the runtime directory which holds one socket per registered process.
+var Dir = "/run/rout5"
 
-const addr = "rout5"
+// timeout bounds how long delivering a signal to a peer may take.
+const timeout = 5 * time.Second
+
+type Signal uint8
 
 const (
 	SigHUP Signal = iota
@@ -14,21 +48,456 @@ const (
 	SigUSR2
 )
 
-func NotifyAll(s Signal) error {
+func (s Signal) String() string {
+	switch s {
+	case SigHUP:
+		return "SIGHUP"
+	case SigUSR1:
+		return "SIGUSR1"
+	case SigUSR2:
+		return "SIGUSR2"
+	}
+	return fmt.Sprintf("Signal(%d)", uint8(s))
+}
+
+// ErrNotRegistered is returned when delivering a signal to a process which has
+// not registered itself on the bus.
+var ErrNotRegistered = errors.New("process not registered")
 
+// Event is a typed payload which can be sent over the bus.
+type Event interface {
+	// EventName identifies the type of the event, e.g. "dhcp4.lease".
+	EventName() string
 }
 
-func Notify(incoming chan Signal, s Signal) error {
+// Message is what travels over the bus: either a Signal or, if Event is
+// non-empty, a typed event with its JSON-encoded payload.
+type Message struct {
+	Signal  Signal          `json:"signal"`
+	Event   string          `json:"event,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Decode unmarshals the payload of m into ev, which must be a pointer to an
+// Event of the type indicated by m.Event.
+func (m Message) Decode(ev Event) error {
+	if got, want := m.Event, ev.EventName(); got != want {
+		return fmt.Errorf("cannot decode %q event into %T (%q)", got, ev, want)
+	}
+	return json.Unmarshal(m.Payload, ev)
+}
 
+func (m Message) String() string {
+	if m.Event != "" {
+		return m.Event
+	}
+	return m.Signal.String()
+}
+
+// ack is written back to the sender once a message was handed to the
+// subscribers of the receiving process, nak if a subscriber did not accept an
+// event within deliverTimeout.
+const (
+	ack = 0x06
+	nak = 0x15
+)
+
+// deliverTimeout bounds how long an event waits for a subscriber whose
+// channel is full. It is shorter than timeout so that the sender learns
+// about the dropped event.
+var deliverTimeout = 2 * time.Second
+
+var (
+	mu          sync.Mutex
+	self        string // name under which this process is registered
+	ln          *net.UnixListener
+	handlers    = make(map[Signal][]chan Signal)
+	subscribers = make(map[string][]chan Message)
+)
+
+// DefaultName returns the name under which a process registers if it does not
+// call Register explicitly, e.g. /user/dhcp4d for binary dhcp4d.
+func DefaultName() string {
+	return "/user/" + filepath.Base(os.Args[0])
+}
+
+func socketPath(name string) string {
+	return filepath.Join(Dir, filepath.Clean("/"+name)) + ".sock"
+}
+
+// Register makes this process reachable under name (e.g. /user/dhcp4d). A stale
+// socket left behind by a previous instance is replaced.
+func Register(name string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	return registerLocked(name)
+}
+
+func registerLocked(name string) error {
+	if ln != nil {
+		if name == self {
+			return nil
+		}
+		return fmt.Errorf("already registered as %s", self)
+	}
+	path := socketPath(name)
+	if err := mkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	// Peers might run under a different uid, e.g. after dropping privileges,
+	// but share config.GID.
+	if err := restrict(path, 0660); err != nil {
+		l.Close()
+		return err
+	}
+	self = name
+	ln = l
+	go serve(l)
+	return nil
+}
+
+// mkdirAll creates dir and its parents up to Dir, accessible only to root and
+// config.GID.
+func mkdirAll(dir string) error {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	for ; ; dir = filepath.Dir(dir) {
+		if err := restrict(dir, 0750); err != nil {
+			return err
+		}
+		if rel, err := filepath.Rel(Dir, dir); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return nil
+		}
+	}
+}
+
+// restrict sets the permissions of path to perm and, when running as root,
+// hands path to group config.GID.
+func restrict(path string, perm os.FileMode) error {
+	if os.Getuid() == 0 {
+		if err := os.Lchown(path, -1, config.GID); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(path, perm)
+}
+
+// trusted reports whether the peer of conn is root, this process's user or
+// config.UID.
+func trusted(conn net.Conn) bool {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return false
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var (
+		cred    *unix.Ucred
+		credErr error
+	)
+	if err := rc.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil || credErr != nil {
+		return false
+	}
+	switch int(cred.Uid) {
+	case 0, os.Getuid(), config.UID:
+		return true
+	}
+	return false
+}
+
+// Listen creates the control socket name (e.g. /user/netconfigd) in Dir, on
+// which a daemon serves requests that must not be reachable over the network,
+// e.g. HTTP handlers which change the configuration. Like the bus sockets, it
+// is only accessible to root and config.GID, and connections from peers other
+// than root, this process's user and config.UID are closed right away.
+func Listen(name string) (net.Listener, error) {
+	path := controlPath(name)
+	if err := mkdirAll(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := restrict(path, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return trustedListener{l}, nil
+}
+
+// Dial connects to the control socket name, see Listen.
+func Dial(name string) (net.Conn, error) {
+	conn, err := net.DialTimeout("unix", controlPath(name), timeout)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%s: no control socket, is it running?", name)
+		}
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return conn, nil
 }
 
+// controlPath differs from socketPath so that Registered does not return
+// control sockets.
+func controlPath(name string) string {
+	return filepath.Join(Dir, filepath.Clean("/"+name)) + ".ctl"
+}
+
+// trustedListener accepts only connections from trusted peers.
+type trustedListener struct {
+	*net.UnixListener
+}
+
+func (l trustedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.UnixListener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if trusted(conn) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+// Unregister removes this process from the bus.
+func Unregister() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if ln == nil {
+		return nil
+	}
+	err := ln.Close()
+	ln = nil
+	self = ""
+	return err
+}
+
+func serve(l *net.UnixListener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return // listener closed
+		}
+		go handle(conn)
+	}
+}
+
+func handle(conn net.Conn) {
+	defer conn.Close()
+	if !trusted(conn) {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	var msg Message
+	if err := json.NewDecoder(conn).Decode(&msg); err != nil {
+		return
+	}
+	reply := byte(ack)
+	if err := dispatch(msg); err != nil {
+		log.Printf("ipc: %v", err)
+		reply = nak
+	}
+	conn.Write([]byte{reply})
+}
+
+// dispatch hands msg to the channels registered via Notify or Subscribe.
+// Unlike signals, events carry state which the subscriber would otherwise
+// miss, so dispatch waits up to deliverTimeout for full channels and returns
+// an error if an event is dropped.
+func dispatch(msg Message) error {
+	mu.Lock()
+	if msg.Event != "" {
+		subs := append([]chan Message(nil), subscribers[msg.Event]...)
+		mu.Unlock()
+		var dropped int
+		for _, ch := range subs {
+			select {
+			case ch <- msg:
+			case <-time.After(deliverTimeout):
+				dropped++
+			}
+		}
+		if dropped > 0 {
+			return fmt.Errorf("%v dropped: %d subscriber(s) not ready within %v", msg, dropped, deliverTimeout)
+		}
+		return nil
+	}
+	defer mu.Unlock()
+	for _, ch := range handlers[msg.Signal] {
+		// Like os/signal, do not block when the receiver is not ready.
+		select {
+		case ch <- msg.Signal:
+		default:
+		}
+	}
+	return nil
+}
+
+// Notify causes incoming signals of the specified types to be relayed to
+// incoming. If this process did not call Register yet, it is registered under
+// DefaultName.
+func Notify(incoming chan Signal, sigs ...Signal) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if ln == nil {
+		if err := registerLocked(DefaultName()); err != nil {
+			return err
+		}
+	}
+	for _, s := range sigs {
+		handlers[s] = append(handlers[s], incoming)
+	}
+	return nil
+}
+
+// Subscribe causes incoming events of the specified types (see
+// Event.EventName) to be relayed to incoming. Like Notify, it registers this
+// process under DefaultName if necessary. Publishing fails if incoming does
+// not accept an event within a few seconds.
+func Subscribe(incoming chan Message, events ...string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if ln == nil {
+		if err := registerLocked(DefaultName()); err != nil {
+			return err
+		}
+	}
+	for _, ev := range events {
+		subscribers[ev] = append(subscribers[ev], incoming)
+	}
+	return nil
+}
+
+// Process delivers sig to the process registered as name.
 func Process(name string, sig Signal) error {
-	c, err := memconn.Dial(addr, name)
+	return send(name, Message{Signal: sig})
+}
+
+// Ping verifies that the process registered as name is reachable, without
+// delivering anything to its subscribers.
+func Ping(name string) error {
+	return send(name, Message{Event: "ipc.ping"})
+}
+
+// Publish delivers ev to the process registered as name.
+func Publish(name string, ev Event) error {
+	msg, err := eventMessage(ev)
+	if err != nil {
+		return err
+	}
+	return send(name, msg)
+}
+
+func eventMessage(ev Event) (Message, error) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Event: ev.EventName(), Payload: b}, nil
+}
+
+func send(name string, msg Message) error {
+	conn, err := net.DialTimeout("unix", socketPath(name), timeout)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%s: %w", name, ErrNotRegistered)
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return fmt.Errorf("%s: registered, but not running: %v", name, err)
+		}
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := json.NewEncoder(conn).Encode(msg); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	var b [1]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil || b[0] != ack {
+		if err == nil && b[0] == nak {
+			return fmt.Errorf("%s: %v dropped: subscriber not ready", name, msg)
+		}
+		return fmt.Errorf("%s: %v not acknowledged: %v", name, msg, err)
+	}
+	return nil
+}
+
+// Registered returns the names of all processes with a socket in Dir.
+func Registered() ([]string, error) {
+	var names []string
+	err := filepath.Walk(Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == Dir {
+				return nil
+			}
+			return err
+		}
+		if info.Mode()&os.ModeSocket == 0 || !strings.HasSuffix(path, ".sock") {
+			return nil
+		}
+		rel, err := filepath.Rel(Dir, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, "/"+strings.TrimSuffix(rel, ".sock"))
+		return nil
+	})
+	return names, err
+}
+
+// NotifyAll delivers s to all registered processes other than this one. An
+// error is returned for every peer which could not be reached.
+func NotifyAll(s Signal) error {
+	return sendAll(Message{Signal: s})
+}
+
+// PublishAll delivers ev to all registered processes other than this one.
+// Processes which did not subscribe to ev discard it.
+func PublishAll(ev Event) error {
+	msg, err := eventMessage(ev)
+	if err != nil {
+		return err
+	}
+	return sendAll(msg)
+}
+
+func sendAll(msg Message) error {
+	names, err := Registered()
 	if err != nil {
 		return err
 	}
-	if _, wErr := c.Write([]byte{byte(sig)}); wErr != nil {
-		return wErr
+	mu.Lock()
+	me := self
+	mu.Unlock()
+	var errs []string
+	for _, name := range names {
+		if name == me {
+			continue
+		}
+		if err := send(name, msg); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("notifying: %s", strings.Join(errs, "; "))
 	}
 	return nil
 }
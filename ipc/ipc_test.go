@@ -0,0 +1,214 @@
+package ipc
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	tmp, err := ioutil.TempDir("", "rout5-ipc")
+	if err != nil {
+		panic(err)
+	}
+	Dir = tmp
+	code := m.Run()
+	os.RemoveAll(tmp)
+	os.Exit(code)
+}
+
+func TestProcess(t *testing.T) {
+	if err := Register("/user/ipctest"); err != nil {
+		t.Fatal(err)
+	}
+	defer Unregister()
+
+	ch := make(chan Signal, 1)
+	if err := Notify(ch, SigUSR1); err != nil {
+		t.Fatal(err)
+	}
+	if err := Process("/user/ipctest", SigUSR1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-ch:
+		if got != SigUSR1 {
+			t.Fatalf("got %v, want %v", got, SigUSR1)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("signal not delivered")
+	}
+
+	names, err := Registered()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "/user/ipctest" {
+		t.Fatalf("Registered() = %v, want [/user/ipctest]", names)
+	}
+}
+
+func TestProcessUnregistered(t *testing.T) {
+	err := Process("/user/nonexistent", SigUSR1)
+	if !errors.Is(err, ErrNotRegistered) {
+		t.Fatalf("Process() = %v, want %v", err, ErrNotRegistered)
+	}
+}
+
+func TestNotifyAllDeadPeer(t *testing.T) {
+	// Leave a socket behind without anyone accepting connections, like a
+	// crashed daemon would.
+	path := filepath.Join(Dir, "user", "dead.sock")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetUnlinkOnClose(false)
+	l.Close()
+	defer os.Remove(path)
+
+	if err := NotifyAll(SigHUP); err == nil {
+		t.Fatalf("NotifyAll unexpectedly succeeded despite dead peer")
+	}
+}
+
+type testEvent struct {
+	Addr string `json:"addr"`
+}
+
+func (testEvent) EventName() string { return "test.event" }
+
+func TestPublish(t *testing.T) {
+	if err := Register("/user/ipctest"); err != nil {
+		t.Fatal(err)
+	}
+	defer Unregister()
+
+	ch := make(chan Message, 1)
+	if err := Subscribe(ch, "test.event"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Publish("/user/ipctest", testEvent{Addr: "192.168.42.1"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-ch:
+		var ev testEvent
+		if err := msg.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := ev.Addr, "192.168.42.1"; got != want {
+			t.Fatalf("event payload: got %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("event not delivered")
+	}
+}
+
+type unreadEvent struct{}
+
+func (unreadEvent) EventName() string { return "test.unread" }
+
+func TestPublishFullSubscriber(t *testing.T) {
+	if err := Register("/user/ipctest"); err != nil {
+		t.Fatal(err)
+	}
+	defer Unregister()
+	defer func(d time.Duration) { deliverTimeout = d }(deliverTimeout)
+	deliverTimeout = 100 * time.Millisecond
+
+	ch := make(chan Message, 1)
+	if err := Subscribe(ch, "test.unread"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Publish("/user/ipctest", unreadEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	// ch is full now, and nobody reads from it.
+	if err := Publish("/user/ipctest", unreadEvent{}); err == nil {
+		t.Fatalf("Publish unexpectedly succeeded despite a full subscriber")
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	if err := Register("/user/ipctest"); err != nil {
+		t.Fatal(err)
+	}
+	defer Unregister()
+
+	for _, tt := range []struct {
+		path string
+		want os.FileMode
+	}{
+		{Dir, os.ModeDir | 0750},
+		{filepath.Join(Dir, "user"), os.ModeDir | 0750},
+		{filepath.Join(Dir, "user", "ipctest.sock"), os.ModeSocket | 0660},
+	} {
+		fi, err := os.Stat(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode() & (os.ModeType | os.ModePerm); got != tt.want {
+			t.Errorf("%s: mode = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	l, err := Listen("/user/ctltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("ok"))
+	}()
+
+	fi, err := os.Stat(filepath.Join(Dir, "user", "ctltest.ctl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fi.Mode()&(os.ModeType|os.ModePerm), os.ModeSocket|0660; got != want {
+		t.Errorf("control socket: mode = %v, want %v", got, want)
+	}
+
+	conn, err := Dial("/user/ctltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "ok"; got != want {
+		t.Errorf("read %q, want %q", got, want)
+	}
+
+	// Control sockets are not on the bus.
+	names, err := Registered()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if name == "/user/ctltest" {
+			t.Errorf("Registered() = %v, unexpectedly contains the control socket", names)
+		}
+	}
+
+	if _, err := Dial("/user/nonexistent"); err == nil {
+		t.Errorf("Dial unexpectedly succeeded without a control socket")
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"path/filepath"
 	"sync"
 
@@ -85,12 +86,19 @@ func IPv6Net1(dir string) (string, error) {
 	if err := json.Unmarshal(b, &got); err != nil {
 		return "", err
 	}
+	return ConfigNet1(got)
+}
 
-	for _, prefix := range got.Prefixes {
+// ConfigNet1 is like IPv6Net1, but takes the DHCPv6 lease directly, e.g. as
+// received in an events.DelegatedPrefix.
+func ConfigNet1(cfg dhcp6.Config) (string, error) {
+	for _, prefix := range cfg.Prefixes {
 		// pick the first address of the prefix, e.g. address 2a02:168:4a00::1
 		// for prefix 2a02:168:4a00::/48
-		prefix.IP[len(prefix.IP)-1] = 1
-		return prefix.IP.String(), nil
+		ip := make(net.IP, len(prefix.IP))
+		copy(ip, prefix.IP)
+		ip[len(ip)-1] = 1
+		return ip.String(), nil
 	}
 	return "", fmt.Errorf("no DHCPv6 prefix obtained")
 }
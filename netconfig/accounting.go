@@ -0,0 +1,219 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+)
+
+// accountingPrefix starts the names of the counters of applyAccounting.
+const accountingPrefix = "host_"
+
+// accountingCounter returns the name of the counter of the traffic which the
+// host with MAC address hwaddr sends (tx) or receives (rx) via the uplinks,
+// e.g. host_02735300cafe_tx.
+func accountingCounter(hwaddr net.HardwareAddr, direction string) string {
+	return accountingPrefix + hex.EncodeToString(hwaddr) + "_" + direction
+}
+
+// applyAccounting adds rules to forward, the forward chain of filter, which
+// count the traffic between each DHCPv4 client of dhcp4d with an active lease
+// and the uplinks in named counters (see HostTraffic), if enabled by
+// firewallConfig.Accounting.
+//
+// Named counters are used instead of a dynamic set or meter, as the nftables
+// package cannot read back the counters of set elements. IPv6 traffic is
+// attributed by the interface identifiers of the host, like pinholes (see
+// hostIIDs), so traffic of addresses which are not in the neighbour table yet
+// is not counted.
+func applyAccounting(c batch, cfg *Config, dir string, filter *nftables.Table, forward *nftables.Chain, uplinks []string) error {
+	if cfg.firewall == nil || !cfg.firewall.Accounting {
+		return nil
+	}
+	leases, err := readLeases(dir)
+	if err != nil {
+		// Accounting is not worth failing the firewall for.
+		log.Printf("accounting: %v", err)
+		return nil
+	}
+	// Carry over the counter values, see applyPortForwardings. The table
+	// does not exist on the first run.
+	existing, _ := c.GetObj(&nftables.CounterObj{Table: filter})
+	var neighs []netlink.Neigh
+	if filter.Family == nftables.TableFamilyIPv6 {
+		if neighs, err = readNeighbors(); err != nil {
+			log.Printf("accounting: %v", err)
+		}
+	}
+	now := time.Now()
+	seen := make(map[string]bool)
+	for _, l := range leases {
+		if l.expired(now) {
+			// The address might belong to another client by now.
+			continue
+		}
+		hwaddr, err := net.ParseMAC(l.HardwareAddr)
+		if err != nil {
+			log.Printf("accounting: lease %v: %v, skipping", l.Addr, err)
+			continue
+		}
+		if seen[hwaddr.String()] {
+			continue
+		}
+		seen[hwaddr.String()] = true
+		var src, dst [][]expr.Any
+		if filter.Family == nftables.TableFamilyIPv6 {
+			iids, err := hostIIDs(hwaddr, neighs)
+			if err != nil {
+				continue
+			}
+			for _, iid := range iids {
+				src = append(src, iidExprs(iid, false))
+				dst = append(dst, iidExprs(iid, true))
+			}
+		} else {
+			ip := l.Addr.To4()
+			if ip == nil {
+				continue
+			}
+			ipnet := &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+			src, dst = [][]expr.Any{addrExprs(ipnet, false)}, [][]expr.Any{addrExprs(ipnet, true)}
+		}
+		for _, r := range []struct {
+			direction string
+			key       expr.MetaKey
+			matches   [][]expr.Any
+		}{
+			// oifname "uplink0" ip saddr 192.168.42.23 counter name "host_…_tx"
+			{"tx", expr.MetaKeyOIFNAME, src},
+			// iifname "uplink0" ip daddr 192.168.42.23 counter name "host_…_rx"
+			{"rx", expr.MetaKeyIIFNAME, dst},
+		} {
+			counter := c.AddObj(carryCounter(existing, &nftables.CounterObj{
+				Table: filter,
+				Name:  accountingCounter(hwaddr, r.direction),
+			})).(*nftables.CounterObj)
+			// The counters sum up the traffic via all uplinks.
+			for _, ifname := range uplinks {
+				for _, match := range r.matches {
+					exprs := append(ifnameExprs(r.key, ifname), match...)
+					c.AddRule(&nftables.Rule{
+						Table: filter,
+						Chain: forward,
+						Exprs: append(exprs, &expr.Objref{
+							Type: NFT_OBJECT_COUNTER,
+							Name: counter.Name,
+						}),
+					})
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// HostCounter is the traffic of a DHCPv4 client of dhcp4d, see HostTraffic.
+type HostCounter struct {
+	HardwareAddr string `json:"hardware_addr"`
+	Hostname     string `json:"hostname"`
+	Family       string `json:"family"` // ip or ip6
+
+	// Tx is the traffic which the host sent to the uplink, Rx the traffic it
+	// received from the uplink.
+	TxPackets uint64 `json:"tx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	RxBytes   uint64 `json:"rx_bytes"`
+}
+
+// HostTraffic returns the traffic counted for each DHCPv4 client of dhcp4d
+// (whose leases are found in dir), if accounting is enabled.
+func HostTraffic(dir string) ([]HostCounter, error) {
+	leases, err := readLeases(dir)
+	if err != nil {
+		return nil, err
+	}
+	hostnames := make(map[string]string)
+	for _, l := range leases {
+		hwaddr, err := net.ParseMAC(l.HardwareAddr)
+		if err != nil {
+			continue
+		}
+		hostname := l.Hostname
+		if l.HostnameOverride != "" {
+			hostname = l.HostnameOverride
+		}
+		hostnames[hex.EncodeToString(hwaddr)] = hostname
+	}
+
+	c := &nftables.Conn{}
+	var counters []HostCounter
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		objs, err := c.GetObj(&nftables.CounterObj{
+			Table: &nftables.Table{Family: family, Name: FilterTable},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("GetObj(%s %s): %v", familyString(family), FilterTable, err)
+		}
+		byHost := make(map[string]*HostCounter)
+		for _, obj := range objs {
+			co, ok := obj.(*nftables.CounterObj)
+			if !ok || !strings.HasPrefix(co.Name, accountingPrefix) {
+				continue
+			}
+			idx := strings.LastIndex(co.Name, "_")
+			key, direction := co.Name[len(accountingPrefix):idx], co.Name[idx+1:]
+			b, err := hex.DecodeString(key)
+			if err != nil {
+				continue
+			}
+			hc, ok := byHost[key]
+			if !ok {
+				hc = &HostCounter{
+					HardwareAddr: net.HardwareAddr(b).String(),
+					Hostname:     hostnames[key],
+					Family:       familyString(family),
+				}
+				byHost[key] = hc
+			}
+			switch direction {
+			case "tx":
+				hc.TxPackets, hc.TxBytes = co.Packets, co.Bytes
+			case "rx":
+				hc.RxPackets, hc.RxBytes = co.Packets, co.Bytes
+			}
+		}
+		for _, hc := range byHost {
+			counters = append(counters, *hc)
+		}
+	}
+	sort.Slice(counters, func(i, j int) bool {
+		if counters[i].HardwareAddr != counters[j].HardwareAddr {
+			return counters[i].HardwareAddr < counters[j].HardwareAddr
+		}
+		return counters[i].Family < counters[j].Family
+	})
+	return counters, nil
+}
@@ -0,0 +1,803 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/renameio"
+	"github.com/mitchellh/mapstructure"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"git.tcp.direct/kayos/rout5/config"
+)
+
+// ConfigFiles are the legacy files in the state directory which LoadConfig
+// reads when config.toml has no [netconfig] section. ImportJSON converts them.
+var ConfigFiles = []string{
+	"interfaces.json",
+	"portforwardings.json",
+	"wireguard.json",
+}
+
+// Section is the key of the config.toml section which holds the network
+// configuration, e.g.:
+//
+//	[netconfig]
+//	confirm_timeout = "5m"
+//	review = true
+//
+//	[[netconfig.interfaces]]
+//	name = "lan0"
+//	addr = "192.168.42.1/24"
+//
+//	[[netconfig.forwardings]]
+//	port = "8080"
+//	dest_addr = "192.168.42.23"
+//	dest_port = "80"
+//
+//	[netconfig.firewall]
+//	allow_tcp = ["22"]
+//
+//	[[netconfig.filter]]
+//	iif = "lan0"
+//	dst = "192.168.1.0/24"
+//	action = "drop"
+const Section = "netconfig"
+
+// section is the typed form of the Section of config.toml.
+type section struct {
+	Interfaces  []InterfaceDetails   `json:"interfaces,omitempty" mapstructure:"interfaces"`
+	Bridges     []BridgeDetails      `json:"bridges,omitempty" mapstructure:"bridges"`
+	Bonds       []BondDetails        `json:"bonds,omitempty" mapstructure:"bonds"`
+	VLANs       []VLANDetails        `json:"vlans,omitempty" mapstructure:"vlans"`
+	Forwardings []portForwarding     `json:"forwardings,omitempty" mapstructure:"forwardings"`
+	WireGuard   []wireguardInterface `json:"wireguard,omitempty" mapstructure:"wireguard"`
+	Firewall    *firewallConfig      `json:"firewall,omitempty" mapstructure:"firewall"`
+	Filter      []filterRule         `json:"filter,omitempty" mapstructure:"filter"`
+	Pinholes    []pinhole            `json:"pinholes,omitempty" mapstructure:"pinholes"`
+	SQM         *sqmConfig           `json:"sqm,omitempty" mapstructure:"sqm"`
+	MultiWAN    *multiWANConfig      `json:"multiwan,omitempty" mapstructure:"multiwan"`
+
+	Routes        []staticRoute  `json:"routes,omitempty" mapstructure:"routes"`
+	RoutingTables []routingTable `json:"routing_tables,omitempty" mapstructure:"routing_tables"`
+	RoutingRules  []routingRule  `json:"routing_rules,omitempty" mapstructure:"routing_rules"`
+
+	// ConfirmTimeout (e.g. “5m”) makes netconfigd roll back changes of the
+	// config unless they are confirmed (see “rout5 config confirm”) within
+	// the timeout, so that a change which locks out the operator reverts.
+	ConfirmTimeout string `json:"confirm_timeout,omitempty" mapstructure:"confirm_timeout"`
+
+	// Review makes netconfigd apply changes of the config only once their
+	// plan was reviewed (see “rout5 config plan” and “rout5 config apply”)
+	// instead of as soon as the config files change.
+	Review bool `json:"review,omitempty" mapstructure:"review"`
+}
+
+// Config is the validated network configuration, read from the Section of
+// config.toml or from ConfigFiles. Keeping a Config around allows re-applying
+// the last known good configuration after the config was changed to something
+// invalid.
+type Config struct {
+	file        string // config.toml, or empty when read from ConfigFiles
+	interfaces  InterfaceConfig
+	forwardings portForwardings
+	wireguard   wireguardInterfaces
+	firewall    *firewallConfig // only in config.toml, nil means defaults
+	filter      []filterRule    // only in config.toml
+	pinholes    []pinhole       // only in config.toml
+	sqm         *sqmConfig      // only in config.toml, nil means disabled
+	multiWAN    *multiWANConfig // only in config.toml, nil means failover
+
+	routes        []staticRoute  // only in config.toml
+	routingTables []routingTable // only in config.toml
+	routingRules  []routingRule  // only in config.toml
+
+	confirmTimeout time.Duration // only in config.toml, zero means disabled
+	review         bool          // only in config.toml
+}
+
+// ConfirmTimeout returns how long netconfigd waits for changes to cfg to be
+// confirmed before it rolls them back, or zero if changes need no
+// confirmation.
+func (cfg *Config) ConfirmTimeout() time.Duration {
+	return cfg.confirmTimeout
+}
+
+// Review reports whether changes to cfg must be applied via “rout5 config
+// apply” (see section.Review).
+func (cfg *Config) Review() bool {
+	return cfg.review
+}
+
+// location returns the file and field prefix under which problems with the
+// contents of the legacy JSON file name are reported.
+func (cfg *Config) location(dir, name string) (file, prefix string) {
+	if cfg.file != "" {
+		return cfg.file, Section + "."
+	}
+	return filepath.Join(dir, name), ""
+}
+
+// Problem describes an issue with a config file.
+type Problem struct {
+	File    string `json:"file"`            // e.g. /perm/interfaces.json
+	Field   string `json:"field,omitempty"` // e.g. interfaces[1].addr
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	if p.Field == "" {
+		return p.File + ": " + p.Message
+	}
+	return p.File + ": " + p.Field + ": " + p.Message
+}
+
+// Problems is the error returned by LoadConfig for invalid config files.
+type Problems []Problem
+
+func (ps Problems) Error() string {
+	msgs := make([]string, len(ps))
+	for idx, p := range ps {
+		msgs[idx] = p.String()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// problemList collects the Problems of a single file.
+type problemList struct {
+	file     string
+	prefix   string // prepended to all fields, e.g. “netconfig.”
+	problems Problems
+}
+
+func (pl *problemList) add(field, format string, args ...interface{}) {
+	if field != "" {
+		field = pl.prefix + field
+	}
+	pl.problems = append(pl.problems, Problem{
+		File:    pl.file,
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// readJSON unmarshals file fn into v. Missing files are treated as empty.
+func readJSON(fn string, v interface{}) error {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// LoadConfig reads and validates the Section of config.toml or, if
+// config.toml has none, ConfigFiles from dir. If the config is invalid, the
+// returned error is of type Problems.
+func LoadConfig(dir string) (*Config, error) {
+	cfg, problems := loadConfig(dir)
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return cfg, nil
+}
+
+// LoadJSONConfig is like LoadConfig, but always reads ConfigFiles.
+func LoadJSONConfig(dir string) (*Config, error) {
+	cfg, problems := loadJSONConfig(dir)
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return cfg, nil
+}
+
+func loadConfig(dir string) (*Config, Problems) {
+	if config.Snek.IsSet(Section) {
+		return loadTOMLConfig()
+	}
+	return loadJSONConfig(dir)
+}
+
+func loadJSONConfig(dir string) (*Config, Problems) {
+	var (
+		cfg      Config
+		problems Problems
+	)
+	for _, f := range []struct {
+		name     string
+		v        interface{}
+		validate func(*problemList)
+	}{
+		{"interfaces.json", &cfg.interfaces, cfg.interfaces.validate},
+		{"portforwardings.json", &cfg.forwardings, cfg.forwardings.validate},
+		{"wireguard.json", &cfg.wireguard, func(pl *problemList) { cfg.wireguard.validate(pl, "interfaces") }},
+	} {
+		pl := problemList{file: filepath.Join(dir, f.name)}
+		if err := readJSON(pl.file, f.v); err != nil {
+			pl.add("", "%v", err)
+		} else {
+			f.validate(&pl)
+		}
+		problems = append(problems, pl.problems...)
+	}
+	return &cfg, problems
+}
+
+func readSection() (section, error) {
+	var s section
+	err := config.Snek.UnmarshalKey(Section, &s, func(dc *mapstructure.DecoderConfig) {
+		// Report typos instead of silently ignoring them.
+		dc.ErrorUnused = true
+	})
+	return s, err
+}
+
+func loadTOMLConfig() (*Config, Problems) {
+	pl := problemList{file: config.Filename, prefix: Section + "."}
+	s, err := readSection()
+	if err != nil {
+		pl.add("", "[%s]: %v", Section, err)
+		return &Config{file: config.Filename}, pl.problems
+	}
+	return loadSection(s, &pl)
+}
+
+// loadSection validates s, reporting problems in pl.file.
+func loadSection(s section, pl *problemList) (*Config, Problems) {
+	cfg := Config{file: pl.file}
+	cfg.interfaces = InterfaceConfig{Interfaces: s.Interfaces, Bridges: s.Bridges, Bonds: s.Bonds, VLANs: s.VLANs}
+	cfg.forwardings = portForwardings{Forwardings: s.Forwardings}
+	cfg.wireguard = wireguardInterfaces{Interfaces: s.WireGuard}
+	cfg.firewall = s.Firewall
+	cfg.filter = s.Filter
+	cfg.pinholes = s.Pinholes
+	cfg.sqm = s.SQM
+	cfg.multiWAN = s.MultiWAN
+	cfg.routes = s.Routes
+	cfg.routingTables = s.RoutingTables
+	cfg.routingRules = s.RoutingRules
+	cfg.interfaces.validate(pl)
+	cfg.forwardings.validate(pl)
+	cfg.wireguard.validate(pl, "wireguard")
+	if cfg.firewall != nil {
+		cfg.firewall.validate(pl)
+	}
+	if cfg.sqm != nil {
+		cfg.sqm.validate(pl)
+	}
+	if cfg.multiWAN != nil {
+		cfg.multiWAN.validate(pl)
+	}
+	validateRouting(pl, cfg.routingTables, cfg.routingRules, cfg.routes)
+	for idx := range cfg.filter {
+		cfg.filter[idx].validate(pl, fmt.Sprintf("filter[%d]", idx))
+	}
+	for idx := range cfg.pinholes {
+		cfg.pinholes[idx].validate(pl, fmt.Sprintf("pinholes[%d]", idx))
+	}
+	if s.ConfirmTimeout != "" {
+		d, err := time.ParseDuration(s.ConfirmTimeout)
+		if err != nil {
+			pl.add("confirm_timeout", "%v", err)
+		} else if d < 0 {
+			pl.add("confirm_timeout", "must not be negative")
+		}
+		cfg.confirmTimeout = d
+	}
+	cfg.review = s.Review
+	return &cfg, pl.problems
+}
+
+// ControlSocket is the name of the ipc control socket (see ipc.Listen) on
+// which netconfigd serves “rout5 config confirm” and “rout5 config apply”.
+// Unlike the admin HTTP port, it is not reachable over the network.
+const ControlSocket = "/user/netconfigd"
+
+// ConfirmedFile is the file in the state directory which holds the last
+// confirmed config while changes await confirmation (see ConfirmTimeout), so
+// that netconfigd can roll back to it when restarting before the changes are
+// confirmed.
+const ConfirmedFile = "netconfig-confirmed.json"
+
+// WriteConfirmed persists cfg in ConfirmedFile in dir.
+func WriteConfirmed(dir string, cfg *Config) error {
+	b, err := json.Marshal(cfg.section())
+	if err != nil {
+		return err
+	}
+	return renameio.WriteFile(filepath.Join(dir, ConfirmedFile), b, 0600)
+}
+
+// LoadConfirmed reads and validates the config which WriteConfirmed
+// persisted in dir. It returns nil if there is none, i.e. if no changes await
+// confirmation.
+func LoadConfirmed(dir string) (*Config, error) {
+	fn := filepath.Join(dir, ConfirmedFile)
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var s section
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	cfg, problems := loadSection(s, &problemList{file: fn})
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return cfg, nil
+}
+
+// RemoveConfirmed removes ConfirmedFile from dir once the changes are
+// confirmed or rolled back.
+func RemoveConfirmed(dir string) error {
+	if err := os.Remove(filepath.Join(dir, ConfirmedFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (cfg *Config) section() section {
+	s := section{
+		Interfaces:  cfg.interfaces.Interfaces,
+		Bridges:     cfg.interfaces.Bridges,
+		Bonds:       cfg.interfaces.Bonds,
+		VLANs:       cfg.interfaces.VLANs,
+		Forwardings: cfg.forwardings.Forwardings,
+		WireGuard:   cfg.wireguard.Interfaces,
+		Firewall:    cfg.firewall,
+		Filter:      cfg.filter,
+		Pinholes:    cfg.pinholes,
+		SQM:         cfg.sqm,
+		MultiWAN:    cfg.multiWAN,
+
+		Routes:        cfg.routes,
+		RoutingTables: cfg.routingTables,
+		RoutingRules:  cfg.routingRules,
+
+		Review: cfg.review,
+	}
+	if cfg.confirmTimeout > 0 {
+		s.ConfirmTimeout = cfg.confirmTimeout.String()
+	}
+	return s
+}
+
+// Section returns cfg in the form of the Section of config.toml, suitable for
+// passing to config.Snek.Set.
+func (cfg *Config) Section() (map[string]interface{}, error) {
+	b, err := json.Marshal(cfg.section())
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var m map[string]interface{}
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	// Numbers would otherwise be written as floats (e.g. port = 51820.0).
+	var fixNumbers func(v interface{}) interface{}
+	fixNumbers = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case json.Number:
+			if i, err := v.Int64(); err == nil {
+				return i
+			}
+			f, _ := v.Float64()
+			return f
+		case map[string]interface{}:
+			for key, val := range v {
+				v[key] = fixNumbers(val)
+			}
+		case []interface{}:
+			for idx, val := range v {
+				v[idx] = fixNumbers(val)
+			}
+		}
+		return v
+	}
+	fixNumbers(m)
+	return m, nil
+}
+
+// Check reads the config like LoadConfig, but reports all problems instead
+// of failing on the first invalid file. In addition to what
+// LoadConfig rejects, Check reports likely mistakes which do not prevent the
+// config from being applied, e.g. port forwardings to addresses outside of
+// all LAN subnets, interfaces in config.toml or filter rules which are not
+// configured, admin ports which the firewall config attempts to expose, or
+// pinholes to hosts without a DHCP lease.
+func Check(dir string) Problems {
+	cfg, problems := loadConfig(dir)
+	if config.Filename == "" {
+		// config.Init was not called, i.e. the built-in defaults are in use.
+		return append(problems, cfg.crossCheck(dir)...)
+	}
+	for _, err := range config.Validate() {
+		problems = append(problems, Problem{
+			File:    config.Filename,
+			Field:   err.Key,
+			Message: err.Message,
+		})
+	}
+	return append(problems, cfg.crossCheck(dir)...)
+}
+
+func (cfg *Config) crossCheck(dir string) Problems {
+	// Interfaces which netconfig creates or configures by name.
+	known := make(map[string]bool)
+	for _, details := range cfg.interfaces.Interfaces {
+		known[details.Name] = true
+	}
+	for _, bridge := range cfg.interfaces.Bridges {
+		known[bridge.Name] = true
+	}
+	for _, bond := range cfg.interfaces.Bonds {
+		known[bond.Name] = true
+	}
+	for _, vlan := range cfg.interfaces.VLANs {
+		known[vlan.Name] = true
+	}
+	for _, iface := range cfg.wireguard.Interfaces {
+		known[iface.Name] = true
+	}
+	wan := make(map[string]bool)
+	where := "[" + Section + "]"
+	if cfg.file == "" {
+		where = filepath.Join(dir, "interfaces.json")
+	}
+	pl := problemList{file: config.Filename}
+	for _, list := range []struct {
+		key   string
+		names []string
+	}{
+		{"interfaces.wan_ifnames", config.Current().PreferredWAN},
+		{"interfaces.lan_ifnames", config.Current().PreferredLAN},
+	} {
+		for idx, name := range list.names {
+			if list.key == "interfaces.wan_ifnames" {
+				wan[name] = true
+			}
+			if !known[name] {
+				pl.add(fmt.Sprintf("%s[%d]", list.key, idx), "interface %q is not configured in %s", name, where)
+			}
+		}
+	}
+	problems := pl.problems
+
+	// Port forwardings must target a host on one of our LAN subnets.
+	var lans []*net.IPNet
+	ifaces := append([]InterfaceDetails{}, cfg.interfaces.Interfaces...)
+	for _, vlan := range cfg.interfaces.VLANs {
+		ifaces = append(ifaces, vlan.details())
+	}
+	for _, details := range ifaces {
+		if details.Addr == "" || wan[details.Name] {
+			continue
+		}
+		if _, ipnet, err := net.ParseCIDR(details.Addr); err == nil {
+			lans = append(lans, ipnet)
+		}
+	}
+	pl = problemList{}
+	pl.file, pl.prefix = cfg.location(dir, "portforwardings.json")
+	// Forwardings and pinholes to dhcp4d clients are only active while the
+	// client has a lease.
+	leases, leasesErr := readLeases(dir)
+	var leasesUsed bool
+	for idx, fw := range cfg.forwardings.Forwardings {
+		if fw.Disabled {
+			continue
+		}
+		if fw.DestHost != "" || fw.DestMAC != "" {
+			leasesUsed = true
+			key := "dest_host"
+			if fw.DestMAC != "" {
+				key = "dest_mac"
+				if _, err := net.ParseMAC(fw.DestMAC); err != nil {
+					continue // already reported
+				}
+			}
+			if _, err := fw.dest(leases); err != nil {
+				pl.add(fmt.Sprintf("forwardings[%d].%s", idx, key), "%v (the forwarding is inactive until the host obtains a lease)", err)
+			}
+			continue
+		}
+		ip := net.ParseIP(fw.DestAddr)
+		if ip == nil {
+			continue // already reported
+		}
+		inLAN := false
+		for _, lan := range lans {
+			if lan.Contains(ip) {
+				inLAN = true
+				break
+			}
+		}
+		if !inLAN {
+			pl.add(fmt.Sprintf("forwardings[%d].dest_addr", idx), "%s is not within any LAN subnet", fw.DestAddr)
+		}
+	}
+	if cfg.firewall != nil {
+		cfg.firewall.checkAdminPorts(&pl)
+	}
+	for idx, r := range cfg.filter {
+		for _, iface := range []struct {
+			key, name string
+		}{
+			{"iif", r.IIF},
+			{"oif", r.OIF},
+		} {
+			if iface.name != "" && !known[iface.name] {
+				pl.add(fmt.Sprintf("filter[%d].%s", idx, iface.key), "interface %q is not configured in %s", iface.name, where)
+			}
+		}
+	}
+	for idx, p := range cfg.pinholes {
+		if p.Host == "" {
+			continue
+		}
+		leasesUsed = true
+		if _, err := lookupHost(leases, p.Host); err != nil {
+			pl.add(fmt.Sprintf("pinholes[%d].host", idx), "%v (the pinhole is inactive until the host obtains a lease)", err)
+		}
+	}
+	problems = append(problems, pl.problems...)
+	if leasesUsed && leasesErr != nil {
+		problems = append(problems, Problem{
+			File:    filepath.Join(dir, "dhcp4d", "leases.json"),
+			Message: leasesErr.Error(),
+		})
+	}
+	return problems
+}
+
+func (cfg *InterfaceConfig) validate(pl *problemList) {
+	names := make(map[string]int)
+	hwaddrs := make(map[string]int)
+	for idx, details := range cfg.Interfaces {
+		field := fmt.Sprintf("interfaces[%d]", idx)
+		if details.Name == "" {
+			pl.add(field+".name", "must not be empty")
+		} else if prev, ok := names[details.Name]; ok {
+			pl.add(field+".name", "duplicate interface name %q (also used by interfaces[%d])", details.Name, prev)
+		} else {
+			names[details.Name] = idx
+		}
+		for _, hw := range []struct {
+			key, addr string
+		}{
+			{"hardware_addr", details.HardwareAddr},
+			{"spoof_hardware_addr", details.SpoofHardwareAddr},
+		} {
+			if hw.addr == "" {
+				continue
+			}
+			if _, err := net.ParseMAC(hw.addr); err != nil {
+				pl.add(field+"."+hw.key, "%v", err)
+				continue
+			}
+			key := strings.ToLower(hw.addr)
+			if prev, ok := hwaddrs[key]; ok && prev != idx {
+				pl.add(field+"."+hw.key, "duplicate hardware address %s (also used by interfaces[%d])", hw.addr, prev)
+				continue
+			}
+			hwaddrs[key] = idx
+		}
+		if details.Addr != "" {
+			if _, err := netlink.ParseAddr(details.Addr); err != nil {
+				pl.add(field+".addr", "invalid CIDR address %q, expected e.g. 192.168.42.1/24", details.Addr)
+			}
+		}
+	}
+	bridges := make(map[string]int)
+	for idx, bridge := range cfg.Bridges {
+		field := fmt.Sprintf("bridges[%d]", idx)
+		if bridge.Name == "" {
+			pl.add(field+".name", "must not be empty")
+		} else if prev, ok := bridges[bridge.Name]; ok {
+			pl.add(field+".name", "duplicate bridge name %q (also used by bridges[%d])", bridge.Name, prev)
+		} else {
+			bridges[bridge.Name] = idx
+		}
+		for i, hwaddr := range bridge.InterfaceHardwareAddrs {
+			if _, err := net.ParseMAC(hwaddr); err != nil {
+				pl.add(fmt.Sprintf("%s.interface_hardware_addrs[%d]", field, i), "%v", err)
+			}
+		}
+		for i, name := range bridge.InterfaceNames {
+			if name == "" {
+				pl.add(fmt.Sprintf("%s.interface_names[%d]", field, i), "must not be empty")
+			}
+		}
+	}
+	bonds := make(map[string]int)
+	for idx, bond := range cfg.Bonds {
+		field := fmt.Sprintf("bonds[%d]", idx)
+		if bond.Name == "" {
+			pl.add(field+".name", "must not be empty")
+		} else if prev, ok := bridges[bond.Name]; ok {
+			pl.add(field+".name", "duplicate interface name %q (also used by bridges[%d])", bond.Name, prev)
+		} else if prev, ok := bonds[bond.Name]; ok {
+			pl.add(field+".name", "duplicate bond name %q (also used by bonds[%d])", bond.Name, prev)
+		} else {
+			bonds[bond.Name] = idx
+		}
+		if bond.Mode != "" && bond.mode() == netlink.BOND_MODE_UNKNOWN {
+			pl.add(field+".mode", "unknown mode %q, expected e.g. 802.3ad or active-backup", bond.Mode)
+		}
+		if bond.Miimon < 0 {
+			pl.add(field+".miimon", "must not be negative (got %d)", bond.Miimon)
+		}
+		for i, hwaddr := range bond.InterfaceHardwareAddrs {
+			if _, err := net.ParseMAC(hwaddr); err != nil {
+				pl.add(fmt.Sprintf("%s.interface_hardware_addrs[%d]", field, i), "%v", err)
+			}
+		}
+	}
+	type parentID struct {
+		parent string
+		id     int
+	}
+	ids := make(map[parentID]int)
+	vlans := make(map[string]int)
+	for idx, vlan := range cfg.VLANs {
+		field := fmt.Sprintf("vlans[%d]", idx)
+		if vlan.Name == "" {
+			pl.add(field+".name", "must not be empty")
+		} else if prev, ok := names[vlan.Name]; ok {
+			pl.add(field+".name", "duplicate interface name %q (also used by interfaces[%d])", vlan.Name, prev)
+		} else if prev, ok := bridges[vlan.Name]; ok {
+			pl.add(field+".name", "duplicate interface name %q (also used by bridges[%d])", vlan.Name, prev)
+		} else if prev, ok := bonds[vlan.Name]; ok {
+			pl.add(field+".name", "duplicate interface name %q (also used by bonds[%d])", vlan.Name, prev)
+		} else if prev, ok := vlans[vlan.Name]; ok {
+			pl.add(field+".name", "duplicate VLAN name %q (also used by vlans[%d])", vlan.Name, prev)
+		} else {
+			vlans[vlan.Name] = idx
+		}
+		if vlan.Parent == "" {
+			pl.add(field+".parent", "must not be empty")
+		} else if vlan.Parent == vlan.Name {
+			pl.add(field+".parent", "must not be the VLAN itself")
+		}
+		if vlan.ID < 1 || vlan.ID > 4094 {
+			pl.add(field+".id", "must be between 1 and 4094 (got %d)", vlan.ID)
+		} else if prev, ok := ids[parentID{vlan.Parent, vlan.ID}]; ok {
+			pl.add(field+".id", "duplicate VLAN %d on %s (also used by vlans[%d])", vlan.ID, vlan.Parent, prev)
+		} else {
+			ids[parentID{vlan.Parent, vlan.ID}] = idx
+		}
+		if vlan.Addr != "" {
+			if _, err := netlink.ParseAddr(vlan.Addr); err != nil {
+				pl.add(field+".addr", "invalid CIDR address %q, expected e.g. 192.168.42.1/24", vlan.Addr)
+			}
+		}
+	}
+}
+
+func (cfg *portForwardings) validate(pl *problemList) {
+	for idx, fw := range cfg.Forwardings {
+		field := fmt.Sprintf("forwardings[%d]", idx)
+		for _, proto := range strings.Split(fw.Proto, ",") {
+			if _, err := parseProto(proto); err != nil {
+				pl.add(field+".proto", "%v", err)
+			}
+		}
+		for _, port := range []struct {
+			key, val string
+		}{
+			{"port", fw.Port},
+			{"dest_port", fw.DestPort},
+		} {
+			if _, _, err := parsePort(port.val); err != nil {
+				pl.add(field+"."+port.key, "%v", err)
+			}
+		}
+		var set int
+		for _, dest := range []string{fw.DestAddr, fw.DestHost, fw.DestMAC} {
+			if dest != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			pl.add(field, "exactly one of dest_addr, dest_host and dest_mac must be set (got %d)", set)
+		}
+		if fw.DestAddr != "" {
+			if ip := net.ParseIP(fw.DestAddr); ip == nil || ip.To4() == nil {
+				pl.add(field+".dest_addr", "malformed address %q, expected IPv4 address", fw.DestAddr)
+			}
+		}
+		if fw.DestMAC != "" {
+			if _, err := net.ParseMAC(fw.DestMAC); err != nil {
+				pl.add(field+".dest_mac", "%v", err)
+			}
+		}
+		for i, src := range fw.AllowedSrc {
+			if _, ipnet, err := net.ParseCIDR(src); err != nil || ipnet.IP.To4() == nil {
+				pl.add(fmt.Sprintf("%s.allowed_src[%d]", field, i), "invalid CIDR address %q, expected e.g. 203.0.113.0/24", src)
+			}
+		}
+		if fw.RateLimit < 0 {
+			pl.add(field+".rate_limit", "invalid rate limit %d, expected connections per second", fw.RateLimit)
+		}
+		if fw.Counter != "" && !counterNameRe.MatchString(fw.Counter) {
+			pl.add(field+".counter", "invalid counter name %q, expected letters, digits, _ and - (e.g. nas_ssh)", fw.Counter)
+		}
+	}
+}
+
+// validate checks the WireGuard interfaces, which are named list in problems
+// (“interfaces” in wireguard.json, “wireguard” in config.toml).
+func (cfg *wireguardInterfaces) validate(pl *problemList, list string) {
+	names := make(map[string]int)
+	for idx, iface := range cfg.Interfaces {
+		field := fmt.Sprintf("%s[%d]", list, idx)
+		if iface.Name == "" {
+			pl.add(field+".name", "must not be empty")
+		} else if prev, ok := names[iface.Name]; ok {
+			pl.add(field+".name", "duplicate interface name %q (also used by %s[%d])", iface.Name, list, prev)
+		} else {
+			names[iface.Name] = idx
+		}
+		if _, err := parseKey(iface.PrivateKey); err != nil {
+			pl.add(field+".private_key", "%v", err)
+		}
+		if iface.Port < 0 || iface.Port > 65535 {
+			pl.add(field+".port", "invalid port %d", iface.Port)
+		}
+		for i, p := range iface.Peers {
+			peer := fmt.Sprintf("%s.peers[%d]", field, i)
+			if _, err := parseKey(p.PublicKey); err != nil {
+				pl.add(peer+".public_key", "%v", err)
+			}
+			for j, ip := range p.AllowedIPs {
+				if _, _, err := net.ParseCIDR(ip); err != nil {
+					pl.add(fmt.Sprintf("%s.allowed_ips[%d]", peer, j), "invalid CIDR address %q, expected e.g. 10.0.137.0/24", ip)
+				}
+			}
+			if p.Endpoint != "" {
+				if _, _, err := net.SplitHostPort(p.Endpoint); err != nil {
+					pl.add(peer+".endpoint", "%v", err)
+				}
+			}
+		}
+	}
+}
+
+func parseKey(s string) (wgtypes.Key, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("invalid base64-encoded key: %v", err)
+	}
+	return wgtypes.NewKey(b)
+}
@@ -0,0 +1,375 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// filterRule is a user-defined firewall rule, read from [[netconfig.filter]]
+// in config.toml, e.g.:
+//
+//	[[netconfig.filter]]
+//	chain = "forward"
+//	iif = "uplink0"
+//	proto = "tcp"
+//	dst = "192.168.42.23/32"
+//	dport = "22"
+//	action = "accept"
+//
+// All specified matches must apply. Rules with an IPv4 (IPv6) address or with
+// proto icmp (icmpv6) are only added to the ip (ip6) filter table, all others
+// to both.
+type filterRule struct {
+	// Chain is “forward” (the default) for traffic passing through the
+	// router, or “input” for traffic destined to the router itself. Input
+	// rules are evaluated before the built-in input rules, forward rules
+	// after the built-in forward rules.
+	Chain   string   `json:"chain,omitempty" mapstructure:"chain"`
+	IIF     string   `json:"iif,omitempty" mapstructure:"iif"`           // e.g. “lan0”
+	OIF     string   `json:"oif,omitempty" mapstructure:"oif"`           // e.g. “uplink0”
+	Src     string   `json:"src,omitempty" mapstructure:"src"`           // e.g. “192.168.42.0/24”
+	Dst     string   `json:"dst,omitempty" mapstructure:"dst"`           // e.g. “2001:db8::/64”
+	Proto   string   `json:"proto,omitempty" mapstructure:"proto"`       // tcp, udp, icmp or icmpv6
+	SPort   string   `json:"sport,omitempty" mapstructure:"sport"`       // e.g. “1024-65535”, tcp/udp only
+	DPort   string   `json:"dport,omitempty" mapstructure:"dport"`       // e.g. “22”, tcp/udp only
+	CtState []string `json:"ct_state,omitempty" mapstructure:"ct_state"` // e.g. [“new”]
+
+	// Action is accept, drop or reject, which end rule evaluation, or log or
+	// counter, which continue with the next rule.
+	Action    string `json:"action" mapstructure:"action"`
+	LogPrefix string `json:"log_prefix,omitempty" mapstructure:"log_prefix"` // for action log
+}
+
+var ctStates = map[string]uint32{
+	"invalid":     expr.CtStateBitINVALID,
+	"established": expr.CtStateBitESTABLISHED,
+	"related":     expr.CtStateBitRELATED,
+	"new":         expr.CtStateBitNEW,
+	"untracked":   expr.CtStateBitUNTRACKED,
+}
+
+func parseFilterProto(proto string) (p uint8, family nftables.TableFamily, _ error) {
+	switch proto {
+	case "":
+		return 0, 0, nil
+	case "tcp":
+		return unix.IPPROTO_TCP, 0, nil
+	case "udp":
+		return unix.IPPROTO_UDP, 0, nil
+	case "icmp":
+		return unix.IPPROTO_ICMP, nftables.TableFamilyIPv4, nil
+	case "icmpv6":
+		return unix.IPPROTO_ICMPV6, nftables.TableFamilyIPv6, nil
+	}
+	return 0, 0, fmt.Errorf(`unknown proto %q, expected "tcp", "udp", "icmp" or "icmpv6"`, proto)
+}
+
+func cidrFamily(ipnet *net.IPNet) nftables.TableFamily {
+	if ipnet.IP.To4() != nil {
+		return nftables.TableFamilyIPv4
+	}
+	return nftables.TableFamilyIPv6
+}
+
+// family returns the only table family to which r applies, or 0 if r applies
+// to both ip and ip6.
+func (r *filterRule) family() (nftables.TableFamily, error) {
+	var family nftables.TableFamily
+	restrict := func(f nftables.TableFamily, what string) error {
+		if family != 0 && f != family {
+			return fmt.Errorf("%s contradicts the other matches (mixed IPv4/IPv6)", what)
+		}
+		family = f
+		return nil
+	}
+	for _, addr := range []struct {
+		key, val string
+	}{
+		{"src", r.Src},
+		{"dst", r.Dst},
+	} {
+		if addr.val == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(addr.val)
+		if err != nil {
+			return 0, fmt.Errorf("%s: invalid CIDR address %q, expected e.g. 192.168.42.0/24", addr.key, addr.val)
+		}
+		if err := restrict(cidrFamily(ipnet), addr.key); err != nil {
+			return 0, err
+		}
+	}
+	_, f, err := parseFilterProto(r.Proto)
+	if err != nil {
+		return 0, err
+	}
+	if f != 0 {
+		if err := restrict(f, "proto "+r.Proto); err != nil {
+			return 0, err
+		}
+	}
+	return family, nil
+}
+
+func (r *filterRule) validate(pl *problemList, field string) {
+	switch r.Chain {
+	case "", "forward", "input":
+	default:
+		pl.add(field+".chain", `unknown chain %q, expected "forward" or "input"`, r.Chain)
+	}
+	if r.Chain == "input" && r.OIF != "" {
+		pl.add(field+".oif", "not available in the input chain")
+	}
+	if _, err := r.family(); err != nil {
+		pl.add(field, "%v", err)
+	}
+	for _, port := range []struct {
+		key, val string
+	}{
+		{"sport", r.SPort},
+		{"dport", r.DPort},
+	} {
+		if port.val == "" {
+			continue
+		}
+		if r.Proto != "tcp" && r.Proto != "udp" {
+			pl.add(field+"."+port.key, `requires proto "tcp" or "udp"`)
+			continue
+		}
+		if _, _, err := parsePort(port.val); err != nil {
+			pl.add(field+"."+port.key, "%v", err)
+		}
+	}
+	for idx, state := range r.CtState {
+		if _, ok := ctStates[state]; !ok {
+			pl.add(fmt.Sprintf("%s.ct_state[%d]", field, idx), "unknown state %q, expected one of new, established, related, invalid, untracked", state)
+		}
+	}
+	switch r.Action {
+	case "accept", "drop", "reject", "log", "counter":
+	case "":
+		pl.add(field+".action", "must not be empty")
+	default:
+		pl.add(field+".action", `unknown action %q, expected "accept", "drop", "reject", "log" or "counter"`, r.Action)
+	}
+	if r.LogPrefix != "" && r.Action != "log" {
+		pl.add(field+".log_prefix", `requires action "log"`)
+	}
+}
+
+func ifnameExprs(key expr.MetaKey, ifname string) []expr.Any {
+	return []expr.Any{
+		// [ meta load iifname => reg 1 ]
+		&expr.Meta{Key: key, Register: 1},
+		// [ cmp eq reg 1 0x306e616c 0x00000000 0x00000000 0x00000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     nfifname(ifname),
+		},
+	}
+}
+
+// addrExprs matches the source (dst == false) or destination address of the
+// network header against ipnet.
+func addrExprs(ipnet *net.IPNet, dst bool) []expr.Any {
+	ip := ipnet.IP.To4()
+	offset := uint32(12) // ip saddr
+	if dst {
+		offset = 16
+	}
+	if ip == nil {
+		ip = ipnet.IP.To16()
+		offset = 8 // ip6 saddr
+		if dst {
+			offset = 24
+		}
+	}
+	ex := []expr.Any{
+		// [ payload load 4b @ network header + 12 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          uint32(len(ip)),
+		},
+	}
+	if ones, bits := ipnet.Mask.Size(); ones != bits {
+		// [ bitwise reg 1 = (reg=1 & 0x00ffffff ) ^ 0x00000000 ]
+		ex = append(ex, &expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            uint32(len(ip)),
+			Mask:           ipnet.Mask,
+			Xor:            make([]byte, len(ip)),
+		})
+	}
+	// [ cmp eq reg 1 0x002aa8c0 ]
+	return append(ex, &expr.Cmp{
+		Op:       expr.CmpOpEq,
+		Register: 1,
+		Data:     ip,
+	})
+}
+
+// exprs compiles r into nftables expressions for a table of family.
+func (r *filterRule) exprs(family nftables.TableFamily) ([]expr.Any, error) {
+	var ex []expr.Any
+	if r.IIF != "" {
+		ex = append(ex, ifnameExprs(expr.MetaKeyIIFNAME, r.IIF)...)
+	}
+	if r.OIF != "" {
+		ex = append(ex, ifnameExprs(expr.MetaKeyOIFNAME, r.OIF)...)
+	}
+	for _, addr := range []struct {
+		val string
+		dst bool
+	}{
+		{r.Src, false},
+		{r.Dst, true},
+	} {
+		if addr.val == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(addr.val)
+		if err != nil {
+			return nil, err
+		}
+		ex = append(ex, addrExprs(ipnet, addr.dst)...)
+	}
+	proto, _, err := parseFilterProto(r.Proto)
+	if err != nil {
+		return nil, err
+	}
+	if proto != 0 {
+		ex = append(ex, l4protoExprs(proto)...)
+	}
+	for _, port := range []struct {
+		val    string
+		offset uint32
+	}{
+		{r.SPort, 0},
+		{r.DPort, 2},
+	} {
+		if port.val == "" {
+			continue
+		}
+		min, max, err := parsePort(port.val)
+		if err != nil {
+			return nil, err
+		}
+		ex = append(ex, portExprs(port.offset, min, max)...)
+	}
+	if len(r.CtState) > 0 {
+		var mask uint32
+		for _, state := range r.CtState {
+			bit, ok := ctStates[state]
+			if !ok {
+				return nil, fmt.Errorf("unknown ct state %q", state)
+			}
+			mask |= bit
+		}
+		ex = append(ex, ctStateExprs(mask)...)
+	}
+	switch r.Action {
+	case "accept":
+		ex = append(ex, verdictExpr(expr.VerdictAccept))
+	case "drop":
+		ex = append(ex, verdictExpr(expr.VerdictDrop))
+	case "reject":
+		if proto == unix.IPPROTO_TCP {
+			// reject with tcp reset
+			ex = append(ex, &expr.Reject{Type: unix.NFT_REJECT_TCP_RST})
+		} else {
+			// reject with icmp(v6) port-unreachable
+			code := uint8(3) // ICMP_PORT_UNREACH
+			if family == nftables.TableFamilyIPv6 {
+				code = 4 // ICMPV6_PORT_UNREACH
+			}
+			ex = append(ex, &expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: code})
+		}
+	case "log":
+		l := &expr.Log{}
+		if r.LogPrefix != "" {
+			l.Key = 1 << unix.NFTA_LOG_PREFIX
+			l.Data = []byte(r.LogPrefix)
+		}
+		ex = append(ex, l)
+	case "counter":
+		ex = append(ex, &expr.Counter{})
+	default:
+		return nil, fmt.Errorf("unknown action %q", r.Action)
+	}
+	return ex, nil
+}
+
+func ctStateExprs(mask uint32) []expr.Any {
+	return []expr.Any{
+		// [ ct load state => reg 1 ]
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		// [ bitwise reg 1 = (reg=1 & 0x00000006 ) ^ 0x00000000 ]
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(mask),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		// [ cmp neq reg 1 0x00000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpNeq,
+			Register: 1,
+			Data:     binaryutil.NativeEndian.PutUint32(0),
+		},
+	}
+}
+
+// applyFilterRules appends the rules of cfg for chainName (“forward” or
+// “input”) to chain in filter, an ip or ip6 table.
+func applyFilterRules(c batch, cfg *Config, filter *nftables.Table, chain *nftables.Chain, chainName string) error {
+	for idx, r := range cfg.filter {
+		name := r.Chain
+		if name == "" {
+			name = "forward"
+		}
+		if name != chainName {
+			continue
+		}
+		family, err := r.family()
+		if err != nil {
+			return fmt.Errorf("filter[%d]: %v", idx, err)
+		}
+		if family != 0 && family != filter.Family {
+			continue
+		}
+		exprs, err := r.exprs(filter.Family)
+		if err != nil {
+			return fmt.Errorf("filter[%d]: %v", idx, err)
+		}
+		c.AddRule(&nftables.Rule{
+			Table: filter,
+			Chain: chain,
+			Exprs: exprs,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,429 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+
+	"git.tcp.direct/kayos/rout5/config"
+)
+
+// firewallConfig configures the input chain, i.e. which traffic arriving on
+// the uplink may reach the router itself. Traffic from trusted interfaces (see
+// Config.trustedInterfaces) is accepted, except for the admin ports, which
+// are only reachable from loopback and the admin interfaces (see
+// Config.adminInterfaces). Traffic from all other interfaces is treated like
+// traffic from the uplink. It is read from [netconfig.firewall] in
+// config.toml:
+//
+//	[netconfig.firewall]
+//	input_policy = "drop"
+//	forward6_policy = "drop"
+//	allow_tcp = ["22"]
+//	allow_udp = ["60000-61000"]
+//	trusted_interfaces = ["guest0", "wg0"]
+//	admin_interfaces = ["lan0"]
+//	admin_ports = [8066, 7733]
+type firewallConfig struct {
+	// InputPolicy applies to traffic from the uplink which no rule accepts:
+	// “drop” (the default) or “accept”. Admin ports are never reachable from
+	// the uplink, regardless of the policy.
+	InputPolicy string `json:"input_policy,omitempty" mapstructure:"input_policy"`
+
+	// Forward6Policy applies to IPv6 traffic from the uplink to the LAN which
+	// is neither a reply nor permitted by a pinhole: “drop” (the default) or
+	// “accept”, which exposes all LAN hosts with global IPv6 addresses.
+	Forward6Policy string `json:"forward6_policy,omitempty" mapstructure:"forward6_policy"`
+
+	// DropPing drops ICMP echo requests from the uplink (to the router and,
+	// for IPv6, to LAN hosts), which are accepted by default.
+	DropPing bool `json:"drop_ping,omitempty" mapstructure:"drop_ping"`
+
+	// AllowTCP and AllowUDP list additional ports (e.g. “22”) or port ranges
+	// (e.g. “60000-61000”) which are reachable from the uplink.
+	AllowTCP []string `json:"allow_tcp,omitempty" mapstructure:"allow_tcp"`
+	AllowUDP []string `json:"allow_udp,omitempty" mapstructure:"allow_udp"`
+
+	// TrustedInterfaces lists interfaces in addition to loopback and the LAN
+	// interfaces from which all traffic but the admin ports is accepted, e.g.
+	// further bridges, VLANs or WireGuard interfaces. Uplinks cannot be
+	// trusted.
+	TrustedInterfaces []string `json:"trusted_interfaces,omitempty" mapstructure:"trusted_interfaces"`
+
+	// AdminInterfaces lists the interfaces from which the admin ports are
+	// reachable, in addition to loopback. Defaults to the LAN interfaces.
+	// Uplinks cannot be admin interfaces.
+	AdminInterfaces []string `json:"admin_interfaces,omitempty" mapstructure:"admin_interfaces"`
+
+	// AdminPorts restricts the admin ports which are reachable from the
+	// admin interfaces to the listed ones (e.g. 8066 for netconfigd). All
+	// admin ports are reachable if empty. Loopback can always reach all of
+	// them.
+	AdminPorts []int `json:"admin_ports,omitempty" mapstructure:"admin_ports"`
+
+	// Accounting counts the traffic between each DHCPv4 client of dhcp4d
+	// and the uplink, see applyAccounting.
+	Accounting bool `json:"accounting,omitempty" mapstructure:"accounting"`
+}
+
+func (fw *firewallConfig) validate(pl *problemList) {
+	for _, policy := range []struct {
+		key, val string
+	}{
+		{"input_policy", fw.InputPolicy},
+		{"forward6_policy", fw.Forward6Policy},
+	} {
+		switch policy.val {
+		case "", "drop", "accept":
+		default:
+			pl.add("firewall."+policy.key, `unknown policy %q, expected "drop" or "accept"`, policy.val)
+		}
+	}
+	for _, list := range []struct {
+		key     string
+		ifnames []string
+	}{
+		{"trusted_interfaces", fw.TrustedInterfaces},
+		{"admin_interfaces", fw.AdminInterfaces},
+	} {
+		for idx, ifname := range list.ifnames {
+			field := fmt.Sprintf("firewall.%s[%d]", list.key, idx)
+			switch {
+			case ifname == "":
+				pl.add(field, "must not be empty")
+			case isUplink(ifname, nil):
+				pl.add(field, "%q is an uplink (see interfaces.wan_ifnames), which cannot be trusted", ifname)
+			}
+		}
+	}
+	for _, list := range []struct {
+		key   string
+		ports []string
+	}{
+		{"allow_tcp", fw.AllowTCP},
+		{"allow_udp", fw.AllowUDP},
+	} {
+		for idx, port := range list.ports {
+			if _, _, err := parsePort(port); err != nil {
+				pl.add(fmt.Sprintf("firewall.%s[%d]", list.key, idx), "%v", err)
+			}
+		}
+	}
+}
+
+// adminPorts are the ports of the rout5 daemons’ admin interfaces, which are
+// only reachable from loopback and the admin interfaces.
+func adminPorts() []uint16 {
+	return []uint16{
+		uint16(config.NetconfigdPort),
+		uint16(config.DHCP4dPort),
+		uint16(config.DiagdPort),
+		uint16(config.CapturedPort),
+		uint16(config.SupervisorPort),
+	}
+}
+
+func l4protoExprs(proto uint8) []expr.Any {
+	return []expr.Any{
+		// [ meta load l4proto => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		// [ cmp eq reg 1 0x00000011 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{proto},
+		},
+	}
+}
+
+// portExprs matches the transport header port at offset (0 for the source
+// port, 2 for the destination port) against the range min-max.
+func portExprs(offset uint32, min, max uint16) []expr.Any {
+	ex := []expr.Any{
+		// [ payload load 2b @ transport header + 2 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       offset,
+			Len:          2,
+		},
+	}
+	if min == max {
+		// [ cmp eq reg 1 0x0000e60f ]
+		return append(ex, &expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     binaryutil.BigEndian.PutUint16(min),
+		})
+	}
+	return append(ex,
+		// [ cmp gte reg 1 0x0000e60f ]
+		&expr.Cmp{
+			Op:       expr.CmpOpGte,
+			Register: 1,
+			Data:     binaryutil.BigEndian.PutUint16(min),
+		},
+		// [ cmp lte reg 1 0x0000fa0f ]
+		&expr.Cmp{
+			Op:       expr.CmpOpLte,
+			Register: 1,
+			Data:     binaryutil.BigEndian.PutUint16(max),
+		})
+}
+
+// icmpTypeExprs matches ICMP (or ICMPv6, depending on proto) messages of type
+// typ, followed by the verdict v.
+func icmpTypeExprs(proto, typ uint8, v *expr.Verdict) []expr.Any {
+	return append(l4protoExprs(proto),
+		// [ payload load 1b @ transport header + 0 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       0,
+			Len:          1,
+		},
+		// [ cmp eq reg 1 0x00000087 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{typ},
+		},
+		v)
+}
+
+func verdictExpr(kind expr.VerdictKind) *expr.Verdict {
+	return &expr.Verdict{Kind: kind}
+}
+
+// applyInput adds the input chain to filter, an ip or ip6 table.
+func applyInput(c batch, cfg *Config, filter *nftables.Table, uplinks []string) error {
+	var fw firewallConfig
+	if cfg.firewall != nil {
+		fw = *cfg.firewall
+	}
+	policy := nftables.ChainPolicyDrop
+	if fw.InputPolicy == "accept" {
+		policy = nftables.ChainPolicyAccept
+	}
+	input := c.AddChain(&nftables.Chain{
+		Name:     "input",
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+		Table:    filter,
+		Type:     nftables.ChainTypeFilter,
+		Policy:   &policy,
+	})
+	add := func(exprs ...expr.Any) {
+		c.AddRule(&nftables.Rule{
+			Table: filter,
+			Chain: input,
+			Exprs: exprs,
+		})
+	}
+
+	// iifname "wan0" drop
+	for _, ifname := range cfg.uplinkParents(uplinks) {
+		add(append(ifnameExprs(expr.MetaKeyIIFNAME, ifname),
+			verdictExpr(expr.VerdictDrop))...)
+	}
+
+	// ct state established,related accept
+	add(append(ctStateExprs(expr.CtStateBitESTABLISHED|expr.CtStateBitRELATED),
+		verdictExpr(expr.VerdictAccept))...)
+
+	// User-defined rules (see filterRule) take precedence over the rules
+	// below, e.g. to restrict access from the LAN.
+	if err := applyFilterRules(c, cfg, filter, input, "input"); err != nil {
+		return err
+	}
+
+	// Loopback may reach everything, e.g. for the rout5 command.
+	add(append(ifnameExprs(expr.MetaKeyIIFNAME, "lo"),
+		verdictExpr(expr.VerdictAccept))...)
+
+	// Admin ports excluded by firewall.admin_ports are unreachable from
+	// everywhere else.
+	open := fw.openAdminPorts()
+	for _, port := range adminPorts() {
+		if !open[port] {
+			add(append(append(l4protoExprs(unix.IPPROTO_TCP),
+				portExprs(2, port, port)...),
+				verdictExpr(expr.VerdictDrop))...)
+		}
+	}
+
+	// Trusted admin interfaces (by default the LAN interfaces) may reach
+	// everything else, other admin interfaces only the admin ports.
+	trusted := make(map[string]bool)
+	for _, ifname := range cfg.trustedInterfaces(uplinks) {
+		trusted[ifname] = true
+	}
+	admin := make(map[string]bool)
+	for _, ifname := range cfg.adminInterfaces(uplinks) {
+		admin[ifname] = true
+		if trusted[ifname] {
+			add(append(ifnameExprs(expr.MetaKeyIIFNAME, ifname),
+				verdictExpr(expr.VerdictAccept))...)
+			continue
+		}
+		for _, port := range adminPorts() {
+			if open[port] {
+				add(append(append(append(ifnameExprs(expr.MetaKeyIIFNAME, ifname),
+					l4protoExprs(unix.IPPROTO_TCP)...),
+					portExprs(2, port, port)...),
+					verdictExpr(expr.VerdictAccept))...)
+			}
+		}
+	}
+
+	// Admin ports are dropped explicitly so that neither trusted interfaces,
+	// the accept policy nor allow_tcp can expose them.
+	for _, port := range adminPorts() {
+		if open[port] {
+			add(append(append(l4protoExprs(unix.IPPROTO_TCP),
+				portExprs(2, port, port)...),
+				verdictExpr(expr.VerdictDrop))...)
+		}
+	}
+
+	// The remaining trusted interfaces may reach everything but the admin
+	// ports.
+	for _, ifname := range cfg.trustedInterfaces(uplinks) {
+		if ifname == "lo" || admin[ifname] {
+			continue
+		}
+		add(append(ifnameExprs(expr.MetaKeyIIFNAME, ifname),
+			verdictExpr(expr.VerdictAccept))...)
+	}
+
+	// ICMP types without which IPv4/IPv6 do not work well, see RFC 4890.
+	icmpProto := uint8(unix.IPPROTO_ICMP)
+	icmpTypes := []uint8{
+		3,  // destination-unreachable (includes fragmentation-needed)
+		11, // time-exceeded
+		12, // parameter-problem
+	}
+	echoRequest := uint8(8)
+	if filter.Family == nftables.TableFamilyIPv6 {
+		icmpProto = unix.IPPROTO_ICMPV6
+		icmpTypes = []uint8{
+			1,   // destination-unreachable
+			2,   // packet-too-big
+			3,   // time-exceeded
+			4,   // parameter-problem
+			134, // nd-router-advert
+			135, // nd-neighbor-solicit
+			136, // nd-neighbor-advert
+		}
+		echoRequest = 128
+	}
+	if !fw.DropPing {
+		icmpTypes = append([]uint8{echoRequest}, icmpTypes...)
+	}
+	for _, typ := range icmpTypes {
+		add(icmpTypeExprs(icmpProto, typ, verdictExpr(expr.VerdictAccept))...)
+	}
+
+	// Replies to our DHCP client (dhcp4 or dhcp6) are not matched by
+	// conntrack: requests are sent to a broadcast (multicast) address.
+	server, client := uint16(67), uint16(68)
+	if filter.Family == nftables.TableFamilyIPv6 {
+		server, client = 547, 546
+	}
+	add(append(append(append(l4protoExprs(unix.IPPROTO_UDP),
+		portExprs(0, server, server)...),
+		portExprs(2, client, client)...),
+		verdictExpr(expr.VerdictAccept))...)
+
+	wgPorts := make(map[int]bool)
+	for _, iface := range cfg.wireguard.Interfaces {
+		if iface.Port == 0 || wgPorts[iface.Port] {
+			continue
+		}
+		wgPorts[iface.Port] = true
+		add(append(append(l4protoExprs(unix.IPPROTO_UDP),
+			portExprs(2, uint16(iface.Port), uint16(iface.Port))...),
+			verdictExpr(expr.VerdictAccept))...)
+	}
+
+	for _, list := range []struct {
+		proto uint8
+		ports []string
+	}{
+		{unix.IPPROTO_TCP, fw.AllowTCP},
+		{unix.IPPROTO_UDP, fw.AllowUDP},
+	} {
+		for _, port := range list.ports {
+			min, max, err := parsePort(port)
+			if err != nil {
+				return err
+			}
+			add(append(append(l4protoExprs(list.proto),
+				portExprs(2, min, max)...),
+				verdictExpr(expr.VerdictAccept))...)
+		}
+	}
+	return nil
+}
+
+// openAdminPorts returns the admin ports which are reachable from the admin
+// interfaces (see firewallConfig.AdminPorts).
+func (fw *firewallConfig) openAdminPorts() map[uint16]bool {
+	open := make(map[uint16]bool)
+	for _, port := range adminPorts() {
+		open[port] = fw == nil || len(fw.AdminPorts) == 0
+	}
+	if fw != nil {
+		for _, port := range fw.AdminPorts {
+			if _, ok := open[uint16(port)]; ok {
+				open[uint16(port)] = true
+			}
+		}
+	}
+	return open
+}
+
+// checkAdminPorts reports allow_tcp entries which cover admin ports, which
+// remain unreachable from the uplink, and admin_ports entries which are not
+// admin ports.
+func (fw *firewallConfig) checkAdminPorts(pl *problemList) {
+	open := fw.openAdminPorts()
+	for idx, port := range fw.AdminPorts {
+		if _, ok := open[uint16(port)]; !ok || port < 1 || port > 65535 {
+			pl.add(fmt.Sprintf("firewall.admin_ports[%d]", idx), "%d is not the port of a rout5 daemon (see [ports] in config.toml)", port)
+		}
+	}
+	for idx, port := range fw.AllowTCP {
+		min, max, err := parsePort(port)
+		if err != nil {
+			continue // already reported
+		}
+		var covered []string
+		for _, admin := range adminPorts() {
+			if admin >= min && admin <= max {
+				covered = append(covered, fmt.Sprint(admin))
+			}
+		}
+		if len(covered) > 0 {
+			pl.add(fmt.Sprintf("firewall.allow_tcp[%d]", idx), "admin port(s) %s are only reachable from the admin interfaces", strings.Join(covered, ", "))
+		}
+	}
+}
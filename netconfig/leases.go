@@ -0,0 +1,178 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dhcpLease is the subset of a dhcp4d lease (see dhcp4d.Lease, which cannot
+// be imported here) which netconfig uses to resolve hostnames.
+type dhcpLease struct {
+	Addr             net.IP    `json:"addr"`
+	HardwareAddr     string    `json:"hardware_addr"`
+	Hostname         string    `json:"hostname"`
+	HostnameOverride string    `json:"hostname_override"`
+	Expiry           time.Time `json:"expiry"`
+}
+
+// expired reports whether l expired at t, like dhcp4d.Lease.Expired: dhcp4d
+// keeps expired leases, whose address might be handed out to another client.
+func (l *dhcpLease) expired(t time.Time) bool {
+	return !l.Expiry.IsZero() && t.After(l.Expiry)
+}
+
+// readLeases returns the leases which dhcp4d persisted in dir. A missing file
+// results in no leases.
+func readLeases(dir string) ([]dhcpLease, error) {
+	var leases []dhcpLease
+	if err := readJSON(filepath.Join(dir, "dhcp4d", "leases.json"), &leases); err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// newestLease returns the lease which matches and expires last, skipping
+// expired leases. Leases without expiry (static leases) never expire.
+func newestLease(leases []dhcpLease, match func(*dhcpLease) bool) *dhcpLease {
+	now := time.Now()
+	var newest *dhcpLease
+	for idx := range leases {
+		l := &leases[idx]
+		if !match(l) || l.expired(now) {
+			continue
+		}
+		if newest == nil || !newest.Expiry.IsZero() && (l.Expiry.IsZero() || l.Expiry.After(newest.Expiry)) {
+			newest = l
+		}
+	}
+	return newest
+}
+
+// lookupHost returns the active lease of the client with the specified
+// hostname, preferring hostname overrides (set in the dhcp4d web interface)
+// over the hostnames which clients sent. If several clients use the hostname,
+// the most recently renewed lease wins.
+func lookupHost(leases []dhcpLease, hostname string) (*dhcpLease, error) {
+	if l := newestLease(leases, func(l *dhcpLease) bool {
+		return strings.EqualFold(l.HostnameOverride, hostname)
+	}); l != nil {
+		return l, nil
+	}
+	if l := newestLease(leases, func(l *dhcpLease) bool {
+		return l.HostnameOverride == "" && strings.EqualFold(l.Hostname, hostname)
+	}); l != nil {
+		return l, nil
+	}
+	return nil, fmt.Errorf("no active DHCP lease for host %q", hostname)
+}
+
+// lookupHardwareAddr returns the active lease of the client with MAC address
+// hwaddr.
+func lookupHardwareAddr(leases []dhcpLease, hwaddr string) (*dhcpLease, error) {
+	want, err := net.ParseMAC(hwaddr)
+	if err != nil {
+		return nil, err
+	}
+	if l := newestLease(leases, func(l *dhcpLease) bool {
+		got, err := net.ParseMAC(l.HardwareAddr)
+		return err == nil && bytes.Equal(got, want)
+	}); l != nil {
+		return l, nil
+	}
+	return nil, fmt.Errorf("no active DHCP lease for MAC address %s", hwaddr)
+}
+
+// DependsOnLease reports whether the rules generated for cfg depend on the
+// DHCP lease of the client with MAC address hwaddr and the specified
+// hostnames, i.e. whether the config needs to be applied again when the lease
+// changes.
+func (cfg *Config) DependsOnLease(hwaddr string, hostnames ...string) bool {
+	if cfg.firewall != nil && cfg.firewall.Accounting {
+		return true // every client is accounted for, see applyAccounting
+	}
+	isHost := func(name string) bool {
+		for _, h := range hostnames {
+			if h != "" && strings.EqualFold(h, name) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, fw := range cfg.forwardings.Forwardings {
+		if fw.Disabled {
+			continue
+		}
+		if fw.DestHost != "" && isHost(fw.DestHost) {
+			return true
+		}
+		if fw.DestMAC != "" && strings.EqualFold(fw.DestMAC, hwaddr) {
+			return true
+		}
+	}
+	for _, p := range cfg.pinholes {
+		if p.Host != "" && isHost(p.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// DependsOnNeighbor reports whether the rules generated for cfg depend on the
+// IPv6 addresses of the host with MAC address hwaddr (see hostIIDs), i.e.
+// whether the config needs to be applied again when the host starts using a
+// new address. Hostnames are resolved using the DHCP leases found in dir.
+func (cfg *Config) DependsOnNeighbor(dir string, hwaddr net.HardwareAddr) bool {
+	leases, _ := readLeases(dir)
+	if cfg.firewall != nil && cfg.firewall.Accounting {
+		// Every client of dhcp4d is accounted for, see applyAccounting.
+		_, err := lookupHardwareAddr(leases, hwaddr.String())
+		return err == nil
+	}
+	for _, p := range cfg.pinholes {
+		mac := p.HardwareAddr
+		if p.Host != "" {
+			l, err := lookupHost(leases, p.Host)
+			if err != nil {
+				continue
+			}
+			mac = l.HardwareAddr
+		}
+		if got, err := net.ParseMAC(mac); err == nil && bytes.Equal(got, hwaddr) {
+			return true
+		}
+	}
+	return false
+}
+
+// eui64 returns the modified EUI-64 interface identifier (RFC 4291, appendix
+// A) which SLAAC derives from hwaddr, in the lower 64 bits of an IPv6 address.
+func eui64(hwaddr net.HardwareAddr) (net.IP, error) {
+	if len(hwaddr) != 6 {
+		return nil, fmt.Errorf("%v is not a 48-bit MAC address", hwaddr)
+	}
+	iid := make(net.IP, net.IPv6len)
+	copy(iid[8:11], hwaddr[0:3])
+	iid[8] ^= 0x02 // universal/local bit
+	iid[11] = 0xff
+	iid[12] = 0xfe
+	copy(iid[13:16], hwaddr[3:6])
+	return iid, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLookupLease(t *testing.T) {
+	now := time.Now()
+	leases := []dhcpLease{
+		// Expired, the address might belong to another client by now.
+		{Addr: net.ParseIP("192.168.42.3"), HardwareAddr: "02:73:53:00:ca:fb", HostnameOverride: "nas", Expiry: now.Add(-time.Minute)},
+		{Addr: net.ParseIP("192.168.42.4"), HardwareAddr: "02:73:53:00:ca:fc", Hostname: "nas", Expiry: now.Add(10 * time.Minute)},
+		{Addr: net.ParseIP("192.168.42.5"), HardwareAddr: "02:73:53:00:ca:fd", Hostname: "nas", Expiry: now.Add(20 * time.Minute)},
+		{Addr: net.ParseIP("192.168.42.6"), HardwareAddr: "02:73:53:00:ca:fe", Hostname: "printer", Expiry: now.Add(-time.Minute)},
+		{Addr: net.ParseIP("192.168.42.7"), HardwareAddr: "02:73:53:00:ca:ff", Hostname: "static"}, // never expires
+	}
+
+	for _, tt := range []struct {
+		hostname string
+		want     string // address, or empty if not found
+	}{
+		{"nas", "192.168.42.5"}, // most recently renewed
+		{"NAS", "192.168.42.5"},
+		{"printer", ""},
+		{"static", "192.168.42.7"},
+	} {
+		l, err := lookupHost(leases, tt.hostname)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("lookupHost(%q) = %v, want error", tt.hostname, l.Addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("lookupHost(%q): %v", tt.hostname, err)
+			continue
+		}
+		if got := l.Addr.String(); got != tt.want {
+			t.Errorf("lookupHost(%q) = %s, want %s", tt.hostname, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		hwaddr string
+		want   string
+	}{
+		{"02:73:53:00:ca:fb", ""},
+		{"02:73:53:00:CA:FC", "192.168.42.4"},
+		{"02:73:53:00:ca:fe", ""},
+	} {
+		l, err := lookupHardwareAddr(leases, tt.hwaddr)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("lookupHardwareAddr(%q) = %v, want error", tt.hwaddr, l.Addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("lookupHardwareAddr(%q): %v", tt.hwaddr, err)
+			continue
+		}
+		if got := l.Addr.String(); got != tt.want {
+			t.Errorf("lookupHardwareAddr(%q) = %s, want %s", tt.hwaddr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,620 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// multiWANConfig configures how IPv4 traffic is distributed across the
+// uplinks (interfaces.wan_ifnames) which obtained a DHCPv4 lease. It is read
+// from [netconfig.multiwan] in config.toml, e.g.:
+//
+//	[netconfig.multiwan]
+//	mode = "balance"
+//
+//	[[netconfig.multiwan.uplinks]]
+//	name = "uplink0"
+//	weight = 3
+//
+//	[[netconfig.multiwan.uplinks]]
+//	name = "uplink1"
+//	weight = 1
+//
+// Uplinks whose diag checks fail (as reported by diagd, see
+// uplinkHealthFile) are not used unless all uplinks are unhealthy.
+type multiWANConfig struct {
+	// Mode is either “failover” (the default), which routes all traffic via
+	// the healthy uplink with the lowest metric, or “balance”, which
+	// distributes connections across all healthy uplinks (weighted ECMP).
+	Mode string `json:"mode,omitempty" mapstructure:"mode"`
+
+	Uplinks []uplinkConfig `json:"uplinks,omitempty" mapstructure:"uplinks"`
+}
+
+type uplinkConfig struct {
+	Name string `json:"name" mapstructure:"name"` // one of interfaces.wan_ifnames
+
+	// Metric is the priority of the default route via this uplink (lower is
+	// preferred). It defaults to the position of the uplink in
+	// interfaces.wan_ifnames.
+	Metric int `json:"metric,omitempty" mapstructure:"metric"`
+
+	// Weight is the share of connections of this uplink in mode “balance”,
+	// from 1 (the default) to 256.
+	Weight int `json:"weight,omitempty" mapstructure:"weight"`
+}
+
+func (m *multiWANConfig) validate(pl *problemList) {
+	switch m.Mode {
+	case "", "failover", "balance":
+	default:
+		pl.add("multiwan.mode", `unknown mode %q, expected "failover" or "balance"`, m.Mode)
+	}
+	seen := make(map[string]bool)
+	metrics := make(map[int]string)
+	for idx, u := range m.Uplinks {
+		field := fmt.Sprintf("multiwan.uplinks[%d]", idx)
+		if u.Name == "" {
+			pl.add(field+".name", "must not be empty")
+			continue
+		}
+		pos := uplinkIndex(u.Name)
+		if pos == -1 {
+			pl.add(field+".name", "%q is not listed in interfaces.wan_ifnames", u.Name)
+			continue
+		}
+		if seen[u.Name] {
+			pl.add(field+".name", "duplicate uplink %q", u.Name)
+			continue
+		}
+		seen[u.Name] = true
+		if u.Metric < 0 {
+			pl.add(field+".metric", "must not be negative (got %d)", u.Metric)
+		}
+		if u.Weight < 0 || u.Weight > 256 {
+			pl.add(field+".weight", "must be between 1 and 256 (got %d)", u.Weight)
+		}
+	}
+	for idx, name := range uplinkNames() {
+		metric := m.uplink(name, idx).Metric
+		if other, ok := metrics[metric]; ok {
+			pl.add("multiwan.uplinks", "uplinks %s and %s share metric %d", other, name, metric)
+		}
+		metrics[metric] = name
+	}
+}
+
+func uplinkIndex(ifname string) int {
+	for idx, name := range uplinkNames() {
+		if name == ifname {
+			return idx
+		}
+	}
+	return -1
+}
+
+// uplink returns the configuration of the uplink ifname, the idx-th of
+// uplinkNames, with defaults filled in. m may be nil.
+func (m *multiWANConfig) uplink(ifname string, idx int) uplinkConfig {
+	u := uplinkConfig{Name: ifname}
+	if m != nil {
+		for _, cu := range m.Uplinks {
+			if cu.Name == ifname {
+				u = cu
+			}
+		}
+	}
+	if u.Metric == 0 {
+		u.Metric = idx
+	}
+	if u.Weight == 0 {
+		u.Weight = 1
+	}
+	return u
+}
+
+func (m *multiWANConfig) balance() bool {
+	return m != nil && m.Mode == "balance"
+}
+
+// uplinkHealthFile (relative to the data directory) is written by diagd and
+// maps the name of each uplink to whether its diag checks succeed, e.g.
+// {"uplink0": true, "uplink1": false}.
+const uplinkHealthFile = "diagd/uplinks.json"
+
+// readUplinkHealth returns the uplinks which diagd reported as unhealthy.
+// Uplinks are considered healthy until diagd reports otherwise.
+func readUplinkHealth(dir string) (unhealthy map[string]bool, _ error) {
+	var health map[string]bool
+	if err := readJSON(filepath.Join(dir, uplinkHealthFile), &health); err != nil {
+		return nil, err
+	}
+	unhealthy = make(map[string]bool)
+	for ifname, healthy := range health {
+		if !healthy {
+			unhealthy[ifname] = true
+		}
+	}
+	return unhealthy, nil
+}
+
+// unhealthyPenalty is added to the metric of the default route via an
+// unhealthy uplink, so that it is used only if all other uplinks are
+// unhealthy, too (mode “failover”), or only by sockets bound to the uplink
+// (mode “balance”).
+const unhealthyPenalty = 1000
+
+// uplinkRoute is the default route of an uplink which obtained a DHCPv4
+// lease, see planDefaultRoutes.
+type uplinkRoute struct {
+	uplinkConfig
+	gw, src net.IP
+	healthy bool
+}
+
+// defaultRoute is a desired default route, whose nexthops refer to links by
+// the names which they will carry once the plan is applied.
+type defaultRoute struct {
+	route    netlink.Route
+	ifname   string   // for routes with a single nexthop
+	nexthops []string // names of the links of route.MultiPath
+}
+
+func (d *defaultRoute) String() string {
+	names := d.nexthops
+	if d.ifname != "" {
+		names = []string{d.ifname}
+	}
+	return defaultRouteString(d.route, func(idx int) string { return names[idx] })
+}
+
+// defaultRouteString renders the IPv4 default route r, e.g. “0.0.0.0/0 via
+// 85.195.207.1 dev uplink0 metric 1” or “0.0.0.0/0 nexthop via 85.195.207.1
+// dev uplink0 weight 3 nexthop via 10.0.0.1 dev uplink1 weight 1”. ifname
+// returns the name of the link of the idx-th nexthop.
+func defaultRouteString(r netlink.Route, ifname func(idx int) string) string {
+	s := "0.0.0.0/0"
+	if len(r.MultiPath) > 0 {
+		for idx, nh := range r.MultiPath {
+			s += fmt.Sprintf(" nexthop via %v dev %s weight %d", nh.Gw, ifname(idx), nh.Hops+1)
+		}
+	} else {
+		s += fmt.Sprintf(" via %v dev %s", r.Gw, ifname(0))
+	}
+	if r.Src != nil {
+		s += fmt.Sprintf(" src %v", r.Src)
+	}
+	if r.Priority != 0 {
+		s += fmt.Sprintf(" metric %d", r.Priority)
+	}
+	return s
+}
+
+// desiredDefaultRoutes returns the default routes via the uplinks in routes
+// according to cfg (nil means failover).
+func desiredDefaultRoutes(cfg *multiWANConfig, routes []uplinkRoute) []*defaultRoute {
+	single := func(r uplinkRoute, metric int) *defaultRoute {
+		return &defaultRoute{
+			route: netlink.Route{
+				Dst:      &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+				Gw:       r.gw,
+				Src:      r.src,
+				Protocol: unix.RTPROT_DHCP,
+				Priority: metric,
+			},
+			ifname: r.Name,
+		}
+	}
+	if !cfg.balance() {
+		var desired []*defaultRoute
+		for _, r := range routes {
+			metric := r.Metric
+			if !r.healthy {
+				metric += unhealthyPenalty
+			}
+			desired = append(desired, single(r, metric))
+		}
+		return desired
+	}
+	var healthy []uplinkRoute
+	for _, r := range routes {
+		if r.healthy {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = routes // better than no default route at all
+	}
+	// Unhealthy uplinks keep a default route which is only used by sockets
+	// bound to them, so that diagd notices once they recover.
+	var fallback []*defaultRoute
+	if len(healthy) < len(routes) {
+		for _, r := range routes {
+			if !r.healthy {
+				fallback = append(fallback, single(r, r.Metric+unhealthyPenalty))
+			}
+		}
+	}
+	if len(healthy) == 1 {
+		return append([]*defaultRoute{single(healthy[0], 0)}, fallback...)
+	}
+	d := &defaultRoute{
+		route: netlink.Route{
+			Dst:      &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+			Protocol: unix.RTPROT_DHCP,
+		},
+	}
+	for _, r := range healthy {
+		d.route.MultiPath = append(d.route.MultiPath, &netlink.NexthopInfo{
+			Gw:   r.gw,
+			Hops: r.Weight - 1,
+		})
+		d.nexthops = append(d.nexthops, r.Name)
+	}
+	return append([]*defaultRoute{d}, fallback...)
+}
+
+// planDefaultRoutes plans the IPv4 default routes via the uplinks in routes,
+// replacing all other default routes which netconfig added before (e.g. via
+// an uplink which turned unhealthy).
+func planDefaultRoutes(p *Plan, cfg *multiWANConfig, routes []uplinkRoute) error {
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Metric < routes[j].Metric })
+	desired := desiredDefaultRoutes(cfg, routes)
+
+	current, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("RouteList: %v", err)
+	}
+	linkName := func(index int) string {
+		l, err := netlink.LinkByIndex(index)
+		if err != nil {
+			return fmt.Sprint(index)
+		}
+		return l.Attrs().Name
+	}
+	type liveRoute struct {
+		route netlink.Route
+		desc  string
+	}
+	var live []liveRoute
+	exists := make(map[string]bool)
+	for _, r := range current {
+		if r.Protocol != unix.RTPROT_DHCP || (r.Dst != nil && r.Dst.String() != "0.0.0.0/0") {
+			continue
+		}
+		r := r // copy
+		desc := defaultRouteString(r, func(idx int) string {
+			if len(r.MultiPath) > 0 {
+				return linkName(r.MultiPath[idx].LinkIndex)
+			}
+			return linkName(r.LinkIndex)
+		})
+		exists[desc] = true
+		live = append(live, liveRoute{route: r, desc: desc})
+	}
+	want := make(map[string]bool)
+	for _, d := range desired {
+		d := d // copy
+		desc := d.String()
+		want[desc] = true
+		if exists[desc] {
+			continue
+		}
+		p.change(Change{Op: "+", Kind: "route", Object: desc}, func() error {
+			r := d.route
+			if d.ifname != "" {
+				l, err := netlink.LinkByName(d.ifname)
+				if err != nil {
+					return err
+				}
+				r.LinkIndex = l.Attrs().Index
+			}
+			for idx, name := range d.nexthops {
+				l, err := netlink.LinkByName(name)
+				if err != nil {
+					return err
+				}
+				r.MultiPath[idx].LinkIndex = l.Attrs().Index
+			}
+			if err := netlink.RouteReplace(&r); err != nil {
+				return fmt.Errorf("RouteReplace(%s): %v", desc, err)
+			}
+			return nil
+		})
+	}
+	for _, lr := range live {
+		lr := lr // copy
+		if want[lr.desc] {
+			continue
+		}
+		p.change(Change{Op: "-", Kind: "route", Object: lr.desc}, func() error {
+			// RouteReplace above might have replaced the route already.
+			if err := netlink.RouteDel(&lr.route); err != nil && err != unix.ESRCH {
+				return fmt.Errorf("RouteDel(%s): %v", lr.desc, err)
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
+// With more than one uplink, connections which arrive via an uplink (e.g. port
+// forwardings, see portForwarding) are marked with the uplink (ct mark), and
+// so are the packets of their replies (meta mark). The mark selects the
+// routing table of the uplink, whose default route leads via the router of
+// its DHCPv4 lease, so that replies leave via the uplink which the connection
+// arrived on instead of via the default route of the main table, where the
+// upstream of another uplink would drop them.
+const (
+	uplinkMarkMask = 0xff000000 // bits of the marks which netconfig uses
+
+	// uplinkTableBase is the id of the routing table of the first uplink;
+	// ids from uplinkTableBase to uplinkTableBase+254 are reserved.
+	uplinkTableBase = 1000
+
+	// uplinkRulePriority is the priority of the routing rules which select
+	// the uplink tables, before any configured rules (see routingRule).
+	uplinkRulePriority = 10
+)
+
+// uplinkMark returns the mark of the idx-th of uplinkNames.
+func uplinkMark(idx int) uint32 {
+	return uint32(idx+1) << 24
+}
+
+// uplinkTable returns the id of the routing table of the idx-th of
+// uplinkNames.
+func uplinkTable(idx int) int {
+	return uplinkTableBase + idx
+}
+
+// uplinkTables reports whether netconfig marks connections by uplink, i.e.
+// whether there is more than one uplink.
+func uplinkTables() bool {
+	return len(uplinkNames()) > 1
+}
+
+// uplinkRules returns the routing rules which select the uplink tables.
+func uplinkRules() []policyRule {
+	if !uplinkTables() {
+		return nil
+	}
+	var rules []policyRule
+	for idx := range uplinkNames() {
+		rules = append(rules, policyRule{
+			family:   unix.AF_INET,
+			priority: uplinkRulePriority,
+			table:    uint32(uplinkTable(idx)),
+			mark:     uplinkMark(idx),
+			mask:     uplinkMarkMask,
+		})
+	}
+	return rules
+}
+
+// uplinkMarkExprs matches the packets of connections which carry the mark of
+// the uplink idx, and adds the mark to the packet.
+func uplinkMarkExprs(idx int) []expr.Any {
+	mark := uplinkMark(idx)
+	return []expr.Any{
+		// [ ct load mark => reg 1 ]
+		&expr.Ct{Register: 1, Key: expr.CtKeyMARK},
+		// [ bitwise reg 1 = (reg=1 & 0xff000000 ) ^ 0x00000000 ]
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(uplinkMarkMask),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		// [ cmp eq reg 1 0x01000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     binaryutil.NativeEndian.PutUint32(mark),
+		},
+		// [ meta load mark => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		// [ bitwise reg 1 = (reg=1 & 0x00ffffff ) ^ 0x01000000 ]
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(^uint32(uplinkMarkMask)),
+			Xor:            binaryutil.NativeEndian.PutUint32(mark),
+		},
+		// [ meta set mark with reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+	}
+}
+
+// applyUplinkMarks marks new connections which arrive via one of uplinks
+// with the uplink, and the packets of their replies with the mark of the
+// connection, which are either forwarded (prerouting) or sent by the router
+// itself (output). filter is an ip table.
+func applyUplinkMarks(c batch, filter *nftables.Table, uplinks []string) {
+	if !uplinkTables() {
+		return
+	}
+	prerouting := c.AddChain(&nftables.Chain{
+		Name:     "prerouting",
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityMangle,
+		Table:    filter,
+		Type:     nftables.ChainTypeFilter,
+	})
+	// A route chain looks up the route again once the mark changed.
+	output := c.AddChain(&nftables.Chain{
+		Name:     "output",
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityMangle,
+		Table:    filter,
+		Type:     nftables.ChainTypeRoute,
+	})
+
+	var notUplink []expr.Any
+	for _, ifname := range uplinks {
+		notUplink = append(notUplink,
+			// [ meta load iifname => reg 1 ]
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			// [ cmp neq reg 1 0x696c7075 0x00306b6e 0x00000000 0x00000000 ]
+			&expr.Cmp{
+				Op:       expr.CmpOpNeq,
+				Register: 1,
+				Data:     nfifname(ifname),
+			})
+	}
+	for _, ifname := range uplinks {
+		idx := uplinkIndex(ifname)
+		if idx == -1 {
+			continue
+		}
+		exprs := append(ifnameExprs(expr.MetaKeyIIFNAME, ifname), ctStateExprs(expr.CtStateBitNEW)...)
+		exprs = append(exprs,
+			// [ ct load mark => reg 1 ]
+			&expr.Ct{Register: 1, Key: expr.CtKeyMARK},
+			// [ bitwise reg 1 = (reg=1 & 0x00ffffff ) ^ 0x01000000 ]
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask:           binaryutil.NativeEndian.PutUint32(^uint32(uplinkMarkMask)),
+				Xor:            binaryutil.NativeEndian.PutUint32(uplinkMark(idx)),
+			},
+			// [ ct set mark with reg 1 ]
+			&expr.Ct{Key: expr.CtKeyMARK, SourceRegister: true, Register: 1},
+		)
+		c.AddRule(&nftables.Rule{
+			Table: filter,
+			Chain: prerouting,
+			Exprs: exprs,
+		})
+	}
+	for _, ifname := range uplinks {
+		idx := uplinkIndex(ifname)
+		if idx == -1 {
+			continue
+		}
+		// Packets which arrive via an uplink are routed by their
+		// destination, e.g. into the LAN.
+		c.AddRule(&nftables.Rule{
+			Table: filter,
+			Chain: prerouting,
+			Exprs: append(append([]expr.Any{}, notUplink...), uplinkMarkExprs(idx)...),
+		})
+		c.AddRule(&nftables.Rule{
+			Table: filter,
+			Chain: output,
+			Exprs: uplinkMarkExprs(idx),
+		})
+	}
+}
+
+// planUplinkTables plans the default routes of the uplink tables (see
+// uplinkTable) via the uplinks in routes, removing the routes of the uplink
+// tables which netconfig added before.
+func planUplinkTables(p *Plan, routes []uplinkRoute) error {
+	desired := make(map[int]netlink.Route)
+	if uplinkTables() {
+		for _, r := range routes {
+			table := uplinkTable(uplinkIndex(r.Name))
+			desired[table] = netlink.Route{
+				Dst:      &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+				Gw:       r.gw,
+				Src:      r.src,
+				Protocol: unix.RTPROT_DHCP,
+				Table:    table,
+			}
+		}
+	}
+	describe := func(r netlink.Route, ifname string) string {
+		return fmt.Sprintf("%s table %d", defaultRouteString(r, func(int) string { return ifname }), r.Table)
+	}
+
+	current, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: unix.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return fmt.Errorf("RouteListFiltered: %v", err)
+	}
+	type liveRoute struct {
+		route netlink.Route
+		desc  string
+	}
+	var live []liveRoute
+	exists := make(map[string]bool)
+	for _, r := range current {
+		if r.Protocol != unix.RTPROT_DHCP ||
+			r.Table < uplinkTableBase || r.Table > uplinkTableBase+254 {
+			continue
+		}
+		if r.Dst == nil {
+			r.Dst = &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+		}
+		ifname := fmt.Sprint(r.LinkIndex)
+		if l, err := netlink.LinkByIndex(r.LinkIndex); err == nil {
+			ifname = l.Attrs().Name
+		}
+		desc := describe(r, ifname)
+		exists[desc] = true
+		live = append(live, liveRoute{route: r, desc: desc})
+	}
+	want := make(map[string]bool)
+	for idx, ifname := range uplinkNames() {
+		r, ok := desired[uplinkTable(idx)]
+		if !ok {
+			continue
+		}
+		desc := describe(r, ifname)
+		want[desc] = true
+		if exists[desc] {
+			continue
+		}
+		ifname := ifname // copy
+		p.change(Change{Op: "+", Kind: "route", Object: desc}, func() error {
+			l, err := netlink.LinkByName(ifname)
+			if err != nil {
+				return err
+			}
+			r.LinkIndex = l.Attrs().Index
+			if err := netlink.RouteReplace(&r); err != nil {
+				return fmt.Errorf("RouteReplace(%s): %v", desc, err)
+			}
+			return nil
+		})
+	}
+	for _, lr := range live {
+		lr := lr // copy
+		if want[lr.desc] {
+			continue
+		}
+		p.change(Change{Op: "-", Kind: "route", Object: lr.desc}, func() error {
+			// RouteReplace above might have replaced the route already.
+			if err := netlink.RouteDel(&lr.route); err != nil && err != unix.ESRCH {
+				return fmt.Errorf("RouteDel(%s): %v", lr.desc, err)
+			}
+			return nil
+		})
+	}
+	return nil
+}
@@ -16,6 +16,7 @@
 package netconfig
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -34,11 +35,29 @@ import (
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
 
+	"git.tcp.direct/kayos/rout5/config"
 	"git.tcp.direct/kayos/rout5/dhcp/dhcp4"
 	"git.tcp.direct/kayos/rout5/dhcp/dhcp6"
-	"git.tcp.direct/kayos/rout5/ipc"
 )
 
+// uplinkNames returns the names of all WAN interfaces, see
+// interfaces.wan_ifnames in config.toml.
+func uplinkNames() []string {
+	if wan := config.Current().PreferredWAN; len(wan) > 0 {
+		return wan
+	}
+	return []string{"uplink0"}
+}
+
+// lanName returns the name of the (first) LAN interface, see
+// interfaces.lan_ifnames in config.toml.
+func lanName() string {
+	if lan := config.Current().PreferredLAN; len(lan) > 0 {
+		return lan[0]
+	}
+	return "lan0"
+}
+
 func subnetMaskSize(mask string) (int, error) {
 	parts := strings.Split(mask, ".")
 	if got, want := len(parts), 4; got != want {
@@ -56,118 +75,147 @@ func subnetMaskSize(mask string) (int, error) {
 	return ones, nil
 }
 
-func applyDhcp4(dir string) error {
-	b, err := ioutil.ReadFile(filepath.Join(dir, "dhcp4/wire/lease.json"))
+func planDhcp4(p *Plan, cfg *multiWANConfig, dir string) error {
+	unhealthy, err := readUplinkHealth(dir)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil // dhcp4 might not have obtained a lease yet
+		// Keep using all uplinks instead of failing over blindly.
+		log.Printf("uplink health: %v", err)
+	}
+	var routes []uplinkRoute
+	for idx, linkName := range uplinkNames() {
+		got, err := planDhcp4Uplink(p, dir, linkName)
+		if err != nil {
+			// One broken uplink must not take down the others.
+			p.fail(fmt.Errorf("%s: %v", linkName, err))
+			continue
+		}
+		if got == nil {
+			continue
 		}
+		routes = append(routes, uplinkRoute{
+			uplinkConfig: cfg.uplink(linkName, idx),
+			gw:           net.ParseIP(got.Router),
+			src:          net.ParseIP(got.ClientIP),
+			healthy:      !unhealthy[linkName],
+		})
+	}
+	if err := planUplinkTables(p, routes); err != nil {
 		return err
 	}
+	if len(routes) == 0 {
+		return nil
+	}
+	return planDefaultRoutes(p, cfg, routes)
+}
+
+// planDhcp4Uplink plans the address and the route to the gateway of the
+// DHCPv4 lease which dhcp4 obtained on linkName, if any. The default route is
+// planned by planDefaultRoutes.
+func planDhcp4Uplink(p *Plan, dir, linkName string) (*dhcp4.Config, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, config.DHCP4Dir(linkName), "lease.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // dhcp4 might not have obtained a lease yet
+		}
+		return nil, err
+	}
 	var got dhcp4.Config
 	if err := json.Unmarshal(b, &got); err != nil {
-		return err
+		return nil, err
 	}
 
-	const linkName = "uplink0"
-	link, err := netlink.LinkByName(linkName)
+	link, err := p.link(linkName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if got.SubnetMask == "" {
-		return fmt.Errorf("invalid DHCP lease: no subnet mask present")
+		return nil, fmt.Errorf("invalid DHCP lease: no subnet mask present")
 	}
 
 	subnetSize, err := subnetMaskSize(got.SubnetMask)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	gotAddr := fmt.Sprintf("%s/%d", got.ClientIP, subnetSize)
 	addr, err := netlink.ParseAddr(gotAddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	h, err := netlink.NewHandle()
-	if err != nil {
-		return fmt.Errorf("netlink.NewHandle: %v", err)
-	}
-	defer h.Delete()
-	log.Printf("replacing address %v on %v", addr, linkName)
-	if err := h.AddrReplace(link, addr); err != nil {
-		return fmt.Errorf("AddrReplace(%v, %v): %v", linkName, addr, err)
+	if err := p.planAddr(linkName, addr); err != nil {
+		return nil, err
 	}
 
-	addrs, err := h.AddrList(link, netlink.FAMILY_V4)
-	if err != nil {
-		return fmt.Errorf("AddrList(%v): %v", linkName, err)
-	}
-	for _, addr := range addrs {
-		ipnet := addr.IPNet.String() // e.g. "85.195.199.99/25"
-		if ipnet == gotAddr {
-			continue
+	if link != nil {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return nil, fmt.Errorf("AddrList(%v): %v", linkName, err)
 		}
-		log.Printf("de-configuring old IP address %s from %v", ipnet, linkName)
-		if err := h.AddrDel(link, &addr); err != nil {
-			return fmt.Errorf("AddrDel(%v, %v): %v", linkName, addr, err)
+		for _, addr := range addrs {
+			addr := addr                 // copy
+			ipnet := addr.IPNet.String() // e.g. "85.195.199.99/25"
+			if ipnet == gotAddr {
+				continue
+			}
+			p.change(Change{Op: "-", Kind: "addr", Object: ipnet + " on " + linkName}, func() error {
+				log.Printf("de-configuring old IP address %s from %v", ipnet, linkName)
+				l, err := netlink.LinkByName(linkName)
+				if err != nil {
+					return err
+				}
+				if err := netlink.AddrDel(l, &addr); err != nil {
+					return fmt.Errorf("AddrDel(%v, %v): %v", linkName, addr, err)
+				}
+				return nil
+			})
 		}
 	}
 
-	// from include/uapi/linux/rtnetlink.h
-	const (
-		RTPROT_STATIC = 4
-		RTPROT_DHCP   = 16
-	)
-
-	if err := h.RouteReplace(&netlink.Route{
-		LinkIndex: link.Attrs().Index,
+	if err := p.planRoute(linkName, netlink.Route{
 		Dst: &net.IPNet{
 			IP:   net.ParseIP(got.Router),
 			Mask: net.CIDRMask(32, 32),
 		},
 		Src:      net.ParseIP(got.ClientIP),
 		Scope:    netlink.SCOPE_LINK,
-		Protocol: RTPROT_DHCP,
+		Protocol: unix.RTPROT_DHCP,
 	}); err != nil {
-		return fmt.Errorf("RouteReplace(router): %v", err)
+		return nil, err
 	}
+	return &got, nil
+}
 
-	if err := h.RouteReplace(&netlink.Route{
-		LinkIndex: link.Attrs().Index,
-		Dst: &net.IPNet{
-			IP:   net.ParseIP("0.0.0.0"),
-			Mask: net.CIDRMask(0, 32),
-		},
-		Gw:       net.ParseIP(got.Router),
-		Src:      net.ParseIP(got.ClientIP),
-		Protocol: RTPROT_DHCP,
-	}); err != nil {
-		return fmt.Errorf("RouteReplace(default): %v", err)
+func planDhcp6(p *Plan, dir string) error {
+	addrs, err := delegatedAddrs(dir)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if err := p.planAddr(lanName(), addr); err != nil {
+			return err
+		}
 	}
-
 	return nil
 }
 
-func applyDhcp6(dir string) error {
+// delegatedAddrs returns the LAN addresses which rout5 picks from the
+// prefixes which dhcp6 obtained, if any.
+func delegatedAddrs(dir string) ([]*netlink.Addr, error) {
 	b, err := ioutil.ReadFile(filepath.Join(dir, "dhcp6/wire/lease.json"))
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil // dhcp6 might not have obtained a lease yet
+			return nil, nil // dhcp6 might not have obtained a lease yet
 		}
-		return err
+		return nil, err
 	}
 	var got dhcp6.Config
 	if err := json.Unmarshal(b, &got); err != nil {
-		return err
-	}
-
-	link, err := netlink.LinkByName("lan0")
-	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var addrs []*netlink.Addr
 	for _, prefix := range got.Prefixes {
 		// pick the first address of the prefix, e.g. address 2a02:168:4a00::1
 		// for prefix 2a02:168:4a00::/48
@@ -178,44 +226,109 @@ func applyDhcp6(dir string) error {
 		}
 		addr, err := netlink.ParseAddr(prefix.String())
 		if err != nil {
-			return err
-		}
-
-		if err := netlink.AddrReplace(link, addr); err != nil {
-			return fmt.Errorf("AddrReplace(%v): %v", addr, err)
+			return nil, err
 		}
+		addrs = append(addrs, addr)
 	}
-	return nil
+	return addrs, nil
 }
 
 type InterfaceDetails struct {
-	HardwareAddr      string `json:"hardware_addr"`       // e.g. dc:9b:9c:ee:72:fd
-	SpoofHardwareAddr string `json:"spoof_hardware_addr"` // e.g. dc:9b:9c:ee:72:fd
-	Name              string `json:"name"`                // e.g. uplink0, or lan0
-	Addr              string `json:"addr"`                // e.g. 192.168.42.1/24
+	HardwareAddr      string `json:"hardware_addr,omitempty" mapstructure:"hardware_addr"`             // e.g. dc:9b:9c:ee:72:fd
+	SpoofHardwareAddr string `json:"spoof_hardware_addr,omitempty" mapstructure:"spoof_hardware_addr"` // e.g. dc:9b:9c:ee:72:fd
+	Name              string `json:"name" mapstructure:"name"`                                         // e.g. uplink0, or lan0
+	Addr              string `json:"addr,omitempty" mapstructure:"addr"`                               // e.g. 192.168.42.1/24
 }
 
 type BridgeDetails struct {
-	Name                   string   `json:"name"` // e.g. br0 or lan0
-	InterfaceHardwareAddrs []string `json:"interface_hardware_addrs"`
+	Name                   string   `json:"name" mapstructure:"name"` // e.g. br0 or lan0
+	InterfaceHardwareAddrs []string `json:"interface_hardware_addrs,omitempty" mapstructure:"interface_hardware_addrs"`
+
+	// InterfaceNames lists members by name, e.g. VLANs, which share the
+	// hardware address of their parent interface.
+	InterfaceNames []string `json:"interface_names,omitempty" mapstructure:"interface_names"`
+}
+
+// BondDetails configures a bonding (link aggregation) interface, which
+// netconfig creates and to which it adds the interfaces with the specified
+// hardware addresses.
+type BondDetails struct {
+	Name string `json:"name" mapstructure:"name"` // e.g. bond0 or lan0
+
+	// Mode is one of the bonding modes of the kernel, e.g. 802.3ad (LACP) or
+	// active-backup (the default).
+	Mode string `json:"mode,omitempty" mapstructure:"mode"`
+
+	// Miimon is the link monitoring interval in milliseconds, defaulting to
+	// 100.
+	Miimon int `json:"miimon,omitempty" mapstructure:"miimon"`
+
+	InterfaceHardwareAddrs []string `json:"interface_hardware_addrs,omitempty" mapstructure:"interface_hardware_addrs"`
+}
+
+// mode returns the bonding mode of b, with the default filled in.
+func (b BondDetails) mode() netlink.BondMode {
+	if b.Mode == "" {
+		return netlink.BOND_MODE_ACTIVE_BACKUP
+	}
+	return netlink.StringToBondMode(b.Mode)
+}
+
+// miimon returns the link monitoring interval of b, with the default filled
+// in.
+func (b BondDetails) miimon() int {
+	if b.Miimon == 0 {
+		return 100
+	}
+	return b.Miimon
+}
+
+// VLANDetails configures an 802.1Q VLAN interface, which netconfig creates on
+// top of the interface Parent.
+type VLANDetails struct {
+	Name   string `json:"name" mapstructure:"name"`           // e.g. uplink0
+	Parent string `json:"parent" mapstructure:"parent"`       // e.g. wan0
+	ID     int    `json:"id" mapstructure:"id"`               // e.g. 7
+	Addr   string `json:"addr,omitempty" mapstructure:"addr"` // e.g. 192.168.43.1/24
+}
+
+// details returns the InterfaceDetails which planInterface applies to v.
+func (v VLANDetails) details() InterfaceDetails {
+	return InterfaceDetails{Name: v.Name, Addr: v.Addr}
 }
 
 type InterfaceConfig struct {
 	Interfaces []InterfaceDetails `json:"interfaces"`
 	Bridges    []BridgeDetails    `json:"bridges"`
+	Bonds      []BondDetails      `json:"bonds,omitempty"`
+	VLANs      []VLANDetails      `json:"vlans,omitempty"`
 }
 
-// Interface returns the InterfaceDetails configured for interface ifname in
+// Interface returns the InterfaceDetails configured for interface (or VLAN)
+// ifname in the Section of config.toml or, if config.toml has none, in
 // interfaces.json.
 func Interface(dir, ifname string) (InterfaceDetails, error) {
-	fn := filepath.Join(dir, "interfaces.json")
-	b, err := ioutil.ReadFile(fn)
-	if err != nil {
-		return InterfaceDetails{}, err
-	}
-	var cfg InterfaceConfig
-	if err := json.Unmarshal(b, &cfg); err != nil {
-		return InterfaceDetails{}, err
+	var (
+		fn  string
+		cfg InterfaceConfig
+	)
+	if config.Snek.IsSet(Section) {
+		fn = config.Filename
+		s, err := readSection()
+		if err != nil {
+			return InterfaceDetails{}, fmt.Errorf("%s: [%s]: %v", fn, Section, err)
+		}
+		cfg.Interfaces = s.Interfaces
+		cfg.VLANs = s.VLANs
+	} else {
+		fn = filepath.Join(dir, "interfaces.json")
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return InterfaceDetails{}, err
+		}
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return InterfaceDetails{}, err
+		}
 	}
 	for _, details := range cfg.Interfaces {
 		if details.Name != ifname {
@@ -223,11 +336,16 @@ func Interface(dir, ifname string) (InterfaceDetails, error) {
 		}
 		return details, nil
 	}
+	for _, vlan := range cfg.VLANs {
+		if vlan.Name == ifname {
+			return vlan.details(), nil
+		}
+	}
 	return InterfaceDetails{}, fmt.Errorf("%s does not configure interface %q", fn, ifname)
 }
 
-// LinkAddress returns the IP address configured for the interface ifname in
-// interfaces.json.
+// LinkAddress returns the IP address configured for the interface ifname, see
+// Interface.
 func LinkAddress(dir, ifname string) (net.IP, error) {
 	iface, err := Interface(dir, ifname)
 	if err != nil {
@@ -237,35 +355,47 @@ func LinkAddress(dir, ifname string) (net.IP, error) {
 	return ip, err
 }
 
-func applyBridges(cfg *InterfaceConfig) error {
+// isUp reports whether l (nil if it does not exist yet) is administratively
+// up.
+func isUp(l netlink.Link) bool {
+	return l != nil && l.Attrs().Flags&net.FlagUp != 0
+}
+
+func planBridges(p *Plan, cfg *InterfaceConfig) error {
 	for _, bridge := range cfg.Bridges {
-		if _, err := netlink.LinkByName(bridge.Name); err != nil {
-			log.Printf("creating bridge %s", bridge.Name)
-			link := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridge.Name}}
-			if err := netlink.LinkAdd(link); err != nil {
-				return fmt.Errorf("netlink.LinkAdd: %v", err)
-			}
+		bridge := bridge // copy
+		bridgeLink, err := netlink.LinkByName(bridge.Name)
+		if err != nil {
+			bridgeLink = nil
+			p.change(Change{Op: "+", Kind: "link", Object: bridge.Name + " type bridge"}, func() error {
+				log.Printf("creating bridge %s", bridge.Name)
+				link := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridge.Name}}
+				if err := netlink.LinkAdd(link); err != nil {
+					return fmt.Errorf("netlink.LinkAdd: %v", err)
+				}
+				return nil
+			})
 		}
+		p.links[bridge.Name] = bridgeLink
 		interfaces := make(map[string]bool)
 		for _, hwaddr := range bridge.InterfaceHardwareAddrs {
 			interfaces[hwaddr] = true
 		}
-		bridgeLink, err := netlink.LinkByName(bridge.Name)
-		if err != nil {
-			return fmt.Errorf("LinkByName(%s): %v", bridge.Name, err)
-		}
 
 		links, err := netlink.LinkList()
 		if err != nil {
 			return err
 		}
 		for _, l := range links {
+			l := l // copy
 			attr := l.Attrs()
 			addr := attr.HardwareAddr.String()
 			if addr == "" {
 				continue
 			}
-			if !interfaces[addr] {
+			if t := l.Type(); !interfaces[addr] || t == "vlan" || t == "bond" || attr.Slave != nil {
+				// VLANs share the hardware address of their parent, bonds
+				// that of their first member.
 				continue
 			}
 			if attr.Name == bridge.Name {
@@ -273,40 +403,277 @@ func applyBridges(cfg *InterfaceConfig) error {
 				// the MAC address of the first interface.
 				continue
 			}
-			log.Printf("adding interface %s to bridge %s", attr.Name, bridge.Name)
-			if err := netlink.LinkSetMaster(l, bridgeLink); err != nil {
-				return fmt.Errorf("LinkSetMaster(%s): %v", attr.Name, err)
+			if bridgeLink == nil || attr.MasterIndex != bridgeLink.Attrs().Index {
+				p.change(Change{Op: "~", Kind: "link", Object: attr.Name + " master " + bridge.Name}, func() error {
+					log.Printf("adding interface %s to bridge %s", attr.Name, bridge.Name)
+					bridgeLink, err := netlink.LinkByName(bridge.Name)
+					if err != nil {
+						return fmt.Errorf("LinkByName(%s): %v", bridge.Name, err)
+					}
+					if err := netlink.LinkSetMaster(l, bridgeLink); err != nil {
+						return fmt.Errorf("LinkSetMaster(%s): %v", attr.Name, err)
+					}
+					return nil
+				})
 			}
-			if attr.OperState != netlink.OperUp {
-				log.Printf("setting interface %s up", attr.Name)
-				if err := netlink.LinkSetUp(l); err != nil {
-					return fmt.Errorf("LinkSetUp(%s): %v", attr.Name, err)
-				}
+			if !isUp(l) {
+				p.change(Change{Op: "~", Kind: "link", Object: attr.Name + " up"}, func() error {
+					log.Printf("setting interface %s up", attr.Name)
+					if err := netlink.LinkSetUp(l); err != nil {
+						return fmt.Errorf("LinkSetUp(%s): %v", attr.Name, err)
+					}
+					return nil
+				})
 			}
 
 		}
-		if attr := bridgeLink.Attrs(); attr.OperState != netlink.OperUp {
-			log.Printf("setting interface %s up", attr.Name)
-			if err := netlink.LinkSetUp(bridgeLink); err != nil {
-				return fmt.Errorf("LinkSetUp(%s): %v", attr.Name, err)
+		for _, name := range bridge.InterfaceNames {
+			if err := planBridgeMember(p, bridge.Name, bridgeLink, name); err != nil {
+				return err
 			}
 		}
+		if !isUp(bridgeLink) {
+			p.change(Change{Op: "~", Kind: "link", Object: bridge.Name + " up"}, func() error {
+				log.Printf("setting interface %s up", bridge.Name)
+				bridgeLink, err := netlink.LinkByName(bridge.Name)
+				if err != nil {
+					return fmt.Errorf("LinkByName(%s): %v", bridge.Name, err)
+				}
+				if err := netlink.LinkSetUp(bridgeLink); err != nil {
+					return fmt.Errorf("LinkSetUp(%s): %v", bridge.Name, err)
+				}
+				return nil
+			})
+		}
 	}
 	return nil
 }
 
-func applyInterfaces(dir, root string) error {
-	b, err := ioutil.ReadFile(filepath.Join(dir, "interfaces.json"))
+// permanentHardwareAddr returns the hardware address of l, which is the
+// address of the bond for members of active-backup bonds, for example.
+func permanentHardwareAddr(l netlink.Link) net.HardwareAddr {
+	if slave, ok := l.Attrs().Slave.(*netlink.BondSlave); ok && len(slave.PermHardwareAddr) > 0 {
+		return slave.PermHardwareAddr
+	}
+	return l.Attrs().HardwareAddr
+}
+
+func planBonds(p *Plan, cfg *InterfaceConfig) error {
+	links, err := netlink.LinkList()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
 		return err
 	}
-	var cfg InterfaceConfig
-	if err := json.Unmarshal(b, &cfg); err != nil {
-		return err
+	configured := make(map[string]bool)
+	for _, details := range cfg.Interfaces {
+		configured[details.Name] = true
 	}
+	for _, bond := range cfg.Bonds {
+		bond := bond // copy
+		desired := fmt.Sprintf("%s type bond mode %s miimon %d", bond.Name, bond.mode(), bond.miimon())
+		var bondLink netlink.Link
+		if l, err := netlink.LinkByName(bond.Name); err == nil {
+			existing, ok := l.(*netlink.Bond)
+			if !ok {
+				log.Printf("bond %s: interface exists with type %s, skipping", bond.Name, l.Type())
+				continue
+			}
+			if existing.Mode == bond.mode() && existing.Miimon == bond.miimon() {
+				bondLink = l
+			} else {
+				// The mode of a bond cannot be changed while it has members,
+				// hence the bond is re-created.
+				p.change(Change{Op: "-", Kind: "link", Object: fmt.Sprintf("%s type bond mode %s miimon %d", bond.Name, existing.Mode, existing.Miimon)}, func() error {
+					if err := netlink.LinkDel(l); err != nil {
+						return fmt.Errorf("LinkDel(%s): %v", bond.Name, err)
+					}
+					return nil
+				})
+			}
+		}
+		if bondLink == nil {
+			p.change(Change{Op: "+", Kind: "link", Object: desired}, func() error {
+				log.Printf("creating bond %s", bond.Name)
+				link := netlink.NewLinkBond(netlink.LinkAttrs{Name: bond.Name})
+				link.Mode = bond.mode()
+				link.Miimon = bond.miimon()
+				if err := netlink.LinkAdd(link); err != nil {
+					return fmt.Errorf("netlink.LinkAdd: %v", err)
+				}
+				return nil
+			})
+		}
+		p.links[bond.Name] = bondLink
+		members := make(map[string]bool)
+		for _, hwaddr := range bond.InterfaceHardwareAddrs {
+			members[strings.ToLower(hwaddr)] = true
+		}
+
+		for _, l := range links {
+			l := l // copy
+			attr := l.Attrs()
+			if t := l.Type(); t == "bond" || t == "vlan" || t == "bridge" {
+				continue // these share the hardware address of other links
+			}
+			if !members[permanentHardwareAddr(l).String()] {
+				continue
+			}
+			if bondLink == nil || attr.MasterIndex != bondLink.Attrs().Index {
+				p.change(Change{Op: "~", Kind: "link", Object: attr.Name + " master " + bond.Name}, func() error {
+					log.Printf("adding interface %s to bond %s", attr.Name, bond.Name)
+					bondLink, err := netlink.LinkByName(bond.Name)
+					if err != nil {
+						return fmt.Errorf("LinkByName(%s): %v", bond.Name, err)
+					}
+					// Interfaces cannot be added to a bond while they are up.
+					// The bond sets them up.
+					if err := netlink.LinkSetDown(l); err != nil {
+						return fmt.Errorf("LinkSetDown(%s): %v", attr.Name, err)
+					}
+					if err := netlink.LinkSetMaster(l, bondLink); err != nil {
+						return fmt.Errorf("LinkSetMaster(%s): %v", attr.Name, err)
+					}
+					return nil
+				})
+			}
+		}
+		// planInterface sets up existing bonds which are configured in
+		// cfg.Interfaces.
+		if bondLink == nil || (!isUp(bondLink) && !configured[bond.Name]) {
+			p.change(Change{Op: "~", Kind: "link", Object: bond.Name + " up"}, func() error {
+				log.Printf("setting interface %s up", bond.Name)
+				bondLink, err := netlink.LinkByName(bond.Name)
+				if err != nil {
+					return fmt.Errorf("LinkByName(%s): %v", bond.Name, err)
+				}
+				if err := netlink.LinkSetUp(bondLink); err != nil {
+					return fmt.Errorf("LinkSetUp(%s): %v", bond.Name, err)
+				}
+				return nil
+			})
+		}
+	}
+	return nil
+}
+
+// planBridgeMember plans adding the link which will be named name (e.g. a
+// VLAN which planVLANs creates) to the bridge bridgeName (bridgeLink is nil
+// if the bridge will be created by the plan).
+func planBridgeMember(p *Plan, bridgeName string, bridgeLink netlink.Link, name string) error {
+	l, err := p.link(name)
+	if err != nil {
+		return fmt.Errorf("bridge %s: %v", bridgeName, err)
+	}
+	if l == nil || bridgeLink == nil || l.Attrs().MasterIndex != bridgeLink.Attrs().Index {
+		p.change(Change{Op: "~", Kind: "link", Object: name + " master " + bridgeName}, func() error {
+			log.Printf("adding interface %s to bridge %s", name, bridgeName)
+			l, err := netlink.LinkByName(name)
+			if err != nil {
+				return fmt.Errorf("LinkByName(%s): %v", name, err)
+			}
+			bridgeLink, err := netlink.LinkByName(bridgeName)
+			if err != nil {
+				return fmt.Errorf("LinkByName(%s): %v", bridgeName, err)
+			}
+			if err := netlink.LinkSetMaster(l, bridgeLink); err != nil {
+				return fmt.Errorf("LinkSetMaster(%s): %v", name, err)
+			}
+			return nil
+		})
+	}
+	if _, ok := p.links[name]; !ok && l != nil && !isUp(l) {
+		// The member is not configured otherwise.
+		p.change(Change{Op: "~", Kind: "link", Object: name + " up"}, func() error {
+			if err := netlink.LinkSetUp(l); err != nil {
+				return fmt.Errorf("LinkSetUp(%s): %v", name, err)
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
+// planVLANs plans creating the VLANs of cfg (re-creating those whose parent
+// or VLAN ID changed) and configuring them. Their parent interfaces must
+// carry their configured names by the time the VLANs are created.
+func planVLANs(p *Plan, cfg *InterfaceConfig, root string) error {
+	for _, vlan := range cfg.VLANs {
+		vlan := vlan // copy
+		parent, err := p.link(vlan.Parent)
+		if err != nil {
+			log.Printf("vlan %s: parent %s: %v", vlan.Name, vlan.Parent, err)
+			continue
+		}
+		if _, ok := p.links[vlan.Parent]; !ok && !isUp(parent) {
+			// The parent is not configured otherwise, e.g. a trunk port.
+			p.change(Change{Op: "~", Kind: "link", Object: vlan.Parent + " up"}, func() error {
+				if err := netlink.LinkSetUp(parent); err != nil {
+					return fmt.Errorf("LinkSetUp(%s): %v", vlan.Parent, err)
+				}
+				return nil
+			})
+		}
+		object := fmt.Sprintf("%s link %s type vlan id %d", vlan.Name, vlan.Parent, vlan.ID)
+		var l netlink.Link
+		if existing, err := netlink.LinkByName(vlan.Name); err == nil {
+			v, ok := existing.(*netlink.Vlan)
+			if !ok {
+				log.Printf("vlan %s: interface exists with type %s, skipping", vlan.Name, existing.Type())
+				continue
+			}
+			if parent != nil && v.ParentIndex == parent.Attrs().Index && v.VlanId == vlan.ID {
+				l = existing
+			} else {
+				from := fmt.Sprintf("id %d", v.VlanId)
+				if pl, err := netlink.LinkByIndex(v.ParentIndex); err == nil {
+					from = fmt.Sprintf("link %s %s", pl.Attrs().Name, from)
+				}
+				p.change(Change{Op: "-", Kind: "link", Object: vlan.Name + " type vlan " + from}, func() error {
+					if err := netlink.LinkDel(existing); err != nil {
+						return fmt.Errorf("LinkDel(%s): %v", vlan.Name, err)
+					}
+					return nil
+				})
+			}
+		}
+		if l == nil {
+			p.change(Change{Op: "+", Kind: "link", Object: object}, func() error {
+				log.Printf("creating vlan %s", vlan.Name)
+				parent, err := netlink.LinkByName(vlan.Parent)
+				if err != nil {
+					return fmt.Errorf("LinkByName(%s): %v", vlan.Parent, err)
+				}
+				link := &netlink.Vlan{
+					LinkAttrs: netlink.LinkAttrs{
+						Name:        vlan.Name,
+						ParentIndex: parent.Attrs().Index,
+					},
+					VlanId: vlan.ID,
+				}
+				if err := netlink.LinkAdd(link); err != nil {
+					return fmt.Errorf("netlink.LinkAdd: %v", err)
+				}
+				return nil
+			})
+			p.change(Change{Op: "~", Kind: "link", Object: vlan.Name + " up"}, func() error {
+				l, err := netlink.LinkByName(vlan.Name)
+				if err != nil {
+					return err
+				}
+				if err := netlink.LinkSetUp(l); err != nil {
+					return fmt.Errorf("LinkSetUp(%s): %v", vlan.Name, err)
+				}
+				return nil
+			})
+		}
+		p.links[vlan.Name] = l
+		if err := planInterface(p, l, vlan.details(), root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func planInterfaces(p *Plan, cfg *InterfaceConfig, root string) error {
 	byName := make(map[string]InterfaceDetails)
 	byHardwareAddr := make(map[string]InterfaceDetails)
 	for _, details := range cfg.Interfaces {
@@ -317,16 +684,16 @@ func applyInterfaces(dir, root string) error {
 		byName[details.Name] = details
 	}
 
-	if err := applyBridges(&cfg); err != nil {
-		log.Printf("applyBridges: %v", err)
-	}
-
 	links, err := netlink.LinkList()
 	if err != nil {
 		return err
 	}
 	for _, l := range links {
+		l := l // copy
 		attr := l.Attrs()
+		if t := l.Type(); t == "vlan" || t == "bond" {
+			continue // see planVLANs and planBonds
+		}
 		// TODO: prefix logging line with details about the interface.
 		// link &{LinkAttrs:{Index:2 MTU:1500 TxQLen:1000 Name:eth0 HardwareAddr:00:0d:b9:49:70:18 Flags:broadcast|multicast RawFlags:4098 ParentIndex:0 MasterIndex:0 Namespace:<nil> Alias: Statistics:0xc4200f45f8 Promisc:0 Xdp:0xc4200ca180 EncapType:ether Protinfo:<nil> OperState:down NetNsID:0 NumTxQueues:0 NumRxQueues:0 Vfs:[]}}, attr &{Index:2 MTU:1500 TxQLen:1000 Name:eth0 HardwareAddr:00:0d:b9:49:70:18 Flags:broadcast|multicast RawFlags:4098 ParentIndex:0 MasterIndex:0 Namespace:<nil> Alias: Statistics:0xc4200f45f8 Promisc:0 Xdp:0xc4200ca180 EncapType:ether Protinfo:<nil> OperState:down NetNsID:0 NumTxQueues:0 NumRxQueues:0 Vfs:[]}
 
@@ -334,7 +701,7 @@ func applyInterfaces(dir, root string) error {
 			details InterfaceDetails
 			ok      bool
 		)
-		addr := attr.HardwareAddr.String()
+		addr := permanentHardwareAddr(l).String()
 		if addr == "" {
 			details, ok = byName[attr.Name]
 			if !ok {
@@ -346,67 +713,314 @@ func applyInterfaces(dir, root string) error {
 				details, ok = byName[attr.Name]
 			}
 		}
-		if !ok {
-			log.Printf("no config for interface %s/%s", attr.Name, addr)
+		if !ok {
+			log.Printf("no config for interface %s/%s", attr.Name, addr)
+			continue
+		}
+		if attr.Name != details.Name {
+			name := details.Name
+			p.change(Change{Op: "~", Kind: "link", Object: attr.Name + " name " + name}, func() error {
+				if err := netlink.LinkSetName(l, name); err != nil {
+					return fmt.Errorf("LinkSetName(%q): %v", name, err)
+				}
+				return nil
+			})
+			p.renamed[attr.Name] = true
+		}
+		p.links[details.Name] = l
+
+		if err := planInterface(p, l, details, root); err != nil {
+			return err
+		}
+	}
+	// Bonds are configured by name, as they take the hardware address of
+	// their first member.
+	if err := planBonds(p, cfg); err != nil {
+		log.Printf("planBonds: %v", err)
+	}
+	for _, bond := range cfg.Bonds {
+		if details, ok := byName[bond.Name]; ok {
+			if err := planInterface(p, p.links[bond.Name], details, root); err != nil {
+				return err
+			}
+		}
+	}
+
+	// VLANs are created once their parents (which might be bonds) carry
+	// their configured names, and before bridges, of which they might be
+	// members.
+	if err := planVLANs(p, cfg, root); err != nil {
+		return err
+	}
+
+	if err := planBridges(p, cfg); err != nil {
+		log.Printf("planBridges: %v", err)
+	}
+
+	// Bridges which planBridges creates are not yet returned by LinkList.
+	for _, bridge := range cfg.Bridges {
+		details, ok := byName[bridge.Name]
+		if l := p.links[bridge.Name]; l != nil || !ok {
+			continue
+		}
+		if err := planInterface(p, nil, details, root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// planInterface plans configuring the link l (nil if it will be created by
+// the plan) as specified by details.
+func planInterface(p *Plan, l netlink.Link, details InterfaceDetails, root string) error {
+	name := details.Name
+	if spoof := details.SpoofHardwareAddr; spoof != "" {
+		hwaddr, err := net.ParseMAC(spoof)
+		if err != nil {
+			return fmt.Errorf("ParseMAC(%q): %v", spoof, err)
+		}
+		var current net.HardwareAddr
+		if l != nil {
+			current = l.Attrs().HardwareAddr
+		}
+		if !bytes.Equal(current, hwaddr) {
+			p.change(Change{Op: "~", Kind: "link", Object: name + " address " + hwaddr.String(), From: current.String()}, func() error {
+				l, err := netlink.LinkByName(name)
+				if err != nil {
+					return err
+				}
+				if err := netlink.LinkSetHardwareAddr(l, hwaddr); err != nil {
+					return fmt.Errorf("LinkSetHardwareAddr(%v): %v", hwaddr, err)
+				}
+				return nil
+			})
+		}
+	}
+
+	if l != nil && !isUp(l) {
+		// Set the interface to up, which is required by all other configuration.
+		p.change(Change{Op: "~", Kind: "link", Object: name + " up"}, func() error {
+			if err := netlink.LinkSetUp(l); err != nil {
+				return fmt.Errorf("LinkSetUp(%s): %v", name, err)
+			}
+			return nil
+		})
+	}
+
+	if details.Addr != "" {
+		addr, err := netlink.ParseAddr(details.Addr)
+		if err != nil {
+			return fmt.Errorf("ParseAddr(%q): %v", details.Addr, err)
+		}
+
+		if err := p.planAddr(name, addr); err != nil {
+			return err
+		}
+
+		if name == lanName() {
+			if err := planResolvConf(p, root, addr.IP); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// planResolvConf plans pointing root/tmp/resolv.conf to the LAN address ip.
+func planResolvConf(p *Plan, root string, ip net.IP) error {
+	b := []byte("nameserver " + ip.String() + "\n")
+	fn := filepath.Join(root, "tmp", "resolv.conf")
+	current, err := ioutil.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && bytes.Equal(current, b) {
+		return nil
+	}
+	op := "~"
+	if err != nil {
+		op = "+"
+	}
+	p.change(Change{Op: op, Kind: "file", Object: fn}, func() error {
+		if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return renameio.WriteFile(fn, b, 0644)
+	})
+	return nil
+}
+
+func nfifname(n string) []byte {
+	b := make([]byte, 16)
+	copy(b, []byte(n+"\x00"))
+	return b
+}
+
+// notUplinkExprs matches packets whose interface (iifname or oifname,
+// depending on key) is none of the uplinks.
+func notUplinkExprs(key expr.MetaKey, uplinks []string) []expr.Any {
+	ex := []expr.Any{
+		// [ meta load iifname => reg 1 ]
+		&expr.Meta{Key: key, Register: 1},
+	}
+	for _, ifname := range uplinks {
+		// [ cmp neq reg 1 0x696c7075 0x00306b6e 0x00000000 0x00000000 ]
+		ex = append(ex, &expr.Cmp{
+			Op:       expr.CmpOpNeq,
+			Register: 1,
+			Data:     nfifname(ifname),
+		})
+	}
+	return ex
+}
+
+// isUplink reports whether ifname is one of uplinks or of the configured WAN
+// interfaces, which might not exist (yet).
+func isUplink(ifname string, uplinks []string) bool {
+	for _, u := range append(append([]string{}, uplinks...), uplinkNames()...) {
+		if u == ifname {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedInterfaces returns the interfaces from which the input chain and the
+// IPv6 forward chain accept all traffic: loopback, the LAN interfaces (see
+// interfaces.lan_ifnames in config.toml) and firewall.trusted_interfaces.
+// Traffic from all other interfaces, including WireGuard interfaces which are
+// not listed explicitly, is treated like traffic from the uplink, so that the
+// firewall fails closed when the uplinks cannot be determined. Uplinks are
+// never trusted.
+func (cfg *Config) trustedInterfaces(uplinks []string) []string {
+	candidates := append([]string{"lo"}, config.Current().PreferredLAN...)
+	if cfg.firewall != nil {
+		candidates = append(candidates, cfg.firewall.TrustedInterfaces...)
+	}
+	var trusted []string
+	seen := make(map[string]bool)
+	for _, ifname := range candidates {
+		if seen[ifname] || isUplink(ifname, uplinks) {
 			continue
 		}
-		log.Printf("apply details %+v", details)
-		if attr.Name != details.Name {
-			if err := netlink.LinkSetName(l, details.Name); err != nil {
-				return fmt.Errorf("LinkSetName(%q): %v", details.Name, err)
-			}
-			attr.Name = details.Name
-		}
+		seen[ifname] = true
+		trusted = append(trusted, ifname)
+	}
+	return trusted
+}
 
-		if spoof := details.SpoofHardwareAddr; spoof != "" {
-			hwaddr, err := net.ParseMAC(spoof)
-			if err != nil {
-				return fmt.Errorf("ParseMAC(%q): %v", spoof, err)
-			}
-			if err := netlink.LinkSetHardwareAddr(l, hwaddr); err != nil {
-				return fmt.Errorf("LinkSetHardwareAddr(%v): %v", hwaddr, err)
-			}
+// adminInterfaces returns the interfaces other than loopback from which the
+// admin ports are reachable: firewall.admin_interfaces if set, the LAN
+// interfaces otherwise. Uplinks are never included.
+func (cfg *Config) adminInterfaces(uplinks []string) []string {
+	candidates := config.Current().PreferredLAN
+	if cfg.firewall != nil && len(cfg.firewall.AdminInterfaces) > 0 {
+		candidates = cfg.firewall.AdminInterfaces
+	}
+	var admin []string
+	seen := make(map[string]bool)
+	for _, ifname := range candidates {
+		if ifname == "lo" || seen[ifname] || isUplink(ifname, uplinks) {
+			continue
 		}
+		seen[ifname] = true
+		admin = append(admin, ifname)
+	}
+	return admin
+}
 
-		if attr.OperState != netlink.OperUp {
-			// Set the interface to up, which is required by all other configuration.
-			if err := netlink.LinkSetUp(l); err != nil {
-				return fmt.Errorf("LinkSetUp(%s): %v", attr.Name, err)
-			}
+// uplinkParents returns the untrusted parents of VLANs which are uplinks, e.g.
+// wan0 for uplink0 on wan0 with id 7. Untagged frames arriving on them come
+// from the ISP’s segment, so they are dropped entirely.
+func (cfg *Config) uplinkParents(uplinks []string) []string {
+	trusted := make(map[string]bool)
+	for _, ifname := range cfg.trustedInterfaces(uplinks) {
+		trusted[ifname] = true
+	}
+	var parents []string
+	seen := make(map[string]bool)
+	for _, v := range cfg.interfaces.VLANs {
+		if !isUplink(v.Name, uplinks) || trusted[v.Parent] || isUplink(v.Parent, uplinks) || seen[v.Parent] {
+			continue
 		}
+		seen[v.Parent] = true
+		parents = append(parents, v.Parent)
+	}
+	return parents
+}
 
-		if details.Addr != "" {
-			addr, err := netlink.ParseAddr(details.Addr)
-			if err != nil {
-				return fmt.Errorf("ParseAddr(%q): %v", details.Addr, err)
-			}
+// portForwardExpr matches traffic arriving on the uplink ifname from src (any
+// source if nil) and destined to proto port portMin-portMax. stmts (see
+// portForwarding.stmts) are evaluated for matching packets before they are
+// DNATed to dest.
+func portForwardExpr(ifname string, src *net.IPNet, proto uint8, portMin, portMax uint16, stmts []expr.Any, dest net.IP, dportMin, dportMax uint16) []expr.Any {
+	ex := []expr.Any{
+		// [ meta load iifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		// [ cmp eq reg 1 0x696c7075 0x00306b6e 0x00000000 0x00000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     nfifname(ifname),
+		},
+	}
+	if src != nil {
+		ex = append(ex, addrExprs(src, false)...)
+	}
+	ex = append(ex, portMatchExpr(proto, portMin, portMax)...)
+	ex = append(ex, stmts...)
+	return append(ex, natExpr(dest, dportMin, dportMax)...)
+}
 
-			if err := netlink.AddrReplace(l, addr); err != nil {
-				return fmt.Errorf("AddrReplace(%s, %v): %v", attr.Name, addr, err)
-			}
+// hairpinExpr is like portForwardExpr, but matches traffic which does not
+// arrive on any of the uplinks and is destined to a public address of the
+// router, so that LAN clients can use forwarded ports, too.
+func hairpinExpr(uplinks []string, public net.IP, proto uint8, portMin, portMax uint16, dest net.IP, dportMin, dportMax uint16) []expr.Any {
+	ex := notUplinkExprs(expr.MetaKeyIIFNAME, uplinks)
+	ex = append(ex, addrExprs(&net.IPNet{IP: public.To4(), Mask: net.CIDRMask(32, 32)}, true)...)
+	return append(ex, dnatExpr(proto, portMin, portMax, dest, dportMin, dportMax)...)
+}
 
-			if details.Name == "lan0" {
-				b := []byte("nameserver " + addr.IP.String() + "\n")
-				fn := filepath.Join(root, "tmp", "resolv.conf")
-				if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
-					return err
-				}
-				if err := renameio.WriteFile(fn, b, 0644); err != nil {
-					return err
-				}
-			}
-		}
+// hairpinMasqExpr masquerades hairpinned connections (see hairpinExpr) to
+// dest, so that replies flow back through the router instead of directly to
+// the LAN client, which would not recognize them.
+func hairpinMasqExpr(uplinks []string, proto uint8, dest net.IP, dportMin, dportMax uint16) []expr.Any {
+	var ex []expr.Any
+	for _, key := range []expr.MetaKey{expr.MetaKeyIIFNAME, expr.MetaKeyOIFNAME} {
+		ex = append(ex, notUplinkExprs(key, uplinks)...)
 	}
-	return nil
+	ex = append(ex, addrExprs(&net.IPNet{IP: dest.To4(), Mask: net.CIDRMask(32, 32)}, true)...)
+	ex = append(ex, l4protoExprs(proto)...)
+	ex = append(ex, portExprs(2, dportMin, dportMax)...)
+	return append(ex,
+		// [ ct load status => reg 1 ]
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATUS},
+		// [ bitwise reg 1 = (reg=1 & 0x00000020 ) ^ 0x00000000 ]
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(ipsDstNAT),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		// [ cmp neq reg 1 0x00000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpNeq,
+			Register: 1,
+			Data:     binaryutil.NativeEndian.PutUint32(0),
+		},
+		// [ masq ]
+		&expr.Masq{})
 }
 
-func nfifname(n string) []byte {
-	b := make([]byte, 16)
-	copy(b, []byte(n+"\x00"))
-	return b
+// ipsDstNAT is IPS_DST_NAT from linux/netfilter/nf_conntrack_common.h.
+const ipsDstNAT = 1 << 5
+
+func dnatExpr(proto uint8, portMin, portMax uint16, dest net.IP, dportMin, dportMax uint16) []expr.Any {
+	return append(portMatchExpr(proto, portMin, portMax), natExpr(dest, dportMin, dportMax)...)
 }
 
-func portForwardExpr(ifname string, proto uint8, portMin, portMax uint16, dest net.IP, dportMin, dportMax uint16) []expr.Any {
+func portMatchExpr(proto uint8, portMin, portMax uint16) []expr.Any {
 	var cmp []expr.Any
 	if portMin == portMax {
 		cmp = []expr.Any{
@@ -434,15 +1048,6 @@ func portForwardExpr(ifname string, proto uint8, portMin, portMax uint16, dest n
 		}
 	}
 	ex := []expr.Any{
-		// [ meta load iifname => reg 1 ]
-		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
-		// [ cmp eq reg 1 0x696c7075 0x00306b6e 0x00000000 0x00000000 ]
-		&expr.Cmp{
-			Op:       expr.CmpOpEq,
-			Register: 1,
-			Data:     nfifname(ifname),
-		},
-
 		// [ meta load l4proto => reg 1 ]
 		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
 		// [ cmp eq reg 1 0x00000006 ]
@@ -460,14 +1065,17 @@ func portForwardExpr(ifname string, proto uint8, portMin, portMax uint16, dest n
 			Len:          2, // TODO
 		},
 	}
-	ex = append(ex, cmp...)
-	ex = append(ex,
+	return append(ex, cmp...)
+}
+
+func natExpr(dest net.IP, dportMin, dportMax uint16) []expr.Any {
+	ex := []expr.Any{
 		// [ immediate reg 1 0x0217a8c0 ]
 		&expr.Immediate{
 			Register: 1,
 			Data:     dest.To4(),
 		},
-	)
+	}
 	if dportMin == dportMax {
 		ex = append(ex,
 			// [ immediate reg 2 0x0000f00f ]
@@ -509,10 +1117,87 @@ func portForwardExpr(ifname string, proto uint8, portMin, portMax uint16, dest n
 }
 
 type portForwarding struct {
-	Proto    string `json:"proto"`     // e.g. “tcp” (or “tcp,udp”)
-	Port     string `json:"port"`      // e.g. “8080” (or “8080-8090”)
-	DestAddr string `json:"dest_addr"` // e.g. “192.168.42.2”
-	DestPort string `json:"dest_port"` // e.g. “80” (or “80-90”)
+	Proto    string `json:"proto,omitempty" mapstructure:"proto"`         // e.g. “tcp” (or “tcp,udp”)
+	Port     string `json:"port" mapstructure:"port"`                     // e.g. “8080” (or “8080-8090”)
+	DestAddr string `json:"dest_addr,omitempty" mapstructure:"dest_addr"` // e.g. “192.168.42.2”
+	DestPort string `json:"dest_port" mapstructure:"dest_port"`           // e.g. “80” (or “80-90”)
+
+	// DestHost (e.g. “nas”) or DestMAC (e.g. “02:73:53:00:b0:0c”) identify
+	// the destination by the hostname or MAC address of a dhcp4d client
+	// instead of by DestAddr, so that the forwarding follows the client when
+	// its lease changes. Exactly one of DestAddr, DestHost and DestMAC must be
+	// set.
+	DestHost string `json:"dest_host,omitempty" mapstructure:"dest_host"`
+	DestMAC  string `json:"dest_mac,omitempty" mapstructure:"dest_mac"`
+
+	// Hairpin enables NAT reflection: LAN clients connecting to the public
+	// address of the router (from the DHCPv4 lease) are forwarded, too.
+	Hairpin bool `json:"hairpin,omitempty" mapstructure:"hairpin"`
+
+	Description string `json:"description,omitempty" mapstructure:"description"`
+	Disabled    bool   `json:"disabled,omitempty" mapstructure:"disabled"`
+
+	// AllowedSrc restricts the forwarding to connections from the specified
+	// networks (e.g. “203.0.113.0/24”). Empty means any source.
+	AllowedSrc []string `json:"allowed_src,omitempty" mapstructure:"allowed_src"`
+
+	// RateLimit is the maximum number of new connections per second (0 means
+	// unlimited). Excess connections are not forwarded. Each DNAT rule of the
+	// forwarding carries its own limit, i.e. the limit is enforced separately
+	// for each uplink, each protocol of Proto and each entry of AllowedSrc:
+	// a “tcp,udp” forwarding on two uplinks accepts up to 4×RateLimit new
+	// connections per second in total.
+	RateLimit int `json:"rate_limit,omitempty" mapstructure:"rate_limit"`
+
+	// Counter is the name of an nftables counter (in NATTable) which
+	// counts the connections forwarded from the uplink. Forwardings may share
+	// a counter.
+	Counter string `json:"counter,omitempty" mapstructure:"counter"`
+}
+
+// NFT_OBJECT_COUNTER is the object type of named counters.
+const NFT_OBJECT_COUNTER = 1 // TODO: get into x/sys/unix
+
+var counterNameRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
+
+// sources returns the parsed AllowedSrc, or a single nil entry (meaning any
+// source) if AllowedSrc is empty.
+func (fw *portForwarding) sources() ([]*net.IPNet, error) {
+	if len(fw.AllowedSrc) == 0 {
+		return []*net.IPNet{nil}, nil
+	}
+	srcs := make([]*net.IPNet, 0, len(fw.AllowedSrc))
+	for _, s := range fw.AllowedSrc {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil || ipnet.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid CIDR address %q, expected e.g. 203.0.113.0/24", s)
+		}
+		srcs = append(srcs, ipnet)
+	}
+	return srcs, nil
+}
+
+// stmts returns the rate limit and counter statements of fw.
+func (fw *portForwarding) stmts() []expr.Any {
+	var ex []expr.Any
+	if fw.RateLimit > 0 {
+		// The NAT chains only see the first packet of each connection.
+		// The limit is anonymous, i.e. not shared between rules.
+		// [ limit rate 10/second burst 0 type packets flags 0x0 ]
+		ex = append(ex, &expr.Limit{
+			Type: expr.LimitTypePkts,
+			Rate: uint64(fw.RateLimit),
+			Unit: expr.LimitTimeSecond,
+		})
+	}
+	if fw.Counter != "" {
+		// [ objref type 1 name nas_ssh ]
+		ex = append(ex, &expr.Objref{
+			Type: NFT_OBJECT_COUNTER,
+			Name: fw.Counter,
+		})
+	}
+	return ex
 }
 
 type portForwardings struct {
@@ -537,32 +1222,136 @@ func parsePort(p string) (min uint16, max uint16, _ error) {
 			return 0, 0, fmt.Errorf("ParseInt(%q): %v", matches[2], err)
 		}
 	}
+	if min64 > max64 {
+		return 0, 0, fmt.Errorf("malformed port range %q: %d > %d", p, min64, max64)
+	}
 	return uint16(min64), uint16(max64), nil
 }
 
-func applyPortForwardings(dir, ifname string, c *nftables.Conn, nat *nftables.Table, prerouting *nftables.Chain) error {
-	b, err := ioutil.ReadFile(filepath.Join(dir, "portforwardings.json"))
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+func parseProto(proto string) (uint8, error) {
+	switch proto {
+	case "", "tcp":
+		return unix.IPPROTO_TCP, nil
+	case "udp":
+		return unix.IPPROTO_UDP, nil
+	}
+	return 0, fmt.Errorf(`unknown proto %q, expected "tcp" or "udp"`, proto)
+}
+
+// publicAddr returns the address of the current DHCPv4 lease of the uplink
+// ifname in dir, or nil if dhcp4 has not obtained a lease yet.
+func publicAddr(dir, ifname string) (net.IP, error) {
+	var got dhcp4.Config
+	if err := readJSON(filepath.Join(dir, config.DHCP4Dir(ifname), "lease.json"), &got); err != nil {
+		return nil, err
+	}
+	if got.ClientIP == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(got.ClientIP).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid DHCP lease: malformed client IP %q", got.ClientIP)
+	}
+	return ip, nil
+}
+
+// dest returns the destination address of fw, looking up DestHost or DestMAC
+// in leases if necessary.
+func (fw *portForwarding) dest(leases []dhcpLease) (net.IP, error) {
+	var (
+		l   *dhcpLease
+		err error
+	)
+	switch {
+	case fw.DestHost != "":
+		l, err = lookupHost(leases, fw.DestHost)
+	case fw.DestMAC != "":
+		l, err = lookupHardwareAddr(leases, fw.DestMAC)
+	default:
+		if ip := net.ParseIP(fw.DestAddr).To4(); ip != nil {
+			return ip, nil
 		}
-		return err
+		return nil, fmt.Errorf("malformed address %q, expected IPv4 address", fw.DestAddr)
 	}
-	var cfg portForwardings
-	if err := json.Unmarshal(b, &cfg); err != nil {
-		return err
+	if err != nil {
+		return nil, err
+	}
+	if ip := l.Addr.To4(); ip != nil {
+		return ip, nil
 	}
+	return nil, fmt.Errorf("lease of %s has no IPv4 address", l.HardwareAddr)
+}
 
+func applyPortForwardings(cfg *portForwardings, dir string, uplinks []string, c batch, nat *nftables.Table, prerouting, postrouting *nftables.Chain) error {
+	var leases []dhcpLease
+	for _, fw := range cfg.Forwardings {
+		if fw.Disabled || fw.DestHost == "" && fw.DestMAC == "" {
+			continue
+		}
+		var err error
+		if leases, err = readLeases(dir); err != nil {
+			// Forwardings to literal addresses still work.
+			log.Printf("port forwardings: %v", err)
+		}
+		break
+	}
+	var public []net.IP
+	for _, fw := range cfg.Forwardings {
+		if fw.Disabled || !fw.Hairpin {
+			continue
+		}
+		for _, ifname := range uplinks {
+			addr, err := publicAddr(dir, ifname)
+			if err != nil {
+				return err
+			}
+			if addr == nil {
+				// netconfigd applies the config again once dhcp4 obtained a
+				// lease, i.e. whenever the public address changes.
+				log.Printf("no DHCPv4 lease on %s yet, not setting up NAT reflection", ifname)
+				continue
+			}
+			public = append(public, addr)
+		}
+		break
+	}
+	// Named counters must exist before rules can reference them.
+	var existing []nftables.Obj
+	counters := make(map[string]bool)
 	for _, fw := range cfg.Forwardings {
+		if fw.Disabled || fw.Counter == "" || counters[fw.Counter] {
+			continue
+		}
+		if len(counters) == 0 {
+			// Carry over the counter values, which are lost when flushing the
+			// ruleset. The table does not exist on the first run.
+			existing, _ = c.GetObj(&nftables.CounterObj{Table: nat})
+		}
+		counters[fw.Counter] = true
+		c.AddObj(carryCounter(existing, &nftables.CounterObj{
+			Table: nat,
+			Name:  fw.Counter,
+		}))
+	}
+	for idx, fw := range cfg.Forwardings {
+		if fw.Disabled {
+			continue
+		}
+		srcs, err := fw.sources()
+		if err != nil {
+			return err
+		}
+		dest, err := fw.dest(leases)
+		if err != nil {
+			// netconfigd applies the config again once the client obtains a
+			// lease, see Config.DependsOnLease.
+			log.Printf("forwardings[%d]: %v, skipping", idx, err)
+			continue
+		}
 		for _, proto := range strings.Split(fw.Proto, ",") {
-			var p uint8
-			switch proto {
-			case "", "tcp":
-				p = unix.IPPROTO_TCP
-			case "udp":
-				p = unix.IPPROTO_UDP
-			default:
-				return fmt.Errorf(`unknown proto %q, expected "tcp" or "udp"`, proto)
+			p, err := parseProto(proto)
+			if err != nil {
+				return err
 			}
 
 			min, max, err := parsePort(fw.Port)
@@ -574,11 +1363,29 @@ func applyPortForwardings(dir, ifname string, c *nftables.Conn, nat *nftables.Ta
 				return err
 			}
 
-			c.AddRule(&nftables.Rule{
-				Table: nat,
-				Chain: prerouting,
-				Exprs: portForwardExpr(ifname, p, min, max, net.ParseIP(fw.DestAddr), dmin, dmax),
-			})
+			for _, ifname := range uplinks {
+				for _, src := range srcs {
+					c.AddRule(&nftables.Rule{
+						Table: nat,
+						Chain: prerouting,
+						Exprs: portForwardExpr(ifname, src, p, min, max, fw.stmts(), dest, dmin, dmax),
+					})
+				}
+			}
+			if fw.Hairpin && len(public) > 0 {
+				for _, addr := range public {
+					c.AddRule(&nftables.Rule{
+						Table: nat,
+						Chain: prerouting,
+						Exprs: hairpinExpr(uplinks, addr, p, min, max, dest, dmin, dmax),
+					})
+				}
+				c.AddRule(&nftables.Rule{
+					Table: nat,
+					Chain: postrouting,
+					Exprs: hairpinMasqExpr(uplinks, p, dest, dmin, dmax),
+				})
+			}
 		}
 	}
 	return nil
@@ -587,7 +1394,7 @@ func applyPortForwardings(dir, ifname string, c *nftables.Conn, nat *nftables.Ta
 // DefaultCounterObj is overridden while testing
 var DefaultCounterObj = &nftables.CounterObj{}
 
-func getCounterObj(c *nftables.Conn, o *nftables.CounterObj) *nftables.CounterObj {
+func getCounterObj(c batch, o *nftables.CounterObj) *nftables.CounterObj {
 	objs, err := c.GetObj(o)
 	if err != nil {
 		o.Bytes = DefaultCounterObj.Bytes
@@ -624,14 +1431,97 @@ func getCounterObj(c *nftables.Conn, o *nftables.CounterObj) *nftables.CounterOb
 	return o
 }
 
-func applyFirewall(dir, ifname string) error {
-	c := &nftables.Conn{}
+// carryCounter returns the counter named like o from existing (see
+// Conn.GetObj), or o with the DefaultCounterObj values.
+func carryCounter(existing []nftables.Obj, o *nftables.CounterObj) *nftables.CounterObj {
+	for _, obj := range existing {
+		if co, ok := obj.(*nftables.CounterObj); ok && co.Table.Name == o.Table.Name && co.Name == o.Name {
+			return co
+		}
+	}
+	o.Bytes = DefaultCounterObj.Bytes
+	o.Packets = DefaultCounterObj.Packets
+	return o
+}
+
+// Names of the nftables tables which rout5 manages. They are prefixed so that
+// they cannot clash with tables of other software on the same box, e.g.
+// iptables-nft (which uses nat and filter), container runtimes or fail2ban.
+const (
+	NATTable    = "rout5_nat"    // family ip
+	FilterTable = "rout5_filter" // families ip and ip6
+)
+
+// legacyTables returns the tables which rout5 used before its table names were
+// prefixed (ip nat, ip filter and ip6 filter), so that they can be deleted:
+// otherwise, their rules (e.g. port forwardings which were removed since)
+// would remain in effect. Tables of the same names which other software
+// created (e.g. iptables-nft) are left alone: the nat table of rout5 is
+// recognized by its lowercase prerouting and postrouting chains, the filter
+// tables by their fwded counter.
+func legacyTables(c batch) ([]*nftables.Table, error) {
+	chains, err := c.ListChains()
+	if err != nil {
+		return nil, fmt.Errorf("ListChains: %v", err)
+	}
+	var (
+		legacy    []*nftables.Table
+		nat       *nftables.Table
+		natChains = make(map[string]bool)
+	)
+	for _, ch := range chains {
+		t := ch.Table
+		switch {
+		case t.Family == nftables.TableFamilyIPv4 && t.Name == "nat":
+			nat = t
+			natChains[ch.Name] = true
+		case (t.Family == nftables.TableFamilyIPv4 || t.Family == nftables.TableFamilyIPv6) &&
+			t.Name == "filter" && ch.Name == "forward":
+			objs, err := c.GetObj(&nftables.CounterObj{Table: t, Name: "fwded"})
+			if err != nil {
+				return nil, fmt.Errorf("GetObj(%s filter): %v", familyString(t.Family), err)
+			}
+			for _, o := range objs {
+				if co, ok := o.(*nftables.CounterObj); ok && co.Name == "fwded" {
+					legacy = append(legacy, t)
+					break
+				}
+			}
+		}
+	}
+	if natChains["prerouting"] && natChains["postrouting"] {
+		legacy = append(legacy, nat)
+	}
+	return legacy, nil
+}
+
+// replaceTable adds t to the batch of c, replacing the previous table of the
+// same name (including its chains, rules and objects). The table is added
+// before it is deleted so that the deletion succeeds on the first run, too.
+func replaceTable(c batch, t *nftables.Table) *nftables.Table {
+	c.AddTable(t)
+	c.DelTable(t)
+	return c.AddTable(t)
+}
 
-	c.FlushRuleset()
+// buildFirewall adds the tables of rout5 (see NATTable and FilterTable) to c,
+// replacing their previous contents. All other tables are left untouched,
+// except for the tables of previous versions (see legacyTables).
+// uplinks are the names of the WAN interfaces, see Plan.uplinkInterfaces.
+func buildFirewall(c batch, cfg *Config, dir string, uplinks []string) error {
+	// Tables of previous versions are deleted in the same batch, i.e. when
+	// the tables which replace them take effect.
+	legacy, err := legacyTables(c)
+	if err != nil {
+		return err
+	}
+	for _, t := range legacy {
+		c.DelTable(t)
+	}
 
-	nat := c.AddTable(&nftables.Table{
+	nat := replaceTable(c, &nftables.Table{
 		Family: nftables.TableFamilyIPv4,
-		Name:   "nat",
+		Name:   NATTable,
 	})
 
 	prerouting := c.AddChain(&nftables.Chain{
@@ -650,113 +1540,133 @@ func applyFirewall(dir, ifname string) error {
 		Type:     nftables.ChainTypeNAT,
 	})
 
-	c.AddRule(&nftables.Rule{
-		Table: nat,
-		Chain: postrouting,
-		Exprs: []expr.Any{
-			// meta load oifname => reg 1
-			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
-			// cmp eq reg 1 0x696c7075 0x00306b6e 0x00000000 0x00000000
-			&expr.Cmp{
-				Op:       expr.CmpOpEq,
-				Register: 1,
-				Data:     nfifname(ifname),
+	for _, ifname := range uplinks {
+		c.AddRule(&nftables.Rule{
+			Table: nat,
+			Chain: postrouting,
+			Exprs: []expr.Any{
+				// meta load oifname => reg 1
+				&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+				// cmp eq reg 1 0x696c7075 0x00306b6e 0x00000000 0x00000000
+				&expr.Cmp{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					Data:     nfifname(ifname),
+				},
+				// masq
+				&expr.Masq{},
 			},
-			// masq
-			&expr.Masq{},
-		},
-	})
+		})
+	}
 
-	if err := applyPortForwardings(dir, ifname, c, nat, prerouting); err != nil {
+	if err := applyPortForwardings(&cfg.forwardings, dir, uplinks, c, nat, prerouting, postrouting); err != nil {
 		return err
 	}
 
-	filter4 := c.AddTable(&nftables.Table{
+	filter4 := replaceTable(c, &nftables.Table{
 		Family: nftables.TableFamilyIPv4,
-		Name:   "filter",
+		Name:   FilterTable,
 	})
 
-	filter6 := c.AddTable(&nftables.Table{
+	filter6 := replaceTable(c, &nftables.Table{
 		Family: nftables.TableFamilyIPv6,
-		Name:   "filter",
+		Name:   FilterTable,
 	})
 
 	for _, filter := range []*nftables.Table{filter4, filter6} {
-		forward := c.AddChain(&nftables.Chain{
+		forward := &nftables.Chain{
 			Name:     "forward",
 			Hooknum:  nftables.ChainHookForward,
 			Priority: nftables.ChainPriorityFilter,
 			Table:    filter,
 			Type:     nftables.ChainTypeFilter,
-		})
-
-		c.AddRule(&nftables.Rule{
-			Table: filter,
-			Chain: forward,
-			Exprs: []expr.Any{
-				// [ meta load oifname => reg 1 ]
-				&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
-				// [ cmp eq reg 1 0x30707070 0x00000000 0x00000000 0x00000000 ]
-				&expr.Cmp{
-					Op:       expr.CmpOpEq,
-					Register: 1,
-					Data:     nfifname(ifname),
-				},
-
-				// [ meta load l4proto => reg 1 ]
-				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
-				// [ cmp eq reg 1 0x00000006 ]
-				&expr.Cmp{
-					Op:       expr.CmpOpEq,
-					Register: 1,
-					Data:     []byte{unix.IPPROTO_TCP},
-				},
+		}
+		if filter == filter6 && (cfg.firewall == nil || cfg.firewall.Forward6Policy != "accept") {
+			// Unlike with IPv4, where NAT hides LAN hosts, all LAN hosts
+			// are addressable via IPv6. See applyForward6.
+			policy := nftables.ChainPolicyDrop
+			forward.Policy = &policy
+		}
+		c.AddChain(forward)
 
-				// [ payload load 1b @ transport header + 13 => reg 1 ]
-				&expr.Payload{
-					DestRegister: 1,
-					Base:         expr.PayloadBaseTransportHeader,
-					Offset:       13, // TODO
-					Len:          1,  // TODO
-				},
-				// [ bitwise reg 1 = (reg=1 & 0x00000002 ) ^ 0x00000000 ]
-				&expr.Bitwise{
-					DestRegister:   1,
-					SourceRegister: 1,
-					Len:            1,
-					Mask:           []byte{0x02},
-					Xor:            []byte{0x00},
-				},
-				// [ cmp neq reg 1 0x00000000 ]
-				&expr.Cmp{
-					Op:       expr.CmpOpNeq,
-					Register: 1,
-					Data:     []byte{0x00},
-				},
+		for _, ifname := range cfg.uplinkParents(uplinks) {
+			c.AddRule(&nftables.Rule{
+				Table: filter,
+				Chain: forward,
+				Exprs: append(ifnameExprs(expr.MetaKeyIIFNAME, ifname),
+					verdictExpr(expr.VerdictDrop)),
+			})
+		}
 
-				// [ rt load tcpmss => reg 1 ]
-				&expr.Rt{
-					Register: 1,
-					Key:      expr.RtTCPMSS,
-				},
-				// [ byteorder reg 1 = hton(reg 1, 2, 2) ]
-				&expr.Byteorder{
-					DestRegister:   1,
-					SourceRegister: 1,
-					Op:             expr.ByteorderHton,
-					Len:            2,
-					Size:           2,
-				},
-				// [ exthdr write tcpopt reg 1 => 2b @ 2 + 2 ]
-				&expr.Exthdr{
-					SourceRegister: 1,
-					Type:           2, // TODO
-					Offset:         2,
-					Len:            2,
-					Op:             expr.ExthdrOpTcpopt,
+		for _, ifname := range uplinks {
+			c.AddRule(&nftables.Rule{
+				Table: filter,
+				Chain: forward,
+				Exprs: []expr.Any{
+					// [ meta load oifname => reg 1 ]
+					&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+					// [ cmp eq reg 1 0x30707070 0x00000000 0x00000000 0x00000000 ]
+					&expr.Cmp{
+						Op:       expr.CmpOpEq,
+						Register: 1,
+						Data:     nfifname(ifname),
+					},
+
+					// [ meta load l4proto => reg 1 ]
+					&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+					// [ cmp eq reg 1 0x00000006 ]
+					&expr.Cmp{
+						Op:       expr.CmpOpEq,
+						Register: 1,
+						Data:     []byte{unix.IPPROTO_TCP},
+					},
+
+					// [ payload load 1b @ transport header + 13 => reg 1 ]
+					&expr.Payload{
+						DestRegister: 1,
+						Base:         expr.PayloadBaseTransportHeader,
+						Offset:       13, // TODO
+						Len:          1,  // TODO
+					},
+					// [ bitwise reg 1 = (reg=1 & 0x00000002 ) ^ 0x00000000 ]
+					&expr.Bitwise{
+						DestRegister:   1,
+						SourceRegister: 1,
+						Len:            1,
+						Mask:           []byte{0x02},
+						Xor:            []byte{0x00},
+					},
+					// [ cmp neq reg 1 0x00000000 ]
+					&expr.Cmp{
+						Op:       expr.CmpOpNeq,
+						Register: 1,
+						Data:     []byte{0x00},
+					},
+
+					// [ rt load tcpmss => reg 1 ]
+					&expr.Rt{
+						Register: 1,
+						Key:      expr.RtTCPMSS,
+					},
+					// [ byteorder reg 1 = hton(reg 1, 2, 2) ]
+					&expr.Byteorder{
+						DestRegister:   1,
+						SourceRegister: 1,
+						Op:             expr.ByteorderHton,
+						Len:            2,
+						Size:           2,
+					},
+					// [ exthdr write tcpopt reg 1 => 2b @ 2 + 2 ]
+					&expr.Exthdr{
+						SourceRegister: 1,
+						Type:           2, // TODO
+						Offset:         2,
+						Len:            2,
+						Op:             expr.ExthdrOpTcpopt,
+					},
 				},
-			},
-		})
+			})
+		}
 
 		counterObj := getCounterObj(c, &nftables.CounterObj{
 			Table: filter,
@@ -764,7 +1674,6 @@ func applyFirewall(dir, ifname string) error {
 		})
 		counter := c.AddObj(counterObj).(*nftables.CounterObj)
 
-		const NFT_OBJECT_COUNTER = 1 // TODO: get into x/sys/unix
 		c.AddRule(&nftables.Rule{
 			Table: filter,
 			Chain: forward,
@@ -776,98 +1685,27 @@ func applyFirewall(dir, ifname string) error {
 				},
 			},
 		})
-	}
-
-	return c.Flush()
-}
 
-func uplinkInterface() (string, error) {
-	names := []string{
-		"uplink0", // rout5
-		"eth0",    // gokrazy
-		"ens3",    // distri
-	}
-	for _, ifname := range names {
-		if _, err := net.InterfaceByName(ifname); err != nil {
-			continue
+		if err := applyAccounting(c, cfg, dir, filter, forward, uplinks); err != nil {
+			return err
 		}
-		return ifname, nil
-	}
-	return "", fmt.Errorf("no uplink ethernet interface found (checked %v)", names)
-}
 
-func applySysctl(ifname string) error {
-	sysctls := []string{
-		"net.ipv4.ip_forward=1",
-		"net.ipv6.conf.all.forwarding=1",
-	}
-	if ifname != "" {
-		sysctls = append(sysctls, "net.ipv6.conf."+ifname+".accept_ra=2")
-	}
-	for _, ctl := range sysctls {
-		idx := strings.Index(ctl, "=")
-		key, val := ctl[:idx], ctl[idx+1:]
-		fn := strings.Replace(key, ".", "/", -1)
-		if err := ioutil.WriteFile("/proc/sys/"+fn, []byte(val), 0644); err != nil {
-			return fmt.Errorf("sysctl(%v=%v): %v", key, val, err)
+		if err := applyFilterRules(c, cfg, filter, forward, "forward"); err != nil {
+			return err
 		}
-	}
-
-	return nil
-}
-
-func Apply(dir, root string) error {
-
-	// TODO: split into two parts: delay the up until later
-	if err := applyInterfaces(dir, root); err != nil {
-		return fmt.Errorf("interfaces: %v", err)
-	}
-
-	var errors []error
-	appendError := func(err error) {
-		errors = append(errors, err)
-		log.Println(err)
-	}
 
-	if err := applyDhcp4(dir); err != nil {
-		appendError(fmt.Errorf("dhcp4: %v", err))
-	}
-
-	if err := applyDhcp6(dir); err != nil {
-		appendError(fmt.Errorf("dhcp6: %v", err))
-	}
-
-	for _, process := range []string{
-		"dyndns",   // depends on the public IPv4 address
-		"dnsd",     // listens on private IPv4/IPv6
-		"diagd",    // listens on private IPv4/IPv6
-		"backupd",  // listens on private IPv4/IPv6
-		"captured", // listens on private IPv4/IPv6
-	} {
-		if err := ipc.Process("/user/"+process, ipc.SigUSR1); err != nil {
-			log.Printf("notifying %s: %v", process, err)
+		if filter == filter6 {
+			if err := applyForward6(c, cfg, dir, filter, forward, uplinks); err != nil {
+				return err
+			}
 		}
-	}
-
-	ifname, err := uplinkInterface()
-	if err != nil {
-		log.Printf("uplinkInterface: %v", err)
-	}
-
-	if err := applySysctl(ifname); err != nil {
-		appendError(fmt.Errorf("sysctl: %v", err))
-	}
 
-	if err := applyFirewall(dir, ifname); err != nil {
-		appendError(fmt.Errorf("firewall: %v", err))
+		if err := applyInput(c, cfg, filter, uplinks); err != nil {
+			return err
+		}
 	}
 
-	if err := applyWireGuard(dir); err != nil {
-		appendError(fmt.Errorf("wireguard: %v", err))
-	}
+	applyUplinkMarks(c, filter4, uplinks)
 
-	if len(errors) > 0 {
-		return fmt.Errorf("%v", errors)
-	}
 	return nil
 }
@@ -0,0 +1,295 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// pinhole makes a port of a LAN host reachable via IPv6 from the Internet,
+// despite the drop policy of the IPv6 forward chain (see
+// firewallConfig.Forward6Policy). It is read from [[netconfig.pinholes]] in
+// config.toml, e.g.:
+//
+//	[[netconfig.pinholes]]
+//	host = "nas"
+//	port = "443"
+//
+// The host is identified by its interface identifiers, i.e. the lower 64
+// bits of its addresses, so that the pinhole remains valid when the delegated
+// prefix changes. Exactly one of Host, HardwareAddr and IID must be set.
+type pinhole struct {
+	// Host is the hostname of a DHCPv4 client of dhcp4d, whose MAC address
+	// determines the interface identifiers, see hostIIDs.
+	Host string `json:"host,omitempty" mapstructure:"host"`
+
+	// HardwareAddr is a MAC address, which determines the interface
+	// identifiers, see hostIIDs.
+	HardwareAddr string `json:"hardware_addr,omitempty" mapstructure:"hardware_addr"`
+
+	// IID is the interface identifier, e.g. “::1:2”, for hosts with a static
+	// address.
+	IID string `json:"iid,omitempty" mapstructure:"iid"`
+
+	Proto string `json:"proto,omitempty" mapstructure:"proto"` // e.g. “tcp” (or “tcp,udp”)
+	Port  string `json:"port" mapstructure:"port"`             // e.g. “443” (or “60000-61000”)
+}
+
+// parseIID parses an interface identifier, e.g. “::1:2”.
+func parseIID(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() != nil || !ip.Mask(net.CIDRMask(64, 128)).Equal(net.IPv6zero) {
+		return nil, fmt.Errorf("malformed interface identifier %q, expected e.g. ::1:2", s)
+	}
+	return ip, nil
+}
+
+func (p *pinhole) validate(pl *problemList, field string) {
+	var set []string
+	for _, id := range []struct {
+		key, val string
+	}{
+		{"host", p.Host},
+		{"hardware_addr", p.HardwareAddr},
+		{"iid", p.IID},
+	} {
+		if id.val != "" {
+			set = append(set, id.key)
+		}
+	}
+	if len(set) != 1 {
+		pl.add(field, "exactly one of host, hardware_addr and iid must be set (got %d)", len(set))
+	}
+	if p.HardwareAddr != "" {
+		if hwaddr, err := net.ParseMAC(p.HardwareAddr); err != nil {
+			pl.add(field+".hardware_addr", "%v", err)
+		} else if _, err := eui64(hwaddr); err != nil {
+			pl.add(field+".hardware_addr", "%v", err)
+		}
+	}
+	if p.IID != "" {
+		if _, err := parseIID(p.IID); err != nil {
+			pl.add(field+".iid", "%v", err)
+		}
+	}
+	for _, proto := range strings.Split(p.Proto, ",") {
+		if _, err := parseProto(proto); err != nil {
+			pl.add(field+".proto", "%v", err)
+		}
+	}
+	if _, _, err := parsePort(p.Port); err != nil {
+		pl.add(field+".port", "%v", err)
+	}
+}
+
+// iids returns the interface identifiers of the pinhole’s host, see hostIIDs.
+func (p *pinhole) iids(leases []dhcpLease, neighs []netlink.Neigh) ([]net.IP, error) {
+	switch {
+	case p.IID != "":
+		iid, err := parseIID(p.IID)
+		if err != nil {
+			return nil, err
+		}
+		return []net.IP{iid}, nil
+	case p.HardwareAddr != "":
+		hwaddr, err := net.ParseMAC(p.HardwareAddr)
+		if err != nil {
+			return nil, err
+		}
+		return hostIIDs(hwaddr, neighs)
+	}
+	l, err := lookupHost(leases, p.Host)
+	if err != nil {
+		return nil, err
+	}
+	hwaddr, err := net.ParseMAC(l.HardwareAddr)
+	if err != nil {
+		return nil, err
+	}
+	return hostIIDs(hwaddr, neighs)
+}
+
+// readNeighbors returns the IPv6 neighbours which the kernel currently knows
+// of, see hostIIDs.
+func readNeighbors() ([]netlink.Neigh, error) {
+	return netlink.NeighList(0, netlink.FAMILY_V6)
+}
+
+// hostIIDs returns the interface identifiers of the host with MAC address
+// hwaddr: the EUI-64 interface identifier which SLAAC derives from hwaddr, and
+// those of the host’s global addresses in the neighbour table neighs. Most
+// operating systems (Windows, macOS, iOS, Android and Linux with stable
+// privacy addresses) do not use EUI-64 addresses, so their addresses are only
+// known once they communicated; netconfigd applies the config again when a
+// host shows up with a new address (see Config.DependsOnNeighbor).
+//
+// The result is sorted, so that the rules do not change with the order of
+// the neighbour table.
+func hostIIDs(hwaddr net.HardwareAddr, neighs []netlink.Neigh) ([]net.IP, error) {
+	eui, err := eui64(hwaddr)
+	if err != nil {
+		return nil, err
+	}
+	iids := []net.IP{eui}
+	seen := map[string]bool{eui.String(): true}
+	for _, n := range neighs {
+		if !bytes.Equal(n.HardwareAddr, hwaddr) ||
+			n.IP.To4() != nil ||
+			!n.IP.IsGlobalUnicast() ||
+			n.State&(netlink.NUD_INCOMPLETE|netlink.NUD_FAILED) != 0 {
+			continue
+		}
+		iid := make(net.IP, net.IPv6len)
+		copy(iid[8:], n.IP.To16()[8:])
+		if seen[iid.String()] {
+			continue
+		}
+		seen[iid.String()] = true
+		iids = append(iids, iid)
+	}
+	sort.Slice(iids, func(i, j int) bool { return bytes.Compare(iids[i], iids[j]) < 0 })
+	return iids, nil
+}
+
+// iidMask is ::ffff:ffff:ffff:ffff, i.e. the interface identifier of an IPv6
+// address.
+var iidMask = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// iidExprs matches the interface identifier of the IPv6 source (dst == false)
+// or destination address against iid, regardless of the prefix.
+func iidExprs(iid net.IP, dst bool) []expr.Any {
+	offset := uint32(8) // ip6 saddr
+	if dst {
+		offset = 24
+	}
+	return []expr.Any{
+		// [ payload load 16b @ network header + 24 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          16,
+		},
+		// [ bitwise reg 1 = (reg=1 & 0x00000000 0x00000000 0xffffffff 0xffffffff ) ^ 0x00000000 0x00000000 0x00000000 0x00000000 ]
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            16,
+			Mask:           iidMask,
+			Xor:            make([]byte, 16),
+		},
+		// [ cmp eq reg 1 0x00000000 0x00000000 0xff110002 0x55443efe ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     iid.To16(),
+		},
+	}
+}
+
+// applyForward6 adds the rules implementing the IPv6 forward policy to
+// forward, the forward chain of the ip6 filter table: LAN hosts may connect to
+// the Internet, but unsolicited inbound traffic from the uplink is dropped
+// unless a pinhole permits it.
+func applyForward6(c batch, cfg *Config, dir string, filter *nftables.Table, forward *nftables.Chain, uplinks []string) error {
+	var fw firewallConfig
+	if cfg.firewall != nil {
+		fw = *cfg.firewall
+	}
+	if fw.Forward6Policy == "accept" {
+		return nil
+	}
+	add := func(exprs ...expr.Any) {
+		c.AddRule(&nftables.Rule{
+			Table: filter,
+			Chain: forward,
+			Exprs: exprs,
+		})
+	}
+
+	// ct state established,related accept
+	add(append(ctStateExprs(expr.CtStateBitESTABLISHED|expr.CtStateBitRELATED),
+		verdictExpr(expr.VerdictAccept))...)
+
+	// iifname "lan0" accept
+	for _, ifname := range cfg.trustedInterfaces(uplinks) {
+		add(append(ifnameExprs(expr.MetaKeyIIFNAME, ifname),
+			verdictExpr(expr.VerdictAccept))...)
+	}
+
+	// ICMPv6 messages which must not be dropped in transit, see RFC 4890,
+	// section 4.3.1.
+	icmpTypes := []uint8{
+		1, // destination-unreachable
+		2, // packet-too-big
+		3, // time-exceeded
+		4, // parameter-problem
+	}
+	if !fw.DropPing {
+		icmpTypes = append([]uint8{128}, icmpTypes...) // echo-request
+	}
+	for _, typ := range icmpTypes {
+		add(icmpTypeExprs(unix.IPPROTO_ICMPV6, typ, verdictExpr(expr.VerdictAccept))...)
+	}
+
+	if len(cfg.pinholes) == 0 {
+		return nil
+	}
+	leases, err := readLeases(dir)
+	if err != nil {
+		// Pinholes which do not reference a host still work.
+		log.Printf("pinholes: %v", err)
+	}
+	neighs, err := readNeighbors()
+	if err != nil {
+		// EUI-64 addresses still work.
+		log.Printf("pinholes: %v", err)
+	}
+	for idx, p := range cfg.pinholes {
+		iids, err := p.iids(leases, neighs)
+		if err != nil {
+			// The host might obtain a lease later on.
+			log.Printf("pinholes[%d]: %v, skipping", idx, err)
+			continue
+		}
+		min, max, err := parsePort(p.Port)
+		if err != nil {
+			return err
+		}
+		for _, iid := range iids {
+			for _, proto := range strings.Split(p.Proto, ",") {
+				pr, err := parseProto(proto)
+				if err != nil {
+					return err
+				}
+				ex := iidExprs(iid, true)
+				ex = append(ex, l4protoExprs(pr)...)
+				ex = append(ex, portExprs(2, min, max)...)
+				add(append(ex, verdictExpr(expr.VerdictAccept))...)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,390 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"git.tcp.direct/kayos/rout5/config"
+)
+
+// A Change is a single modification of the kernel state (or of a file below
+// root), see Plan.
+type Change struct {
+	Op     string `json:"op"`             // "+" (add), "-" (remove) or "~" (modify)
+	Kind   string `json:"kind"`           // e.g. link, addr, route, sysctl, file, nft, wireguard
+	Object string `json:"object"`         // e.g. 192.168.42.1/24 on lan0
+	From   string `json:"from,omitempty"` // previous value of modified objects
+}
+
+// String returns c in the form “+ addr 192.168.42.1/24 on lan0”.
+func (c Change) String() string {
+	s := c.Op + " " + c.Kind + " " + c.Object
+	if c.From != "" {
+		s += " (was " + c.From + ")"
+	}
+	return s
+}
+
+// A Plan lists the changes which applying a Config entails, computed by
+// diffing the desired state against the kernel state at the time of planning.
+// Apply makes these changes without diffing again, so changes which others
+// made in the meantime are overwritten. Callers which apply a plan that was
+// reviewed earlier (e.g. “rout5 config apply”) must plan again and compare
+// the Digest of both plans before calling Apply.
+type Plan struct {
+	Changes []Change `json:"changes"`
+
+	// Errors lists the parts of the config which could not be planned (e.g.
+	// “dhcp4: invalid DHCP lease: no subnet mask present”). Apply returns
+	// them, too.
+	Errors []string `json:"errors,omitempty"`
+
+	area  string // part of the config which is currently planned
+	steps []planStep
+
+	// links maps interface names to the links which will carry these names
+	// once the changes planned so far are applied. The link is nil if it will
+	// be created by such a change.
+	links   map[string]netlink.Link
+	renamed map[string]bool // current names of links which will be renamed
+}
+
+type planStep struct {
+	area  string // e.g. dhcp4, see Plan.area
+	apply func() error
+}
+
+func (p *Plan) describe(c Change) {
+	p.Changes = append(p.Changes, c)
+}
+
+func (p *Plan) step(fn func() error) {
+	p.steps = append(p.steps, planStep{area: p.area, apply: fn})
+}
+
+// change records c, which fn makes once the plan is applied.
+func (p *Plan) change(c Change, fn func() error) {
+	p.describe(c)
+	p.step(fn)
+}
+
+func (p *Plan) fail(err error) {
+	err = fmt.Errorf("%s: %v", p.area, err)
+	p.Errors = append(p.Errors, err.Error())
+	log.Println(err)
+}
+
+// link returns the link which will be named name once the changes planned so
+// far are applied, see Plan.links.
+func (p *Plan) link(name string) (netlink.Link, error) {
+	if l, ok := p.links[name]; ok {
+		return l, nil
+	}
+	if p.renamed[name] {
+		return nil, fmt.Errorf("link %s is renamed", name)
+	}
+	return netlink.LinkByName(name)
+}
+
+// String returns the changes of p in human-readable form, one per line.
+func (p *Plan) String() string {
+	var b strings.Builder
+	for _, c := range p.Changes {
+		b.WriteString(c.String())
+		b.WriteByte('\n')
+	}
+	for _, err := range p.Errors {
+		fmt.Fprintf(&b, "! %s\n", err)
+	}
+	return b.String()
+}
+
+// Digest identifies the changes and errors of p, e.g. “3f2a9c1e0b7d4a65”:
+// plans which describe the same changes have the same digest.
+func (p *Plan) Digest() string {
+	h := sha256.Sum256([]byte(p.String()))
+	return hex.EncodeToString(h[:8])
+}
+
+// Apply makes the changes of p. Once a change fails, the remaining changes of
+// the same part of the config (e.g. dhcp4) are skipped. A failure to
+// configure interfaces aborts Apply, as all other parts depend on them.
+func (p *Plan) Apply() error {
+	var errors []error
+	for _, err := range p.Errors {
+		errors = append(errors, fmt.Errorf("%s", err))
+	}
+	failed := make(map[string]bool)
+	for _, s := range p.steps {
+		if failed[s.area] {
+			continue
+		}
+		if err := s.apply(); err != nil {
+			err = fmt.Errorf("%s: %v", s.area, err)
+			if s.area == "interfaces" {
+				return err
+			}
+			failed[s.area] = true
+			errors = append(errors, err)
+			log.Println(err)
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("%v", errors)
+	}
+	return nil
+}
+
+// hasAddr reports whether l (nil if it does not exist yet) carries addr.
+func hasAddr(l netlink.Link, addr *netlink.Addr) (bool, error) {
+	if l == nil {
+		return false, nil
+	}
+	addrs, err := netlink.AddrList(l, netlink.FAMILY_ALL)
+	if err != nil {
+		return false, fmt.Errorf("AddrList(%s): %v", l.Attrs().Name, err)
+	}
+	for _, a := range addrs {
+		if a.IPNet.String() == addr.IPNet.String() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// planAddr plans adding addr to the link which will be named name.
+func (p *Plan) planAddr(name string, addr *netlink.Addr) error {
+	l, err := p.link(name)
+	if err != nil {
+		return err
+	}
+	ok, err := hasAddr(l, addr)
+	if err != nil || ok {
+		return err
+	}
+	p.change(Change{Op: "+", Kind: "addr", Object: addr.IPNet.String() + " on " + name}, func() error {
+		l, err := netlink.LinkByName(name)
+		if err != nil {
+			return err
+		}
+		if err := netlink.AddrReplace(l, addr); err != nil {
+			return fmt.Errorf("AddrReplace(%s, %v): %v", name, addr, err)
+		}
+		return nil
+	})
+	return nil
+}
+
+// planRoute plans replacing the route r of the link which will be named name.
+// r.LinkIndex is filled in when the plan is applied.
+func (p *Plan) planRoute(name string, r netlink.Route) error {
+	l, err := p.link(name)
+	if err != nil {
+		return err
+	}
+	if l != nil {
+		routes, err := netlink.RouteList(l, netlink.FAMILY_V4)
+		if err != nil {
+			return fmt.Errorf("RouteList(%s): %v", name, err)
+		}
+		for _, got := range routes {
+			if got.Dst == nil {
+				// netlink reports default routes without destination.
+				got.Dst = &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+			}
+			if got.Dst.String() == r.Dst.String() &&
+				got.Gw.Equal(r.Gw) &&
+				got.Src.Equal(r.Src) &&
+				got.Protocol == r.Protocol {
+				return nil
+			}
+		}
+	}
+	desc := r.Dst.String()
+	if r.Gw != nil {
+		desc += " via " + r.Gw.String()
+	}
+	p.change(Change{Op: "+", Kind: "route", Object: desc + " dev " + name}, func() error {
+		l, err := netlink.LinkByName(name)
+		if err != nil {
+			return err
+		}
+		r.LinkIndex = l.Attrs().Index
+		if err := netlink.RouteReplace(&r); err != nil {
+			return fmt.Errorf("RouteReplace(%s): %v", desc, err)
+		}
+		return nil
+	})
+	return nil
+}
+
+func planSysctl(p *Plan, uplinks []string) error {
+	sysctls := []string{
+		"net.ipv4.ip_forward=1",
+		"net.ipv6.conf.all.forwarding=1",
+	}
+	for _, ifname := range uplinks {
+		sysctls = append(sysctls, "net.ipv6.conf."+ifname+".accept_ra=2")
+	}
+	for _, ctl := range sysctls {
+		idx := strings.Index(ctl, "=")
+		key, val := ctl[:idx], ctl[idx+1:]
+		fn := "/proc/sys/" + strings.Replace(key, ".", "/", -1)
+		// The file does not exist yet if ifname is created by this plan.
+		b, err := ioutil.ReadFile(fn)
+		current := strings.TrimSpace(string(b))
+		if err == nil && current == val {
+			continue
+		}
+		p.change(Change{Op: "~", Kind: "sysctl", Object: ctl, From: current}, func() error {
+			if err := ioutil.WriteFile(fn, []byte(val), 0644); err != nil {
+				return fmt.Errorf("sysctl(%v=%v): %v", key, val, err)
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
+// uplinkInterfaces returns the names of the uplinks (interfaces.wan_ifnames)
+// which exist once the changes planned so far are applied, in order of
+// preference. Without any, it falls back to the first of the default
+// interfaces of gokrazy and distri.
+func (p *Plan) uplinkInterfaces() ([]string, error) {
+	exists := func(ifname string) bool {
+		if _, ok := p.links[ifname]; ok {
+			return true
+		}
+		if p.renamed[ifname] {
+			return false
+		}
+		_, err := net.InterfaceByName(ifname)
+		return err == nil
+	}
+	wan := config.Current().PreferredWAN
+	var uplinks []string
+	for _, ifname := range wan {
+		if exists(ifname) {
+			uplinks = append(uplinks, ifname)
+		}
+	}
+	if len(uplinks) > 0 {
+		return uplinks, nil
+	}
+	fallback := []string{
+		"eth0", // gokrazy
+		"ens3", // distri
+	}
+	for _, ifname := range fallback {
+		if exists(ifname) {
+			return []string{ifname}, nil
+		}
+	}
+	return nil, fmt.Errorf("no uplink ethernet interface found (checked %v)", append(append([]string{}, wan...), fallback...))
+}
+
+// PlanConfig computes the changes which applying cfg (previously returned by
+// LoadConfig) along with the DHCP leases found in dir entails.
+func PlanConfig(cfg *Config, dir, root string) (*Plan, error) {
+	p := &Plan{
+		links:   make(map[string]netlink.Link),
+		renamed: make(map[string]bool),
+	}
+
+	p.area = "interfaces"
+	if err := planInterfaces(p, &cfg.interfaces, root); err != nil {
+		return nil, fmt.Errorf("interfaces: %v", err)
+	}
+
+	p.area = "dhcp4"
+	if err := planDhcp4(p, cfg.multiWAN, dir); err != nil {
+		p.fail(err)
+	}
+
+	p.area = "dhcp6"
+	if err := planDhcp6(p, dir); err != nil {
+		p.fail(err)
+	}
+
+	uplinks, err := p.uplinkInterfaces()
+	if err != nil {
+		log.Printf("uplinkInterfaces: %v", err)
+	}
+
+	p.area = "sysctl"
+	if err := planSysctl(p, uplinks); err != nil {
+		p.fail(err)
+	}
+
+	p.area = "firewall"
+	if err := planFirewall(p, cfg, dir, uplinks); err != nil {
+		p.fail(err)
+	}
+
+	// Each uplink is shaped to its own bandwidth, see sqmConfig.
+	p.area = "sqm"
+	for _, ifname := range uplinks {
+		if err := planSQM(p, cfg.sqm.rates(ifname), ifname); err != nil {
+			p.fail(fmt.Errorf("%s: %v", ifname, err))
+		}
+	}
+
+	p.area = "wireguard"
+	if err := planWireGuard(p, &cfg.wireguard); err != nil {
+		p.fail(err)
+	}
+
+	// Static routes might lead into WireGuard tunnels, hence they are
+	// planned last.
+	p.area = "routing"
+	if err := planRouting(p, cfg, dir); err != nil {
+		p.fail(err)
+	}
+
+	return p, nil
+}
+
+// Apply loads the configuration from dir (see LoadConfig) and applies it,
+// along with the DHCP leases found in dir.
+func Apply(dir, root string) error {
+	cfg, err := LoadConfig(dir)
+	if err != nil {
+		return err
+	}
+	return ApplyConfig(cfg, dir, root)
+}
+
+// ApplyConfig applies cfg, which was previously returned by LoadConfig, along
+// with the DHCP leases found in dir: it computes the changes (see PlanConfig)
+// and applies them.
+func ApplyConfig(cfg *Config, dir, root string) error {
+	p, err := PlanConfig(cfg, dir, root)
+	if err != nil {
+		return err
+	}
+	for _, c := range p.Changes {
+		log.Print(c)
+	}
+	return p.Apply()
+}
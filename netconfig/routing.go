@@ -0,0 +1,663 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+
+	"git.tcp.direct/kayos/rout5/config"
+	"git.tcp.direct/kayos/rout5/dhcp/dhcp4"
+)
+
+// routingTable is an additional routing table, read from
+// [[netconfig.routing_tables]] in config.toml, e.g.:
+//
+//	[[netconfig.routing_tables]]
+//	name = "guest"
+//	id = 100
+//
+//	[[netconfig.routing_tables.routes]]
+//	dst = "default"
+//	via = "dhcp"
+//	dev = "uplink1"
+//
+// Routing rules (see routingRule) select the table for a packet.
+type routingTable struct {
+	Name   string       `json:"name" mapstructure:"name"`
+	ID     int          `json:"id" mapstructure:"id"` // 1-252 or ≥ 256, except 1000-1254 (see uplinkTable)
+	Routes []tableRoute `json:"routes,omitempty" mapstructure:"routes"`
+}
+
+type tableRoute struct {
+	// Dst is the destination CIDR (IPv4 or IPv6), or “default” for
+	// 0.0.0.0/0.
+	Dst string `json:"dst" mapstructure:"dst"`
+
+	// Via is the IP address of the gateway, or “dhcp” for the router of the
+	// DHCPv4 lease of Dev. Without a gateway, the route is a link route (e.g.
+	// into a WireGuard tunnel).
+	Via string `json:"via,omitempty" mapstructure:"via"`
+
+	Dev    string `json:"dev,omitempty" mapstructure:"dev"`
+	Metric int    `json:"metric,omitempty" mapstructure:"metric"`
+}
+
+// staticRoute is a route read from [[netconfig.routes]] in config.toml, e.g.:
+//
+//	[[netconfig.routes]]
+//	dst = "10.10.0.0/16"
+//	via = "192.168.42.254"
+//
+//	[[netconfig.routes]]
+//	dst = "2001:db8::/32"
+//	dev = "wg0"
+//	metric = 10
+//
+// netconfig installs static routes with protocol RTPROT_STATIC, by which it
+// recognizes the routes it owns.
+type staticRoute struct {
+	tableRoute `mapstructure:",squash"`
+
+	// Table is the name of a routing table (see routingTable), or “main”
+	// (the default).
+	Table string `json:"table,omitempty" mapstructure:"table"`
+}
+
+// routingRule selects the routing table of the packets which match all of
+// its (optional) selectors. It is read from [[netconfig.routing_rules]] in
+// config.toml, e.g.:
+//
+//	[[netconfig.routing_rules]]
+//	priority = 1000
+//	from = "192.168.43.0/24"
+//	table = "guest"
+//
+// Rules without from apply to both IPv4 and IPv6.
+type routingRule struct {
+	// Priority orders the rules (lower first). The main table is consulted at
+	// priority 32766, so rules must use priorities from 1 to 32765. With
+	// more than one uplink, the rules at priority 10 route replies via the
+	// uplink which their connection arrived on (see uplinkMark).
+	Priority int `json:"priority" mapstructure:"priority"`
+
+	From     string `json:"from,omitempty" mapstructure:"from"`           // source CIDR
+	IIF      string `json:"iif,omitempty" mapstructure:"iif"`             // input interface
+	FWMark   string `json:"fwmark,omitempty" mapstructure:"fwmark"`       // e.g. 0x1 or 0x1/0xff
+	UIDRange string `json:"uid_range,omitempty" mapstructure:"uid_range"` // e.g. 1000-1999, locally generated traffic only
+
+	Table string `json:"table" mapstructure:"table"` // name of a routing table, or “main”
+}
+
+// reservedTables are the tables which the kernel sets up by itself.
+var reservedTables = map[string]int{
+	"default": unix.RT_TABLE_DEFAULT,
+	"main":    unix.RT_TABLE_MAIN,
+	"local":   unix.RT_TABLE_LOCAL,
+}
+
+func validateRouting(pl *problemList, tables []routingTable, rules []routingRule, routes []staticRoute) {
+	names := make(map[string]bool)
+	ids := make(map[int]bool)
+	for idx, t := range tables {
+		field := fmt.Sprintf("routing_tables[%d]", idx)
+		switch {
+		case t.Name == "":
+			pl.add(field+".name", "must not be empty")
+		case reservedTables[t.Name] != 0:
+			pl.add(field+".name", "%q is reserved", t.Name)
+		case names[t.Name]:
+			pl.add(field+".name", "duplicate table %q", t.Name)
+		}
+		names[t.Name] = true
+		switch {
+		case t.ID < 1 || (t.ID >= unix.RT_TABLE_DEFAULT && t.ID <= unix.RT_TABLE_LOCAL):
+			pl.add(field+".id", "must be between 1 and 252 or at least 256 (got %d)", t.ID)
+		case t.ID >= uplinkTableBase && t.ID <= uplinkTableBase+254:
+			pl.add(field+".id", "ids from %d to %d are reserved for the uplinks (got %d)", uplinkTableBase, uplinkTableBase+254, t.ID)
+		case ids[t.ID]:
+			pl.add(field+".id", "duplicate id %d", t.ID)
+		}
+		ids[t.ID] = true
+		for ridx, r := range t.Routes {
+			r.validate(pl, fmt.Sprintf("%s.routes[%d]", field, ridx))
+		}
+	}
+	for idx, r := range rules {
+		field := fmt.Sprintf("routing_rules[%d]", idx)
+		if r.Priority < 1 || r.Priority > 32765 {
+			pl.add(field+".priority", "must be between 1 and 32765 (got %d)", r.Priority)
+		}
+		if r.From != "" {
+			if _, _, err := net.ParseCIDR(r.From); err != nil {
+				pl.add(field+".from", "%v", err)
+			}
+		}
+		if r.FWMark != "" {
+			if _, _, err := parseFWMark(r.FWMark); err != nil {
+				pl.add(field+".fwmark", "%v", err)
+			}
+		}
+		if r.UIDRange != "" {
+			if _, _, err := parseUIDRange(r.UIDRange); err != nil {
+				pl.add(field+".uid_range", "%v", err)
+			}
+		}
+		if r.Table != "main" && !names[r.Table] {
+			pl.add(field+".table", "unknown table %q, expected “main” or one of routing_tables", r.Table)
+		}
+	}
+	for idx, r := range routes {
+		field := fmt.Sprintf("routes[%d]", idx)
+		r.validate(pl, field)
+		if r.Table != "" && r.Table != "main" && !names[r.Table] {
+			pl.add(field+".table", "unknown table %q, expected “main” or one of routing_tables", r.Table)
+		}
+	}
+}
+
+func (r *tableRoute) validate(pl *problemList, field string) {
+	dst, err := r.dst()
+	if err != nil {
+		pl.add(field+".dst", "%v", err)
+	}
+	switch {
+	case r.Via == "dhcp":
+		if r.Dev == "" {
+			pl.add(field+".dev", `must be set for via = "dhcp"`)
+		}
+		if dst != nil && dst.IP.To4() == nil {
+			pl.add(field+".via", `"dhcp" requires an IPv4 dst`)
+		}
+	case r.Via != "":
+		via := net.ParseIP(r.Via)
+		if via == nil {
+			pl.add(field+".via", "invalid IP address %q", r.Via)
+		} else if dst != nil && (via.To4() == nil) != (dst.IP.To4() == nil) {
+			pl.add(field+".via", "address family of %s does not match dst %s", via, dst)
+		}
+	case r.Dev == "":
+		pl.add(field, "must set via or dev")
+	}
+	if r.Metric < 0 {
+		pl.add(field+".metric", "must not be negative (got %d)", r.Metric)
+	}
+}
+
+func (r *tableRoute) dst() (*net.IPNet, error) {
+	if r.Dst == "default" {
+		return &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}, nil
+	}
+	_, dst, err := net.ParseCIDR(r.Dst)
+	return dst, err
+}
+
+// parseFWMark parses a firewall mark with optional mask, e.g. 0x1/0xff.
+func parseFWMark(s string) (mark, mask uint32, _ error) {
+	mask = 0xffffffff
+	if idx := strings.IndexByte(s, '/'); idx > -1 {
+		m, err := strconv.ParseUint(s[idx+1:], 0, 32)
+		if err != nil {
+			return 0, 0, err
+		}
+		mask = uint32(m)
+		s = s[:idx]
+	}
+	m, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint32(m), mask, nil
+}
+
+// parseUIDRange parses a single uid or an inclusive range, e.g. 1000-1999.
+func parseUIDRange(s string) (start, end uint32, _ error) {
+	parts := strings.SplitN(s, "-", 2)
+	first, err := strconv.ParseUint(parts[0], 0, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	last := first
+	if len(parts) > 1 {
+		if last, err = strconv.ParseUint(parts[1], 0, 32); err != nil {
+			return 0, 0, err
+		}
+	}
+	if last < first {
+		return 0, 0, fmt.Errorf("invalid range %q: %d < %d", s, last, first)
+	}
+	return uint32(first), uint32(last), nil
+}
+
+// policyRule is a routing rule in the form in which the kernel stores it.
+// netlink.Rule cannot represent uid ranges nor the protocol by which rout5
+// recognizes its own rules, hence rules are (de)serialized here.
+type policyRule struct {
+	family   int
+	priority uint32
+	table    uint32
+	src      *net.IPNet
+	iif      string
+
+	mark, mask uint32 // mask is zero if the rule does not match the fwmark
+
+	uidStart, uidEnd uint32
+	uidRange         bool
+}
+
+// describe renders r like “ip rule” does, e.g. “1000: from 192.168.43.0/24
+// lookup guest”. tableName returns the name of a table id.
+func (r *policyRule) describe(tableName func(uint32) string) string {
+	s := fmt.Sprintf("%d: from ", r.priority)
+	if r.src != nil {
+		s += r.src.String()
+	} else {
+		s += "all"
+	}
+	if r.iif != "" {
+		s += " iif " + r.iif
+	}
+	if r.mask != 0 {
+		s += fmt.Sprintf(" fwmark %#x", r.mark)
+		if r.mask != 0xffffffff {
+			s += fmt.Sprintf("/%#x", r.mask)
+		}
+	}
+	if r.uidRange {
+		s += fmt.Sprintf(" uidrange %d-%d", r.uidStart, r.uidEnd)
+	}
+	s += " lookup " + tableName(r.table)
+	if r.family == unix.AF_INET6 {
+		s += " (ipv6)"
+	}
+	return s
+}
+
+func (r *policyRule) request(proto, flags int) *nl.NetlinkRequest {
+	req := nl.NewNetlinkRequest(proto, flags|unix.NLM_F_ACK)
+	// struct fib_rule_hdr shares its layout with struct rtmsg.
+	msg := nl.NewRtMsg()
+	msg.Family = uint8(r.family)
+	msg.Protocol = 0 // res1
+	msg.Scope = 0    // res2
+	msg.Type = unix.FR_ACT_TO_TBL
+	msg.Table = unix.RT_TABLE_UNSPEC
+	if r.table < 256 {
+		msg.Table = uint8(r.table)
+	}
+	if r.src != nil {
+		ones, _ := r.src.Mask.Size()
+		msg.Src_len = uint8(ones)
+	}
+	req.AddData(msg)
+	if r.src != nil {
+		ip := r.src.IP.To4()
+		if ip == nil {
+			ip = r.src.IP.To16()
+		}
+		req.AddData(nl.NewRtAttr(nl.FRA_SRC, ip))
+	}
+	req.AddData(nl.NewRtAttr(nl.FRA_PRIORITY, nl.Uint32Attr(r.priority)))
+	req.AddData(nl.NewRtAttr(nl.FRA_TABLE, nl.Uint32Attr(r.table)))
+	if r.iif != "" {
+		req.AddData(nl.NewRtAttr(nl.FRA_IIFNAME, nl.ZeroTerminated(r.iif)))
+	}
+	if r.mask != 0 {
+		req.AddData(nl.NewRtAttr(nl.FRA_FWMARK, nl.Uint32Attr(r.mark)))
+		req.AddData(nl.NewRtAttr(nl.FRA_FWMASK, nl.Uint32Attr(r.mask)))
+	}
+	if r.uidRange {
+		b := make([]byte, 8)
+		nl.NativeEndian().PutUint32(b[0:4], r.uidStart)
+		nl.NativeEndian().PutUint32(b[4:8], r.uidEnd)
+		req.AddData(nl.NewRtAttr(unix.FRA_UID_RANGE, b))
+	}
+	req.AddData(nl.NewRtAttr(unix.FRA_PROTOCOL, []byte{unix.RTPROT_STATIC}))
+	return req
+}
+
+func (r *policyRule) add() error {
+	_, err := r.request(unix.RTM_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_EXCL).Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+func (r *policyRule) del() error {
+	_, err := r.request(unix.RTM_DELRULE, 0).Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+// listRules returns the rules which rout5 added, i.e. those with protocol
+// RTPROT_STATIC.
+func listRules() ([]policyRule, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETRULE, unix.NLM_F_DUMP)
+	req.AddData(nl.NewIfInfomsg(unix.AF_UNSPEC))
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWRULE)
+	if err != nil {
+		return nil, err
+	}
+	var rules []policyRule
+	for _, m := range msgs {
+		msg := nl.DeserializeRtMsg(m)
+		if msg.Type != unix.FR_ACT_TO_TBL {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return nil, err
+		}
+		r := policyRule{
+			family: int(msg.Family),
+			table:  uint32(msg.Table),
+		}
+		var ours, mask bool
+		for _, attr := range attrs {
+			v := attr.Value
+			switch attr.Attr.Type {
+			case unix.FRA_PROTOCOL:
+				ours = len(v) > 0 && v[0] == unix.RTPROT_STATIC
+			case nl.FRA_SRC:
+				r.src = &net.IPNet{
+					IP:   net.IP(v),
+					Mask: net.CIDRMask(int(msg.Src_len), 8*len(v)),
+				}
+			case nl.FRA_PRIORITY:
+				r.priority = nl.NativeEndian().Uint32(v)
+			case nl.FRA_TABLE:
+				r.table = nl.NativeEndian().Uint32(v)
+			case nl.FRA_IIFNAME:
+				r.iif = strings.TrimRight(string(v), "\x00")
+			case nl.FRA_FWMARK:
+				r.mark = nl.NativeEndian().Uint32(v)
+				if !mask {
+					r.mask = 0xffffffff // omitted by the kernel if all ones
+				}
+			case nl.FRA_FWMASK:
+				r.mask = nl.NativeEndian().Uint32(v)
+				mask = true
+			case unix.FRA_UID_RANGE:
+				if len(v) >= 8 {
+					r.uidRange = true
+					r.uidStart = nl.NativeEndian().Uint32(v[0:4])
+					r.uidEnd = nl.NativeEndian().Uint32(v[4:8])
+				}
+			}
+		}
+		if ours {
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+// desiredRules converts the configured rules into kernel rules. Rules without
+// a source CIDR are installed for IPv4 and IPv6.
+func desiredRules(tables []routingTable, rules []routingRule) []policyRule {
+	ids := make(map[string]uint32)
+	for name, id := range reservedTables {
+		ids[name] = uint32(id)
+	}
+	for _, t := range tables {
+		ids[t.Name] = uint32(t.ID)
+	}
+	var desired []policyRule
+	for _, rr := range rules {
+		r := policyRule{
+			priority: uint32(rr.Priority),
+			table:    ids[rr.Table],
+			iif:      rr.IIF,
+		}
+		if rr.FWMark != "" {
+			r.mark, r.mask, _ = parseFWMark(rr.FWMark) // validated
+		}
+		if rr.UIDRange != "" {
+			r.uidStart, r.uidEnd, _ = parseUIDRange(rr.UIDRange) // validated
+			r.uidRange = true
+		}
+		families := []int{unix.AF_INET, unix.AF_INET6}
+		if rr.From != "" {
+			_, src, _ := net.ParseCIDR(rr.From) // validated
+			r.src = src
+			families = []int{unix.AF_INET6}
+			if src.IP.To4() != nil {
+				families = []int{unix.AF_INET}
+			}
+		}
+		for _, family := range families {
+			r.family = family
+			desired = append(desired, r)
+		}
+	}
+	return desired
+}
+
+// tableRouteString renders the route r of a routing table, e.g.
+// “0.0.0.0/0 via 10.0.0.1 dev uplink1 table guest metric 5”.
+func tableRouteString(r netlink.Route, dev, table string) string {
+	s := r.Dst.String()
+	if r.Gw != nil {
+		s += fmt.Sprintf(" via %v", r.Gw)
+	}
+	if dev != "" {
+		s += " dev " + dev
+	}
+	s += " table " + table
+	if r.Priority != 0 {
+		s += fmt.Sprintf(" metric %d", r.Priority)
+	}
+	return s
+}
+
+// planRouting plans the routing rules, the routes of the routing tables and
+// the static routes of cfg, removing the rules and routes which netconfig
+// added before but which are no longer configured. Routes whose gateway is
+// the router of a DHCPv4 lease (found in dir) are skipped until the lease was
+// obtained.
+func planRouting(p *Plan, cfg *Config, dir string) error {
+	names := make(map[uint32]string)
+	ids := make(map[string]int)
+	for name, id := range reservedTables {
+		names[uint32(id)] = name
+		ids[name] = id
+	}
+	for _, t := range cfg.routingTables {
+		names[uint32(t.ID)] = t.Name
+		ids[t.Name] = t.ID
+	}
+	if uplinkTables() {
+		for idx, ifname := range uplinkNames() {
+			names[uint32(uplinkTable(idx))] = ifname
+		}
+	}
+	tableName := func(id uint32) string {
+		if name, ok := names[id]; ok {
+			return name
+		}
+		return fmt.Sprint(id)
+	}
+
+	current, err := listRules()
+	if err != nil {
+		return fmt.Errorf("listing rules: %v", err)
+	}
+	exists := make(map[string]bool)
+	for _, r := range current {
+		exists[r.describe(tableName)] = true
+	}
+	want := make(map[string]bool)
+	for _, r := range append(uplinkRules(), desiredRules(cfg.routingTables, cfg.routingRules)...) {
+		r := r // copy
+		desc := r.describe(tableName)
+		want[desc] = true
+		if exists[desc] {
+			continue
+		}
+		p.change(Change{Op: "+", Kind: "rule", Object: desc}, func() error {
+			if err := r.add(); err != nil {
+				return fmt.Errorf("adding rule %s: %v", desc, err)
+			}
+			return nil
+		})
+	}
+	for _, r := range current {
+		r := r // copy
+		desc := r.describe(tableName)
+		if want[desc] {
+			continue
+		}
+		p.change(Change{Op: "-", Kind: "rule", Object: desc}, func() error {
+			if err := r.del(); err != nil {
+				return fmt.Errorf("deleting rule %s: %v", desc, err)
+			}
+			return nil
+		})
+	}
+
+	var routes []staticRoute
+	for _, t := range cfg.routingTables {
+		for _, tr := range t.Routes {
+			routes = append(routes, staticRoute{tableRoute: tr, Table: t.Name})
+		}
+	}
+	routes = append(routes, cfg.routes...)
+	return planStaticRoutes(p, routes, ids, dir, tableName)
+}
+
+// planStaticRoutes reconciles the routes with protocol RTPROT_STATIC, which
+// only netconfig adds, with routes. Routes of other protocols (e.g. the
+// default routes obtained via DHCP) are left alone.
+func planStaticRoutes(p *Plan, routes []staticRoute, ids map[string]int, dir string, tableName func(uint32) string) error {
+	linkName := func(index int) string {
+		if index == 0 {
+			return ""
+		}
+		l, err := netlink.LinkByIndex(index)
+		if err != nil {
+			return fmt.Sprint(index)
+		}
+		return l.Attrs().Name
+	}
+	type liveRoute struct {
+		route netlink.Route
+		desc  string
+		// anyDev describes the route regardless of its link, for matching
+		// configured routes which leave the link to the kernel.
+		anyDev string
+	}
+	var live []liveRoute
+	exists := make(map[string]bool)
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		current, err := netlink.RouteListFiltered(family, &netlink.Route{Table: unix.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return fmt.Errorf("RouteListFiltered: %v", err)
+		}
+		for _, r := range current {
+			if r.Protocol != unix.RTPROT_STATIC {
+				continue
+			}
+			if r.Dst == nil {
+				if family == netlink.FAMILY_V4 {
+					r.Dst = &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+				} else {
+					r.Dst = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+				}
+			}
+			table := tableName(uint32(r.Table))
+			lr := liveRoute{
+				route:  r,
+				desc:   tableRouteString(r, linkName(r.LinkIndex), table),
+				anyDev: tableRouteString(r, "", table),
+			}
+			exists[lr.desc] = true
+			exists[lr.anyDev] = true
+			live = append(live, lr)
+		}
+	}
+
+	want := make(map[string]bool)
+	for _, sr := range routes {
+		table := sr.Table
+		if table == "" {
+			table = "main"
+		}
+		dst, _ := sr.dst() // validated
+		r := netlink.Route{
+			Dst:      dst,
+			Table:    ids[table],
+			Protocol: unix.RTPROT_STATIC,
+			Priority: sr.Metric,
+		}
+		if dst.IP.To4() == nil && r.Priority == 0 {
+			r.Priority = 1024 // the kernel’s default metric for IPv6 routes
+		}
+		switch sr.Via {
+		case "":
+			r.Scope = netlink.SCOPE_LINK
+		case "dhcp":
+			var got dhcp4.Config
+			if err := readJSON(filepath.Join(dir, config.DHCP4Dir(sr.Dev), "lease.json"), &got); err != nil {
+				return err
+			}
+			if got.Router == "" {
+				continue // dhcp4 might not have obtained a lease yet
+			}
+			r.Gw = net.ParseIP(got.Router).To4()
+		default:
+			r.Gw = net.ParseIP(sr.Via)
+			if ip := r.Gw.To4(); ip != nil {
+				r.Gw = ip
+			}
+		}
+		desc := tableRouteString(r, sr.Dev, table)
+		want[desc] = true
+		if exists[desc] {
+			continue
+		}
+		dev := sr.Dev
+		p.change(Change{Op: "+", Kind: "route", Object: desc}, func() error {
+			if dev != "" {
+				l, err := netlink.LinkByName(dev)
+				if err != nil {
+					return err
+				}
+				r.LinkIndex = l.Attrs().Index
+			}
+			if err := netlink.RouteReplace(&r); err != nil {
+				return fmt.Errorf("RouteReplace(%s): %v", desc, err)
+			}
+			return nil
+		})
+	}
+	for _, lr := range live {
+		lr := lr // copy
+		if want[lr.desc] || want[lr.anyDev] {
+			continue
+		}
+		p.change(Change{Op: "-", Kind: "route", Object: lr.desc}, func() error {
+			// RouteReplace above might have replaced the route already.
+			if err := netlink.RouteDel(&lr.route); err != nil && err != unix.ESRCH {
+				return fmt.Errorf("RouteDel(%s): %v", lr.desc, err)
+			}
+			return nil
+		})
+	}
+	return nil
+}
@@ -0,0 +1,825 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// batch is implemented by *nftables.Conn and by ruleset, which records the
+// firewall for planFirewall instead of sending it to the kernel.
+type batch interface {
+	AddTable(*nftables.Table) *nftables.Table
+	DelTable(*nftables.Table)
+	AddChain(*nftables.Chain) *nftables.Chain
+	AddRule(*nftables.Rule) *nftables.Rule
+	AddObj(nftables.Obj) nftables.Obj
+	GetObj(nftables.Obj) ([]nftables.Obj, error)
+	ListChains() ([]*nftables.Chain, error)
+}
+
+// ruleset records the tables built by buildFirewall, so that they can be
+// compared to the current ruleset before they are sent in a single batch.
+type ruleset struct {
+	conn   *nftables.Conn // for reading the current ruleset
+	ops    []func(c *nftables.Conn)
+	tables []*nftables.Table
+	chains []*nftables.Chain
+	rules  []*nftables.Rule
+	objs   []nftables.Obj
+
+	// deleted are tables which are deleted without being replaced, see
+	// legacyTables.
+	deleted []*nftables.Table
+}
+
+func (r *ruleset) AddTable(t *nftables.Table) *nftables.Table {
+	r.ops = append(r.ops, func(c *nftables.Conn) { c.AddTable(t) })
+	for _, tt := range r.tables {
+		if tt.Family == t.Family && tt.Name == t.Name {
+			return t
+		}
+	}
+	r.tables = append(r.tables, t)
+	return t
+}
+
+func (r *ruleset) DelTable(t *nftables.Table) {
+	r.ops = append(r.ops, func(c *nftables.Conn) { c.DelTable(t) })
+	r.deleted = append(r.deleted, t)
+}
+
+func (r *ruleset) AddChain(ch *nftables.Chain) *nftables.Chain {
+	r.ops = append(r.ops, func(c *nftables.Conn) { c.AddChain(ch) })
+	r.chains = append(r.chains, ch)
+	return ch
+}
+
+func (r *ruleset) AddRule(rule *nftables.Rule) *nftables.Rule {
+	r.ops = append(r.ops, func(c *nftables.Conn) { c.AddRule(rule) })
+	r.rules = append(r.rules, rule)
+	return rule
+}
+
+func (r *ruleset) AddObj(o nftables.Obj) nftables.Obj {
+	r.ops = append(r.ops, func(c *nftables.Conn) { c.AddObj(o) })
+	r.objs = append(r.objs, o)
+	return o
+}
+
+func (r *ruleset) GetObj(o nftables.Obj) ([]nftables.Obj, error) {
+	return r.conn.GetObj(o)
+}
+
+func (r *ruleset) ListChains() ([]*nftables.Chain, error) {
+	return r.conn.ListChains()
+}
+
+// flush sends the recorded tables to the kernel in a single batch.
+func (r *ruleset) flush() error {
+	c := &nftables.Conn{}
+	for _, op := range r.ops {
+		op(c)
+	}
+	return c.Flush()
+}
+
+func sameTable(a, b *nftables.Table) bool {
+	return a.Family == b.Family && a.Name == b.Name
+}
+
+func chainString(ch *nftables.Chain) string {
+	if ch.Type == "" {
+		return "" // regular chain
+	}
+	policy := "accept"
+	if ch.Policy != nil && *ch.Policy == nftables.ChainPolicyDrop {
+		policy = "drop"
+	}
+	return fmt.Sprintf("type %s hook %s priority %d policy %s",
+		ch.Type, hookString(ch.Hooknum), int32(ch.Priority), policy)
+}
+
+// diff compares the recorded tables to the current ruleset.
+func (r *ruleset) diff() ([]Change, error) {
+	tables, err := r.conn.ListTables()
+	if err != nil {
+		return nil, fmt.Errorf("ListTables: %v", err)
+	}
+	chains, err := r.conn.ListChains()
+	if err != nil {
+		return nil, fmt.Errorf("ListChains: %v", err)
+	}
+	var changes []Change
+	add := func(op, object, from string) {
+		changes = append(changes, Change{Op: op, Kind: "nft", Object: object, From: from})
+	}
+	for _, t := range r.deleted {
+		replaced := false
+		for _, tt := range r.tables {
+			replaced = replaced || sameTable(tt, t)
+		}
+		if replaced {
+			continue
+		}
+		for _, tt := range tables {
+			if sameTable(tt, t) {
+				add("-", "table "+familyString(t.Family)+" "+t.Name, "")
+				break
+			}
+		}
+	}
+	for _, t := range r.tables {
+		table := familyString(t.Family) + " " + t.Name
+		exists := false
+		for _, tt := range tables {
+			if sameTable(tt, t) {
+				exists = true
+				break
+			}
+		}
+		var (
+			liveChains []*nftables.Chain
+			liveObjs   []nftables.Obj
+		)
+		if exists {
+			for _, ch := range chains {
+				if sameTable(ch.Table, t) {
+					liveChains = append(liveChains, ch)
+				}
+			}
+			if liveObjs, err = r.conn.GetObjects(t); err != nil {
+				return nil, fmt.Errorf("GetObjects(%s): %v", table, err)
+			}
+		} else {
+			add("+", "table "+table, "")
+		}
+
+		// Named counters (only their existence, not their values).
+		counters := func(objs []nftables.Obj) map[string]bool {
+			names := make(map[string]bool)
+			for _, o := range objs {
+				if co, ok := o.(*nftables.CounterObj); ok && sameTable(co.Table, t) {
+					names[co.Name] = true
+				}
+			}
+			return names
+		}
+		want, got := counters(r.objs), counters(liveObjs)
+		for _, o := range r.objs {
+			if co, ok := o.(*nftables.CounterObj); ok && sameTable(co.Table, t) && !got[co.Name] {
+				add("+", "counter "+table+" "+co.Name, "")
+				got[co.Name] = true // shared counters are added once
+			}
+		}
+		for _, o := range liveObjs {
+			if co, ok := o.(*nftables.CounterObj); ok && !want[co.Name] {
+				add("-", "counter "+table+" "+co.Name, "")
+			}
+		}
+
+		desired := make(map[string]bool)
+		for _, ch := range r.chains {
+			if !sameTable(ch.Table, t) {
+				continue
+			}
+			desired[ch.Name] = true
+			prefix := table + " " + ch.Name
+			var live *nftables.Chain
+			for _, lc := range liveChains {
+				if lc.Name == ch.Name {
+					live = lc
+				}
+			}
+			var liveRules []*nftables.Rule
+			if live == nil {
+				add("+", strings.TrimSpace("chain "+prefix+" "+chainString(ch)), "")
+			} else {
+				if got, want := chainString(live), chainString(ch); got != want {
+					add("~", "chain "+prefix+" "+want, got)
+				}
+				if liveRules, err = getRules(t, live); err != nil {
+					return nil, fmt.Errorf("GetRules(%s): %v", prefix, err)
+				}
+			}
+			var wantRules []*nftables.Rule
+			for _, rule := range r.rules {
+				if sameTable(rule.Table, t) && rule.Chain.Name == ch.Name {
+					wantRules = append(wantRules, rule)
+				}
+			}
+			for _, c := range diffRules(liveRules, wantRules) {
+				add(c.Op, "rule "+prefix+": "+c.Object, c.From)
+			}
+		}
+		for _, lc := range liveChains {
+			if !desired[lc.Name] {
+				add("-", "chain "+table+" "+lc.Name, "")
+			}
+		}
+	}
+	return changes, nil
+}
+
+// getRules returns the rules of ch. Unlike nftables.Conn.GetRules, which
+// skips expressions it cannot decode (e.g. masquerade, reject, objref), it
+// returns all expressions of each rule, so that diffRules notices when only
+// those change. Expressions of unknown types are returned as opaqueExpr.
+func getRules(t *nftables.Table, ch *nftables.Chain) ([]*nftables.Rule, error) {
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_RULE_TABLE, Data: []byte(t.Name + "\x00")},
+		{Type: unix.NFTA_RULE_CHAIN, Data: []byte(ch.Name + "\x00")},
+	})
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | unix.NFT_MSG_GETRULE),
+			Flags: netlink.Request | netlink.Acknowledge | netlink.Dump,
+		},
+		// struct nfgenmsg: family, version, resource id
+		Data: append([]byte{byte(t.Family), unix.NFNETLINK_V0, 0, 0}, attrs...),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var rules []*nftables.Rule
+	for _, msg := range msgs {
+		if msg.Header.Type&0xff != unix.NFT_MSG_NEWRULE || len(msg.Data) < 4 {
+			continue
+		}
+		ad, err := netlink.NewAttributeDecoder(msg.Data[4:])
+		if err != nil {
+			return nil, err
+		}
+		ad.ByteOrder = binary.BigEndian
+		rule := &nftables.Rule{Table: t, Chain: ch}
+		for ad.Next() {
+			if ad.Type() == unix.NFTA_RULE_EXPRESSIONS {
+				ad.Do(func(b []byte) error {
+					rule.Exprs, err = decodeExprs(byte(t.Family), b)
+					return err
+				})
+			}
+		}
+		if err := ad.Err(); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// opaqueExpr stands in for an expression which decodeExprs cannot decode.
+type opaqueExpr struct {
+	expr.Any // nil, opaqueExpr is never marshaled
+	name     string
+	data     []byte
+}
+
+// decodeExprs decodes the NFTA_RULE_EXPRESSIONS attribute of a rule.
+func decodeExprs(fam byte, b []byte) ([]expr.Any, error) {
+	ad, err := netlink.NewAttributeDecoder(b)
+	if err != nil {
+		return nil, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	var exprs []expr.Any
+	for ad.Next() {
+		ad.Do(func(b []byte) error {
+			ad, err := netlink.NewAttributeDecoder(b)
+			if err != nil {
+				return err
+			}
+			ad.ByteOrder = binary.BigEndian
+			var (
+				name string
+				data []byte
+			)
+			for ad.Next() {
+				switch ad.Type() {
+				case unix.NFTA_EXPR_NAME:
+					name = ad.String()
+				case unix.NFTA_EXPR_DATA:
+					data = ad.Bytes()
+				}
+			}
+			if err := ad.Err(); err != nil {
+				return err
+			}
+			e, err := decodeExpr(fam, name, data)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			exprs = append(exprs, e)
+			return nil
+		})
+	}
+	return exprs, ad.Err()
+}
+
+func decodeExpr(fam byte, name string, data []byte) (expr.Any, error) {
+	var e expr.Any
+	switch name {
+	case "notrack":
+		return &expr.Notrack{}, nil
+	case "rt", "byteorder", "ct", "meta":
+		// The unmarshal methods of these are not implemented or, for ct and
+		// meta, ignore the source register of set expressions.
+		return decodeRegExpr(name, data)
+	case "range":
+		e = &expr.Range{}
+	case "cmp":
+		e = &expr.Cmp{}
+	case "counter":
+		e = &expr.Counter{}
+	case "payload":
+		e = &expr.Payload{}
+	case "lookup":
+		e = &expr.Lookup{}
+	case "immediate":
+		e = &expr.Immediate{}
+	case "bitwise":
+		e = &expr.Bitwise{}
+	case "redir":
+		e = &expr.Redir{}
+	case "nat":
+		e = &expr.NAT{}
+	case "masq":
+		e = &expr.Masq{}
+	case "reject":
+		e = &expr.Reject{}
+	case "objref":
+		e = &expr.Objref{}
+	case "limit":
+		e = &expr.Limit{}
+	case "quota":
+		e = &expr.Quota{}
+	case "dynset":
+		e = &expr.Dynset{}
+	case "log":
+		e = &expr.Log{}
+	case "exthdr":
+		e = &expr.Exthdr{}
+	default:
+		return &opaqueExpr{name: name, data: data}, nil
+	}
+	if err := expr.Unmarshal(fam, data, e); err != nil {
+		return nil, err
+	}
+	// Verdicts are immediates which write into the verdict register.
+	if imm, ok := e.(*expr.Immediate); ok && imm.Register == unix.NFT_REG_VERDICT && len(imm.Data) == 0 {
+		e = &expr.Verdict{}
+		if err := expr.Unmarshal(fam, data, e); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// decodeRegExpr decodes rt, byteorder, ct and meta expressions.
+func decodeRegExpr(name string, data []byte) (expr.Any, error) {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return nil, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	switch name {
+	case "rt":
+		e := &expr.Rt{}
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.NFTA_RT_DREG:
+				e.Register = ad.Uint32()
+			case unix.NFTA_RT_KEY:
+				e.Key = expr.RtKey(ad.Uint32())
+			}
+		}
+		return e, ad.Err()
+	case "ct":
+		e := &expr.Ct{}
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.NFTA_CT_KEY:
+				e.Key = expr.CtKey(ad.Uint32())
+			case unix.NFTA_CT_DREG:
+				e.Register = ad.Uint32()
+			case unix.NFTA_CT_SREG:
+				e.Register = ad.Uint32()
+				e.SourceRegister = true
+			}
+		}
+		return e, ad.Err()
+	case "meta":
+		e := &expr.Meta{}
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.NFTA_META_KEY:
+				e.Key = expr.MetaKey(ad.Uint32())
+			case unix.NFTA_META_DREG:
+				e.Register = ad.Uint32()
+			case unix.NFTA_META_SREG:
+				e.Register = ad.Uint32()
+				e.SourceRegister = true
+			}
+		}
+		return e, ad.Err()
+	}
+	e := &expr.Byteorder{}
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_BYTEORDER_SREG:
+			e.SourceRegister = ad.Uint32()
+		case unix.NFTA_BYTEORDER_DREG:
+			e.DestRegister = ad.Uint32()
+		case unix.NFTA_BYTEORDER_OP:
+			e.Op = expr.ByteorderOp(ad.Uint32())
+		case unix.NFTA_BYTEORDER_LEN:
+			e.Len = ad.Uint32()
+		case unix.NFTA_BYTEORDER_SIZE:
+			e.Size = ad.Uint32()
+		}
+	}
+	return e, ad.Err()
+}
+
+// ruleKey identifies a rule by all of its expressions. ruleString omits some
+// details of rt, byteorder and masquerade expressions, which are appended.
+func ruleKey(r *nftables.Rule) string {
+	key := ruleString(r.Exprs)
+	for _, e := range r.Exprs {
+		switch e := e.(type) {
+		case *expr.Rt, *expr.Byteorder, *expr.Masq:
+			key += fmt.Sprintf(" [%T %+v]", e, e)
+		}
+	}
+	return key
+}
+
+// diffRules returns the changes which turn the rules of a chain from got into
+// want, based on their longest common subsequence. Adjacent removals and
+// additions are reported as modifications.
+func diffRules(got, want []*nftables.Rule) []Change {
+	g := make([]string, len(got))
+	for i, r := range got {
+		g[i] = ruleKey(r)
+	}
+	w := make([]string, len(want))
+	for i, r := range want {
+		w[i] = ruleKey(r)
+	}
+	// lcs[i][j] is the length of the longest common subsequence of g[i:]
+	// and w[j:].
+	lcs := make([][]int, len(g)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(w)+1)
+	}
+	for i := len(g) - 1; i >= 0; i-- {
+		for j := len(w) - 1; j >= 0; j-- {
+			if g[i] == w[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var (
+		changes        []Change
+		removed, added []string
+		flushPending   = func() {
+			for len(removed) > 0 && len(added) > 0 {
+				changes = append(changes, Change{Op: "~", Object: added[0], From: removed[0]})
+				removed, added = removed[1:], added[1:]
+			}
+			for _, r := range removed {
+				changes = append(changes, Change{Op: "-", Object: r})
+			}
+			for _, a := range added {
+				changes = append(changes, Change{Op: "+", Object: a})
+			}
+			removed, added = nil, nil
+		}
+	)
+	i, j := 0, 0
+	for i < len(g) || j < len(w) {
+		switch {
+		case i < len(g) && j < len(w) && g[i] == w[j]:
+			flushPending()
+			i++
+			j++
+		case j == len(w) || (i < len(g) && lcs[i+1][j] >= lcs[i][j+1]):
+			removed = append(removed, ruleString(got[i].Exprs))
+			i++
+		default:
+			added = append(added, ruleString(want[j].Exprs))
+			j++
+		}
+	}
+	flushPending()
+	return changes
+}
+
+// ruleString renders exprs in a notation resembling nft(8), e.g.
+// `iifname == "uplink0" meta l4proto == tcp th dport == 2222 dnat to 192.168.42.4:22`.
+func ruleString(exprs []expr.Any) string {
+	regs := make(map[uint32]string) // contents of the registers
+	var parts []string
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Meta:
+			if e.SourceRegister {
+				parts = append(parts, metaString(e.Key)+" set "+regs[e.Register])
+			} else {
+				regs[e.Register] = metaString(e.Key)
+			}
+		case *expr.Payload:
+			if e.OperationType == expr.PayloadWrite {
+				parts = append(parts, payloadString(e)+" set "+regs[e.SourceRegister])
+			} else {
+				regs[e.DestRegister] = payloadString(e)
+			}
+		case *expr.Ct:
+			if e.SourceRegister {
+				parts = append(parts, ctString(e.Key)+" set "+regs[e.Register])
+			} else {
+				regs[e.Register] = ctString(e.Key)
+			}
+		case *expr.Rt:
+			regs[e.Register] = "rt mtu"
+			if e.Key != expr.RtTCPMSS {
+				regs[e.Register] = fmt.Sprintf("rt %d", e.Key)
+			}
+		case *expr.Byteorder:
+			regs[e.DestRegister] = regs[e.SourceRegister]
+		case *expr.Bitwise:
+			s := fmt.Sprintf("%s & 0x%x", regs[e.SourceRegister], e.Mask)
+			for _, b := range e.Xor {
+				if b != 0 {
+					s += fmt.Sprintf(" ^ 0x%x", e.Xor)
+					break
+				}
+			}
+			regs[e.DestRegister] = s
+		case *expr.Cmp:
+			src := regs[e.Register]
+			parts = append(parts, src+" "+cmpOpString(e.Op)+" "+dataString(src, e.Data))
+		case *expr.Immediate:
+			regs[e.Register] = dataString("", e.Data)
+		case *expr.NAT:
+			s := "snat to "
+			if e.Type == expr.NATTypeDestNAT {
+				s = "dnat to "
+			}
+			s += regs[e.RegAddrMin]
+			if e.RegAddrMax != 0 {
+				s += "-" + regs[e.RegAddrMax]
+			}
+			if e.RegProtoMin != 0 {
+				s += ":" + regs[e.RegProtoMin]
+				if e.RegProtoMax != 0 {
+					s += "-" + regs[e.RegProtoMax]
+				}
+			}
+			parts = append(parts, s)
+		case *expr.Masq:
+			parts = append(parts, "masquerade")
+		case *expr.Verdict:
+			parts = append(parts, verdictString(e))
+		case *expr.Counter:
+			parts = append(parts, "counter")
+		case *expr.Objref:
+			if e.Type == NFT_OBJECT_COUNTER {
+				parts = append(parts, fmt.Sprintf("counter name %q", e.Name))
+			} else {
+				parts = append(parts, fmt.Sprintf("objref %d %q", e.Type, e.Name))
+			}
+		case *expr.Limit:
+			s := "limit rate "
+			if e.Over {
+				s += "over "
+			}
+			s += fmt.Sprintf("%d", e.Rate)
+			if e.Type == expr.LimitTypePktBytes {
+				s += " bytes"
+			}
+			parts = append(parts, s+"/"+limitUnitString(e.Unit))
+		case *expr.Log:
+			s := "log"
+			if prefix := strings.TrimRight(string(e.Data), "\x00"); prefix != "" {
+				s += fmt.Sprintf(" prefix %q", prefix)
+			}
+			parts = append(parts, s)
+		case *expr.Reject:
+			parts = append(parts, fmt.Sprintf("reject type %d code %d", e.Type, e.Code))
+		case *expr.Exthdr:
+			s := fmt.Sprintf("exthdr %d @%d,%d", e.Type, e.Offset, e.Len)
+			if e.Op == expr.ExthdrOpTcpopt {
+				s = fmt.Sprintf("tcp option %d @%d,%d", e.Type, e.Offset, e.Len)
+			}
+			if e.SourceRegister != 0 {
+				parts = append(parts, s+" set "+regs[e.SourceRegister])
+			} else {
+				regs[e.DestRegister] = s
+			}
+		case *opaqueExpr:
+			parts = append(parts, fmt.Sprintf("%s 0x%x", e.name, e.data))
+		default:
+			parts = append(parts, strings.TrimPrefix(fmt.Sprintf("%T", e), "*expr."))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func metaString(key expr.MetaKey) string {
+	switch key {
+	case expr.MetaKeyIIFNAME:
+		return "iifname"
+	case expr.MetaKeyOIFNAME:
+		return "oifname"
+	case expr.MetaKeyL4PROTO:
+		return "meta l4proto"
+	case expr.MetaKeyNFPROTO:
+		return "meta nfproto"
+	case expr.MetaKeyMARK:
+		return "meta mark"
+	}
+	return fmt.Sprintf("meta %d", key)
+}
+
+func ctString(key expr.CtKey) string {
+	switch key {
+	case expr.CtKeySTATE:
+		return "ct state"
+	case expr.CtKeySTATUS:
+		return "ct status"
+	case expr.CtKeyMARK:
+		return "ct mark"
+	}
+	return fmt.Sprintf("ct %d", key)
+}
+
+func payloadString(e *expr.Payload) string {
+	type field struct {
+		base        expr.PayloadBase
+		offset, len uint32
+	}
+	switch (field{e.Base, e.Offset, e.Len}) {
+	case field{expr.PayloadBaseNetworkHeader, 12, 4}:
+		return "ip saddr"
+	case field{expr.PayloadBaseNetworkHeader, 16, 4}:
+		return "ip daddr"
+	case field{expr.PayloadBaseNetworkHeader, 8, 16}:
+		return "ip6 saddr"
+	case field{expr.PayloadBaseNetworkHeader, 24, 16}:
+		return "ip6 daddr"
+	case field{expr.PayloadBaseTransportHeader, 0, 2}:
+		return "th sport"
+	case field{expr.PayloadBaseTransportHeader, 2, 2}:
+		return "th dport"
+	case field{expr.PayloadBaseTransportHeader, 13, 1}:
+		return "tcp flags"
+	case field{expr.PayloadBaseTransportHeader, 0, 1}:
+		return "icmp type"
+	}
+	base := "th"
+	switch e.Base {
+	case expr.PayloadBaseLLHeader:
+		base = "ll"
+	case expr.PayloadBaseNetworkHeader:
+		base = "nh"
+	}
+	return fmt.Sprintf("@%s,%d,%d", base, e.Offset*8, e.Len*8)
+}
+
+func cmpOpString(op expr.CmpOp) string {
+	switch op {
+	case expr.CmpOpEq:
+		return "=="
+	case expr.CmpOpNeq:
+		return "!="
+	case expr.CmpOpLt:
+		return "<"
+	case expr.CmpOpLte:
+		return "<="
+	case expr.CmpOpGt:
+		return ">"
+	case expr.CmpOpGte:
+		return ">="
+	}
+	return fmt.Sprintf("cmp(%d)", op)
+}
+
+// dataString formats data, which is compared to (or loaded into) a register
+// holding src (e.g. iifname, see ruleString).
+func dataString(src string, data []byte) string {
+	switch {
+	case src == "iifname" || src == "oifname":
+		return fmt.Sprintf("%q", strings.TrimRight(string(data), "\x00"))
+	case src == "meta l4proto" && len(data) == 1:
+		switch data[0] {
+		case 1:
+			return "icmp"
+		case 6:
+			return "tcp"
+		case 17:
+			return "udp"
+		case 58:
+			return "icmpv6"
+		}
+	case strings.HasSuffix(src, "addr") || src == "":
+		if len(data) == net.IPv4len || len(data) == net.IPv6len {
+			return net.IP(data).String()
+		}
+	}
+	switch len(data) {
+	case 1:
+		return fmt.Sprintf("%d", data[0])
+	case 2:
+		return fmt.Sprintf("%d", binary.BigEndian.Uint16(data))
+	}
+	return fmt.Sprintf("0x%x", data)
+}
+
+func limitUnitString(unit expr.LimitTime) string {
+	switch unit {
+	case expr.LimitTimeSecond:
+		return "second"
+	case expr.LimitTimeMinute:
+		return "minute"
+	case expr.LimitTimeHour:
+		return "hour"
+	case expr.LimitTimeDay:
+		return "day"
+	case expr.LimitTimeWeek:
+		return "week"
+	}
+	return fmt.Sprintf("%ds", unit)
+}
+
+func verdictString(v *expr.Verdict) string {
+	switch v.Kind {
+	case expr.VerdictAccept:
+		return "accept"
+	case expr.VerdictDrop:
+		return "drop"
+	case expr.VerdictReturn:
+		return "return"
+	case expr.VerdictContinue:
+		return "continue"
+	case expr.VerdictJump:
+		return "jump " + v.Chain
+	case expr.VerdictGoto:
+		return "goto " + v.Chain
+	}
+	return fmt.Sprintf("verdict(%d)", v.Kind)
+}
+
+// planFirewall plans replacing the tables of rout5 (see NATTable and
+// FilterTable). If any of them differs from the desired state, all of them are
+// replaced in a single batch, i.e. atomically.
+func planFirewall(p *Plan, cfg *Config, dir string, uplinks []string) error {
+	r := &ruleset{conn: &nftables.Conn{}}
+	if err := buildFirewall(r, cfg, dir, uplinks); err != nil {
+		return err
+	}
+	changes, err := r.diff()
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	for _, c := range changes {
+		p.describe(c)
+	}
+	p.step(r.flush)
+	return nil
+}
@@ -0,0 +1,115 @@
+package netconfig
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestRuleKey(t *testing.T) {
+	base := func(last expr.Any) *nftables.Rule {
+		return &nftables.Rule{Exprs: append(ifnameExprs(expr.MetaKeyOIFNAME, "uplink0"), last)}
+	}
+	// Each of these rules differs from the others only in expressions which
+	// nftables.Conn.GetRules does not return.
+	rules := map[string]*nftables.Rule{
+		"masq":        base(&expr.Masq{}),
+		"reject":      base(&expr.Reject{Type: unix.NFT_REJECT_TCP_RST}),
+		"reject icmp": base(&expr.Reject{Type: unix.NFT_REJECT_ICMPX_UNREACH, Code: unix.NFT_REJECT_ICMPX_ADMIN_PROHIBITED}),
+		"objref":      base(&expr.Objref{Type: NFT_OBJECT_COUNTER, Name: "a"}),
+		"objref b":    base(&expr.Objref{Type: NFT_OBJECT_COUNTER, Name: "b"}),
+		"rt":          base(&expr.Rt{Register: 1, Key: expr.RtTCPMSS}),
+		"rt classid":  base(&expr.Rt{Register: 1, Key: expr.RtClassid}),
+		"hton":        base(&expr.Byteorder{DestRegister: 1, SourceRegister: 1, Op: expr.ByteorderHton, Len: 2, Size: 2}),
+		"ntoh":        base(&expr.Byteorder{DestRegister: 1, SourceRegister: 1, Op: expr.ByteorderNtoh, Len: 2, Size: 2}),
+	}
+	seen := make(map[string]string)
+	for name, r := range rules {
+		key := ruleKey(r)
+		if other, ok := seen[key]; ok {
+			t.Errorf("rules %q and %q have the same key %q", name, other, key)
+		}
+		seen[key] = name
+	}
+}
+
+func TestDecodeExpr(t *testing.T) {
+	attrs := func(a ...netlink.Attribute) []byte {
+		t.Helper()
+		b, err := netlink.MarshalAttributes(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	u32 := binaryutil.BigEndian.PutUint32
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want expr.Any
+	}{
+		{
+			name: "rt",
+			data: attrs(
+				netlink.Attribute{Type: unix.NFTA_RT_KEY, Data: u32(unix.NFT_RT_TCPMSS)},
+				netlink.Attribute{Type: unix.NFTA_RT_DREG, Data: u32(1)},
+			),
+			want: &expr.Rt{Register: 1, Key: expr.RtTCPMSS},
+		},
+		{
+			name: "byteorder",
+			data: attrs(
+				netlink.Attribute{Type: unix.NFTA_BYTEORDER_SREG, Data: u32(1)},
+				netlink.Attribute{Type: unix.NFTA_BYTEORDER_DREG, Data: u32(2)},
+				netlink.Attribute{Type: unix.NFTA_BYTEORDER_OP, Data: u32(unix.NFT_BYTEORDER_HTON)},
+				netlink.Attribute{Type: unix.NFTA_BYTEORDER_LEN, Data: u32(2)},
+				netlink.Attribute{Type: unix.NFTA_BYTEORDER_SIZE, Data: u32(2)},
+			),
+			want: &expr.Byteorder{SourceRegister: 1, DestRegister: 2, Op: expr.ByteorderHton, Len: 2, Size: 2},
+		},
+		{
+			name: "ct",
+			data: attrs(
+				netlink.Attribute{Type: unix.NFTA_CT_KEY, Data: u32(unix.NFT_CT_MARK)},
+				netlink.Attribute{Type: unix.NFTA_CT_SREG, Data: u32(1)},
+			),
+			want: &expr.Ct{Key: expr.CtKeyMARK, SourceRegister: true, Register: 1},
+		},
+		{
+			name: "meta",
+			data: attrs(
+				netlink.Attribute{Type: unix.NFTA_META_KEY, Data: u32(unix.NFT_META_MARK)},
+				netlink.Attribute{Type: unix.NFTA_META_DREG, Data: u32(1)},
+			),
+			want: &expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		},
+		{
+			name: "objref",
+			data: attrs(
+				netlink.Attribute{Type: unix.NFTA_OBJREF_IMM_TYPE, Data: u32(NFT_OBJECT_COUNTER)},
+				netlink.Attribute{Type: unix.NFTA_OBJREF_IMM_NAME, Data: []byte("fwded\x00")},
+			),
+			want: &expr.Objref{Type: NFT_OBJECT_COUNTER, Name: "fwded"},
+		},
+		{
+			name: "synproxy",
+			data: []byte{1, 2},
+			want: &opaqueExpr{name: "synproxy", data: []byte{1, 2}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeExpr(unix.NFPROTO_IPV4, tt.name, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(opaqueExpr{})); diff != "" {
+				t.Errorf("decodeExpr: unexpected result: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,468 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"git.tcp.direct/kayos/rout5/config"
+	"git.tcp.direct/kayos/rout5/dhcp/dhcp4"
+)
+
+// A Snapshot is the network state which Restore returns to, see TakeSnapshot.
+type Snapshot struct {
+	links     []linkSnapshot
+	routes    []netlink.Route
+	rules     []policyRule
+	wireguard []wgtypes.Device
+	firewall  *ruleset // nil if no config was in effect
+
+	dir   string          // state directory, for reading DHCP leases
+	owned map[string]bool // addresses netconfig added, see ownAddrs
+}
+
+type linkSnapshot struct {
+	index  int // stable across renames
+	name   string
+	hwaddr net.HardwareAddr
+	master int
+	up     bool
+	addrs  []netlink.Addr
+}
+
+// routeKey identifies r for comparing routes across snapshots.
+func routeKey(r netlink.Route) string {
+	return fmt.Sprintf("%d %v %v %v %d %d %d", r.LinkIndex, r.Dst, r.Gw, r.Src, r.Protocol, r.Table, r.Priority)
+}
+
+// TakeSnapshot records the links, addresses, routes (of all tables), the
+// routing rules which netconfig added and WireGuard devices, as
+// well as the nftables tables of cfg (the config which is currently in
+// effect, or nil), so that they can be restored after applying a different
+// config turns out to be a mistake.
+//
+// The tables are built from cfg (with the DHCP leases found in dir) instead
+// of being read back, as the nftables package cannot decode all expressions
+// rout5 uses (e.g. masquerade).
+func TakeSnapshot(cfg *Config, dir string) (*Snapshot, error) {
+	s := Snapshot{dir: dir, owned: ownAddrs(cfg, dir)}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("LinkList: %v", err)
+	}
+	for _, l := range links {
+		attrs := l.Attrs()
+		addrs, err := netlink.AddrList(l, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, fmt.Errorf("AddrList(%s): %v", attrs.Name, err)
+		}
+		s.links = append(s.links, linkSnapshot{
+			index:  attrs.Index,
+			name:   attrs.Name,
+			hwaddr: attrs.HardwareAddr,
+			master: attrs.MasterIndex,
+			up:     isUp(l),
+			addrs:  addrs,
+		})
+	}
+
+	routes, err := listAllRoutes()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		// The kernel adds and removes these routes along with addresses.
+		if r.Protocol == unix.RTPROT_KERNEL {
+			continue
+		}
+		s.routes = append(s.routes, r)
+	}
+
+	if s.rules, err = listRules(); err != nil {
+		return nil, fmt.Errorf("listing rules: %v", err)
+	}
+
+	cl, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	defer cl.Close()
+	devices, err := cl.Devices()
+	if err != nil {
+		return nil, fmt.Errorf("wireguard: %v", err)
+	}
+	for _, d := range devices {
+		s.wireguard = append(s.wireguard, *d)
+	}
+
+	if cfg != nil {
+		uplinks, err := (&Plan{}).uplinkInterfaces()
+		if err != nil {
+			log.Printf("uplinkInterfaces: %v", err)
+		}
+		r := &ruleset{conn: &nftables.Conn{}}
+		if err := buildFirewall(r, cfg, dir, uplinks); err != nil {
+			return nil, fmt.Errorf("firewall: %v", err)
+		}
+		s.firewall = r
+	}
+	return &s, nil
+}
+
+// Restore returns the network state to s, but leaves alone what other
+// software set up since s was taken: links which were created since are only
+// deleted if one of the applied configs (those applied since s was taken)
+// names them, addresses only if netconfig added them (see ownAddrs), and routes
+// only if netconfig installs routes of their protocol (see ownRoute). Restore
+// continues after errors so that as much of s as possible is restored.
+func (s *Snapshot) Restore(applied ...*Config) error {
+	var errors []error
+	fail := func(err error) {
+		log.Printf("restore: %v", err)
+		errors = append(errors, err)
+	}
+
+	if err := s.restoreLinks(applied); err != nil {
+		fail(err)
+	}
+
+	owned := make(map[string]bool)
+	for addr := range s.owned {
+		owned[addr] = true
+	}
+	for _, cfg := range applied {
+		for addr := range ownAddrs(cfg, s.dir) {
+			owned[addr] = true
+		}
+	}
+	for _, ls := range s.links {
+		if err := ls.restoreAddrs(owned); err != nil {
+			fail(err)
+		}
+	}
+
+	if err := s.restoreRoutes(); err != nil {
+		fail(err)
+	}
+
+	if err := s.restoreRules(); err != nil {
+		fail(err)
+	}
+
+	if err := s.restoreWireGuard(); err != nil {
+		fail(err)
+	}
+
+	if s.firewall != nil {
+		if err := s.firewall.flush(); err != nil {
+			fail(fmt.Errorf("firewall: %v", err))
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("%v", errors)
+	}
+	return nil
+}
+
+// createdLinks returns the names of the links which netconfig creates when
+// applying cfg, as opposed to the physical links it configures.
+func (cfg *Config) createdLinks() map[string]bool {
+	names := make(map[string]bool)
+	for _, bridge := range cfg.interfaces.Bridges {
+		names[bridge.Name] = true
+	}
+	for _, bond := range cfg.interfaces.Bonds {
+		names[bond.Name] = true
+	}
+	for _, vlan := range cfg.interfaces.VLANs {
+		names[vlan.Name] = true
+	}
+	for _, iface := range cfg.wireguard.Interfaces {
+		names[iface.Name] = true
+	}
+	return names
+}
+
+func (s *Snapshot) restoreLinks(applied []*Config) error {
+	created := make(map[string]bool)
+	for _, cfg := range applied {
+		for name := range cfg.createdLinks() {
+			created[name] = true
+		}
+	}
+	byIndex := make(map[int]linkSnapshot)
+	for _, ls := range s.links {
+		byIndex[ls.index] = ls
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("LinkList: %v", err)
+	}
+	for _, l := range links {
+		attrs := l.Attrs()
+		ls, ok := byIndex[attrs.Index]
+		if !ok {
+			// Only delete the links which netconfig created, not e.g. USB
+			// network adapters which were plugged in meanwhile or the
+			// bridges of container runtimes.
+			if created[attrs.Name] {
+				if err := netlink.LinkDel(l); err != nil {
+					return fmt.Errorf("LinkDel(%s): %v", attrs.Name, err)
+				}
+			}
+			continue
+		}
+		if attrs.Name != ls.name {
+			if err := netlink.LinkSetDown(l); err != nil {
+				return fmt.Errorf("LinkSetDown(%s): %v", attrs.Name, err)
+			}
+			if err := netlink.LinkSetName(l, ls.name); err != nil {
+				return fmt.Errorf("LinkSetName(%s, %s): %v", attrs.Name, ls.name, err)
+			}
+		}
+		if !bytes.Equal(attrs.HardwareAddr, ls.hwaddr) && len(ls.hwaddr) > 0 {
+			if err := netlink.LinkSetHardwareAddr(l, ls.hwaddr); err != nil {
+				return fmt.Errorf("LinkSetHardwareAddr(%s, %v): %v", ls.name, ls.hwaddr, err)
+			}
+		}
+		if attrs.MasterIndex != ls.master {
+			if ls.master == 0 {
+				err = netlink.LinkSetNoMaster(l)
+			} else {
+				err = netlink.LinkSetMasterByIndex(l, ls.master)
+			}
+			if err != nil {
+				return fmt.Errorf("setting master of %s: %v", ls.name, err)
+			}
+		}
+		// Renaming requires setting the link down, so always set the state.
+		if ls.up {
+			err = netlink.LinkSetUp(l)
+		} else {
+			err = netlink.LinkSetDown(l)
+		}
+		if err != nil {
+			return fmt.Errorf("setting %s up/down: %v", ls.name, err)
+		}
+	}
+	return nil
+}
+
+// ownAddrs returns the addresses (e.g. 192.168.42.1/24) which netconfig adds
+// when applying cfg (nil if no config is in effect) with the DHCP leases found
+// in dir: those of the configured interfaces (including WireGuard
+// interfaces), of the DHCPv4 leases of the uplinks and of the delegated
+// DHCPv6 prefixes.
+func ownAddrs(cfg *Config, dir string) map[string]bool {
+	owned := make(map[string]bool)
+	add := func(s string) {
+		if addr, err := netlink.ParseAddr(s); err == nil {
+			owned[addr.IPNet.String()] = true
+		}
+	}
+	if cfg != nil {
+		for _, details := range cfg.interfaces.Interfaces {
+			if details.Addr != "" {
+				add(details.Addr)
+			}
+		}
+	}
+	for _, linkName := range uplinkNames() {
+		var got dhcp4.Config
+		if err := readJSON(filepath.Join(dir, config.DHCP4Dir(linkName), "lease.json"), &got); err != nil {
+			log.Printf("%s: %v", linkName, err)
+			continue
+		}
+		if got.ClientIP == "" || got.SubnetMask == "" {
+			continue
+		}
+		if size, err := subnetMaskSize(got.SubnetMask); err == nil {
+			add(fmt.Sprintf("%s/%d", got.ClientIP, size))
+		}
+	}
+	delegated, err := delegatedAddrs(dir)
+	if err != nil {
+		log.Printf("dhcp6: %v", err)
+	}
+	for _, addr := range delegated {
+		owned[addr.IPNet.String()] = true
+	}
+	return owned
+}
+
+// restoreAddrs restores the addresses of ls which netconfig added (see
+// ownAddrs): those which were added since the snapshot are deleted, those
+// which were removed are added again. Other addresses, e.g. IPv6 link-local
+// addresses, SLAAC addresses or those of other software, are left alone.
+func (ls *linkSnapshot) restoreAddrs(owned map[string]bool) error {
+	l, err := netlink.LinkByIndex(ls.index)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil // e.g. unplugged since the snapshot was taken
+		}
+		return fmt.Errorf("LinkByIndex(%d): %v", ls.index, err)
+	}
+	want := make(map[string]bool)
+	for _, a := range ls.addrs {
+		want[a.IPNet.String()] = true
+	}
+	current, err := netlink.AddrList(l, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("AddrList(%s): %v", ls.name, err)
+	}
+	for _, a := range current {
+		if !owned[a.IPNet.String()] || want[a.IPNet.String()] {
+			continue
+		}
+		if err := netlink.AddrDel(l, &a); err != nil {
+			return fmt.Errorf("AddrDel(%s, %v): %v", ls.name, a.IPNet, err)
+		}
+	}
+	for _, a := range ls.addrs {
+		if !owned[a.IPNet.String()] {
+			continue
+		}
+		a := a // copy
+		if err := netlink.AddrReplace(l, &a); err != nil {
+			return fmt.Errorf("AddrReplace(%s, %v): %v", ls.name, a.IPNet, err)
+		}
+	}
+	return nil
+}
+
+// ownRoute reports whether r might have been installed by netconfig, i.e.
+// whether it is a static route (see planStaticRoutes) or a route of a DHCP
+// lease (see planDhcp4 and planDefaultRoutes). Restore does not delete routes
+// of other protocols, e.g. those of routing daemons or of the kernel.
+func ownRoute(r netlink.Route) bool {
+	return r.Protocol == unix.RTPROT_STATIC || r.Protocol == unix.RTPROT_DHCP
+}
+
+func (s *Snapshot) restoreRoutes() error {
+	want := make(map[string]bool)
+	for _, r := range s.routes {
+		want[routeKey(r)] = true
+	}
+	current, err := listAllRoutes()
+	if err != nil {
+		return err
+	}
+	for _, r := range current {
+		if !ownRoute(r) || want[routeKey(r)] {
+			continue
+		}
+		r := r // copy
+		if err := netlink.RouteDel(&r); err != nil {
+			return fmt.Errorf("RouteDel(%v): %v", r, err)
+		}
+	}
+	for _, r := range s.routes {
+		r := r // copy
+		if err := netlink.RouteReplace(&r); err != nil {
+			return fmt.Errorf("RouteReplace(%v): %v", r, err)
+		}
+	}
+	return nil
+}
+
+// listAllRoutes returns the routes of all routing tables, not just of the
+// main table.
+func listAllRoutes() ([]netlink.Route, error) {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: unix.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, fmt.Errorf("RouteListFiltered: %v", err)
+	}
+	return routes, nil
+}
+
+func (s *Snapshot) restoreRules() error {
+	tableName := func(id uint32) string { return fmt.Sprint(id) }
+	want := make(map[string]bool)
+	for _, r := range s.rules {
+		want[r.describe(tableName)] = true
+	}
+	current, err := listRules()
+	if err != nil {
+		return fmt.Errorf("listing rules: %v", err)
+	}
+	exists := make(map[string]bool)
+	for _, r := range current {
+		desc := r.describe(tableName)
+		exists[desc] = true
+		if want[desc] {
+			continue
+		}
+		if err := r.del(); err != nil {
+			return fmt.Errorf("deleting rule %s: %v", desc, err)
+		}
+	}
+	for _, r := range s.rules {
+		desc := r.describe(tableName)
+		if exists[desc] {
+			continue
+		}
+		if err := r.add(); err != nil {
+			return fmt.Errorf("adding rule %s: %v", desc, err)
+		}
+	}
+	return nil
+}
+
+func (s *Snapshot) restoreWireGuard() error {
+	if len(s.wireguard) == 0 {
+		return nil
+	}
+	cl, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+	for _, d := range s.wireguard {
+		peers := make([]wgtypes.PeerConfig, 0, len(d.Peers))
+		for _, p := range d.Peers {
+			p := p // copy
+			peers = append(peers, wgtypes.PeerConfig{
+				PublicKey:                   p.PublicKey,
+				PresharedKey:                &p.PresharedKey,
+				Endpoint:                    p.Endpoint,
+				PersistentKeepaliveInterval: &p.PersistentKeepaliveInterval,
+				ReplaceAllowedIPs:           true,
+				AllowedIPs:                  p.AllowedIPs,
+			})
+		}
+		d := d // copy
+		if err := cl.ConfigureDevice(d.Name, wgtypes.Config{
+			PrivateKey:   &d.PrivateKey,
+			ListenPort:   &d.ListenPort,
+			FirewallMark: &d.FirewallMark,
+			ReplacePeers: true,
+			Peers:        peers,
+		}); err != nil {
+			return fmt.Errorf("ConfigureDevice(%s): %v", d.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,402 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// sqmConfig configures smart queue management on the uplinks, which keeps
+// latency low under load by shaping traffic to slightly less than the
+// bandwidth of each uplink, so that packets queue in rout5 (where fq_codel
+// manages the queue) instead of in the modem. It is read from
+// [netconfig.sqm] in config.toml, e.g.:
+//
+//	[netconfig.sqm]
+//	upload_kbit = 9000
+//	download_kbit = 95000
+//
+//	[[netconfig.sqm.uplinks]]
+//	name = "uplink1"
+//	upload_kbit = 1800
+//	download_kbit = 18000
+//
+// The rates at the top apply to the first uplink (of interfaces.wan_ifnames),
+// those of uplinks to the named uplink. Every uplink is shaped independently
+// of whether it currently carries the default route, so that shaping remains
+// in effect after failing over (see multiWANConfig).
+//
+// Upload traffic is shaped on the uplink itself. Download traffic is
+// redirected to an IFB device (see ifbName) and shaped on its egress.
+type sqmConfig struct {
+	sqmRates `mapstructure:",squash"`
+
+	Uplinks []sqmUplink `json:"uplinks,omitempty" mapstructure:"uplinks"`
+}
+
+type sqmRates struct {
+	// UploadKbit and DownloadKbit are the shaped rates in kbit/s, typically
+	// 85-95% of the bandwidth of the uplink. Zero disables shaping in the
+	// respective direction.
+	UploadKbit   int `json:"upload_kbit,omitempty" mapstructure:"upload_kbit"`
+	DownloadKbit int `json:"download_kbit,omitempty" mapstructure:"download_kbit"`
+}
+
+type sqmUplink struct {
+	Name string `json:"name" mapstructure:"name"` // one of interfaces.wan_ifnames
+
+	sqmRates `mapstructure:",squash"`
+}
+
+func (r sqmRates) validate(pl *problemList, field string) {
+	for _, rate := range []struct {
+		key string
+		val int
+	}{
+		{"upload_kbit", r.UploadKbit},
+		{"download_kbit", r.DownloadKbit},
+	} {
+		if rate.val < 0 {
+			pl.add(field+"."+rate.key, "must not be negative (got %d)", rate.val)
+		}
+	}
+}
+
+func (s *sqmConfig) validate(pl *problemList) {
+	s.sqmRates.validate(pl, "sqm")
+	set := s.UploadKbit != 0 || s.DownloadKbit != 0
+	seen := make(map[string]bool)
+	for idx, u := range s.Uplinks {
+		field := fmt.Sprintf("sqm.uplinks[%d]", idx)
+		switch {
+		case u.Name == "":
+			pl.add(field+".name", "must not be empty")
+		case uplinkIndex(u.Name) == -1:
+			pl.add(field+".name", "%q is not listed in interfaces.wan_ifnames", u.Name)
+		case seen[u.Name]:
+			pl.add(field+".name", "duplicate uplink %q", u.Name)
+		}
+		seen[u.Name] = true
+		u.sqmRates.validate(pl, field)
+		set = set || u.UploadKbit != 0 || u.DownloadKbit != 0
+	}
+	if !set {
+		pl.add("sqm", "at least one of upload_kbit and download_kbit must be set")
+	}
+}
+
+// rates returns the rates of the uplink ifname. s may be nil.
+func (s *sqmConfig) rates(ifname string) sqmRates {
+	if s == nil {
+		return sqmRates{}
+	}
+	for _, u := range s.Uplinks {
+		if u.Name == ifname {
+			return u.sqmRates
+		}
+	}
+	if uplinkIndex(ifname) == 0 {
+		return s.sqmRates
+	}
+	return sqmRates{}
+}
+
+// ifbName returns the name of the IFB device which shapes the download
+// traffic of ifname, following the convention of sqm-scripts.
+func ifbName(ifname string) string {
+	name := "ifb4" + ifname
+	if len(name) > unix.IFNAMSIZ-1 {
+		name = name[:unix.IFNAMSIZ-1]
+	}
+	return name
+}
+
+var (
+	sqmRoot  = netlink.MakeHandle(1, 0)
+	sqmClass = netlink.MakeHandle(1, 1)
+	sqmLeaf  = netlink.MakeHandle(10, 0)
+
+	ingressHandle = netlink.MakeHandle(0xffff, 0)
+)
+
+// shaped reports whether the link l (nil if it does not exist yet) is shaped
+// to kbit by an htb root qdisc with an fq_codel leaf, see shape.
+func shaped(l netlink.Link, kbit int) (bool, error) {
+	if l == nil {
+		return false, nil
+	}
+	qdiscs, err := netlink.QdiscList(l)
+	if err != nil {
+		return false, fmt.Errorf("QdiscList(%s): %v", l.Attrs().Name, err)
+	}
+	var root, leaf bool
+	for _, q := range qdiscs {
+		attrs := q.Attrs()
+		switch {
+		case q.Type() == "htb" && attrs.Parent == netlink.HANDLE_ROOT && attrs.Handle == sqmRoot:
+			root = true
+		case q.Type() == "fq_codel" && attrs.Parent == sqmClass:
+			leaf = true
+		}
+	}
+	if !root || !leaf {
+		return false, nil
+	}
+	classes, err := netlink.ClassList(l, sqmRoot)
+	if err != nil {
+		return false, fmt.Errorf("ClassList(%s): %v", l.Attrs().Name, err)
+	}
+	for _, c := range classes {
+		if htb, ok := c.(*netlink.HtbClass); ok && htb.Handle == sqmClass {
+			return htb.Rate == uint64(kbit)*1000/8, nil
+		}
+	}
+	return false, nil
+}
+
+// hasRootQdisc reports whether l carries the htb root qdisc of shape.
+func hasRootQdisc(l netlink.Link) (bool, error) {
+	qdiscs, err := netlink.QdiscList(l)
+	if err != nil {
+		return false, fmt.Errorf("QdiscList(%s): %v", l.Attrs().Name, err)
+	}
+	for _, q := range qdiscs {
+		if attrs := q.Attrs(); q.Type() == "htb" && attrs.Parent == netlink.HANDLE_ROOT && attrs.Handle == sqmRoot {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// shape limits the egress of ifname to kbit using an htb root qdisc, whose
+// only (and hence default) class queues packets in an fq_codel qdisc.
+func shape(ifname string, kbit int) error {
+	l, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return err
+	}
+	idx := l.Attrs().Index
+	htb := netlink.NewHtb(netlink.QdiscAttrs{
+		LinkIndex: idx,
+		Handle:    sqmRoot,
+		Parent:    netlink.HANDLE_ROOT,
+	})
+	htb.Defcls = 1 // i.e. sqmClass
+	if err := netlink.QdiscReplace(htb); err != nil {
+		return fmt.Errorf("QdiscReplace(%s, htb): %v", ifname, err)
+	}
+	class := netlink.NewHtbClass(netlink.ClassAttrs{
+		LinkIndex: idx,
+		Handle:    sqmClass,
+		Parent:    sqmRoot,
+	}, netlink.HtbClassAttrs{
+		Rate: uint64(kbit) * 1000, // bit/s
+	})
+	if err := netlink.ClassReplace(class); err != nil {
+		return fmt.Errorf("ClassReplace(%s, htb): %v", ifname, err)
+	}
+	fq := netlink.NewFqCodel(netlink.QdiscAttrs{
+		LinkIndex: idx,
+		Handle:    sqmLeaf,
+		Parent:    sqmClass,
+	})
+	if err := netlink.QdiscReplace(fq); err != nil {
+		return fmt.Errorf("QdiscReplace(%s, fq_codel): %v", ifname, err)
+	}
+	return nil
+}
+
+// unshape removes the qdiscs of shape, so that the kernel restores the
+// default qdisc of ifname.
+func unshape(ifname string) error {
+	l, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return err
+	}
+	if err := netlink.QdiscDel(&netlink.Htb{QdiscAttrs: netlink.QdiscAttrs{
+		LinkIndex: l.Attrs().Index,
+		Handle:    sqmRoot,
+		Parent:    netlink.HANDLE_ROOT,
+	}}); err != nil {
+		return fmt.Errorf("QdiscDel(%s, htb): %v", ifname, err)
+	}
+	return nil
+}
+
+// redirected reports whether the ingress of l is redirected to the link with
+// index ifbIndex, see redirectIngress.
+func redirected(l netlink.Link, ifbIndex int) (bool, error) {
+	qdiscs, err := netlink.QdiscList(l)
+	if err != nil {
+		return false, fmt.Errorf("QdiscList(%s): %v", l.Attrs().Name, err)
+	}
+	var ingress bool
+	for _, q := range qdiscs {
+		if q.Type() == "ingress" {
+			ingress = true
+		}
+	}
+	if !ingress {
+		return false, nil
+	}
+	filters, err := netlink.FilterList(l, ingressHandle)
+	if err != nil {
+		return false, fmt.Errorf("FilterList(%s): %v", l.Attrs().Name, err)
+	}
+	for _, f := range filters {
+		if u32, ok := f.(*netlink.U32); ok && u32.RedirIndex == ifbIndex {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// redirectIngress creates the IFB device ifb and redirects all traffic
+// received on ifname to it, so that it can be shaped on the egress of ifb.
+func redirectIngress(ifname, ifb string) error {
+	if _, err := netlink.LinkByName(ifb); err != nil {
+		if err := netlink.LinkAdd(&netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: ifb}}); err != nil {
+			return fmt.Errorf("LinkAdd(%s): %v", ifb, err)
+		}
+	}
+	ifbLink, err := netlink.LinkByName(ifb)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetUp(ifbLink); err != nil {
+		return fmt.Errorf("LinkSetUp(%s): %v", ifb, err)
+	}
+	l, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return err
+	}
+	if err := netlink.QdiscReplace(&netlink.Ingress{QdiscAttrs: netlink.QdiscAttrs{
+		LinkIndex: l.Attrs().Index,
+		Handle:    ingressHandle,
+		Parent:    netlink.HANDLE_INGRESS,
+	}}); err != nil {
+		return fmt.Errorf("QdiscReplace(%s, ingress): %v", ifname, err)
+	}
+	// The default selector of U32 matches all packets.
+	if err := netlink.FilterReplace(&netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: l.Attrs().Index,
+			Parent:    ingressHandle,
+			Priority:  1,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		RedirIndex: ifbLink.Attrs().Index,
+	}); err != nil {
+		return fmt.Errorf("FilterReplace(%s, redirect to %s): %v", ifname, ifb, err)
+	}
+	return nil
+}
+
+// removeIngress undoes redirectIngress.
+func removeIngress(ifname, ifb string) error {
+	if l, err := netlink.LinkByName(ifname); err == nil {
+		if err := netlink.QdiscDel(&netlink.Ingress{QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: l.Attrs().Index,
+			Handle:    ingressHandle,
+			Parent:    netlink.HANDLE_INGRESS,
+		}}); err != nil {
+			return fmt.Errorf("QdiscDel(%s, ingress): %v", ifname, err)
+		}
+	}
+	l, err := netlink.LinkByName(ifb)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkDel(l); err != nil {
+		return fmt.Errorf("LinkDel(%s): %v", ifb, err)
+	}
+	return nil
+}
+
+// planSQM plans shaping the uplink ifname to s, removing the shaping in
+// directions whose rate is zero. As with all other parts of the config, the
+// qdiscs are compared on every Apply, so that e.g. a deleted IFB device is set
+// up again.
+func planSQM(p *Plan, s sqmRates, ifname string) error {
+	l, err := p.link(ifname)
+	if err != nil {
+		return err
+	}
+	if l == nil {
+		return fmt.Errorf("uplink %s does not exist", ifname)
+	}
+
+	// Upload: shape the egress of the uplink.
+	if s.UploadKbit > 0 {
+		ok, err := shaped(l, s.UploadKbit)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			p.change(Change{Op: "+", Kind: "qdisc", Object: fmt.Sprintf("%s root htb rate %dkbit, fq_codel", ifname, s.UploadKbit)}, func() error {
+				return shape(ifname, s.UploadKbit)
+			})
+		}
+	} else {
+		ok, err := hasRootQdisc(l)
+		if err != nil {
+			return err
+		}
+		if ok {
+			p.change(Change{Op: "-", Kind: "qdisc", Object: ifname + " root htb"}, func() error {
+				return unshape(ifname)
+			})
+		}
+	}
+
+	// Download: redirect the ingress of the uplink to an IFB device and
+	// shape its egress.
+	ifb := ifbName(ifname)
+	ifbLink, err := netlink.LinkByName(ifb)
+	if err != nil {
+		ifbLink = nil
+	}
+	if s.DownloadKbit == 0 {
+		if ifbLink != nil {
+			p.change(Change{Op: "-", Kind: "link", Object: ifb + " type ifb"}, func() error {
+				return removeIngress(ifname, ifb)
+			})
+		}
+		return nil
+	}
+	ok := false
+	if ifbLink != nil && isUp(ifbLink) {
+		if ok, err = redirected(l, ifbLink.Attrs().Index); err != nil {
+			return err
+		}
+	}
+	if !ok {
+		p.change(Change{Op: "+", Kind: "qdisc", Object: ifname + " ingress, redirect to " + ifb}, func() error {
+			return redirectIngress(ifname, ifb)
+		})
+	}
+	if ok, err = shaped(ifbLink, s.DownloadKbit); err != nil {
+		return err
+	}
+	if !ok {
+		p.change(Change{Op: "+", Kind: "qdisc", Object: fmt.Sprintf("%s root htb rate %dkbit, fq_codel", ifb, s.DownloadKbit)}, func() error {
+			return shape(ifb, s.DownloadKbit)
+		})
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+// TableStatus summarizes an nftables table, see FirewallStatus.
+type TableStatus struct {
+	Family   string          `json:"family"` // e.g. ip, ip6
+	Name     string          `json:"name"`
+	Chains   []ChainStatus   `json:"chains"`
+	Counters []CounterStatus `json:"counters,omitempty"`
+}
+
+// ChainStatus summarizes an nftables chain.
+type ChainStatus struct {
+	Name     string `json:"name"`
+	Type     string `json:"type,omitempty"` // e.g. filter, nat
+	Hook     string `json:"hook,omitempty"` // e.g. forward
+	Priority int32  `json:"priority"`
+	Policy   string `json:"policy,omitempty"` // accept or drop
+	Rules    int    `json:"rules"`
+	Packets  uint64 `json:"packets"` // summed over all anonymous rule counters
+	Bytes    uint64 `json:"bytes"`
+}
+
+// CounterStatus is a named nftables counter.
+type CounterStatus struct {
+	Name    string `json:"name"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+func familyString(f nftables.TableFamily) string {
+	switch f {
+	case nftables.TableFamilyINet:
+		return "inet"
+	case nftables.TableFamilyIPv4:
+		return "ip"
+	case nftables.TableFamilyIPv6:
+		return "ip6"
+	case nftables.TableFamilyARP:
+		return "arp"
+	case nftables.TableFamilyNetdev:
+		return "netdev"
+	case nftables.TableFamilyBridge:
+		return "bridge"
+	}
+	return fmt.Sprintf("family(%d)", f)
+}
+
+func hookString(h nftables.ChainHook) string {
+	switch h {
+	case nftables.ChainHookPrerouting:
+		return "prerouting"
+	case nftables.ChainHookInput:
+		return "input"
+	case nftables.ChainHookForward:
+		return "forward"
+	case nftables.ChainHookOutput:
+		return "output"
+	case nftables.ChainHookPostrouting:
+		return "postrouting"
+	}
+	return fmt.Sprintf("hook(%d)", h)
+}
+
+// FirewallStatus returns all nftables tables, including their chains and
+// named counters.
+func FirewallStatus() ([]TableStatus, error) {
+	c := &nftables.Conn{}
+	tables, err := c.ListTables()
+	if err != nil {
+		return nil, fmt.Errorf("ListTables: %v", err)
+	}
+	chains, err := c.ListChains()
+	if err != nil {
+		return nil, fmt.Errorf("ListChains: %v", err)
+	}
+	var status []TableStatus
+	for _, t := range tables {
+		ts := TableStatus{
+			Family: familyString(t.Family),
+			Name:   t.Name,
+		}
+		for _, ch := range chains {
+			if ch.Table.Name != t.Name || ch.Table.Family != t.Family {
+				continue
+			}
+			cs := ChainStatus{
+				Name:     ch.Name,
+				Type:     string(ch.Type),
+				Priority: int32(ch.Priority),
+			}
+			if ch.Type != "" {
+				// Only base chains are attached to a hook.
+				cs.Hook = hookString(ch.Hooknum)
+			}
+			if ch.Policy != nil {
+				cs.Policy = "accept"
+				if *ch.Policy == nftables.ChainPolicyDrop {
+					cs.Policy = "drop"
+				}
+			}
+			rules, err := c.GetRules(t, ch)
+			if err != nil {
+				return nil, fmt.Errorf("GetRules(%s %s %s): %v", ts.Family, t.Name, ch.Name, err)
+			}
+			cs.Rules = len(rules)
+			for _, r := range rules {
+				for _, e := range r.Exprs {
+					if cnt, ok := e.(*expr.Counter); ok {
+						cs.Packets += cnt.Packets
+						cs.Bytes += cnt.Bytes
+					}
+				}
+			}
+			ts.Chains = append(ts.Chains, cs)
+		}
+		objs, err := c.GetObjects(t)
+		if err != nil {
+			return nil, fmt.Errorf("GetObjects(%s %s): %v", ts.Family, t.Name, err)
+		}
+		for _, o := range objs {
+			if co, ok := o.(*nftables.CounterObj); ok {
+				ts.Counters = append(ts.Counters, CounterStatus{
+					Name:    co.Name,
+					Packets: co.Packets,
+					Bytes:   co.Bytes,
+				})
+			}
+		}
+		status = append(status, ts)
+	}
+	return status, nil
+}
+
+// WireGuardStatus describes a WireGuard interface and its peers.
+type WireGuardStatus struct {
+	Name       string                `json:"name"`
+	PublicKey  string                `json:"public_key"`
+	ListenPort int                   `json:"listen_port"`
+	Peers      []WireGuardPeerStatus `json:"peers"`
+}
+
+// WireGuardPeerStatus describes a WireGuard peer, see WireGuardStatus.
+type WireGuardPeerStatus struct {
+	PublicKey     string    `json:"public_key"`
+	Endpoint      string    `json:"endpoint,omitempty"`
+	AllowedIPs    []string  `json:"allowed_ips"`
+	LastHandshake time.Time `json:"last_handshake"`
+	ReceiveBytes  int64     `json:"receive_bytes"`
+	TransmitBytes int64     `json:"transmit_bytes"`
+}
+
+// WireGuardStatuses returns the status of all WireGuard interfaces.
+func WireGuardStatuses() ([]WireGuardStatus, error) {
+	cl, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	defer cl.Close()
+	devices, err := cl.Devices()
+	if err != nil {
+		return nil, err
+	}
+	status := make([]WireGuardStatus, 0, len(devices))
+	for _, d := range devices {
+		ws := WireGuardStatus{
+			Name:       d.Name,
+			PublicKey:  d.PublicKey.String(),
+			ListenPort: d.ListenPort,
+		}
+		for _, p := range d.Peers {
+			ps := WireGuardPeerStatus{
+				PublicKey:     p.PublicKey.String(),
+				LastHandshake: p.LastHandshakeTime,
+				ReceiveBytes:  p.ReceiveBytes,
+				TransmitBytes: p.TransmitBytes,
+			}
+			if p.Endpoint != nil {
+				ps.Endpoint = p.Endpoint.String()
+			}
+			for _, ipnet := range p.AllowedIPs {
+				ps.AllowedIPs = append(ps.AllowedIPs, ipnet.String())
+			}
+			ws.Peers = append(ws.Peers, ps)
+		}
+		status = append(status, ws)
+	}
+	return status, nil
+}
@@ -15,13 +15,10 @@
 package netconfig
 
 import (
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net"
-	"os"
-	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
 
 	"github.com/vishvananda/netlink"
@@ -30,16 +27,16 @@ import (
 )
 
 type wireguardPeer struct {
-	PublicKey  string   `json:"public_key"`  // base64-encoded
-	Endpoint   string   `json:"endpoint"`    // e.g. “[::1]:12345”
-	AllowedIPs []string `json:"allowed_ips"` // e.g. “["fe80::/64", "10.0.137.0/24"]”
+	PublicKey  string   `json:"public_key" mapstructure:"public_key"`       // base64-encoded
+	Endpoint   string   `json:"endpoint,omitempty" mapstructure:"endpoint"` // e.g. “[::1]:12345”
+	AllowedIPs []string `json:"allowed_ips" mapstructure:"allowed_ips"`     // e.g. “["fe80::/64", "10.0.137.0/24"]”
 }
 
 type wireguardInterface struct {
-	Name       string          `json:"name"`        // e.g. “wg0”
-	PrivateKey string          `json:"private_key"` // base64-encoded
-	Port       int             `json:"port"`        // e.g. “51820”
-	Peers      []wireguardPeer `json:"peers"`
+	Name       string          `json:"name" mapstructure:"name"`               // e.g. “wg0”
+	PrivateKey string          `json:"private_key" mapstructure:"private_key"` // base64-encoded
+	Port       int             `json:"port,omitempty" mapstructure:"port"`     // e.g. “51820”
+	Peers      []wireguardPeer `json:"peers,omitempty" mapstructure:"peers"`
 }
 
 type wireguardInterfaces struct {
@@ -60,25 +57,11 @@ func (w *wgLink) Attrs() *netlink.LinkAttrs {
 	return &attrs
 }
 
-func applyWireGuard(dir string) error {
-	b, err := ioutil.ReadFile(filepath.Join(dir, "wireguard.json"))
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
-	}
-	var cfg wireguardInterfaces
-	if err := json.Unmarshal(b, &cfg); err != nil {
-		return err
+func planWireGuard(p *Plan, cfg *wireguardInterfaces) error {
+	if len(cfg.Interfaces) == 0 {
+		return nil
 	}
 
-	h, err := netlink.NewHandle()
-	if err != nil {
-		return fmt.Errorf("netlink.NewHandle: %v", err)
-	}
-	defer h.Delete()
-
 	cl, err := wgctrl.New()
 	if err != nil {
 		return err
@@ -86,11 +69,20 @@ func applyWireGuard(dir string) error {
 	defer cl.Close()
 
 	for _, iface := range cfg.Interfaces {
-		l := &wgLink{iface.Name}
-		if err := h.LinkAdd(l); err != nil {
-			if ee, ok := err.(syscall.Errno); !ok || ee != syscall.EEXIST {
-				return fmt.Errorf("LinkAdd(%v): %v", l, err)
-			}
+		iface := iface // copy
+		var current *wgtypes.Device
+		if _, err := netlink.LinkByName(iface.Name); err != nil {
+			p.change(Change{Op: "+", Kind: "link", Object: iface.Name + " type wireguard"}, func() error {
+				l := &wgLink{iface.Name}
+				if err := netlink.LinkAdd(l); err != nil {
+					if ee, ok := err.(syscall.Errno); !ok || ee != syscall.EEXIST {
+						return fmt.Errorf("LinkAdd(%v): %v", l, err)
+					}
+				}
+				return nil
+			})
+		} else if current, err = cl.Device(iface.Name); err != nil {
+			return fmt.Errorf("Device(%s): %v", iface.Name, err)
 		}
 
 		var peers []wgtypes.PeerConfig
@@ -104,11 +96,7 @@ func applyWireGuard(dir string) error {
 
 				ips = append(ips, *ipnet)
 			}
-			b, err := base64.StdEncoding.DecodeString(p.PublicKey)
-			if err != nil {
-				return err
-			}
-			publicKey, err := wgtypes.NewKey(b)
+			publicKey, err := parseKey(p.PublicKey)
 			if err != nil {
 				return err
 			}
@@ -126,25 +114,90 @@ func applyWireGuard(dir string) error {
 				AllowedIPs:        ips,
 			})
 		}
-		b, err := base64.StdEncoding.DecodeString(iface.PrivateKey)
+		privateKey, err := parseKey(iface.PrivateKey)
 		if err != nil {
 			return err
 		}
-		privateKey, err := wgtypes.NewKey(b)
-		if err != nil {
-			return err
+		changes := diffWireGuard(iface.Name, current, privateKey, iface.Port, peers)
+		if len(changes) == 0 {
+			continue
 		}
-		err = cl.ConfigureDevice(iface.Name, wgtypes.Config{
-			PrivateKey:   &privateKey,
-			ListenPort:   &iface.Port,
-			ReplacePeers: true, // replace instead of appending
-			// Peers specifies a list of peer configurations to apply to a device.
-			Peers: peers,
-		})
-		if err != nil {
-			return err
+		for _, c := range changes {
+			p.describe(c)
 		}
+		p.step(func() error {
+			cl, err := wgctrl.New()
+			if err != nil {
+				return err
+			}
+			defer cl.Close()
+			return cl.ConfigureDevice(iface.Name, wgtypes.Config{
+				PrivateKey:   &privateKey,
+				ListenPort:   &iface.Port,
+				ReplacePeers: true, // replace instead of appending
+				// Peers specifies a list of peer configurations to apply to a device.
+				Peers: peers,
+			})
+		})
 	}
 
 	return nil
 }
+
+// diffWireGuard compares the configuration of WireGuard device name (nil if it
+// does not exist yet) to the desired configuration.
+func diffWireGuard(name string, current *wgtypes.Device, privateKey wgtypes.Key, port int, peers []wgtypes.PeerConfig) []Change {
+	if current == nil {
+		current = &wgtypes.Device{}
+	}
+	var changes []Change
+	if current.PrivateKey != privateKey {
+		// Neither key is printed.
+		changes = append(changes, Change{Op: "~", Kind: "wireguard", Object: name + " private key"})
+	}
+	if current.ListenPort != port && port != 0 {
+		changes = append(changes, Change{Op: "~", Kind: "wireguard", Object: fmt.Sprintf("%s listen port %d", name, port), From: fmt.Sprint(current.ListenPort)})
+	}
+	peerString := func(endpoint *net.UDPAddr, ips []net.IPNet) string {
+		var s []string
+		for _, ip := range ips {
+			s = append(s, ip.String())
+		}
+		sort.Strings(s)
+		str := "allowed ips " + strings.Join(s, ",")
+		if endpoint != nil {
+			str += " endpoint " + endpoint.String()
+		}
+		return str
+	}
+	got := make(map[wgtypes.Key]wgtypes.Peer)
+	for _, p := range current.Peers {
+		got[p.PublicKey] = p
+	}
+	want := make(map[wgtypes.Key]bool)
+	for _, p := range peers {
+		want[p.PublicKey] = true
+		desc := peerString(p.Endpoint, p.AllowedIPs)
+		object := fmt.Sprintf("%s peer %s %s", name, p.PublicKey, desc)
+		cur, ok := got[p.PublicKey]
+		if !ok {
+			changes = append(changes, Change{Op: "+", Kind: "wireguard", Object: object})
+			continue
+		}
+		endpoint := cur.Endpoint
+		if p.Endpoint == nil {
+			// Peers without configured endpoint roam, i.e. their endpoint
+			// is learnt from incoming packets.
+			endpoint = nil
+		}
+		if from := peerString(endpoint, cur.AllowedIPs); from != desc {
+			changes = append(changes, Change{Op: "~", Kind: "wireguard", Object: object, From: from})
+		}
+	}
+	for _, p := range current.Peers {
+		if !want[p.PublicKey] {
+			changes = append(changes, Change{Op: "-", Kind: "wireguard", Object: fmt.Sprintf("%s peer %s", name, p.PublicKey)})
+		}
+	}
+	return changes
+}
@@ -22,16 +22,6 @@ type ifreqFlags struct {
 	pad   [22]byte
 }
 
-// as per http://lxr.free-electrons.com/source/include/uapi/linux/route.h#L30
-type rtentry struct {
-	pad1    uint64
-	dst     syscall.RawSockaddrInet4
-	gateway syscall.RawSockaddrInet4
-	genmask syscall.RawSockaddrInet4
-	flags   uint16
-	pad     [512]byte
-}
-
 type Configsocket struct {
 	fd   int
 	name [16]byte
@@ -96,31 +86,3 @@ func (cs Configsocket) Up() error {
 
 	return nil
 }
-
-func (cs Configsocket) AddRoute(dst, gateway net.IP, genmask net.IPMask) syscall.Errno {
-	req := rtentry{
-		dst:     syscall.RawSockaddrInet4{Family: syscall.AF_INET},
-		gateway: syscall.RawSockaddrInet4{Family: syscall.AF_INET},
-		genmask: syscall.RawSockaddrInet4{Family: syscall.AF_INET},
-		flags:   syscall.RTF_UP | syscall.RTF_GATEWAY,
-	}
-	copy(req.dst.Addr[:], dst)
-	copy(req.gateway.Addr[:], gateway)
-	copy(req.genmask.Addr[:], genmask)
-	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(cs.fd), syscall.SIOCADDRT, uintptr(unsafe.Pointer(&req)))
-	return errno
-}
-
-func (cs Configsocket) DelRoute(dst, gateway net.IP, genmask net.IPMask) syscall.Errno {
-	req := rtentry{
-		dst:     syscall.RawSockaddrInet4{Family: syscall.AF_INET},
-		gateway: syscall.RawSockaddrInet4{Family: syscall.AF_INET},
-		genmask: syscall.RawSockaddrInet4{Family: syscall.AF_INET},
-		flags:   syscall.RTF_UP | syscall.RTF_GATEWAY,
-	}
-	copy(req.dst.Addr[:], dst)
-	copy(req.gateway.Addr[:], gateway)
-	copy(req.genmask.Addr[:], genmask)
-	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(cs.fd), syscall.SIOCDELRT, uintptr(unsafe.Pointer(&req)))
-	return errno
-}
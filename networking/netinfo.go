@@ -4,7 +4,8 @@ package networking
 
 import (
 	"net"
-	"strings"
+
+	"git.tcp.direct/kayos/rout5/config"
 )
 
 // IsInPrivateNet reports whether ip is private or not.
@@ -13,8 +14,10 @@ func IsInPrivateNet(ip net.IP) bool {
 }
 
 func isPrivate(iface string, ip net.IP) bool {
-	if strings.HasPrefix(iface, "uplink") {
-		return false
+	for _, wan := range config.Current().PreferredWAN {
+		if iface == wan {
+			return false
+		}
 	}
 	switch {
 	case ip.IsPrivate(),
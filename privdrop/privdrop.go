@@ -0,0 +1,143 @@
+// Package privdrop switches rout5 daemons to an unprivileged user while
+// retaining only the Linux capabilities each daemon declares it needs.
+//
+// Daemons are expected to acquire privileged resources first (raw sockets,
+// ports below 1024, …) and call Drop afterwards.
+package privdrop
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"git.tcp.direct/kayos/rout5/config"
+)
+
+// Cap is a Linux capability, see capabilities(7).
+type Cap uint
+
+const (
+	CAP_DAC_OVERRIDE     Cap = unix.CAP_DAC_OVERRIDE
+	CAP_NET_BIND_SERVICE Cap = unix.CAP_NET_BIND_SERVICE
+	CAP_NET_ADMIN        Cap = unix.CAP_NET_ADMIN
+	CAP_NET_RAW          Cap = unix.CAP_NET_RAW
+)
+
+var capNames = map[Cap]string{
+	CAP_DAC_OVERRIDE:     "CAP_DAC_OVERRIDE",
+	CAP_NET_BIND_SERVICE: "CAP_NET_BIND_SERVICE",
+	CAP_NET_ADMIN:        "CAP_NET_ADMIN",
+	CAP_NET_RAW:          "CAP_NET_RAW",
+}
+
+func (c Cap) String() string {
+	if name, ok := capNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("cap(%d)", uint(c))
+}
+
+// Chown hands the specified paths (recursively) to config.UID and config.GID,
+// so that a daemon can still write its state after calling Drop. Paths which
+// do not exist are created as directories.
+func Chown(paths ...string) error {
+	if os.Getuid() != 0 {
+		return nil // Drop will not switch users either
+	}
+	for _, path := range paths {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+		if err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(path, config.UID, config.GID)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allThreads runs a syscall on all threads of the process, which is required
+// for per-thread credentials like capabilities. Go does not support this in
+// binaries built with cgo, so rout5 must be built with CGO_ENABLED=0.
+func allThreads(trap, a1, a2, a3 uintptr) error {
+	if _, _, errno := syscall.AllThreadsSyscall(trap, a1, a2, a3); errno != 0 {
+		if errno == syscall.ENOTSUP {
+			return fmt.Errorf("%w (binary built with cgo?)", errno)
+		}
+		return errno
+	}
+	return nil
+}
+
+// Drop switches the process to config.UID and config.GID, retaining only caps.
+// It is a no-op when not running as root.
+func Drop(caps ...Cap) error {
+	if os.Getuid() != 0 {
+		log.Printf("not running as root (uid %d), not dropping privileges", os.Getuid())
+		return nil
+	}
+
+	keep := make(map[Cap]bool)
+	for _, c := range caps {
+		keep[c] = true
+	}
+
+	// Remove all other capabilities from the bounding set so that they cannot
+	// be regained, e.g. via execve(2) of a file with capabilities.
+	for c := Cap(0); c <= Cap(unix.CAP_LAST_CAP); c++ {
+		if keep[c] {
+			continue
+		}
+		if err := allThreads(unix.SYS_PRCTL, unix.PR_CAPBSET_DROP, uintptr(c), 0); err != nil && err != syscall.EINVAL {
+			return fmt.Errorf("prctl(PR_CAPBSET_DROP, %v): %w", c, err)
+		}
+	}
+
+	// Retain permitted capabilities across the setresuid(2) call below.
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 1, 0); err != nil {
+		return fmt.Errorf("prctl(PR_SET_KEEPCAPS): %w", err)
+	}
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setresgid(config.GID, config.GID, config.GID); err != nil {
+		return fmt.Errorf("setresgid(%d): %v", config.GID, err)
+	}
+	if err := syscall.Setresuid(config.UID, config.UID, config.UID); err != nil {
+		return fmt.Errorf("setresuid(%d): %v", config.UID, err)
+	}
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 0, 0); err != nil {
+		return fmt.Errorf("prctl(PR_SET_KEEPCAPS): %w", err)
+	}
+
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	for c := range keep {
+		data[c/32].Effective |= 1 << (c % 32)
+		data[c/32].Permitted |= 1 << (c % 32)
+	}
+	if err := allThreads(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); err != nil {
+		return fmt.Errorf("capset: %w", err)
+	}
+
+	names := make([]string, 0, len(caps))
+	for _, c := range caps {
+		names = append(names, c.String())
+	}
+	retained := "no capabilities"
+	if len(names) > 0 {
+		retained = strings.Join(names, ", ")
+	}
+	log.Printf("dropped privileges to uid %d, gid %d, retaining %s", config.UID, config.GID, retained)
+	return nil
+}
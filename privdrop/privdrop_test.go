@@ -0,0 +1,52 @@
+package privdrop
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"syscall"
+	"testing"
+
+	"git.tcp.direct/kayos/rout5/config"
+)
+
+func TestDrop(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("dropping privileges requires root")
+	}
+	if os.Getenv("HELPER_PROCESS") == "1" {
+		if err := Drop(CAP_NET_RAW); err != nil {
+			if errors.Is(err, syscall.ENOTSUP) {
+				t.Skipf("test binary built with cgo: %v", err)
+			}
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile("/proc/self/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{
+			fmt.Sprintf(`(?m)^Uid:\s+%d\s+%d\s+%d`, config.UID, config.UID, config.UID),
+			fmt.Sprintf(`(?m)^Gid:\s+%d\s+%d\s+%d`, config.GID, config.GID, config.GID),
+			fmt.Sprintf(`(?m)^CapEff:\s+%016x$`, 1<<CAP_NET_RAW),
+			fmt.Sprintf(`(?m)^CapPrm:\s+%016x$`, 1<<CAP_NET_RAW),
+		} {
+			if !regexp.MustCompile(want).Match(b) {
+				t.Errorf("regexp %s does not match /proc/self/status:\n%s", want, b)
+			}
+		}
+		return
+	}
+
+	// Dropping privileges cannot be undone, so do it in a separate process.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDrop$")
+	cmd.Env = append(os.Environ(), "HELPER_PROCESS=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+}